@@ -0,0 +1,559 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package backup implements incremental backups of a DB.
+//
+// A backup directory holds any number of backups, each of which is a
+// checkpoint of a DB (see DB.Checkpoint). Sstables and blob files are
+// immutable once written, so they are stored in a shared directory keyed by
+// the checksum of their contents, and are stored only once no matter how many
+// backups (of any number of DBs) reference them. The remaining files of a backup (the MANIFEST, OPTIONS,
+// CURRENT and WAL files) are stored in a directory private to the backup.
+// Each backup is described by a small manifest which lists the backup's files
+// along with their sizes and checksums:
+//
+//   <dir>/LOCK
+//   <dir>/meta/<id>.json
+//   <dir>/private/<id>/<file>
+//   <dir>/shared/<checksum><ext>
+//
+// The manifest of a backup is written only after all of its files are in
+// place, and is removed before any of its files are, so a crash during the
+// creation or deletion of a backup leaves behind only unreferenced files.
+// Unreferenced files are removed when the backup directory is next opened.
+package backup // import "github.com/cockroachdb/pebble/backup"
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+const (
+	metaDir    = "meta"
+	privateDir = "private"
+	sharedDir  = "shared"
+	tmpDir     = "tmp"
+
+	manifestExt = ".json"
+	tmpExt      = ".tmp"
+)
+
+// ErrNotFound is returned when the requested backup does not exist.
+var ErrNotFound = errors.New("pebble: backup not found")
+
+// File describes a file that is part of a backup.
+type File struct {
+	// Name is the name of the file in the DB directory.
+	Name string `json:"name"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// Checksum is the hex encoded SHA-256 checksum of the file's contents.
+	Checksum string `json:"checksum"`
+	// Shared is true if the file is stored in the shared directory, and false
+	// if it is stored in the backup's private directory.
+	Shared bool `json:"shared,omitempty"`
+}
+
+// Info describes a backup.
+type Info struct {
+	// ID uniquely identifies the backup within the backup directory. IDs are
+	// assigned in increasing order.
+	ID uint64 `json:"id"`
+	// Created is the time at which the backup was created.
+	Created time.Time `json:"created"`
+	// Files lists the files in the backup, sorted by name.
+	Files []File `json:"files"`
+}
+
+// Size returns the total size of the files in the backup, including files
+// which are shared with other backups.
+func (i *Info) Size() int64 {
+	var size int64
+	for _, f := range i.Files {
+		size += f.Size
+	}
+	return size
+}
+
+// Engine creates, verifies, deletes and restores the backups stored in a
+// backup directory. An Engine is safe for concurrent use, but only a single
+// Engine (in any process) may have a given backup directory open at a time.
+type Engine struct {
+	fs   vfs.FS
+	dir  string
+	lock io.Closer
+
+	mu      sync.Mutex
+	backups map[uint64]*Info
+	// shared maps the name of each file in the shared directory to the number
+	// of references to it from backups.
+	shared map[string]int
+	nextID uint64
+}
+
+// Open opens the backup directory dir, creating it if it does not exist. The
+// file system must be the one used by the DBs which are backed up, as
+// DB.Checkpoint creates the files of a backup using the DB's file system.
+func Open(fs vfs.FS, dir string) (*Engine, error) {
+	for _, d := range []string{metaDir, privateDir, sharedDir} {
+		if err := fs.MkdirAll(fs.PathJoin(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	lock, err := fs.Lock(fs.PathJoin(dir, "LOCK"))
+	if err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		fs:      fs,
+		dir:     dir,
+		lock:    lock,
+		backups: make(map[uint64]*Info),
+		shared:  make(map[string]int),
+		nextID:  1,
+	}
+	if err := e.load(); err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Engine) load() error {
+	names, err := e.fs.List(e.fs.PathJoin(e.dir, metaDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := e.fs.PathJoin(e.dir, metaDir, name)
+		if strings.HasSuffix(name, tmpExt) {
+			// A manifest which was never renamed into place. The backup it
+			// describes was not created.
+			if err := e.fs.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, manifestExt) {
+			continue
+		}
+		info, err := e.readManifest(path)
+		if err != nil {
+			return err
+		}
+		e.backups[info.ID] = info
+		e.addRefs(info)
+		if info.ID >= e.nextID {
+			e.nextID = info.ID + 1
+		}
+	}
+	return e.removeUnreferenced()
+}
+
+func (e *Engine) readManifest(path string) (*Info, error) {
+	f, err := e.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, errors.Wrapf(err, "pebble: backup manifest %s", path)
+	}
+	return info, nil
+}
+
+func (e *Engine) writeManifest(info *Info) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := e.manifestPath(info.ID)
+	tmpPath := path + tmpExt
+	f, err := e.fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := e.fs.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return e.syncDir(e.fs.PathJoin(e.dir, metaDir))
+}
+
+// removeUnreferenced removes the shared files which are not referenced by
+// any backup, the private directories of backups which do not exist, and the
+// temporary directory used while creating a backup.
+func (e *Engine) removeUnreferenced() error {
+	if err := e.removeAll(e.fs.PathJoin(e.dir, tmpDir)); err != nil {
+		return err
+	}
+	names, err := e.fs.List(e.fs.PathJoin(e.dir, sharedDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := e.shared[name]; !ok {
+			if err := e.fs.Remove(e.fs.PathJoin(e.dir, sharedDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	names, err = e.fs.List(e.fs.PathJoin(e.dir, privateDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err == nil {
+			if _, ok := e.backups[id]; ok {
+				continue
+			}
+		}
+		if err := e.removeAll(e.fs.PathJoin(e.dir, privateDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Engine) removeAll(path string) error {
+	if err := e.fs.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (e *Engine) syncDir(path string) error {
+	dir, err := e.fs.OpenDir(path)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+func (e *Engine) addRefs(info *Info) {
+	for _, f := range info.Files {
+		if !f.Shared {
+			continue
+		}
+		e.shared[sharedName(f)]++
+	}
+}
+
+func (e *Engine) manifestPath(id uint64) string {
+	return e.fs.PathJoin(e.dir, metaDir, fmt.Sprintf("%06d%s", id, manifestExt))
+}
+
+func (e *Engine) privatePath(id uint64) string {
+	return e.fs.PathJoin(e.dir, privateDir, fmt.Sprintf("%06d", id))
+}
+
+// path returns the path within the backup directory of a file which is part
+// of the specified backup.
+func (e *Engine) path(info *Info, f File) string {
+	if f.Shared {
+		return e.fs.PathJoin(e.dir, sharedDir, sharedName(f))
+	}
+	return e.fs.PathJoin(e.privatePath(info.ID), f.Name)
+}
+
+// sharedName returns the name in the shared directory of a file, which is
+// the checksum of its contents. Files with the same contents share a name,
+// whichever DB they came from and whatever their names within it.
+func sharedName(f File) string {
+	return f.Checksum + filepath.Ext(f.Name)
+}
+
+// isShared returns true if the named DB file is immutable, and thus may be
+// shared between backups.
+func isShared(fs vfs.FS, name string) bool {
+	fileType, _, ok := base.ParseFilename(fs, name)
+	return ok && (fileType == base.FileTypeTable || fileType == base.FileTypeBlob)
+}
+
+func checksum(fs vfs.FS, path string) (size int64, sum string, err error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Close releases the lock on the backup directory.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lock == nil {
+		return nil
+	}
+	err := e.lock.Close()
+	e.lock = nil
+	return err
+}
+
+// Create creates a new backup of the DB and returns a description of it.
+//
+// The DB is first checkpointed into a temporary directory within the backup
+// directory, and each of the checkpoint's files is checksummed. The sstables
+// and blob files whose contents are already present in the shared directory
+// are then discarded, and the remaining files are moved into place. If hard
+// links are supported, backing up a file which is already present in the
+// backup directory requires reading, but not copying, the file.
+func (e *Engine) Create(db *pebble.DB) (_ *Info, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tmp := e.fs.PathJoin(e.dir, tmpDir)
+	if err := e.removeAll(tmp); err != nil {
+		return nil, err
+	}
+	if err := db.Checkpoint(tmp); err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		ID:      e.nextID,
+		Created: time.Now(),
+	}
+	defer func() {
+		if err != nil {
+			// Remove the files moved into the backup directory before the failure,
+			// as well as the rest of the checkpoint.
+			_ = e.removeUnreferenced()
+		}
+	}()
+
+	names, err := e.fs.List(tmp)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	if err := e.fs.MkdirAll(e.privatePath(info.ID), 0755); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		src := e.fs.PathJoin(tmp, name)
+		stat, err := e.fs.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		f := File{
+			Name:   name,
+			Size:   stat.Size(),
+			Shared: isShared(e.fs, name),
+		}
+		var size int64
+		size, f.Checksum, err = checksum(e.fs, src)
+		if err != nil {
+			return nil, err
+		}
+		if size != f.Size {
+			return nil, errors.Errorf("pebble: backup file %s: expected size %d, but found %d",
+				errors.Safe(src), errors.Safe(f.Size), errors.Safe(size))
+		}
+		info.Files = append(info.Files, f)
+		if f.Shared {
+			if _, ok := e.shared[sharedName(f)]; ok {
+				// An earlier backup already contains the file.
+				continue
+			}
+		}
+		if err := e.fs.Rename(src, e.path(info, f)); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.syncDir(e.fs.PathJoin(e.dir, sharedDir)); err != nil {
+		return nil, err
+	}
+	if err := e.syncDir(e.privatePath(info.ID)); err != nil {
+		return nil, err
+	}
+	if err := e.syncDir(e.fs.PathJoin(e.dir, privateDir)); err != nil {
+		return nil, err
+	}
+	if err := e.writeManifest(info); err != nil {
+		return nil, err
+	}
+
+	e.backups[info.ID] = info
+	e.addRefs(info)
+	e.nextID++
+	// The backup has been created. Failing to remove the remains of the
+	// checkpoint is harmless as they will be removed by the next call to Create
+	// or Open.
+	_ = e.removeAll(tmp)
+	return info, nil
+}
+
+// List returns the backups in the backup directory, in increasing order of
+// ID.
+func (e *Engine) List() []*Info {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	infos := make([]*Info, 0, len(e.backups))
+	for _, info := range e.backups {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+func (e *Engine) getLocked(id uint64) (*Info, error) {
+	info, ok := e.backups[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrNotFound, "pebble: backup %d", errors.Safe(id))
+	}
+	return info, nil
+}
+
+// Verify checks the integrity of the backup with the specified ID by reading
+// each of its files and comparing their sizes and checksums against those
+// recorded when the backup was created.
+func (e *Engine) Verify(id uint64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	info, err := e.getLocked(id)
+	if err != nil {
+		return err
+	}
+	for _, f := range info.Files {
+		path := e.path(info, f)
+		size, sum, err := checksum(e.fs, path)
+		if err != nil {
+			return err
+		}
+		if size != f.Size {
+			return errors.Errorf("pebble: backup %d: file %s: expected size %d, but found %d",
+				errors.Safe(id), errors.Safe(f.Name), errors.Safe(f.Size), errors.Safe(size))
+		}
+		if sum != f.Checksum {
+			return errors.Errorf("pebble: backup %d: file %s: checksum mismatch",
+				errors.Safe(id), errors.Safe(f.Name))
+		}
+	}
+	return nil
+}
+
+// Delete deletes the backup with the specified ID. The shared files which are
+// not referenced by any remaining backup are deleted along with it.
+func (e *Engine) Delete(id uint64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	info, err := e.getLocked(id)
+	if err != nil {
+		return err
+	}
+
+	// Remove the manifest first so that the backup's files are unreferenced if
+	// we crash part way through removing them.
+	if err := e.fs.Remove(e.manifestPath(id)); err != nil {
+		return err
+	}
+	if err := e.syncDir(e.fs.PathJoin(e.dir, metaDir)); err != nil {
+		return err
+	}
+	delete(e.backups, id)
+
+	for _, f := range info.Files {
+		if !f.Shared {
+			continue
+		}
+		name := sharedName(f)
+		if e.shared[name]--; e.shared[name] > 0 {
+			continue
+		}
+		delete(e.shared, name)
+		if err := e.fs.Remove(e.path(info, f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return e.removeAll(e.privatePath(id))
+}
+
+// Restore restores the backup with the specified ID into destDir, which must
+// not exist. The restored directory can be opened with pebble.Open. Shared
+// files are hard-linked into destDir when possible, while private files are
+// always copied as the DB may modify or reuse them.
+func (e *Engine) Restore(id uint64, destDir string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	info, err := e.getLocked(id)
+	if err != nil {
+		return err
+	}
+	if _, err := e.fs.Stat(destDir); !os.IsNotExist(err) {
+		if err == nil {
+			return &os.PathError{
+				Op:   "restore",
+				Path: destDir,
+				Err:  os.ErrExist,
+			}
+		}
+		return err
+	}
+
+	if err := e.fs.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	for _, f := range info.Files {
+		src := e.path(info, f)
+		dest := e.fs.PathJoin(destDir, f.Name)
+		if f.Shared {
+			err = vfs.LinkOrCopy(e.fs, src, dest)
+		} else {
+			err = vfs.Copy(e.fs, src, dest)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return e.syncDir(destDir)
+}
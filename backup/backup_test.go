@@ -0,0 +1,253 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package backup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := pebble.Open("db", &pebble.Options{FS: mem})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+
+	e, err := Open(mem, "backups")
+	require.NoError(t, err)
+
+	list := func(dir string) []string {
+		names, err := mem.List(dir)
+		require.NoError(t, err)
+		sort.Strings(names)
+		return names
+	}
+	ids := func() []uint64 {
+		var ids []uint64
+		for _, info := range e.List() {
+			ids = append(ids, info.ID)
+		}
+		return ids
+	}
+	sharedFiles := func(info *Info) []string {
+		var names []string
+		for _, f := range info.Files {
+			if f.Shared {
+				names = append(names, f.Name)
+			}
+		}
+		return names
+	}
+	firstShared := func(info *Info) File {
+		for _, f := range info.Files {
+			if f.Shared {
+				return f
+			}
+		}
+		t.Fatalf("backup %d has no shared files", info.ID)
+		return File{}
+	}
+	set := func(keys ...string) {
+		for _, k := range keys {
+			require.NoError(t, d.Set([]byte(k), []byte(k), nil))
+		}
+	}
+
+	set("a", "b")
+	require.NoError(t, d.Flush())
+	b1, err := e.Create(d)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), b1.ID)
+	require.Equal(t, []string{"000005.sst"}, sharedFiles(b1))
+
+	// The second backup shares the sstable of the first.
+	set("c")
+	require.NoError(t, d.Flush())
+	set("d")
+	b2, err := e.Create(d)
+	require.NoError(t, err)
+	require.Equal(t, []string{"000005.sst", "000007.sst"}, sharedFiles(b2))
+	require.Equal(t, 2, len(list("backups/shared")))
+
+	// After a compaction, the third backup shares nothing with the others.
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	b3, err := e.Create(d)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sharedFiles(b3)))
+	require.Equal(t, 3, len(list("backups/shared")))
+	require.Equal(t, []uint64{1, 2, 3}, ids())
+	require.NotContains(t, list("backups"), tmpDir)
+
+	for _, id := range ids() {
+		require.NoError(t, e.Verify(id))
+	}
+
+	// Deleting the first backup leaves its sstable in place, as it is still
+	// referenced by the second.
+	require.NoError(t, e.Delete(1))
+	require.Equal(t, []uint64{2, 3}, ids())
+	require.Equal(t, 3, len(list("backups/shared")))
+	require.NoError(t, e.Verify(2))
+	require.True(t, errors.Is(e.Verify(1), ErrNotFound))
+	require.True(t, errors.Is(e.Delete(1), ErrNotFound))
+
+	// Deleting the second backup removes the sstables it shared with the first.
+	require.NoError(t, e.Delete(2))
+	require.Equal(t, []string{sharedName(firstShared(b3))}, list("backups/shared"))
+	require.Equal(t, []string{"000003"}, list("backups/private"))
+
+	// The backups are found after reopening the backup directory, and backup
+	// IDs are not reused.
+	require.NoError(t, e.Close())
+	e, err = Open(mem, "backups")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, e.Close())
+	}()
+	require.Equal(t, []uint64{3}, ids())
+	set("e")
+	b4, err := e.Create(d)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), b4.ID)
+
+	// A restored backup can be opened, and contains the data written before the
+	// backup was created.
+	require.NoError(t, e.Restore(4, "restore"))
+	require.True(t, os.IsExist(e.Restore(4, "restore")))
+	r, err := pebble.Open("restore", &pebble.Options{FS: mem})
+	require.NoError(t, err)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		v, closer, err := r.Get([]byte(k))
+		require.NoError(t, err)
+		require.Equal(t, k, string(v))
+		require.NoError(t, closer.Close())
+	}
+	require.NoError(t, r.Close())
+
+	// Corruption of a shared file is detected.
+	f := firstShared(b4)
+	path := e.path(b4, f)
+	require.NoError(t, mem.Remove(path))
+	w, err := mem.Create(path)
+	require.NoError(t, err)
+	_, err = w.Write(make([]byte, f.Size))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.EqualError(t, e.Verify(4),
+		fmt.Sprintf("pebble: backup 4: file %s: checksum mismatch", f.Name))
+}
+
+func TestBackupRemovesUnreferencedFiles(t *testing.T) {
+	mem := vfs.NewMem()
+	for _, dir := range []string{"backups/shared", "backups/private/000007", "backups/meta", "backups/tmp"} {
+		require.NoError(t, mem.MkdirAll(dir, 0755))
+	}
+	for _, name := range []string{"backups/shared/abc.sst", "backups/meta/000007.json.tmp"} {
+		f, err := mem.Create(name)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	e, err := Open(mem, "backups")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, e.Close())
+	}()
+	require.Empty(t, e.List())
+	for _, dir := range []string{"backups/shared", "backups/private", "backups/meta"} {
+		names, err := mem.List(dir)
+		require.NoError(t, err)
+		require.Empty(t, names, dir)
+	}
+	_, err = mem.Stat("backups/tmp")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestBackupSharedFiles(t *testing.T) {
+	mem := vfs.NewMem()
+	e, err := Open(mem, "backups")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, e.Close())
+	}()
+	sharedNames := func() []string {
+		names, err := mem.List("backups/shared")
+		require.NoError(t, err)
+		sort.Strings(names)
+		return names
+	}
+
+	// The two DBs have sstables with the same file numbers and sizes, but
+	// different contents, which are kept apart in the shared directory.
+	var dbs []*pebble.DB
+	for i := 0; i < 2; i++ {
+		d, err := pebble.Open(fmt.Sprintf("db%d", i), &pebble.Options{FS: mem})
+		require.NoError(t, err)
+		require.NoError(t, d.Set([]byte("k"), []byte(fmt.Sprint(i)), nil))
+		require.NoError(t, d.Flush())
+		dbs = append(dbs, d)
+	}
+	var expected []string
+	for i, d := range dbs {
+		info, err := e.Create(d)
+		require.NoError(t, err)
+		for _, f := range info.Files {
+			if f.Shared {
+				require.Equal(t, "000005.sst", f.Name)
+				expected = append(expected, f.Checksum+".sst")
+			}
+		}
+		require.NoError(t, e.Restore(info.ID, fmt.Sprintf("restore%d", i)))
+		r, err := pebble.Open(fmt.Sprintf("restore%d", i), &pebble.Options{FS: mem})
+		require.NoError(t, err)
+		v, closer, err := r.Get([]byte("k"))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i), string(v))
+		require.NoError(t, closer.Close())
+		require.NoError(t, r.Close())
+	}
+	sort.Strings(expected)
+	require.Equal(t, 2, len(expected))
+	require.NotEqual(t, expected[0], expected[1])
+	require.Equal(t, expected, sharedNames())
+
+	// A DB which reuses the file numbers of an earlier DB with the same name,
+	// after its directory was removed, is not mistaken for the earlier DB.
+	require.NoError(t, dbs[1].Close())
+	require.NoError(t, mem.RemoveAll("db1"))
+	d, err := pebble.Open("db1", &pebble.Options{FS: mem})
+	require.NoError(t, err)
+	require.NoError(t, d.Set([]byte("k"), []byte("2"), nil))
+	require.NoError(t, d.Flush())
+	info, err := e.Create(d)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(sharedNames()))
+	require.NoError(t, e.Restore(info.ID, "restore2"))
+	r, err := pebble.Open("restore2", &pebble.Options{FS: mem})
+	require.NoError(t, err)
+	v, closer, err := r.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(v))
+	require.NoError(t, closer.Close())
+	require.NoError(t, r.Close())
+	require.NoError(t, d.Close())
+
+	// The sstable shared with an earlier backup is stored once.
+	require.NoError(t, dbs[0].Set([]byte("k2"), nil, nil))
+	info, err = e.Create(dbs[0])
+	require.NoError(t, err)
+	require.Equal(t, 3, len(sharedNames()))
+	require.NoError(t, e.Verify(info.ID))
+	require.NoError(t, dbs[0].Close())
+}
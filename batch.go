@@ -19,6 +19,7 @@ import (
 	"github.com/cockroachdb/pebble/internal/batchskl"
 	"github.com/cockroachdb/pebble/internal/private"
 	"github.com/cockroachdb/pebble/internal/rangedel"
+	"github.com/cockroachdb/pebble/internal/rangekey"
 	"github.com/cockroachdb/pebble/internal/rawalloc"
 )
 
@@ -155,9 +156,14 @@ func (d DeferredBatchOp) Finish() {
 //   InternalKeyKindSet          varstring varstring
 //   InternalKeyKindMerge        varstring varstring
 //   InternalKeyKindRangeDelete  varstring varstring
+//   InternalKeyKindRangeKeyDelete  varstring varstring
+//   InternalKeyKindRangeKeyUnset   varstring varstring
+//   InternalKeyKindRangeKeySet     varstring varstring
 //
 // The intuitive understanding here are that the arguments to Delete(), Set(),
-// Merge(), and DeleteRange() are encoded into the batch.
+// Merge(), and DeleteRange() are encoded into the batch. For the range key
+// kinds, the key is the start key and the value is the end key, suffix and
+// value encoded by rangekey.EncodeValue.
 //
 // The internal batch representation is the on disk format for a batch in the
 // WAL, and thus stable. New record kinds may be added, but the existing ones
@@ -183,6 +189,10 @@ type Batch struct {
 	abbreviatedKey AbbreviatedKey
 
 	memTableSize uint32
+	// hasRangeKeys indicates whether the batch contains range keys. It is only
+	// tracked for batches which track memTableSize, and is used by
+	// memTable.prepare to lazily allocate the memtable's range key skiplist.
+	hasRangeKeys bool
 
 	// The db to which the batch will be committed. Do not change this field
 	// after the batch has been created as it might invalidate internal state.
@@ -199,6 +209,7 @@ type Batch struct {
 	// An optional skiplist keyed by offset into data of the entry.
 	index         *batchskl.Skiplist
 	rangeDelIndex *batchskl.Skiplist
+	rangeKeyIndex *batchskl.Skiplist
 
 	// Fragmented range deletion tombstones. Cached the first time a range
 	// deletion iterator is requested. The cache is invalidated whenever a new
@@ -269,6 +280,7 @@ func (b *Batch) release() {
 	b.cmp = nil
 	b.abbreviatedKey = nil
 	b.memTableSize = 0
+	b.hasRangeKeys = false
 
 	b.deferredOp = DeferredBatchOp{}
 	b.tombstones = nil
@@ -281,23 +293,27 @@ func (b *Batch) release() {
 		batchPool.Put(b)
 	} else {
 		b.index.Reset()
-		b.index, b.rangeDelIndex = nil, nil
+		b.index, b.rangeDelIndex, b.rangeKeyIndex = nil, nil, nil
 		indexedBatchPool.Put((*indexedBatch)(unsafe.Pointer(b)))
 	}
 }
 
 func (b *Batch) refreshMemTableSize() {
 	b.memTableSize = 0
+	b.hasRangeKeys = false
 	if len(b.data) < batchHeaderLen {
 		return
 	}
 
 	for r := b.Reader(); ; {
-		_, key, value, ok := r.Next()
+		kind, key, value, ok := r.Next()
 		if !ok {
 			break
 		}
 		b.memTableSize += memTableEntrySize(len(key), len(value))
+		if rangekey.IsRangeKey(kind) {
+			b.hasRangeKeys = true
+		}
 	}
 }
 
@@ -332,13 +348,19 @@ func (b *Batch) Apply(batch *Batch, _ *WriteOptions) error {
 			}
 			if b.index != nil {
 				var err error
-				if kind == InternalKeyKindRangeDelete {
+				switch kind {
+				case InternalKeyKindRangeDelete:
 					b.tombstones = nil
 					if b.rangeDelIndex == nil {
 						b.rangeDelIndex = batchskl.NewSkiplist(&b.data, b.cmp, b.abbreviatedKey)
 					}
 					err = b.rangeDelIndex.Add(uint32(offset))
-				} else {
+				case InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeyDelete:
+					if b.rangeKeyIndex == nil {
+						b.rangeKeyIndex = batchskl.NewSkiplist(&b.data, b.cmp, b.abbreviatedKey)
+					}
+					err = b.rangeKeyIndex.Add(uint32(offset))
+				default:
 					err = b.index.Add(uint32(offset))
 				}
 				if err != nil {
@@ -347,6 +369,9 @@ func (b *Batch) Apply(batch *Batch, _ *WriteOptions) error {
 				}
 			}
 			b.memTableSize += memTableEntrySize(len(key), len(value))
+			if rangekey.IsRangeKey(kind) {
+				b.hasRangeKeys = true
+			}
 		}
 	}
 	return nil
@@ -601,6 +626,54 @@ func (b *Batch) DeleteRangeDeferred(startLen, endLen int) *DeferredBatchOp {
 	return &b.deferredOp
 }
 
+// RangeKeySet sets the range key with the specified suffix to value over the
+// key span [start,end). Range keys are stored separately from point keys and
+// are surfaced by iterators configured with IterOptions.KeyTypes.
+//
+// It is safe to modify the contents of the arguments after RangeKeySet
+// returns.
+func (b *Batch) RangeKeySet(start, end, suffix, value []byte, _ *WriteOptions) error {
+	b.addRangeKey(InternalKeyKindRangeKeySet, start, end, suffix, value)
+	return nil
+}
+
+// RangeKeyUnset removes the range key with the specified suffix over the key
+// span [start,end). Range keys with other suffixes are not affected.
+//
+// It is safe to modify the contents of the arguments after RangeKeyUnset
+// returns.
+func (b *Batch) RangeKeyUnset(start, end, suffix []byte, _ *WriteOptions) error {
+	b.addRangeKey(InternalKeyKindRangeKeyUnset, start, end, suffix, nil)
+	return nil
+}
+
+// RangeKeyDelete removes all of the range keys over the key span
+// [start,end). Point keys are not affected.
+//
+// It is safe to modify the contents of the arguments after RangeKeyDelete
+// returns.
+func (b *Batch) RangeKeyDelete(start, end []byte, _ *WriteOptions) error {
+	b.addRangeKey(InternalKeyKindRangeKeyDelete, start, end, nil, nil)
+	return nil
+}
+
+func (b *Batch) addRangeKey(kind InternalKeyKind, start, end, suffix, value []byte) {
+	b.prepareDeferredKeyValueRecord(len(start), rangekey.EncodedValueLen(end, suffix, value), kind)
+	copy(b.deferredOp.Key, start)
+	rangekey.EncodeValue(b.deferredOp.Value[:0], end, suffix, value)
+	b.hasRangeKeys = true
+	if b.index != nil {
+		// Range keys are rare, so we lazily allocate the index for them.
+		if b.rangeKeyIndex == nil {
+			b.rangeKeyIndex = batchskl.NewSkiplist(&b.data, b.cmp, b.abbreviatedKey)
+		}
+		if err := b.rangeKeyIndex.Add(b.deferredOp.offset); err != nil {
+			// We never add duplicate entries, so an error should never occur.
+			panic(err)
+		}
+	}
+}
+
 // LogData adds the specified to the batch. The data will be written to the
 // WAL, but not added to memtables or sstables. Log data is never indexed,
 // which makes it useful for testing WAL performance.
@@ -657,7 +730,7 @@ func (b *Batch) NewIter(o *IterOptions) *Iterator {
 		return &Iterator{err: ErrNotIndexed}
 	}
 	return b.db.newIterInternal(b.newInternalIter(o),
-		b.newRangeDelIter(o), nil /* snapshot */, o)
+		b.newRangeDelIter(o), b.newRangeKeyIter(o), nil /* snapshot */, o)
 }
 
 // newInternalIter creates a new internalIterator that iterates over the
@@ -711,6 +784,23 @@ func (b *Batch) newRangeDelIter(o *IterOptions) internalIterator {
 	return rangedel.NewIter(b.cmp, b.tombstones)
 }
 
+// newRangeKeyIter creates a new internalIterator that iterates over the
+// unfragmented range keys in the batch. Returns nil if the batch does not
+// contain any range keys.
+func (b *Batch) newRangeKeyIter(o *IterOptions) internalIterator {
+	if b.index == nil {
+		return newErrorIter(ErrNotIndexed)
+	}
+	if b.rangeKeyIndex == nil {
+		return nil
+	}
+	return &batchIter{
+		cmp:   b.cmp,
+		batch: b,
+		iter:  b.rangeKeyIndex.NewIter(nil, nil),
+	}
+}
+
 // Commit applies the batch to its parent writer.
 func (b *Batch) Commit(o *WriteOptions) error {
 	return b.db.Apply(b, o)
@@ -745,6 +835,7 @@ func (b *Batch) init(cap int) {
 // Commits and Closes take care of releasing resources when appropriate.
 func (b *Batch) Reset() {
 	b.count = 0
+	b.hasRangeKeys = false
 	if b.data != nil {
 		if cap(b.data) > batchMaxRetainedSize {
 			// If the capacity of the buffer is larger than our maximum
@@ -760,6 +851,30 @@ func (b *Batch) Reset() {
 	}
 }
 
+// truncate truncates the batch to its first n bytes of data, which contain
+// count records. The indexes of an indexed batch are rebuilt. Any iterators
+// open on the batch are invalidated.
+func (b *Batch) truncate(n int, count uint64) {
+	if n >= len(b.data) {
+		return
+	}
+	var prefix Batch
+	if n > batchHeaderLen {
+		prefix.data = append([]byte(nil), b.data[:n]...)
+		prefix.count = count
+	}
+	b.Reset()
+	b.memTableSize = 0
+	b.tombstones = nil
+	if b.index != nil {
+		b.index.Init(&b.data, b.cmp, b.abbreviatedKey)
+		b.rangeDelIndex = nil
+		b.rangeKeyIndex = nil
+	}
+	// NB: Apply cannot fail as the prefix was taken from a valid batch.
+	_ = b.Apply(&prefix, nil)
+}
+
 // seqNumData returns the 8 byte little-endian sequence number. Zero means that
 // the batch has not yet been applied.
 func (b *Batch) seqNumData() []byte {
@@ -869,7 +984,8 @@ func (r *BatchReader) Next() (kind InternalKeyKind, ukey []byte, value []byte, o
 		return 0, nil, nil, false
 	}
 	switch kind {
-	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete:
+	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete,
+		InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeyDelete:
 		*r, value, ok = batchDecodeStr(*r)
 		if !ok {
 			return 0, nil, nil, false
@@ -964,7 +1080,8 @@ func (i *batchIter) Value() []byte {
 	}
 
 	switch InternalKeyKind(data[offset]) {
-	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete:
+	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete,
+		InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeyDelete:
 		_, value, ok := batchDecodeStr(data[keyEnd:])
 		if !ok {
 			return nil
@@ -1023,9 +1140,13 @@ type flushableBatch struct {
 	// Sorted in increasing order of key and decreasing order of offset (since
 	// higher offsets correspond to higher sequence numbers).
 	//
-	// Does not include range deletion entries.
+	// Does not include range deletion or range key entries.
 	offsets []flushableBatchEntry
 
+	// The range key entries in the batch, sorted in the same order as
+	// offsets. Range keys are not fragmented.
+	rangeKeyOffsets []flushableBatchEntry
+
 	// Fragmented range deletion tombstones.
 	tombstones []rangedel.Tombstone
 }
@@ -1073,19 +1194,25 @@ func newFlushableBatch(batch *Batch, comparer *Comparer) *flushableBatch {
 					uintptr(unsafe.Pointer(&b.data[0])))
 				entry.keyEnd = entry.keyStart + keySize
 			}
-			if kind == InternalKeyKindRangeDelete {
+			switch kind {
+			case InternalKeyKindRangeDelete:
 				rangeDelOffsets = append(rangeDelOffsets, entry)
-			} else {
+			case InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeyDelete:
+				b.rangeKeyOffsets = append(b.rangeKeyOffsets, entry)
+			default:
 				b.offsets = append(b.offsets, entry)
 			}
 		}
 	}
 
-	// Sort both offsets and rangeDelOffsets.
+	// Sort offsets, rangeDelOffsets and rangeKeyOffsets.
 	sort.Sort(b)
 	rangeDelOffsets, b.offsets = b.offsets, rangeDelOffsets
 	sort.Sort(b)
 	rangeDelOffsets, b.offsets = b.offsets, rangeDelOffsets
+	b.rangeKeyOffsets, b.offsets = b.offsets, b.rangeKeyOffsets
+	sort.Sort(b)
+	b.rangeKeyOffsets, b.offsets = b.offsets, b.rangeKeyOffsets
 
 	if len(rangeDelOffsets) > 0 {
 		frag := &rangedel.Fragmenter{
@@ -1175,6 +1302,19 @@ func (b *flushableBatch) newRangeDelIter(o *IterOptions) internalIterator {
 	return rangedel.NewIter(b.cmp, b.tombstones)
 }
 
+func (b *flushableBatch) newRangeKeyIter(o *IterOptions) internalIterator {
+	if len(b.rangeKeyOffsets) == 0 {
+		return nil
+	}
+	return &flushableBatchIter{
+		batch:   b,
+		data:    b.data,
+		offsets: b.rangeKeyOffsets,
+		cmp:     b.cmp,
+		index:   -1,
+	}
+}
+
 func (b *flushableBatch) inuseBytes() uint64 {
 	return uint64(len(b.data) - batchHeaderLen)
 }
@@ -1353,7 +1493,8 @@ func (i *flushableBatchIter) Value() []byte {
 	var value []byte
 	var ok bool
 	switch kind {
-	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete:
+	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete,
+		InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeyDelete:
 		keyEnd := i.offsets[i.index].keyEnd
 		_, value, ok = batchDecodeStr(i.data[keyEnd:])
 		if !ok {
@@ -1451,7 +1592,8 @@ func (i flushFlushableBatchIter) valueSize() uint64 {
 	}
 	var length uint64
 	switch kind {
-	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete:
+	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete,
+		InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeyDelete:
 		keyEnd := i.offsets[i.index].keyEnd
 		v, n := binary.Uvarint(i.data[keyEnd:])
 		if n <= 0 {
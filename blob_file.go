@@ -0,0 +1,471 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/crc"
+	"github.com/cockroachdb/pebble/internal/manifest"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// Key-value separation
+//
+// Large values are expensive to compact: a value is rewritten every time the
+// table containing it is compacted, even though only the keys are needed to
+// merge the inputs of a compaction. When Options.ValueSeparationThreshold is
+// set, flushes and compactions write SET values of at least that size to
+// separate blob files, and store only a handle for the value in the sstable
+// under a key with the kind InternalKeyKindBlobIndex. Compactions then pass
+// the handle through without reading the value.
+//
+// A blob file is a sequence of values, each followed by a 4-byte checksum of
+// the value, and terminated by a footer:
+//
+//   +---------+----------+-----+---------+----------+--------------------------+
+//   | value 1 | crc (4B) | ... | value n | crc (4B) | count | size | magic (8B) |
+//   +---------+----------+-----+---------+----------+--------------------------+
+//
+// where count is the number of values and size is the total size of the
+// values, each encoded as a fixed 8-byte little-endian integer. A blob handle
+// is the blob file number, the offset of the value within the file and the
+// length of the value, each encoded as a uvarint.
+//
+// Blob files are recorded in the MANIFEST. Each table records the total size
+// of the values it references in each blob file (see
+// manifest.BlobReference). A blob file is removed from the version when no
+// table references it, and deleted from disk once no version references it.
+//
+// As the keys referencing a blob file are deleted or overwritten, the
+// fraction of the blob file's values which are live falls. When the live
+// fraction falls below Options.BlobFileGCThreshold, the blob file is garbage
+// collected: compactions of tables referencing the blob file rewrite the live
+// values to a new blob file, and the compaction picker schedules such
+// compactions (see pickBlobFileGC) when there is no other compaction to run.
+// Once all of the tables referencing the blob file have been rewritten, the
+// blob file is no longer referenced and is deleted.
+
+const (
+	blobFileMagic      = "\xf0\x9f\x90\xa1blob"
+	blobFileFooterLen  = 24
+	blobFileTrailerLen = 4
+)
+
+var errCorruptBlobFile = errors.New("pebble: corrupt blob file")
+
+// blobHandle locates a value within a blob file.
+type blobHandle struct {
+	fileNum FileNum
+	offset  uint64
+	length  uint64
+}
+
+func (h blobHandle) encode(buf []byte) []byte {
+	var tmp [3 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(h.fileNum))
+	n += binary.PutUvarint(tmp[n:], h.offset)
+	n += binary.PutUvarint(tmp[n:], h.length)
+	return append(buf, tmp[:n]...)
+}
+
+func decodeBlobHandle(buf []byte) (blobHandle, error) {
+	var h blobHandle
+	var vals [3]uint64
+	for i := range vals {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return blobHandle{}, errors.Wrap(errCorruptBlobFile, "invalid blob handle")
+		}
+		vals[i] = v
+		buf = buf[n:]
+	}
+	if len(buf) != 0 {
+		return blobHandle{}, errors.Wrap(errCorruptBlobFile, "invalid blob handle")
+	}
+	h.fileNum, h.offset, h.length = FileNum(vals[0]), vals[1], vals[2]
+	return h, nil
+}
+
+// blobFileWriter writes the values of a blob file.
+type blobFileWriter struct {
+	fileNum    FileNum
+	file       vfs.File
+	w          *bufio.Writer
+	offset     uint64
+	valueCount uint64
+	valueSize  uint64
+	err        error
+}
+
+func newBlobFileWriter(fileNum FileNum, file vfs.File) *blobFileWriter {
+	return &blobFileWriter{
+		fileNum: fileNum,
+		file:    file,
+		w:       bufio.NewWriter(file),
+	}
+}
+
+// add appends value to the blob file and returns its handle.
+func (w *blobFileWriter) add(value []byte) (blobHandle, error) {
+	if w.err != nil {
+		return blobHandle{}, w.err
+	}
+	h := blobHandle{fileNum: w.fileNum, offset: w.offset, length: uint64(len(value))}
+	var trailer [blobFileTrailerLen]byte
+	binary.LittleEndian.PutUint32(trailer[:], crc.New(value).Value())
+	if _, err := w.w.Write(value); err != nil {
+		w.err = err
+		return blobHandle{}, err
+	}
+	if _, err := w.w.Write(trailer[:]); err != nil {
+		w.err = err
+		return blobHandle{}, err
+	}
+	w.offset += uint64(len(value)) + blobFileTrailerLen
+	w.valueCount++
+	w.valueSize += uint64(len(value))
+	return h, nil
+}
+
+// close writes the footer, syncs and closes the blob file, and returns the
+// metadata for the file.
+func (w *blobFileWriter) close() (*manifest.BlobFileMetadata, error) {
+	if w.file == nil {
+		return nil, w.err
+	}
+	err := w.err
+	if err == nil {
+		var footer [blobFileFooterLen]byte
+		binary.LittleEndian.PutUint64(footer[0:], w.valueCount)
+		binary.LittleEndian.PutUint64(footer[8:], w.valueSize)
+		copy(footer[16:], blobFileMagic)
+		if _, err = w.w.Write(footer[:]); err == nil {
+			w.offset += blobFileFooterLen
+			if err = w.w.Flush(); err == nil {
+				err = w.file.Sync()
+			}
+		}
+	}
+	err = firstError(err, w.file.Close())
+	w.file = nil
+	if err != nil {
+		w.err = err
+		return nil, err
+	}
+	return &manifest.BlobFileMetadata{
+		FileNum:   w.fileNum,
+		Size:      w.offset,
+		ValueSize: w.valueSize,
+	}, nil
+}
+
+// blobFileCache holds the open blob files of a DB and reads values from them.
+// At most size blob files are held open: the least recently used file is
+// closed when another is opened. A file which is being read from is closed
+// once the read completes.
+type blobFileCache struct {
+	fs      vfs.FS
+	dirname string
+	size    int
+
+	mu    sync.Mutex
+	files map[FileNum]*blobFileCacheNode
+	lru   blobFileCacheNode
+}
+
+type blobFileCacheNode struct {
+	fileNum FileNum
+	file    vfs.File
+
+	// The remaining fields are protected by the blobFileCache mutex. The node
+	// has a reference while it is present in blobFileCache.files, and one per
+	// read in progress. The file is closed when the last reference is dropped.
+	next, prev *blobFileCacheNode
+	refCount   int32
+}
+
+func (c *blobFileCache) init(fs vfs.FS, dirname string, size int) {
+	c.fs = fs
+	c.dirname = dirname
+	c.size = size
+	if c.size < 1 {
+		c.size = 1
+	}
+	c.files = make(map[FileNum]*blobFileCacheNode)
+	c.lru.next = &c.lru
+	c.lru.prev = &c.lru
+}
+
+// get returns the node for the specified blob file, opening the file if it is
+// not already open. The caller is responsible for releasing the node with
+// unref.
+func (c *blobFileCache) get(fileNum FileNum) (*blobFileCacheNode, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.files[fileNum]
+	if n != nil {
+		// Remove n from the doubly-linked list.
+		n.next.prev = n.prev
+		n.prev.next = n.next
+	} else {
+		f, err := c.fs.Open(base.MakeFilename(c.fs, c.dirname, fileTypeBlob, fileNum))
+		if err != nil {
+			return nil, err
+		}
+		n = &blobFileCacheNode{fileNum: fileNum, file: f, refCount: 1}
+		c.files[fileNum] = n
+	}
+	// Insert n at the front of the doubly-linked list.
+	n.next = c.lru.next
+	n.prev = &c.lru
+	n.next.prev = n
+	n.prev.next = n
+	// The caller is responsible for decrementing the refCount.
+	n.refCount++
+	if len(c.files) > c.size {
+		// Release the tail node.
+		_ = c.releaseNodeLocked(c.lru.prev)
+	}
+	return n, nil
+}
+
+// releaseNodeLocked removes the node from the cache, and drops the cache's
+// reference to it.
+//
+// c.mu must be held when calling this.
+func (c *blobFileCache) releaseNodeLocked(n *blobFileCacheNode) error {
+	delete(c.files, n.fileNum)
+	n.next.prev = n.prev
+	n.prev.next = n.next
+	n.prev = nil
+	n.next = nil
+	return c.unrefNodeLocked(n)
+}
+
+// unrefNodeLocked decrements the reference count for the specified node,
+// closing its file if the reference count fell to 0.
+//
+// c.mu must be held when calling this.
+func (c *blobFileCache) unrefNodeLocked(n *blobFileCacheNode) error {
+	n.refCount--
+	if n.refCount == 0 {
+		return n.file.Close()
+	}
+	return nil
+}
+
+func (c *blobFileCache) unref(n *blobFileCacheNode) {
+	c.mu.Lock()
+	_ = c.unrefNodeLocked(n)
+	c.mu.Unlock()
+}
+
+// fetch returns the value for the encoded blob handle. The value is read into
+// buf, which is grown if necessary, and the returned slice aliases buf.
+func (c *blobFileCache) fetch(encodedHandle []byte, buf []byte) ([]byte, error) {
+	h, err := decodeBlobHandle(encodedHandle)
+	if err != nil {
+		return nil, err
+	}
+	n, err := c.get(h.fileNum)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unref(n)
+	l := int(h.length) + blobFileTrailerLen
+	if cap(buf) < l {
+		buf = make([]byte, l)
+	}
+	buf = buf[:l]
+	if _, err := n.file.ReadAt(buf, int64(h.offset)); err != nil && err != io.EOF {
+		return nil, err
+	} else if err == io.EOF {
+		return nil, errors.Wrapf(errCorruptBlobFile, "blob file %s: value out of range", h.fileNum)
+	}
+	value := buf[:h.length]
+	checksum := binary.LittleEndian.Uint32(buf[h.length:])
+	if crc.New(value).Value() != checksum {
+		return nil, errors.Wrapf(errCorruptBlobFile, "blob file %s: checksum mismatch at offset %d",
+			h.fileNum, errors.Safe(h.offset))
+	}
+	return value, nil
+}
+
+// evict removes the specified blob file from the cache, closing it if it is
+// not being read from. It is called when the blob file is deleted.
+func (c *blobFileCache) evict(fileNum FileNum) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := c.files[fileNum]; n != nil {
+		_ = c.releaseNodeLocked(n)
+	}
+}
+
+func (c *blobFileCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, n := range c.files {
+		err = firstError(err, c.releaseNodeLocked(n))
+	}
+	return err
+}
+
+// valueSeparator separates the large values written by a flush or compaction
+// into blob files, and tracks the blob files referenced by each output table.
+type valueSeparator struct {
+	// threshold is the minimum size of a value which is separated. Zero
+	// disables value separation, though existing blob index keys are still
+	// tracked and rewritten.
+	threshold int
+	// maxBlobFileSize is the size at which a new blob file is started.
+	maxBlobFileSize uint64
+	// newBlobFile creates a new blob file.
+	newBlobFile func() (*blobFileWriter, error)
+	// fetch reads the value for a blob handle.
+	fetch func(encodedHandle []byte, buf []byte) ([]byte, error)
+	// rewrite contains the blob files which are being garbage collected. The
+	// values referenced in these blob files are rewritten to new blob files.
+	rewrite map[FileNum]bool
+
+	w        *blobFileWriter
+	finished []*manifest.BlobFileMetadata
+	refs     map[FileNum]uint64
+	valueBuf []byte
+	handle   []byte
+}
+
+// add processes a key and value being written to an output table, and
+// returns the kind and value to write.
+func (s *valueSeparator) add(key *InternalKey, value []byte) (InternalKeyKind, []byte, error) {
+	switch kind := key.Kind(); kind {
+	case InternalKeyKindSet:
+		if s.threshold == 0 || len(value) < s.threshold {
+			return kind, value, nil
+		}
+		return s.separate(value)
+
+	case InternalKeyKindBlobIndex:
+		h, err := decodeBlobHandle(value)
+		if err != nil {
+			return kind, nil, err
+		}
+		if !s.rewrite[h.fileNum] {
+			s.addRef(h.fileNum, h.length)
+			return kind, value, nil
+		}
+		s.valueBuf, err = s.fetch(value, s.valueBuf)
+		if err != nil {
+			return kind, nil, err
+		}
+		return s.separate(s.valueBuf)
+
+	default:
+		return kind, value, nil
+	}
+}
+
+func (s *valueSeparator) separate(value []byte) (InternalKeyKind, []byte, error) {
+	if s.w != nil && s.w.offset >= s.maxBlobFileSize {
+		if err := s.finishBlobFile(); err != nil {
+			return 0, nil, err
+		}
+	}
+	if s.w == nil {
+		var err error
+		if s.w, err = s.newBlobFile(); err != nil {
+			return 0, nil, err
+		}
+	}
+	h, err := s.w.add(value)
+	if err != nil {
+		return 0, nil, err
+	}
+	s.addRef(h.fileNum, h.length)
+	s.handle = h.encode(s.handle[:0])
+	return InternalKeyKindBlobIndex, s.handle, nil
+}
+
+func (s *valueSeparator) addRef(fileNum FileNum, valueSize uint64) {
+	if s.refs == nil {
+		s.refs = make(map[FileNum]uint64)
+	}
+	s.refs[fileNum] += valueSize
+}
+
+// takeReferences returns the blob references of the current output table,
+// sorted by file number, and resets them for the next output table.
+func (s *valueSeparator) takeReferences() []manifest.BlobReference {
+	if len(s.refs) == 0 {
+		return nil
+	}
+	refs := make([]manifest.BlobReference, 0, len(s.refs))
+	for fileNum, size := range s.refs {
+		refs = append(refs, manifest.BlobReference{FileNum: fileNum, ValueSize: size})
+		delete(s.refs, fileNum)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].FileNum < refs[j].FileNum
+	})
+	return refs
+}
+
+func (s *valueSeparator) finishBlobFile() error {
+	meta, err := s.w.close()
+	s.w = nil
+	if err != nil {
+		return err
+	}
+	s.finished = append(s.finished, meta)
+	return nil
+}
+
+// finish closes the current blob file, and returns the metadata of the blob
+// files written.
+func (s *valueSeparator) finish() ([]*manifest.BlobFileMetadata, error) {
+	if s.w != nil {
+		if err := s.finishBlobFile(); err != nil {
+			return nil, err
+		}
+	}
+	return s.finished, nil
+}
+
+// close closes the current blob file, if any, without finishing it. It is
+// used to clean up after an error.
+func (s *valueSeparator) close() {
+	if s.w != nil && s.w.file != nil {
+		_ = s.w.file.Close()
+		s.w.file = nil
+	}
+	s.w = nil
+}
+
+// blobFilesToGC returns the blob files in the version whose fraction of live
+// values is below threshold.
+func blobFilesToGC(v *version, threshold float64) map[FileNum]bool {
+	if len(v.BlobFiles) == 0 || threshold <= 0 {
+		return nil
+	}
+	var gc map[FileNum]bool
+	live := v.BlobFileLiveSizes()
+	for fileNum, meta := range v.BlobFiles {
+		if meta.ValueSize == 0 || float64(live[fileNum]) >= threshold*float64(meta.ValueSize) {
+			continue
+		}
+		if gc == nil {
+			gc = make(map[FileNum]bool)
+		}
+		gc[fileNum] = true
+	}
+	return gc
+}
@@ -0,0 +1,267 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/manifest"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobHandleEncodeDecode(t *testing.T) {
+	testCases := []blobHandle{
+		{},
+		{fileNum: 1, offset: 0, length: 100},
+		{fileNum: 1 << 40, offset: 1 << 35, length: 1 << 20},
+	}
+	for _, h := range testCases {
+		buf := h.encode(nil)
+		decoded, err := decodeBlobHandle(buf)
+		require.NoError(t, err)
+		require.Equal(t, h, decoded)
+
+		_, err = decodeBlobHandle(buf[:len(buf)-1])
+		require.True(t, errors.Is(err, errCorruptBlobFile))
+		_, err = decodeBlobHandle(append(buf, 0))
+		require.True(t, errors.Is(err, errCorruptBlobFile))
+	}
+}
+
+func TestBlobFile(t *testing.T) {
+	mem := vfs.NewMem()
+	f, err := mem.Create(base.MakeFilename(mem, "", fileTypeBlob, 7))
+	require.NoError(t, err)
+
+	w := newBlobFileWriter(7, f)
+	var values [][]byte
+	var handles [][]byte
+	for i := 0; i < 10; i++ {
+		value := bytes.Repeat([]byte{byte('a' + i)}, 10*i)
+		h, err := w.add(value)
+		require.NoError(t, err)
+		values = append(values, value)
+		handles = append(handles, h.encode(nil))
+	}
+	meta, err := w.close()
+	require.NoError(t, err)
+	require.Equal(t, FileNum(7), meta.FileNum)
+	require.Equal(t, uint64(450), meta.ValueSize)
+	require.Equal(t, uint64(450+10*blobFileTrailerLen+blobFileFooterLen), meta.Size)
+
+	var c blobFileCache
+	c.init(mem, "", 10)
+	var buf []byte
+	for i := range handles {
+		value, err := c.fetch(handles[i], buf)
+		require.NoError(t, err)
+		require.Equal(t, values[i], value)
+	}
+
+	// A handle which extends past the end of the file is an error.
+	h := blobHandle{fileNum: 7, offset: meta.Size - 2, length: 100}
+	_, err = c.fetch(h.encode(nil), nil)
+	require.True(t, errors.Is(err, errCorruptBlobFile))
+
+	// Corrupt a value, and verify the corruption is detected.
+	c.evict(7)
+	data, err := mem.Open(base.MakeFilename(mem, "", fileTypeBlob, 7))
+	require.NoError(t, err)
+	contents := make([]byte, meta.Size)
+	_, err = data.ReadAt(contents, 0)
+	require.NoError(t, err)
+	require.NoError(t, data.Close())
+	contents[20] ^= 0xff
+	f, err = mem.Create(base.MakeFilename(mem, "", fileTypeBlob, 7))
+	require.NoError(t, err)
+	_, err = f.Write(contents)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = c.fetch(handles[2], nil)
+	require.True(t, errors.Is(err, errCorruptBlobFile))
+	require.NoError(t, c.close())
+}
+
+func TestBlobFileCacheSize(t *testing.T) {
+	mem := vfs.NewMem()
+	handles := make(map[FileNum][]byte)
+	for _, fileNum := range []FileNum{1, 2, 3} {
+		f, err := mem.Create(base.MakeFilename(mem, "", fileTypeBlob, fileNum))
+		require.NoError(t, err)
+		w := newBlobFileWriter(fileNum, f)
+		h, err := w.add([]byte("value"))
+		require.NoError(t, err)
+		handles[fileNum] = h.encode(nil)
+		_, err = w.close()
+		require.NoError(t, err)
+	}
+
+	var c blobFileCache
+	c.init(mem, "", 2)
+	openFiles := func() []FileNum {
+		var fileNums []FileNum
+		for n := c.lru.next; n != &c.lru; n = n.next {
+			fileNums = append(fileNums, n.fileNum)
+		}
+		return fileNums
+	}
+	for _, fileNum := range []FileNum{1, 2, 1, 3} {
+		value, err := c.fetch(handles[fileNum], nil)
+		require.NoError(t, err)
+		require.Equal(t, "value", string(value))
+	}
+	// The least recently used file was closed when the third file was opened.
+	// MemFS refuses to remove open files.
+	require.Equal(t, []FileNum{3, 1}, openFiles())
+	require.NoError(t, mem.Remove(base.MakeFilename(mem, "", fileTypeBlob, 2)))
+	require.Error(t, mem.Remove(base.MakeFilename(mem, "", fileTypeBlob, 1)))
+
+	// A file which is being read from is closed once the read completes.
+	n, err := c.get(3)
+	require.NoError(t, err)
+	c.evict(3)
+	require.Error(t, mem.Remove(base.MakeFilename(mem, "", fileTypeBlob, 3)))
+	c.unref(n)
+	require.NoError(t, mem.Remove(base.MakeFilename(mem, "", fileTypeBlob, 3)))
+
+	require.NoError(t, c.close())
+	require.NoError(t, mem.Remove(base.MakeFilename(mem, "", fileTypeBlob, 1)))
+}
+
+func TestValueSeparation(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{
+		FS:                       mem,
+		ValueSeparationThreshold: 100,
+		DebugCheck:               DebugCheckLevels,
+	}
+	d, err := Open("", opts)
+	require.NoError(t, err)
+
+	largeValue := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, 200)
+	}
+	blobFiles := func() []FileNum {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var fileNums []FileNum
+		for fileNum := range d.mu.versions.currentVersion().BlobFiles {
+			fileNums = append(fileNums, fileNum)
+		}
+		return fileNums
+	}
+	verify := func(expected map[string]string) {
+		for k, v := range expected {
+			value, closer, err := d.Get([]byte(k))
+			require.NoError(t, err)
+			require.Equal(t, v, string(value), "key %s", k)
+			require.NoError(t, closer.Close())
+		}
+		actual := make(map[string]string)
+		iter := d.NewIter(nil)
+		for valid := iter.Last(); valid; valid = iter.Prev() {
+			actual[string(iter.Key())] = string(iter.Value())
+		}
+		require.NoError(t, iter.Close())
+		require.Equal(t, expected, actual)
+	}
+
+	// Large values are written to a blob file by the flush.
+	expected := make(map[string]string)
+	for _, k := range []string{"a", "b", "c", "e"} {
+		require.NoError(t, d.Set([]byte(k), largeValue(k[0]), nil))
+		expected[k] = string(largeValue(k[0]))
+	}
+	require.NoError(t, d.Set([]byte("d"), []byte("small"), nil))
+	expected["d"] = "small"
+	require.NoError(t, d.Flush())
+	initial := blobFiles()
+	require.Equal(t, 1, len(initial))
+	verify(expected)
+
+	// A merge on top of a separated value reads the value from the blob file.
+	require.NoError(t, d.Merge([]byte("c"), []byte("x"), nil))
+	expected["c"] += "x"
+	verify(expected)
+	require.NoError(t, d.Compact([]byte("a"), []byte("f")))
+	verify(expected)
+
+	// The blob files are recovered when the DB is reopened.
+	require.NoError(t, d.Close())
+	d, err = Open("", opts)
+	require.NoError(t, err)
+	verify(expected)
+
+	// Overwrite most of the values in the first blob file. Compacting the
+	// overwrites into the tables referencing the blob file leaves it with few
+	// live values, so a background compaction rewrites the remaining live
+	// value of "e", and the blob file is deleted.
+	require.NoError(t, d.Set([]byte("a"), largeValue('A'), nil))
+	require.NoError(t, d.Delete([]byte("b"), nil))
+	expected["a"] = string(largeValue('A'))
+	delete(expected, "b")
+	require.NoError(t, d.Compact([]byte("a"), []byte("f")))
+	d.mu.Lock()
+	for d.mu.compact.compactingCount > 0 {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+	verify(expected)
+	for _, fileNum := range blobFiles() {
+		require.NotEqual(t, initial[0], fileNum)
+	}
+	_, err = mem.Stat(base.MakeFilename(mem, "", fileTypeBlob, initial[0]))
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, d.Close())
+}
+
+func TestPickBlobFileGC(t *testing.T) {
+	opts := (&Options{}).EnsureDefaults()
+	newFile := func(fileNum FileNum, start, end string, refs ...manifest.BlobReference) *fileMetadata {
+		return &fileMetadata{
+			FileNum:        fileNum,
+			Size:           1,
+			Smallest:       base.MakeInternalKey([]byte(start), 1, InternalKeyKindSet),
+			Largest:        base.MakeInternalKey([]byte(end), 1, InternalKeyKindSet),
+			BlobReferences: refs,
+		}
+	}
+	vers := &version{
+		BlobFiles: map[FileNum]*manifest.BlobFileMetadata{
+			10: {FileNum: 10, Size: 120, ValueSize: 100},
+			11: {FileNum: 11, Size: 120, ValueSize: 100},
+		},
+	}
+	vers.Files[5] = []*fileMetadata{
+		newFile(1, "a", "b", manifest.BlobReference{FileNum: 11, ValueSize: 80}),
+	}
+	vers.Files[6] = []*fileMetadata{
+		newFile(2, "a", "b", manifest.BlobReference{FileNum: 11, ValueSize: 20}),
+		newFile(3, "c", "d", manifest.BlobReference{FileNum: 10, ValueSize: 40}),
+	}
+
+	var bytesCompacted uint64
+	env := compactionEnv{bytesCompacted: &bytesCompacted}
+	c := pickBlobFileGC(env, opts, vers, 5)
+	require.NotNil(t, c)
+	require.Equal(t, 6, c.startLevel)
+	require.Equal(t, 6, c.outputLevel)
+	require.Equal(t, FileNum(3), c.inputs[0][0].FileNum)
+	require.False(t, c.trivialMove())
+
+	vers.Files[6][1].Compacting = true
+	require.Nil(t, pickBlobFileGC(env, opts, vers, 5))
+
+	opts.BlobFileGCThreshold = 0.3
+	vers.Files[6][1].Compacting = false
+	require.Nil(t, pickBlobFileGC(env, opts, vers, 5))
+}
@@ -0,0 +1,465 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/record"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// ErrChangeFeedUnavailable is returned by DB.NewChangeFeed if the WAL files
+// containing the batches at the requested sequence number may have been
+// deleted. See Options.WALRetentionPeriod.
+var ErrChangeFeedUnavailable = errors.New("pebble: change feed sequence number has been discarded")
+
+// ErrChangeFeedOverflow is returned by a ChangeFeed which has fallen behind
+// the batches committed to the DB by more than
+// Options.MaxChangeFeedBufferSize. See DB.NewChangeFeed.
+var ErrChangeFeedOverflow = errors.New("pebble: change feed buffer overflow")
+
+// ChangeFeedBatch is a committed batch returned by a ChangeFeed.
+type ChangeFeedBatch struct {
+	// SeqNum is the sequence number of the first entry in the batch. The
+	// sequence number is incremented for each subsequent entry.
+	SeqNum uint64
+	// Count is the number of entries in the batch which consume a sequence
+	// number (i.e. all entries other than LogData).
+	Count uint32
+	// Reader iterates over the entries in the batch.
+	Reader BatchReader
+}
+
+// ChangeFeed is a stream of the batches committed to a DB, in sequence number
+// order. A change feed first returns the batches in the WAL files retained by
+// the DB, and then the batches committed after the feed was created. See
+// DB.NewChangeFeed.
+//
+// Next and TryNext must not be called concurrently, but Close may be called
+// concurrently with Next in order to unblock it.
+type ChangeFeed struct {
+	db   *DB
+	from uint64
+
+	// mu protects the state used to read the WAL files below.
+	mu sync.Mutex
+	// The WAL files remaining to be read, oldest first. The batches committed
+	// after the feed was created are written to the last log after liveOffset,
+	// and are not read from the WAL.
+	logs       []FileNum
+	liveOffset int64
+	file       vfs.File
+	rr         *record.Reader
+	buf        bytes.Buffer
+
+	// The oldest WAL file needed by the feed, or 0 if the feed has finished
+	// reading the WAL. Protected by DB.mu.
+	pinned FileNum
+
+	// The batches committed after the feed was created, which have not yet
+	// been returned, and their total size. The feed overflows, discarding the
+	// queue, if the size exceeds Options.MaxChangeFeedBufferSize. Protected by
+	// DB.feeds.
+	live       [][]byte
+	liveSize   int
+	overflowed bool
+	closed     bool
+}
+
+// NewChangeFeed returns a ChangeFeed which returns the committed batches
+// starting at the batch containing the sequence number fromSeqNum. A
+// fromSeqNum of 0 starts the feed at the oldest batch in the retained WAL
+// files. The feed returns ErrChangeFeedUnavailable if batches with sequence
+// numbers at or after fromSeqNum may have been discarded.
+//
+// Obsolete WAL files are retained for Options.WALRetentionPeriod, and for as
+// long as an open change feed needs them. Batches are returned once they are
+// visible to readers, which may be before they are synced. Ingested sstables
+// are not written to the WAL, and are not returned by a change feed.
+//
+// The feed must be closed when it is no longer needed. A feed buffers the
+// batches committed to the DB in memory until they are returned. If the
+// buffered batches exceed Options.MaxChangeFeedBufferSize, the feed discards
+// them and returns ErrChangeFeedOverflow. The caller may then resume from the
+// retained WAL files by creating a new feed starting after the last batch it
+// received.
+func (d *DB) NewChangeFeed(fromSeqNum uint64) (*ChangeFeed, error) {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if d.opts.DisableWAL {
+		return nil, errors.New("pebble: WAL disabled")
+	}
+
+	// Block commits while the feed is registered so that each batch is either
+	// in the WAL files read by the feed, or added to the feed's live queue.
+	d.commit.mu.Lock()
+	defer d.commit.mu.Unlock()
+
+	d.mu.Lock()
+	if fromSeqNum != 0 && fromSeqNum < d.mu.log.discardedSeqNum {
+		d.mu.Unlock()
+		return nil, ErrChangeFeedUnavailable
+	}
+	f := &ChangeFeed{db: d, from: fromSeqNum}
+	if fromSeqNum <= atomic.LoadUint64(&d.mu.versions.logSeqNum) {
+		for _, l := range d.mu.log.retained {
+			if l.endSeqNum >= fromSeqNum {
+				f.logs = append(f.logs, l.fileNum)
+			}
+		}
+		f.logs = append(f.logs, d.mu.log.queue...)
+		f.liveOffset = d.mu.log.Size()
+		f.pinned = f.logs[0]
+	}
+	if d.mu.log.feeds == nil {
+		d.mu.log.feeds = make(map[*ChangeFeed]struct{})
+	}
+	d.mu.log.feeds[f] = struct{}{}
+	atomic.AddInt32(&d.feeds.count, 1)
+	d.mu.Unlock()
+
+	// The LogWriter may buffer the batches written to the current log. Write
+	// them to the file so that they can be read by the feed.
+	if len(f.logs) > 0 {
+		if err := d.mu.log.Sync(); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Next returns the next batch, blocking until one is committed. The returned
+// batch remains valid until the next call to Next or TryNext. Next returns
+// ErrClosed if the feed or the DB is closed, and ErrChangeFeedOverflow if the
+// feed has fallen too far behind.
+func (f *ChangeFeed) Next() (ChangeFeedBatch, error) {
+	b, _, err := f.next(true /* wait */)
+	return b, err
+}
+
+// TryNext returns the next batch if one has been committed, without
+// blocking. The returned batch remains valid until the next call to Next or
+// TryNext.
+func (f *ChangeFeed) TryNext() (ChangeFeedBatch, bool, error) {
+	return f.next(false /* wait */)
+}
+
+func (f *ChangeFeed) next(wait bool) (ChangeFeedBatch, bool, error) {
+	if b, ok, err := f.nextLogged(); ok || err != nil {
+		return b, ok, err
+	}
+
+	d := f.db
+	d.feeds.Lock()
+	defer d.feeds.Unlock()
+	for {
+		if f.closed || d.feeds.closed {
+			return ChangeFeedBatch{}, false, ErrClosed
+		}
+		if f.overflowed {
+			return ChangeFeedBatch{}, false, ErrChangeFeedOverflow
+		}
+		if len(f.live) > 0 {
+			repr := f.live[0]
+			b, ok := f.makeBatch(repr)
+			if b.SeqNum+uint64(b.Count) <= atomic.LoadUint64(&d.mu.versions.visibleSeqNum) {
+				f.live[0] = nil
+				f.live = f.live[1:]
+				f.liveSize -= len(repr)
+				if ok {
+					return b, true, nil
+				}
+				continue
+			}
+		}
+		if !wait {
+			return ChangeFeedBatch{}, false, nil
+		}
+		d.feeds.cond.Wait()
+	}
+}
+
+// nextLogged returns the next batch in the WAL files, or false if all of the
+// batches in the WAL files have been returned.
+func (f *ChangeFeed) nextLogged() (ChangeFeedBatch, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.logs) > 0 {
+		if f.isClosed() {
+			return ChangeFeedBatch{}, false, ErrClosed
+		}
+		repr, err := f.readLog()
+		if err != nil {
+			return ChangeFeedBatch{}, false, err
+		}
+		if repr == nil {
+			continue
+		}
+		if b, ok := f.makeBatch(repr); ok {
+			return b, true, nil
+		}
+	}
+	return ChangeFeedBatch{}, false, nil
+}
+
+// readLog reads the next batch from the current WAL file, returning nil if
+// the end of the file was reached.
+func (f *ChangeFeed) readLog() ([]byte, error) {
+	d := f.db
+	logNum := f.logs[0]
+	if f.rr == nil {
+		file, err := d.opts.FS.Open(base.MakeFilename(d.opts.FS, d.walDirname, fileTypeLog, logNum))
+		if err != nil {
+			return nil, err
+		}
+		f.file = file
+		f.rr = record.NewReader(file, logNum)
+	}
+
+	r, err := f.rr.Next()
+	if err == nil {
+		f.buf.Reset()
+		_, err = io.Copy(&f.buf, r)
+	}
+	if err != nil {
+		// See DB.replayWAL for why zeroed and invalid chunks are treated like
+		// EOF.
+		if err == io.EOF || err == record.ErrZeroedChunk || err == record.ErrInvalidChunk {
+			return nil, f.nextLog()
+		}
+		return nil, err
+	}
+	if len(f.logs) == 1 && f.rr.Offset() > f.liveOffset {
+		// The batch was committed after the feed was created, and is in the
+		// live queue.
+		return nil, f.nextLog()
+	}
+	if f.buf.Len() < batchHeaderLen {
+		return nil, errors.Errorf("pebble: corrupt log file %q (num %s)",
+			base.MakeFilename(d.opts.FS, d.walDirname, fileTypeLog, logNum), errors.Safe(logNum))
+	}
+	return f.buf.Bytes(), nil
+}
+
+// nextLog closes the current log and unpins it, allowing it to be deleted.
+func (f *ChangeFeed) nextLog() error {
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+		f.rr = nil
+	}
+	f.logs = f.logs[1:]
+
+	d := f.db
+	d.mu.Lock()
+	f.pinned = 0
+	if len(f.logs) > 0 {
+		f.pinned = f.logs[0]
+	}
+	d.mu.Unlock()
+	return err
+}
+
+// makeBatch decodes the batch repr, returning false if the batch precedes
+// the start of the feed.
+func (f *ChangeFeed) makeBatch(repr []byte) (ChangeFeedBatch, bool) {
+	b := ChangeFeedBatch{
+		SeqNum: binary.LittleEndian.Uint64(repr[:8]),
+		Count:  binary.LittleEndian.Uint32(repr[8:12]),
+		Reader: MakeBatchReader(repr),
+	}
+	if b.SeqNum < f.from && b.SeqNum+uint64(b.Count) <= f.from {
+		return b, false
+	}
+	return b, true
+}
+
+func (f *ChangeFeed) isClosed() bool {
+	d := f.db
+	d.feeds.Lock()
+	defer d.feeds.Unlock()
+	return f.closed || d.feeds.closed
+}
+
+// Close closes the feed, unblocking a concurrent call to Next.
+func (f *ChangeFeed) Close() error {
+	d := f.db
+	d.mu.Lock()
+	if _, ok := d.mu.log.feeds[f]; ok {
+		delete(d.mu.log.feeds, f)
+		atomic.AddInt32(&d.feeds.count, -1)
+	}
+	f.pinned = 0
+	d.mu.Unlock()
+
+	d.feeds.Lock()
+	f.closed = true
+	f.live = nil
+	f.liveSize = 0
+	d.feeds.cond.Broadcast()
+	d.feeds.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs = nil
+	if f.file != nil {
+		err := f.file.Close()
+		f.file = nil
+		f.rr = nil
+		return err
+	}
+	return nil
+}
+
+// queueChangeFeedBatchLocked adds the repr of a batch being committed to the
+// live queues of the open change feeds, overflowing the feeds whose queues
+// would exceed Options.MaxChangeFeedBufferSize. d.mu and commitPipeline.mu
+// must be held when calling this.
+func (d *DB) queueChangeFeedBatchLocked(repr []byte) {
+	repr = append([]byte(nil), repr...)
+	d.feeds.Lock()
+	for f := range d.mu.log.feeds {
+		if f.overflowed {
+			continue
+		}
+		if f.liveSize+len(repr) > d.opts.MaxChangeFeedBufferSize {
+			f.overflowed = true
+			f.live = nil
+			f.liveSize = 0
+			d.feeds.cond.Broadcast()
+			continue
+		}
+		f.live = append(f.live, repr)
+		f.liveSize += len(repr)
+	}
+	d.feeds.Unlock()
+}
+
+// notifyChangeFeeds wakes change feeds waiting for a batch to become visible.
+func (d *DB) notifyChangeFeeds() {
+	if atomic.LoadInt32(&d.feeds.count) == 0 {
+		return
+	}
+	d.feeds.Lock()
+	d.feeds.cond.Broadcast()
+	d.feeds.Unlock()
+}
+
+// closeChangeFeeds marks the change feeds as closed, unblocking their
+// callers.
+func (d *DB) closeChangeFeeds() {
+	d.feeds.Lock()
+	d.feeds.closed = true
+	d.feeds.cond.Broadcast()
+	d.feeds.Unlock()
+}
+
+// retainedLog is an obsolete WAL file which is retained for change feeds.
+type retainedLog struct {
+	fileNum    FileNum
+	obsoleteAt time.Time
+	// endSeqNum is greater than the sequence numbers of the batches in the log.
+	endSeqNum uint64
+}
+
+// retainObsoleteLogsLocked adds obsolete logs to the list of retained logs.
+// endSeqNum is greater than the sequence numbers of the batches in the logs.
+// d.mu must be held when calling this.
+func (d *DB) retainObsoleteLogsLocked(obsoleteLogs []FileNum, endSeqNum uint64) {
+	now := time.Now()
+	for _, fileNum := range obsoleteLogs {
+		d.mu.log.retained = append(d.mu.log.retained, retainedLog{
+			fileNum:    fileNum,
+			obsoleteAt: now,
+			endSeqNum:  endSeqNum,
+		})
+	}
+}
+
+// releaseRetainedLogsLocked removes and returns the prefix of the retained
+// logs which can be deleted: those whose retention period has elapsed, and
+// which are not needed by a change feed. d.mu must be held when calling this.
+func (d *DB) releaseRetainedLogsLocked() []FileNum {
+	minPinned := ^FileNum(0)
+	for f := range d.mu.log.feeds {
+		if f.pinned != 0 && f.pinned < minPinned {
+			minPinned = f.pinned
+		}
+	}
+	now := time.Now()
+	retained := d.mu.log.retained
+	n := 0
+	for ; n < len(retained); n++ {
+		l := retained[n]
+		if l.fileNum >= minPinned || now.Sub(l.obsoleteAt) < d.opts.WALRetentionPeriod {
+			break
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	released := make([]FileNum, n)
+	for i := range released {
+		released[i] = retained[i].fileNum
+	}
+	if s := retained[n-1].endSeqNum; d.mu.log.discardedSeqNum < s {
+		d.mu.log.discardedSeqNum = s
+	}
+	d.mu.log.retained = retained[n:]
+	return released
+}
+
+// retainScannedLogsLocked retains the obsolete logs found when the DB is
+// opened. d.mu must be held when calling this.
+func (d *DB) retainScannedLogsLocked(obsoleteLogs []FileNum) {
+	sort.Slice(obsoleteLogs, func(i, j int) bool {
+		return obsoleteLogs[i] < obsoleteLogs[j]
+	})
+	// The batches in the logs deleted before the DB was opened precede the
+	// first batch in the oldest log.
+	for _, fileNum := range obsoleteLogs {
+		if seqNum, ok := d.firstLogSeqNum(fileNum); ok {
+			if seqNum < d.mu.log.discardedSeqNum {
+				d.mu.log.discardedSeqNum = seqNum
+			}
+			break
+		}
+	}
+	d.retainObsoleteLogsLocked(obsoleteLogs, atomic.LoadUint64(&d.mu.versions.logSeqNum))
+}
+
+// firstLogSeqNum returns the sequence number of the first batch in the log,
+// or false if the log contains no batches.
+func (d *DB) firstLogSeqNum(fileNum FileNum) (uint64, bool) {
+	file, err := d.opts.FS.Open(base.MakeFilename(d.opts.FS, d.walDirname, fileTypeLog, fileNum))
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+	r, err := record.NewReader(file, fileNum).Next()
+	if err != nil {
+		return 0, false
+	}
+	var header [batchHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(header[:8]), true
+}
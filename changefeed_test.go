@@ -0,0 +1,249 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func formatChangeFeedBatch(b ChangeFeedBatch) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%d:", b.SeqNum)
+	for r := b.Reader; ; {
+		kind, key, value, ok := r.Next()
+		if !ok {
+			break
+		}
+		fmt.Fprintf(&buf, " %s:%s=%s", kind, key, value)
+	}
+	return buf.String()
+}
+
+func TestChangeFeed(t *testing.T) {
+	d, err := Open("", &Options{
+		FS:                 vfs.NewMem(),
+		WALRetentionPeriod: time.Hour,
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	b := d.NewBatch()
+	require.NoError(t, b.Set([]byte("b"), []byte("2"), nil))
+	require.NoError(t, b.Delete([]byte("a"), nil))
+	require.NoError(t, b.Commit(nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Merge([]byte("c"), []byte("3"), nil))
+
+	// The batches written before the flush are read from the retained logs.
+	f, err := d.NewChangeFeed(0)
+	require.NoError(t, err)
+	var batches []string
+	for i := 0; i < 3; i++ {
+		b, err := f.Next()
+		require.NoError(t, err)
+		batches = append(batches, formatChangeFeedBatch(b))
+	}
+	require.Equal(t, []string{
+		"1: SET:a=1",
+		"2: SET:b=2 DEL:a=",
+		"4: MERGE:c=3",
+	}, batches)
+	_, ok, err := f.TryNext()
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Batches committed after the feed is created are returned once they are
+	// committed.
+	require.NoError(t, d.Set([]byte("d"), []byte("4"), nil))
+	b2, ok, err := f.TryNext()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "5: SET:d=4", formatChangeFeedBatch(b2))
+
+	done := make(chan string)
+	go func() {
+		b, err := f.Next()
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		done <- formatChangeFeedBatch(b)
+	}()
+	require.NoError(t, d.Set([]byte("e"), []byte("5"), nil))
+	require.Equal(t, "6: SET:e=5", <-done)
+
+	// Close unblocks a concurrent call to Next.
+	go func() {
+		_, err := f.Next()
+		done <- err.Error()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, f.Close())
+	require.Equal(t, ErrClosed.Error(), <-done)
+
+	// A feed starting part way through a batch returns the whole batch.
+	f, err = d.NewChangeFeed(3)
+	require.NoError(t, err)
+	batches = batches[:0]
+	for i := 0; i < 4; i++ {
+		b, err := f.Next()
+		require.NoError(t, err)
+		batches = append(batches, formatChangeFeedBatch(b))
+	}
+	require.Equal(t, []string{
+		"2: SET:b=2 DEL:a=",
+		"4: MERGE:c=3",
+		"5: SET:d=4",
+		"6: SET:e=5",
+	}, batches)
+	require.NoError(t, f.Close())
+
+	// A feed may start after the last committed batch.
+	f, err = d.NewChangeFeed(10)
+	require.NoError(t, err)
+	for _, k := range []string{"f", "g", "h", "i", "j"} {
+		require.NoError(t, d.Set([]byte(k), nil, nil))
+	}
+	b2, err = f.Next()
+	require.NoError(t, err)
+	require.Equal(t, "10: SET:i=", formatChangeFeedBatch(b2))
+	require.NoError(t, f.Close())
+}
+
+func TestChangeFeedOverflow(t *testing.T) {
+	d, err := Open("", &Options{
+		FS:                 vfs.NewMem(),
+		WALRetentionPeriod: time.Hour,
+		// Each batch below is 17 bytes.
+		MaxChangeFeedBufferSize: 40,
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	f, err := d.NewChangeFeed(1)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// The batches which fit in the buffer are returned.
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Set([]byte("b"), []byte("2"), nil))
+	for _, expected := range []string{"1: SET:a=1", "2: SET:b=2"} {
+		b, err := f.Next()
+		require.NoError(t, err)
+		require.Equal(t, expected, formatChangeFeedBatch(b))
+	}
+
+	// A feed which falls behind discards its buffer and fails.
+	for _, k := range []string{"c", "d", "e"} {
+		require.NoError(t, d.Set([]byte(k), nil, nil))
+	}
+	_, err = f.Next()
+	require.True(t, errors.Is(err, ErrChangeFeedOverflow))
+	require.NoError(t, d.Set([]byte("f"), nil, nil))
+	_, _, err = f.TryNext()
+	require.True(t, errors.Is(err, ErrChangeFeedOverflow))
+
+	// A new feed resumes from the retained WAL files.
+	f2, err := d.NewChangeFeed(3)
+	require.NoError(t, err)
+	defer f2.Close()
+	var batches []string
+	for i := 0; i < 4; i++ {
+		b, err := f2.Next()
+		require.NoError(t, err)
+		batches = append(batches, formatChangeFeedBatch(b))
+	}
+	require.Equal(t, []string{
+		"3: SET:c=",
+		"4: SET:d=",
+		"5: SET:e=",
+		"6: SET:f=",
+	}, batches)
+}
+
+func TestChangeFeedRetention(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{FS: mem})
+	require.NoError(t, err)
+
+	retainedLogs := func() []FileNum {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var fileNums []FileNum
+		for _, l := range d.mu.log.retained {
+			fileNums = append(fileNums, l.fileNum)
+		}
+		return fileNums
+	}
+	currentLog := func() FileNum {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.mu.log.queue[len(d.mu.log.queue)-1]
+	}
+
+	// Without a retention period, flushed logs are not retained.
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Set([]byte("b"), []byte("2"), nil))
+	_, err = d.NewChangeFeed(1)
+	require.True(t, errors.Is(err, ErrChangeFeedUnavailable))
+
+	// An open feed retains the logs which it has not read, and the logs which
+	// follow them.
+	f, err := d.NewChangeFeed(2)
+	require.NoError(t, err)
+	pinnedLog := currentLog()
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Set([]byte("c"), []byte("3"), nil))
+	nextLog := currentLog()
+	require.NoError(t, d.Flush())
+	require.Equal(t, []FileNum{pinnedLog, nextLog}, retainedLogs())
+	require.Equal(t, int64(2), d.Metrics().WAL.ObsoleteFiles)
+
+	b, err := f.Next()
+	require.NoError(t, err)
+	require.Equal(t, "2: SET:b=2", formatChangeFeedBatch(b))
+	b, err = f.Next()
+	require.NoError(t, err)
+	require.Equal(t, "3: SET:c=3", formatChangeFeedBatch(b))
+	require.NoError(t, f.Close())
+
+	// The logs are deleted after the feed no longer needs them.
+	require.NoError(t, d.Set([]byte("d"), []byte("4"), nil))
+	require.NoError(t, d.Flush())
+	require.Empty(t, retainedLogs())
+	_, err = d.NewChangeFeed(3)
+	require.True(t, errors.Is(err, ErrChangeFeedUnavailable))
+	require.NoError(t, d.Close())
+
+	// The obsolete logs found when the DB is opened are retained, but the
+	// batches in the logs deleted earlier are unavailable.
+	opts := &Options{FS: mem, WALRetentionPeriod: time.Hour}
+	d, err = Open("", opts)
+	require.NoError(t, err)
+	_, err = d.NewChangeFeed(1)
+	require.True(t, errors.Is(err, ErrChangeFeedUnavailable))
+	require.NoError(t, d.Set([]byte("e"), []byte("5"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Close())
+
+	d, err = Open("", opts)
+	require.NoError(t, err)
+	f, err = d.NewChangeFeed(5)
+	require.NoError(t, err)
+	b, err = f.Next()
+	require.NoError(t, err)
+	require.Equal(t, "5: SET:e=5", formatChangeFeedBatch(b))
+	require.NoError(t, f.Close())
+	require.NoError(t, d.Close())
+}
@@ -5,19 +5,65 @@
 package pebble
 
 import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
 	"os"
+	"sort"
+	"sync/atomic"
 
+	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/manifest"
+	"github.com/cockroachdb/pebble/internal/record"
 	"github.com/cockroachdb/pebble/vfs"
 )
 
+// CheckpointSpan is a key range [Start, End) of interest for a checkpoint.
+type CheckpointSpan struct {
+	Start []byte
+	End   []byte
+}
+
+// CheckpointOption sets optional parameters used by DB.Checkpoint.
+type CheckpointOption func(*checkpointOptions)
+
+type checkpointOptions struct {
+	// restrictToSpans specifies the spans of interest for the checkpoint.
+	restrictToSpans []CheckpointSpan
+}
+
+// WithRestrictToSpans restricts the checkpoint to the specified spans. The
+// sstables (and blob files) which do not overlap any of the spans are excluded
+// from the checkpoint, and the checkpoint's MANIFEST describes only the
+// sstables which are included. An sstable straddling the edge of a span is
+// described by virtual sstables bounded by the spans it overlaps. The spans
+// are recorded in the checkpoint, and the first time the checkpoint is opened
+// the remaining keys outside of the spans (such as those in the WAL) are
+// deleted. Until then, the checkpoint cannot be opened in read-only or
+// follower mode. An empty list of spans does not restrict the checkpoint.
+func WithRestrictToSpans(spans []CheckpointSpan) CheckpointOption {
+	return func(opt *checkpointOptions) {
+		opt.restrictToSpans = spans
+	}
+}
+
 // Checkpoint constructs a snapshot of the DB instance in the specified
 // directory. The WAL, MANIFEST, OPTIONS, and sstables will be copied into the
 // snapshot. Hard links will be used when possible. Beware of the significant
 // space overhead for a checkpoint if hard links are disabled. Also beware that
 // even if hard links are used, the space overhead for the checkpoint will
 // increase over time as the DB performs compactions.
-func (d *DB) Checkpoint(destDir string) (err error) {
+func (d *DB) Checkpoint(destDir string, opts ...CheckpointOption) (err error) {
+	var opt checkpointOptions
+	for _, fn := range opts {
+		fn(&opt)
+	}
+	var spans []CheckpointSpan
+	if len(opt.restrictToSpans) > 0 {
+		spans = normalizeCheckpointSpans(d.cmp, opt.restrictToSpans)
+	}
+
 	if _, err := d.opts.FS.Stat(destDir); !os.IsNotExist(err) {
 		if err == nil {
 			return &os.PathError{
@@ -49,6 +95,9 @@ func (d *DB) Checkpoint(destDir string) (err error) {
 	manifestFileNum := d.mu.versions.manifestFileNum
 	manifestSize := d.mu.versions.manifest.Size()
 	optionsFileNum := d.optionsFileNum
+	minUnflushedLogNum := d.mu.versions.minUnflushedLogNum
+	nextFileNum := d.mu.versions.nextFileNum
+	logSeqNum := atomic.LoadUint64(&d.mu.versions.logSeqNum)
 
 	// Release DB.mu so we don't block other operations on the database.
 	d.mu.Unlock()
@@ -94,7 +143,35 @@ func (d *DB) Checkpoint(destDir string) (err error) {
 		}
 	}
 
-	{
+	// Determine the sstables and blob files to include in the checkpoint.
+	var tables []newFileEntry
+	blobFiles := make(map[FileNum]*manifest.BlobFileMetadata)
+	for level, files := range current.Files {
+		for _, meta := range files {
+			if spans == nil {
+				tables = append(tables, newFileEntry{Level: level, Meta: meta})
+				continue
+			}
+			restricted, err := d.restrictToCheckpointSpans(level, meta, spans)
+			if err != nil {
+				return err
+			}
+			for _, m := range restricted {
+				tables = append(tables, newFileEntry{Level: level, Meta: m})
+				if m.FileNum >= nextFileNum {
+					nextFileNum = m.FileNum + 1
+				}
+				for _, ref := range m.BlobReferences {
+					blobFiles[ref.FileNum] = current.BlobFiles[ref.FileNum]
+				}
+			}
+		}
+	}
+	if spans == nil {
+		blobFiles = current.BlobFiles
+	}
+
+	if spans == nil {
 		// Copy the MANIFEST, and create CURRENT. We copy rather than link because
 		// additional version edits added to the MANIFEST after we took our
 		// snapshot of the sstables will reference sstables that aren't in our
@@ -105,20 +182,61 @@ func (d *DB) Checkpoint(destDir string) (err error) {
 		if err := vfs.LimitedCopy(fs, srcPath, destPath, manifestSize); err != nil {
 			return err
 		}
-		if err := setCurrentFile(destDir, fs, manifestFileNum); err != nil {
+	} else {
+		// Write a MANIFEST which describes only the sstables and blob files
+		// included in the checkpoint, and record the spans so that the keys
+		// outside of them can be deleted when the checkpoint is opened.
+		ve := versionEdit{
+			ComparerName:       d.mu.versions.cmpName,
+			MinUnflushedLogNum: minUnflushedLogNum,
+			NextFileNum:        nextFileNum,
+			LastSeqNum:         logSeqNum - 1,
+			NewFiles:           tables,
+		}
+		for _, meta := range blobFiles {
+			ve.NewBlobFiles = append(ve.NewBlobFiles, meta)
+		}
+		sort.Slice(ve.NewBlobFiles, func(i, j int) bool {
+			return ve.NewBlobFiles[i].FileNum < ve.NewBlobFiles[j].FileNum
+		})
+		destPath := base.MakeFilename(fs, destDir, fileTypeManifest, manifestFileNum)
+		if err := writeCheckpointRecord(fs, destPath, ve.Encode); err != nil {
+			return err
+		}
+		destPath = fs.PathJoin(destDir, checkpointSpansFilename)
+		if err := writeCheckpointRecord(fs, destPath, func(w io.Writer) error {
+			_, err := w.Write(encodeCheckpointSpans(spans))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	if err := setCurrentFile(destDir, fs, manifestFileNum); err != nil {
+		return err
+	}
+
+	// Link or copy the sstables. The physical sstable backing several virtual
+	// tables is only linked once.
+	linked := make(map[FileNum]bool, len(tables))
+	for i := range tables {
+		fileNum := tables[i].Meta.BackingFileNum()
+		if linked[fileNum] {
+			continue
+		}
+		linked[fileNum] = true
+		srcPath := base.MakeFilename(fs, d.dirname, fileTypeTable, fileNum)
+		destPath := fs.PathJoin(destDir, fs.PathBase(srcPath))
+		if err := vfs.LinkOrCopy(fs, srcPath, destPath); err != nil {
 			return err
 		}
 	}
 
-	// Link or copy the sstables.
-	for l := range current.Files {
-		level := current.Files[l]
-		for i := range level {
-			srcPath := base.MakeFilename(fs, d.dirname, fileTypeTable, level[i].FileNum)
-			destPath := fs.PathJoin(destDir, fs.PathBase(srcPath))
-			if err := vfs.LinkOrCopy(fs, srcPath, destPath); err != nil {
-				return err
-			}
+	// Link or copy the blob files.
+	for fileNum := range blobFiles {
+		srcPath := base.MakeFilename(fs, d.dirname, fileTypeBlob, fileNum)
+		destPath := fs.PathJoin(destDir, fs.PathBase(srcPath))
+		if err := vfs.LinkOrCopy(fs, srcPath, destPath); err != nil {
+			return err
 		}
 	}
 
@@ -140,3 +258,225 @@ func (d *DB) Checkpoint(destDir string) (err error) {
 	// Sync the destination directory.
 	return dir.Sync()
 }
+
+// checkpointSpansFilename is the name of the file in which a span-restricted
+// checkpoint records its spans. The file is removed once the keys outside of
+// the spans have been deleted.
+const checkpointSpansFilename = "CHECKPOINT-SPANS"
+
+// normalizeCheckpointSpans returns the non-empty spans sorted by start key,
+// with overlapping and adjacent spans merged.
+func normalizeCheckpointSpans(cmp Compare, spans []CheckpointSpan) []CheckpointSpan {
+	sorted := make([]CheckpointSpan, 0, len(spans))
+	for _, s := range spans {
+		if cmp(s.Start, s.End) < 0 {
+			sorted = append(sorted, s)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return cmp(sorted[i].Start, sorted[j].Start) < 0
+	})
+	result := make([]CheckpointSpan, 0, len(sorted))
+	for _, s := range sorted {
+		if n := len(result); n > 0 && cmp(s.Start, result[n-1].End) <= 0 {
+			if cmp(s.End, result[n-1].End) > 0 {
+				result[n-1].End = s.End
+			}
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// restrictToCheckpointSpans returns the tables describing the data of the
+// table meta which lies within the normalized spans. A table which does not
+// overlap the spans is dropped, and a table lying within a single span is
+// kept as is. The data of a table straddling the edge of a span is described
+// by a virtual table for each span it overlaps, except for an L0 table
+// overlapping several spans, as two L0 tables cannot share the same largest
+// sequence number. Such a table is kept as is, and the keys outside of the
+// spans are deleted when the checkpoint is first opened.
+func (d *DB) restrictToCheckpointSpans(
+	level int, meta *fileMetadata, spans []CheckpointSpan,
+) ([]*fileMetadata, error) {
+	i := sort.Search(len(spans), func(i int) bool {
+		return d.cmp(spans[i].End, meta.Smallest.UserKey) > 0
+	})
+	j := i
+	for j < len(spans) && d.cmp(spans[j].Start, meta.Largest.UserKey) <= 0 {
+		j++
+	}
+	switch {
+	case i == j:
+		return nil, nil
+	case i+1 == j && exciseContains(d.cmp, KeyRange(spans[i]), meta):
+		return []*fileMetadata{meta}, nil
+	case level == 0 && i+1 < j:
+		return []*fileMetadata{meta}, nil
+	}
+	var restricted []*fileMetadata
+	for _, s := range spans[i:j] {
+		m, err := d.exciseVirtual(meta, KeyRange(s))
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			restricted = append(restricted, m)
+		}
+	}
+	return restricted, nil
+}
+
+// writeCheckpointRecord creates the named file containing a single record
+// written by fn.
+func writeCheckpointRecord(fs vfs.FS, filename string, fn func(w io.Writer) error) error {
+	f, err := fs.Create(filename)
+	if err != nil {
+		return err
+	}
+	rw := record.NewWriter(f)
+	w, err := rw.Next()
+	if err == nil {
+		err = fn(w)
+	}
+	if err1 := rw.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func encodeCheckpointSpans(spans []CheckpointSpan) []byte {
+	var buf []byte
+	var tmp [binary.MaxVarintLen64]byte
+	for _, s := range spans {
+		for _, key := range [2][]byte{s.Start, s.End} {
+			n := binary.PutUvarint(tmp[:], uint64(len(key)))
+			buf = append(buf, tmp[:n]...)
+			buf = append(buf, key...)
+		}
+	}
+	return buf
+}
+
+func decodeCheckpointSpans(buf []byte) ([]CheckpointSpan, error) {
+	// NB: spans is non-nil even if there are no spans, in which case every key
+	// lies outside of the spans.
+	spans := []CheckpointSpan{}
+	var keys [2][]byte
+	for len(buf) > 0 {
+		for i := range keys {
+			n, m := binary.Uvarint(buf)
+			if m <= 0 || uint64(len(buf)-m) < n {
+				return nil, errors.New("pebble: corrupt checkpoint spans")
+			}
+			keys[i] = buf[m : m+int(n)]
+			buf = buf[m+int(n):]
+		}
+		spans = append(spans, CheckpointSpan{Start: keys[0], End: keys[1]})
+	}
+	return spans, nil
+}
+
+// readCheckpointSpans reads the spans recorded in a span-restricted
+// checkpoint.
+func readCheckpointSpans(fs vfs.FS, filename string) ([]CheckpointSpan, error) {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := record.NewReader(f, 0 /* logNum */).Next()
+	if err != nil {
+		return nil, errors.Wrapf(err, "pebble: checkpoint spans %q", filename)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCheckpointSpans(buf)
+}
+
+// applyCheckpointSpans deletes the keys which lie outside of the spans
+// recorded in a span-restricted checkpoint, and then removes the record of
+// the spans.
+func (d *DB) applyCheckpointSpans(spans []CheckpointSpan) error {
+	// gaps are the ranges between the spans. The start of the first gap and the
+	// end of the last gap are nil, denoting the first and last keys in the DB.
+	gaps := make([]CheckpointSpan, 0, len(spans)+1)
+	var start []byte
+	for _, s := range spans {
+		gaps = append(gaps, CheckpointSpan{Start: start, End: s.Start})
+		start = s.End
+	}
+	gaps = append(gaps, CheckpointSpan{Start: start})
+
+	b := d.NewBatch()
+	defer b.Close()
+
+	// Delete the point keys in the gaps. The end of the last gap is the last
+	// point key, which is deleted separately as range deletions have an
+	// exclusive end key.
+	iter := d.NewIter(nil)
+	if iter.First() {
+		first := append([]byte(nil), iter.Key()...)
+		iter.Last()
+		last := append([]byte(nil), iter.Key()...)
+		for _, g := range gaps {
+			if g.Start == nil {
+				g.Start = first
+			}
+			if g.End == nil {
+				if d.cmp(g.Start, last) <= 0 {
+					_ = b.DeleteRange(g.Start, last, nil)
+					_ = b.Delete(last, nil)
+				}
+			} else if d.cmp(g.Start, g.End) < 0 {
+				_ = b.DeleteRange(g.Start, g.End, nil)
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	// Delete the range keys in the gaps.
+	iter = d.NewIter(&IterOptions{KeyTypes: IterKeyTypeRangesOnly})
+	if iter.First() {
+		first, _ := iter.RangeBounds()
+		first = append([]byte(nil), first...)
+		iter.Last()
+		_, last := iter.RangeBounds()
+		last = append([]byte(nil), last...)
+		for _, g := range gaps {
+			if g.Start == nil {
+				g.Start = first
+			}
+			if g.End == nil {
+				g.End = last
+			}
+			if d.cmp(g.Start, g.End) < 0 {
+				_ = b.RangeKeyDelete(g.Start, g.End, nil)
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if !b.Empty() {
+		if err := d.Apply(b, Sync); err != nil {
+			return err
+		}
+	}
+	if err := d.opts.FS.Remove(d.opts.FS.PathJoin(d.dirname, checkpointSpansFilename)); err != nil {
+		return err
+	}
+	return d.dataDir.Sync()
+}
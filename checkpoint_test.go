@@ -47,12 +47,24 @@ func TestCheckpoint(t *testing.T) {
 			return buf.String()
 
 		case "checkpoint":
-			if len(td.CmdArgs) != 2 {
-				return "checkpoint <db> <dir>"
+			if len(td.CmdArgs) != 2 && len(td.CmdArgs) != 3 {
+				return "checkpoint <db> <dir> [restrict=(start-end, ...)]"
+			}
+			var opts []CheckpointOption
+			if len(td.CmdArgs) == 3 {
+				var spans []CheckpointSpan
+				for _, v := range td.CmdArgs[2].Vals {
+					parts := strings.Split(v, "-")
+					if len(parts) != 2 {
+						return fmt.Sprintf("invalid span %s", v)
+					}
+					spans = append(spans, CheckpointSpan{Start: []byte(parts[0]), End: []byte(parts[1])})
+				}
+				opts = append(opts, WithRestrictToSpans(spans))
 			}
 			buf.Reset()
 			d := dbs[td.CmdArgs[0].String()]
-			if err := d.Checkpoint(td.CmdArgs[1].String()); err != nil {
+			if err := d.Checkpoint(td.CmdArgs[1].String(), opts...); err != nil {
 				return err.Error()
 			}
 			return buf.String()
@@ -66,6 +78,7 @@ func TestCheckpoint(t *testing.T) {
 			if err := d.Compact(nil, []byte("\xff")); err != nil {
 				return err.Error()
 			}
+			d.waitTableStats()
 			return buf.String()
 
 		case "flush":
@@ -77,6 +90,7 @@ func TestCheckpoint(t *testing.T) {
 			if err := d.Flush(); err != nil {
 				return err.Error()
 			}
+			d.waitTableStats()
 			return buf.String()
 
 		case "list":
@@ -134,3 +148,76 @@ func TestCheckpoint(t *testing.T) {
 		}
 	})
 }
+
+func TestCheckpointRestrictToSpans(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("db", &Options{FS: mem, FormatMajorVersion: FormatRangeKeys})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+
+	b := d.NewBatch()
+	for _, k := range []string{"a", "c", "e", "g"} {
+		require.NoError(t, b.Set([]byte(k), []byte(k), nil))
+	}
+	require.NoError(t, b.RangeKeySet([]byte("a"), []byte("z"), nil, []byte("v"), nil))
+	require.NoError(t, b.Commit(nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Set([]byte("y"), nil, nil))
+	require.NoError(t, d.Flush())
+
+	// Overlapping spans are merged, and empty spans are ignored.
+	require.NoError(t, d.Checkpoint("checkpoint", WithRestrictToSpans([]CheckpointSpan{
+		{Start: []byte("d"), End: []byte("f")},
+		{Start: []byte("b"), End: []byte("d")},
+		{Start: []byte("x"), End: []byte("w")},
+	})))
+
+	// The table which does not overlap the spans is excluded, and the table
+	// straddling the edges of the span is replaced by a virtual table.
+	names, err := mem.List("checkpoint")
+	require.NoError(t, err)
+	var tables []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".sst") {
+			tables = append(tables, name)
+		}
+	}
+	require.Equal(t, []string{"000005.sst"}, tables)
+	c, err := Open("checkpoint", &Options{FS: mem})
+	require.NoError(t, err)
+	c.mu.Lock()
+	l0 := c.mu.versions.currentVersion().Files[0]
+	c.mu.Unlock()
+	require.Len(t, l0, 1)
+	require.True(t, l0[0].Virtual)
+	require.Equal(t, "b", string(l0[0].Smallest.UserKey))
+	require.Equal(t, "f", string(l0[0].Largest.UserKey))
+	iter := c.NewIter(&IterOptions{KeyTypes: IterKeyTypePointsAndRanges})
+	var keys []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		hasPoint, hasRange := iter.HasPointAndRange()
+		if hasRange {
+			start, end := iter.RangeBounds()
+			keys = append(keys, fmt.Sprintf("[%s-%s)", start, end))
+		}
+		if hasPoint {
+			keys = append(keys, string(iter.Key()))
+		}
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, []string{"[b-f)", "[b-f)", "c", "[b-f)", "e"}, keys)
+	require.NoError(t, c.Close())
+
+	// A checkpoint restricted to empty spans contains no keys.
+	require.NoError(t, d.Checkpoint("empty", WithRestrictToSpans([]CheckpointSpan{
+		{Start: []byte("b"), End: []byte("b")},
+	})))
+	c, err = Open("empty", &Options{FS: mem})
+	require.NoError(t, err)
+	iter = c.NewIter(&IterOptions{KeyTypes: IterKeyTypePointsAndRanges})
+	require.False(t, iter.First())
+	require.NoError(t, iter.Close())
+	require.NoError(t, c.Close())
+}
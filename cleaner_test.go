@@ -57,6 +57,7 @@ func TestArchiveCleaner(t *testing.T) {
 			if err := d.Compact(nil, []byte("\xff")); err != nil {
 				return err.Error()
 			}
+			d.waitTableStats()
 			return buf.String()
 
 		case "flush":
@@ -68,6 +69,7 @@ func TestArchiveCleaner(t *testing.T) {
 			if err := d.Flush(); err != nil {
 				return err.Error()
 			}
+			d.waitTableStats()
 			return buf.String()
 
 		case "list":
@@ -10,6 +10,7 @@ import (
 	"sync/atomic"
 	"unsafe"
 
+	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/record"
 )
 
@@ -231,6 +232,19 @@ func newCommitPipeline(env commitEnv) *commitPipeline {
 // WAL, and applying the batch to the memtable. Upon successful return the
 // batch's mutations will be visible for reading.
 func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
+	return p.commit(b, 0 /* seqNum */, syncWAL)
+}
+
+// CommitAtSeqNum commits the specified batch like Commit, requiring that the
+// batch is assigned the sequence number seqNum. If seqNum is not the next
+// sequence number, the batch is not committed and an error wrapping
+// ErrOutOfOrderSeqNum is returned.
+func (p *commitPipeline) CommitAtSeqNum(b *Batch, seqNum uint64, syncWAL bool) error {
+	return p.commit(b, seqNum, syncWAL)
+}
+
+// commit commits the batch, at the sequence number seqNum if non-zero.
+func (p *commitPipeline) commit(b *Batch, seqNum uint64, syncWAL bool) error {
 	if b.Empty() {
 		return nil
 	}
@@ -243,9 +257,10 @@ func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
 	//
 	// NB: We set Batch.commitErr on error so that the batch won't be a candidate
 	// for reuse. See Batch.release().
-	mem, err := p.prepare(b, syncWAL)
+	mem, err := p.prepare(b, seqNum, syncWAL)
 	if err != nil {
 		b.db = nil // prevent batch reuse on error
+		<-p.sem
 		return err
 	}
 
@@ -325,7 +340,7 @@ func (p *commitPipeline) AllocateSeqNum(count int, prepare func(), apply func(se
 	<-p.sem
 }
 
-func (p *commitPipeline) prepare(b *Batch, syncWAL bool) (*memTable, error) {
+func (p *commitPipeline) prepare(b *Batch, seqNum uint64, syncWAL bool) (*memTable, error) {
 	n := uint64(b.Count())
 	if n == invalidBatchCount {
 		return nil, ErrInvalidBatch
@@ -344,6 +359,13 @@ func (p *commitPipeline) prepare(b *Batch, syncWAL bool) (*memTable, error) {
 
 	p.mu.Lock()
 
+	if next := atomic.LoadUint64(p.env.logSeqNum); seqNum != 0 && seqNum != next {
+		p.mu.Unlock()
+		b.commit.Add(-count)
+		return nil, errors.Wrapf(ErrOutOfOrderSeqNum,
+			"pebble: batch sequence number %d, expected %d", errors.Safe(seqNum), errors.Safe(next))
+	}
+
 	// Enqueue the batch in the pending queue. Note that while the pending queue
 	// is lock-free, we want the order of batches to be the same as the sequence
 	// number order.
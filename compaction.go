@@ -15,7 +15,6 @@ import (
 	"sort"
 	"strings"
 	"sync/atomic"
-	"time"
 	"unsafe"
 
 	"github.com/cockroachdb/errors"
@@ -23,6 +22,7 @@ import (
 	"github.com/cockroachdb/pebble/internal/manifest"
 	"github.com/cockroachdb/pebble/internal/private"
 	"github.com/cockroachdb/pebble/internal/rangedel"
+	"github.com/cockroachdb/pebble/internal/rangekey"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 )
@@ -87,6 +87,34 @@ type compaction struct {
 	// equal to startLevel+1 except when startLevel is 0 in which case it is
 	// equal to compactionPicker.baseLevel().
 	outputLevel int
+	// deleteOnly is set for a delete-only compaction, which removes its input
+	// tables from startLevel (which is also its outputLevel) without reading
+	// or writing any tables, as every key within them is deleted by a range
+	// tombstone. See pickDeleteOnlyCompactionLocked.
+	deleteOnly bool
+	// fifo is set for a delete-only compaction which drops the oldest tables
+	// of the DB under CompactionStyleFIFO. See compactionPickerFIFO.
+	fifo bool
+	// keepCreationTime is set for a compaction whose outputs take the creation
+	// time of its oldest input rather than the current time, so that
+	// rewriting the tables does not extend the lifetime of their data under
+	// FIFOCompactionOptions.TTL. See compactionPickerFIFO.
+	keepCreationTime bool
+	// marked is set for a compaction of a table marked for compaction by
+	// DB.MarkForCompaction.
+	marked bool
+	// periodic is set for a compaction of a table whose age exceeds
+	// Options.PeriodicCompactionSeconds. See pickPeriodicCompaction.
+	periodic bool
+	// readTriggered is set for a compaction picked because the sampled reads
+	// of iterators exhausted the allowed seeks of its input table. See
+	// pickReadTriggeredCompaction.
+	readTriggered bool
+	// extraLevel is the intermediate level of a multi-level compaction, which
+	// compacts startLevel into outputLevel, merging the tables of the level in
+	// between them in the same pass. It is zero for a compaction of two
+	// levels.
+	extraLevel int
 
 	// maxOutputFileSize is the maximum size of an individual table created
 	// during compaction.
@@ -102,6 +130,12 @@ type compaction struct {
 	// tests to allow range tombstones to be added to tables where they would
 	// otherwise be elided.
 	disableRangeTombstoneElision bool
+	// writerOpts are the options for the tables written by the compaction, and
+	// maxBlobFileSize is the maximum size of the blob files it writes. They are
+	// captured when the compaction starts running, as the options of the
+	// output level may be changed by DB.SetOptions.
+	writerOpts      sstable.WriterOptions
+	maxBlobFileSize uint64
 
 	// flushing contains the flushables (aka memtables) that are being flushed.
 	flushing flushableList
@@ -113,8 +147,10 @@ type compaction struct {
 	// compaction routine to know how many bytes have been flushed before the flush
 	// is applied.
 	atomicBytesIterated *uint64
-	// inputs are the tables to be compacted.
-	inputs [2][]*fileMetadata
+	// inputs are the tables to be compacted: inputs[0] are the tables from
+	// startLevel, inputs[1] are the tables from outputLevel, and inputs[2] are
+	// the tables from extraLevel, for a multi-level compaction.
+	inputs [3][]*fileMetadata
 	// The boundaries of the input data.
 	smallest InternalKey
 	largest  InternalKey
@@ -124,6 +160,10 @@ type compaction struct {
 	// Referenced by `compactionIter` which uses it to check whether keys are deleted.
 	rangeDelFrag rangedel.Fragmenter
 
+	// The fragmented range keys which have yet to be written to an output
+	// file, sorted by start key. See collectRangeKeys().
+	rangeKeys []rangekey.Span
+
 	// A list of objects to close when the compaction finishes. Used by input
 	// iteration to keep rangeDelIters open for the lifetime of the compaction,
 	// and only close them when the compaction finishes.
@@ -142,6 +182,21 @@ type compaction struct {
 	elideTombstoneIndex int
 
 	metrics map[int]*LevelMetrics
+
+	// filterInfo holds the statistics of the compaction filter, populated when
+	// the compaction completes.
+	filterInfo CompactionFilterInfo
+
+	// subcompactions holds the info for the subcompactions the compaction was
+	// split into, populated when the compaction completes. See split().
+	subcompactions []SubcompactionInfo
+	// deletionHints holds the hints for the range tombstones written to the
+	// outputs of the compaction, populated when the compaction completes.
+	deletionHints []deleteCompactionHint
+	// splitLower and splitUpper are the user key bounds [lower, upper) of a
+	// subcompaction. The keys of the input tables which lie outside of the
+	// bounds are ignored. A nil bound is unbounded.
+	splitLower, splitUpper []byte
 }
 
 func newCompaction(
@@ -160,23 +215,55 @@ func newCompaction(
 	if outputLevel >= numLevels-1 {
 		outputLevel = numLevels - 1
 	}
-	// Output level is in the range [baseLevel,numLevels]. For the purpose of
-	// determining the target output file size, overlap bytes, and expanded
-	// bytes, we want to adjust the range to [1,numLevels].
-	adjustedOutputLevel := 1 + outputLevel - baseLevel
 
-	return &compaction{
+	c := &compaction{
 		cmp:                 opts.Comparer.Compare,
 		format:              opts.Comparer.Format,
 		logger:              opts.Logger,
 		version:             cur,
 		startLevel:          startLevel,
-		outputLevel:         outputLevel,
-		maxOutputFileSize:   uint64(opts.Level(adjustedOutputLevel).TargetFileSize),
-		maxOverlapBytes:     maxGrandparentOverlapBytes(opts, adjustedOutputLevel),
-		maxExpandedBytes:    expandedCompactionByteSizeLimit(opts, adjustedOutputLevel),
 		atomicBytesIterated: bytesCompacted,
 	}
+	c.setOutputLevel(opts, outputLevel, baseLevel)
+	return c
+}
+
+// setOutputLevel sets the output level of a compaction, along with the limits
+// on the sizes of its inputs and outputs which depend on the output level.
+func (c *compaction) setOutputLevel(opts *Options, outputLevel, baseLevel int) {
+	// Output level is in the range [baseLevel,numLevels]. For the purpose of
+	// determining the target output file size, overlap bytes, and expanded
+	// bytes, we want to adjust the range to [1,numLevels].
+	adjustedOutputLevel := 1 + outputLevel - baseLevel
+
+	c.outputLevel = outputLevel
+	c.maxOutputFileSize = uint64(opts.Level(adjustedOutputLevel).TargetFileSize)
+	c.maxOverlapBytes = maxGrandparentOverlapBytes(opts, adjustedOutputLevel)
+	c.maxExpandedBytes = expandedCompactionByteSizeLimit(opts, adjustedOutputLevel)
+}
+
+// inputLevel returns the level of the tables in c.inputs[i].
+func (c *compaction) inputLevel(i int) int {
+	switch i {
+	case 0:
+		return c.startLevel
+	case 1:
+		return c.outputLevel
+	default:
+		return c.extraLevel
+	}
+}
+
+// predictedWriteAmp returns the estimated write amplification of the
+// compaction: the ratio of the bytes written to the output level, which are
+// assumed to be all of the bytes read, to the bytes moved into the output
+// level from the levels above it.
+func (c *compaction) predictedWriteAmp() float64 {
+	moved := totalSize(c.inputs[0]) + totalSize(c.inputs[2])
+	if moved == 0 {
+		return 0
+	}
+	return float64(moved+totalSize(c.inputs[1])) / float64(moved)
 }
 
 func newFlush(
@@ -235,24 +322,46 @@ func newFlush(
 		}
 	}
 
+	updateRangeKeyBounds := func(iter internalIterator) {
+		// Range keys are not fragmented within a flushable, so the largest end
+		// key is not necessarily that of the last range key.
+		for key, value := iter.First(); key != nil; key, value = iter.Next() {
+			if !smallestSet ||
+				base.InternalCompare(c.cmp, c.smallest, *key) > 0 {
+				smallestSet = true
+				c.smallest = key.Clone()
+			}
+			end, _, _, ok := rangekey.DecodeValue(value)
+			if !ok {
+				continue
+			}
+			tmp := base.MakeRangeDeleteSentinelKey(end)
+			if !largestSet ||
+				base.InternalCompare(c.cmp, c.largest, tmp) < 0 {
+				largestSet = true
+				c.largest = tmp.Clone()
+			}
+		}
+	}
+
 	for i := range flushing {
 		f := flushing[i]
 		updatePointBounds(f.newIter(nil))
 		if rangeDelIter := f.newRangeDelIter(nil); rangeDelIter != nil {
 			updateRangeBounds(rangeDelIter)
 		}
+		if rangeKeyIter := f.newRangeKeyIter(nil); rangeKeyIter != nil {
+			updateRangeKeyBounds(rangeKeyIter)
+		}
 	}
 
-	// TODO(peter): When we allow flushing to create multiple tables we'll want
-	// to choose sstable boundaries based on the grandparents. But for now we
-	// want to create a single table during flushing so this is all commented
-	// out.
-	if false {
-		c.maxOutputFileSize = uint64(opts.Level(0).TargetFileSize)
-		c.maxOverlapBytes = maxGrandparentOverlapBytes(opts, 0)
-		c.maxExpandedBytes = expandedCompactionByteSizeLimit(opts, 0)
-		c.grandparents = c.version.Overlaps(baseLevel, c.cmp, c.smallest.UserKey, c.largest.UserKey)
-	}
+	// Split the output of the flush at the boundaries of the tables in the base
+	// level, treating them as the grandparents of the flush. A new table is
+	// started once the current one overlaps FlushSplitBytes of data in the
+	// base level. The resulting L0 tables do not overlap one another, and can
+	// be compacted into the base level independently, and concurrently.
+	c.maxOverlapBytes = uint64(opts.FlushSplitBytes)
+	c.grandparents = c.version.Overlaps(baseLevel, c.cmp, c.smallest.UserKey, c.largest.UserKey)
 
 	c.setupInuseKeyRanges()
 	return c
@@ -391,6 +500,13 @@ func (c *compaction) grow(sm, la InternalKey) bool {
 	if len(grow0) <= len(c.inputs[0]) {
 		return false
 	}
+	for _, f := range grow0 {
+		if f.Compacting {
+			// Growing the inputs to include a table which is being compacted
+			// would prevent the compaction from running.
+			return false
+		}
+	}
 	if totalSize(grow0)+totalSize(c.inputs[1]) >= c.maxExpandedBytes {
 		return false
 	}
@@ -454,11 +570,16 @@ func (c *compaction) trivialMove() bool {
 	if len(c.flushing) != 0 {
 		return false
 	}
+	if c.startLevel == c.outputLevel {
+		// A compaction within a level, such as a blob file GC compaction, must
+		// rewrite its inputs.
+		return false
+	}
 	// Check for a trivial move of one table from one level to the next. We avoid
 	// such a move if there is lots of overlapping grandparent data. Otherwise,
 	// the move could create a parent file that will require a very expensive
 	// merge later on.
-	if len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 &&
+	if len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 && len(c.inputs[2]) == 0 &&
 		totalSize(c.grandparents) <= c.maxOverlapBytes {
 		return true
 	}
@@ -499,6 +620,23 @@ func (c *compaction) findGrandparentLimit(start []byte) []byte {
 	return nil
 }
 
+// oldestCreationTime returns the oldest creation time of the input tables. A
+// table without a creation time is treated as the oldest, so the outputs of a
+// compaction of such a table have no creation time either.
+func (c *compaction) oldestCreationTime() int64 {
+	var oldest int64
+	first := true
+	for i := range c.inputs {
+		for _, f := range c.inputs[i] {
+			if first || f.CreationTime < oldest {
+				oldest = f.CreationTime
+				first = false
+			}
+		}
+	}
+	return oldest
+}
+
 // allowZeroSeqNum returns true if seqnum's can be zeroed if there are no
 // snapshots requiring them to be kept. It performs this determination by
 // looking for an sstable which overlaps the bounds of the compaction at a
@@ -625,6 +763,70 @@ func (c *compaction) atomicUnitBounds(f *fileMetadata) (lower, upper []byte) {
 	return nil, nil
 }
 
+// collectRangeKeys gathers the range keys from the compaction inputs. The
+// range keys are fragmented, and those which are shadowed by newer range keys
+// in the same snapshot stripe are elided. Range keys are expected to be rare
+// so they are held in memory for the duration of the compaction and written
+// to the output files by finishOutput().
+func (c *compaction) collectRangeKeys(
+	newRangeKeyIter func(*fileMetadata) (internalIterator, error), snapshots []uint64,
+) error {
+	var spans []rangekey.Span
+	collect := func(iter internalIterator) error {
+		if iter == nil {
+			return nil
+		}
+		var err error
+		spans, err = rangekey.Collect(spans, iter)
+		return firstError(err, iter.Close())
+	}
+
+	if len(c.flushing) != 0 {
+		for i := range c.flushing {
+			if err := collect(c.flushing[i].newRangeKeyIter(nil)); err != nil {
+				return err
+			}
+		}
+	} else {
+		for i := range c.inputs {
+			for _, f := range c.inputs[i] {
+				if !f.HasRangeKeys {
+					continue
+				}
+				iter, err := newRangeKeyIter(f)
+				if err != nil {
+					return err
+				}
+				if err := collect(iter); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	spans = rangekey.Fragment(c.cmp, spans)
+	if c.splitLower != nil || c.splitUpper != nil {
+		spans = rangekey.Truncate(c.cmp, spans, c.splitLower, c.splitUpper)
+	}
+	c.rangeKeys = rangekey.Elide(c.cmp, spans, snapshots, c.elideRangeTombstone)
+	return nil
+}
+
+// rangeKeysStraddle returns true if any of the range keys remaining to be
+// written would be present in an output file bounded by key as well as in the
+// following output file.
+func (c *compaction) rangeKeysStraddle(key []byte) bool {
+	for i := range c.rangeKeys {
+		if c.cmp(c.rangeKeys[i].Start.UserKey, key) > 0 {
+			break
+		}
+		if c.cmp(c.rangeKeys[i].End, key) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // newInputIter returns an iterator over all the input tables in a compaction.
 func (c *compaction) newInputIter(newIters tableNewIters) (_ internalIterator, retErr error) {
 	if len(c.flushing) != 0 {
@@ -656,6 +858,9 @@ func (c *compaction) newInputIter(newIters tableNewIters) (_ internalIterator, r
 	if err := manifest.CheckOrdering(c.cmp, c.format, c.outputLevel, c.inputs[1]); err != nil {
 		c.logger.Fatalf("%s", err)
 	}
+	if err := manifest.CheckOrdering(c.cmp, c.format, c.extraLevel, c.inputs[2]); err != nil {
+		c.logger.Fatalf("%s", err)
+	}
 
 	iters := make([]internalIterator, 0, 2*len(c.inputs[0])+1)
 	defer func() {
@@ -709,6 +914,7 @@ func (c *compaction) newInputIter(newIters tableNewIters) (_ internalIterator, r
 			if lowerBound != nil || upperBound != nil {
 				rangeDelIter = rangedel.Truncate(c.cmp, rangeDelIter, lowerBound, upperBound)
 			}
+			rangeDelIter = c.truncateToSplit(rangeDelIter)
 		}
 		if rangeDelIter == nil {
 			rangeDelIter = emptyIter
@@ -718,8 +924,8 @@ func (c *compaction) newInputIter(newIters tableNewIters) (_ internalIterator, r
 
 	iterOpts := IterOptions{logger: c.logger}
 	if c.startLevel != 0 {
-		iters = append(iters, newLevelIter(iterOpts, c.cmp, newIters, c.inputs[0], c.startLevel, &c.bytesIterated))
-		iters = append(iters, newLevelIter(iterOpts, c.cmp, newRangeDelIter, c.inputs[0], c.startLevel, &c.bytesIterated))
+		iters = append(iters, newLevelIter(iterOpts, c.cmp, nil /* split */, newIters, c.inputs[0], c.startLevel, &c.bytesIterated))
+		iters = append(iters, newLevelIter(iterOpts, c.cmp, nil /* split */, newRangeDelIter, c.inputs[0], c.startLevel, &c.bytesIterated))
 	} else {
 		for i := range c.inputs[0] {
 			f := c.inputs[0][i]
@@ -729,14 +935,33 @@ func (c *compaction) newInputIter(newIters tableNewIters) (_ internalIterator, r
 			}
 			iters = append(iters, iter)
 			if rangeDelIter != nil {
-				iters = append(iters, rangeDelIter)
+				split := c.splitLower != nil || c.splitUpper != nil
+				if f.Largest.Trailer == InternalKeyRangeDeleteSentinel || split {
+					// Keep the table's rangeDelIter open for the lifetime of the
+					// compaction as the truncated tombstones reference its memory.
+					c.closers = append(c.closers, rangeDelIter)
+					rangeDelIter = noCloseIter{rangeDelIter}
+				}
+				if f.Largest.Trailer == InternalKeyRangeDeleteSentinel {
+					// The tables produced by a flush which was split at the
+					// boundaries of the base level tables do not truncate the range
+					// tombstones which straddle them. Truncate the range tombstones
+					// to the bounds of the table.
+					rangeDelIter = rangedel.Truncate(c.cmp, rangeDelIter,
+						f.Smallest.UserKey, f.Largest.UserKey)
+				}
+				iters = append(iters, c.truncateToSplit(rangeDelIter))
 			}
 		}
 	}
 
-	iters = append(iters, newLevelIter(iterOpts, c.cmp, newIters, c.inputs[1], c.outputLevel, &c.bytesIterated))
-	iters = append(iters, newLevelIter(iterOpts, c.cmp, newRangeDelIter, c.inputs[1], c.outputLevel, &c.bytesIterated))
-	return newMergingIter(c.logger, c.cmp, iters...), nil
+	if len(c.inputs[2]) > 0 {
+		iters = append(iters, newLevelIter(iterOpts, c.cmp, nil /* split */, newIters, c.inputs[2], c.extraLevel, &c.bytesIterated))
+		iters = append(iters, newLevelIter(iterOpts, c.cmp, nil /* split */, newRangeDelIter, c.inputs[2], c.extraLevel, &c.bytesIterated))
+	}
+	iters = append(iters, newLevelIter(iterOpts, c.cmp, nil /* split */, newIters, c.inputs[1], c.outputLevel, &c.bytesIterated))
+	iters = append(iters, newLevelIter(iterOpts, c.cmp, nil /* split */, newRangeDelIter, c.inputs[1], c.outputLevel, &c.bytesIterated))
+	return c.boundToSplit(newMergingIter(c.logger, c.cmp, iters...)), nil
 }
 
 func (c *compaction) String() string {
@@ -745,12 +970,11 @@ func (c *compaction) String() string {
 	}
 
 	var buf bytes.Buffer
-	for i := range c.inputs {
-		level := c.startLevel
-		if i == 1 {
-			level = c.outputLevel
+	for _, i := range []int{0, 2, 1} {
+		if i == 2 && c.extraLevel == 0 {
+			continue
 		}
-		fmt.Fprintf(&buf, "%d:", level)
+		fmt.Fprintf(&buf, "%d:", c.inputLevel(i))
 		for _, f := range c.inputs[i] {
 			fmt.Fprintf(&buf, " %s:%s-%s", f.FileNum, f.Smallest, f.Largest)
 		}
@@ -836,6 +1060,21 @@ func (d *DB) getCompactionPacerInfo() compactionPacerInfo {
 	return pacerInfo
 }
 
+// newCompactionPacer returns the pacer for a compaction, or for one of the
+// subcompactions of a compaction.
+func (d *DB) newCompactionPacer() pacer {
+	if !d.opts.enablePacing {
+		return nilPacer
+	}
+	// TODO(peter): Compaction pacing is disabled until we figure out why it
+	// impacts throughput.
+	return newCompactionPacer(compactionPacerEnv{
+		limiter:      d.compactionLimiter,
+		memTableSize: uint64(d.opts.MemTableSize),
+		getInfo:      d.getCompactionPacerInfo,
+	})
+}
+
 func (d *DB) getFlushPacerInfo() flushPacerInfo {
 	var pacerInfo flushPacerInfo
 	d.mu.Lock()
@@ -860,7 +1099,7 @@ func (d *DB) maybeScheduleFlush() {
 	var n int
 	var size uint64
 	for ; n < len(d.mu.mem.queue)-1; n++ {
-		if !d.mu.mem.queue[n].readyForFlush() {
+		if !d.mu.mem.queue[n].readyForFlush() || d.mu.mem.queue[n].flushHold > 0 {
 			break
 		}
 		if d.mu.mem.queue[n].flushForced {
@@ -916,7 +1155,7 @@ func (d *DB) flush() {
 func (d *DB) flush1() error {
 	var n int
 	for ; n < len(d.mu.mem.queue)-1; n++ {
-		if !d.mu.mem.queue[n].readyForFlush() {
+		if !d.mu.mem.queue[n].readyForFlush() || d.mu.mem.queue[n].flushHold > 0 {
 			break
 		}
 	}
@@ -926,8 +1165,13 @@ func (d *DB) flush1() error {
 	}
 
 	// Require that every memtable being flushed has a log number less than the
-	// new minimum unflushed log number.
+	// new minimum unflushed log number. A memtable followed by a large batch has
+	// handed its log number to the batch (see DB.makeRoomForWrite), and may be
+	// the first memtable not flushed if its flush is held by an excise.
 	minUnflushedLogNum := d.mu.mem.queue[n].logNum
+	for i := n + 1; minUnflushedLogNum == 0 && i < len(d.mu.mem.queue); i++ {
+		minUnflushedLogNum = d.mu.mem.queue[i].logNum
+	}
 	if !d.opts.DisableWAL {
 		for i := 0; i < n; i++ {
 			logNum := d.mu.mem.queue[i].logNum
@@ -987,7 +1231,7 @@ func (d *DB) flush1() error {
 			func() []compactionInfo { return d.getInProgressCompactionInfoLocked(c) })
 		if err != nil {
 			// TODO(peter): untested.
-			d.mu.versions.obsoleteTables = append(d.mu.versions.obsoleteTables, pendingOutputs...)
+			d.addObsoletePendingOutputsLocked(ve, pendingOutputs)
 		}
 	}
 
@@ -1002,7 +1246,9 @@ func (d *DB) flush1() error {
 	if err == nil {
 		flushed = d.mu.mem.queue[:n]
 		d.mu.mem.queue = d.mu.mem.queue[n:]
+		d.mu.compact.deletionHints = append(d.mu.compact.deletionHints, c.deletionHints...)
 		d.updateReadStateLocked(d.opts.DebugCheck)
+		d.maybeCollectTableStatsLocked()
 	}
 
 	d.deleteObsoleteFiles(jobID)
@@ -1055,6 +1301,8 @@ func (d *DB) maybeScheduleCompaction() {
 	env := compactionEnv{
 		bytesCompacted:          &d.bytesCompacted,
 		earliestUnflushedSeqNum: d.getEarliestUnflushedSeqNumLocked(),
+		readCompactions:         &d.mu.compact.readCompactions,
+		now:                     d.timeNow().Unix(),
 	}
 	for len(d.mu.compact.manual) > 0 && d.mu.compact.compactingCount < d.opts.MaxConcurrentCompactions {
 		manual := d.mu.compact.manual[0]
@@ -1078,7 +1326,12 @@ func (d *DB) maybeScheduleCompaction() {
 
 	for d.mu.compact.compactingCount < d.opts.MaxConcurrentCompactions {
 		env.inProgressCompactions = d.getInProgressCompactionInfoLocked(nil)
-		c := d.mu.versions.picker.pickAuto(env)
+		// Delete-only compactions are cheap, and reclaim space, so they are
+		// picked ahead of the score-based compactions.
+		c := d.pickDeleteOnlyCompactionLocked()
+		if c == nil {
+			c = d.mu.versions.picker.pickAuto(env)
+		}
 		if c == nil {
 			break
 		}
@@ -1123,26 +1376,31 @@ func (d *DB) compact1(c *compaction, errChannel chan error) (err error) {
 	}
 	info.Input.Level = c.startLevel
 	info.Output.Level = c.outputLevel
-	for i := range c.inputs {
+	if c.fifo {
+		info.Reason = "fifo"
+	} else if c.deleteOnly {
+		info.Reason = "delete-only"
+	} else if c.readTriggered {
+		info.Reason = "read"
+	} else if c.marked {
+		info.Reason = "marked"
+	} else if c.periodic {
+		info.Reason = "periodic"
+	}
+	for i := range info.Input.Tables {
 		for j := range c.inputs[i] {
 			m := c.inputs[i][j]
 			info.Input.Tables[i] = append(info.Input.Tables[i], m.TableInfo())
 		}
 	}
+	info.Intermediate.Level = c.extraLevel
+	for _, m := range c.inputs[2] {
+		info.Intermediate.Tables = append(info.Intermediate.Tables, m.TableInfo())
+	}
 	d.opts.EventListener.CompactionBegin(info)
 	startTime := d.timeNow()
 
-	compactionPacer := (pacer)(nilPacer)
-	if d.opts.enablePacing {
-		// TODO(peter): Compaction pacing is disabled until we figure out why it
-		// impacts throughput.
-		compactionPacer = newCompactionPacer(compactionPacerEnv{
-			limiter:      d.compactionLimiter,
-			memTableSize: uint64(d.opts.MemTableSize),
-			getInfo:      d.getCompactionPacerInfo,
-		})
-	}
-	ve, pendingOutputs, err := d.runCompaction(jobID, c, compactionPacer)
+	ve, pendingOutputs, err := d.runCompaction(jobID, c, d.newCompactionPacer())
 
 	info.Duration = d.timeNow().Sub(startTime)
 	if err == nil {
@@ -1152,7 +1410,7 @@ func (d *DB) compact1(c *compaction, errChannel chan error) (err error) {
 		})
 		if err != nil {
 			// TODO(peter): untested.
-			d.mu.versions.obsoleteTables = append(d.mu.versions.obsoleteTables, pendingOutputs...)
+			d.addObsoletePendingOutputsLocked(ve, pendingOutputs)
 		}
 	}
 
@@ -1163,6 +1421,15 @@ func (d *DB) compact1(c *compaction, errChannel chan error) (err error) {
 			e := &ve.NewFiles[i]
 			info.Output.Tables = append(info.Output.Tables, e.Meta.TableInfo())
 		}
+		info.Filter = c.filterInfo
+		info.Subcompactions = c.subcompactions
+		if c.deleteOnly {
+			info.ReclaimedBytes = totalSize(c.inputs[0])
+		}
+		d.mu.compact.deletionHints = append(d.mu.compact.deletionHints, c.deletionHints...)
+		if c.readTriggered {
+			d.mu.versions.metrics.Compact.ReadCount++
+		}
 	}
 
 	d.removeInProgressCompaction(c)
@@ -1175,20 +1442,34 @@ func (d *DB) compact1(c *compaction, errChannel chan error) (err error) {
 	// table list.
 	if err == nil {
 		d.updateReadStateLocked(d.opts.DebugCheck)
+		d.maybeCollectTableStatsLocked()
 	}
 	d.deleteObsoleteFiles(jobID)
 
 	return err
 }
 
-// runCompactions runs a compaction that produces new on-disk tables from
-// memtables or old on-disk tables.
+// runCompaction runs a compaction that produces new on-disk tables from
+// memtables or old on-disk tables. The compaction is split into
+// subcompactions if Options.MaxSubcompactions permits.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
 func (d *DB) runCompaction(
 	jobID int, c *compaction, pacer pacer,
 ) (ve *versionEdit, pendingOutputs []FileNum, retErr error) {
+	// A delete-only compaction removes its input tables without reading them.
+	if c.deleteOnly {
+		ve := &versionEdit{
+			DeletedFiles: map[deletedFileEntry]bool{},
+		}
+		for _, f := range c.inputs[0] {
+			ve.DeletedFiles[deletedFileEntry{Level: c.startLevel, FileNum: f.FileNum}] = true
+		}
+		c.metrics = map[int]*LevelMetrics{}
+		return ve, nil, nil
+	}
+
 	// Check for a trivial move of one table from one level to the next. We avoid
 	// such a move if there is lots of overlapping grandparent data. Otherwise,
 	// the move could create a parent file that will require a very expensive
@@ -1212,31 +1493,83 @@ func (d *DB) runCompaction(
 		return ve, nil, nil
 	}
 
-	defer func() {
-		if retErr != nil {
-			pendingOutputs = nil
-		}
-	}()
-
 	snapshots := d.mu.snapshots.toSlice()
+	c.writerOpts = d.opts.MakeWriterOptions(c.outputLevel)
+	c.maxBlobFileSize = uint64(d.opts.Level(c.outputLevel).TargetFileSize)
 
 	// Release the d.mu lock while doing I/O.
 	// Note the unusual order: Unlock and then Lock.
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
+	if subs := c.split(d.opts.MaxSubcompactions); len(subs) > 1 {
+		return d.runSubcompactions(jobID, c, subs, snapshots)
+	}
+	return d.runSubcompaction(jobID, c, snapshots, pacer)
+}
+
+// runSubcompaction runs a compaction, or one of the subcompactions of a
+// compaction, producing new on-disk tables from the input memtables or
+// tables. A compaction which is not split into subcompactions runs as a single
+// subcompaction.
+//
+// d.mu must not be held when calling this.
+func (d *DB) runSubcompaction(
+	jobID int, c *compaction, snapshots []uint64, pacer pacer,
+) (ve *versionEdit, pendingOutputs []FileNum, retErr error) {
+	defer func() {
+		if retErr != nil {
+			pendingOutputs = nil
+		}
+	}()
+
 	iiter, err := c.newInputIter(d.newIters)
 	if err != nil {
 		return nil, pendingOutputs, err
 	}
+	if err := c.collectRangeKeys(d.tableCache.newRangeKeyIter, snapshots); err != nil {
+		iiter.Close()
+		return nil, pendingOutputs, err
+	}
 	allowZeroSeqNum := c.allowZeroSeqNum(iiter)
+	var filter CompactionFilter
+	if d.opts.CompactionFilter != nil && c.flushing == nil {
+		filter = d.opts.CompactionFilter(CompactionFilterContext{
+			StartLevel:  c.startLevel,
+			OutputLevel: c.outputLevel,
+		})
+	}
 	iter := newCompactionIter(c.cmp, d.merge, iiter, snapshots, &c.rangeDelFrag,
-		allowZeroSeqNum, c.elideTombstone, c.elideRangeTombstone)
+		allowZeroSeqNum, c.elideTombstone, c.elideRangeTombstone, filter)
+	iter.fetchBlobValue = d.blobFiles.fetch
 
 	var (
 		filenames []string
 		tw        *sstable.Writer
 	)
+	sep := &valueSeparator{
+		threshold:       d.opts.ValueSeparationThreshold,
+		maxBlobFileSize: c.maxBlobFileSize,
+		fetch:           d.blobFiles.fetch,
+		rewrite:         blobFilesToGC(c.version, d.opts.BlobFileGCThreshold),
+	}
+	sep.newBlobFile = func() (*blobFileWriter, error) {
+		d.mu.Lock()
+		fileNum := d.mu.versions.getNextFileNum()
+		pendingOutputs = append(pendingOutputs, fileNum)
+		d.mu.Unlock()
+
+		filename := base.MakeFilename(d.opts.FS, d.dirname, fileTypeBlob, fileNum)
+		file, err := d.opts.FS.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+		file = vfs.NewSyncingFile(file, vfs.SyncingFileOptions{
+			BytesPerSync: d.opts.BytesPerSync,
+		})
+		return newBlobFileWriter(fileNum, file), nil
+	}
 	defer func() {
 		if iter != nil {
 			retErr = firstError(retErr, iter.Close())
@@ -1245,6 +1578,7 @@ func (d *DB) runCompaction(
 			retErr = firstError(retErr, tw.Close())
 		}
 		if retErr != nil {
+			sep.close()
 			for _, filename := range filenames {
 				d.opts.FS.Remove(filename)
 			}
@@ -1258,8 +1592,10 @@ func (d *DB) runCompaction(
 		DeletedFiles: map[deletedFileEntry]bool{},
 	}
 
+	// The bytes from the start level and from the intermediate level of a
+	// multi-level compaction are incoming bytes of the output level.
 	metrics := &LevelMetrics{
-		BytesIn:   totalSize(c.inputs[0]),
+		BytesIn:   totalSize(c.inputs[0]) + totalSize(c.inputs[2]),
 		BytesRead: totalSize(c.inputs[1]),
 	}
 	metrics.BytesRead += metrics.BytesIn
@@ -1267,7 +1603,7 @@ func (d *DB) runCompaction(
 		c.outputLevel: metrics,
 	}
 
-	writerOpts := d.opts.MakeWriterOptions(c.outputLevel)
+	writerOpts := c.writerOpts
 
 	newOutput := func() error {
 		d.mu.Lock()
@@ -1298,11 +1634,15 @@ func (d *DB) runCompaction(
 		internalTableOpt := private.SSTableInternalTableOpt.(sstable.WriterOption)
 		tw = sstable.NewWriter(file, writerOpts, cacheOpts, internalTableOpt)
 
+		creationTime := d.timeNow().Unix()
+		if c.keepCreationTime {
+			creationTime = c.oldestCreationTime()
+		}
 		ve.NewFiles = append(ve.NewFiles, newFileEntry{
 			Level: c.outputLevel,
 			Meta: &fileMetadata{
 				FileNum:      fileNum,
-				CreationTime: time.Now().Unix(),
+				CreationTime: creationTime,
 			},
 		})
 		return nil
@@ -1314,7 +1654,8 @@ func (d *DB) runCompaction(
 		// NB: clone the key because the data can be held on to by the call to
 		// compactionIter.Tombstones via rangedel.Fragmenter.FlushTo.
 		key = append([]byte(nil), key...)
-		for _, v := range iter.Tombstones(key) {
+		tombstones := iter.Tombstones(key)
+		for _, v := range tombstones {
 			if tw == nil {
 				if err := newOutput(); err != nil {
 					return err
@@ -1325,6 +1666,32 @@ func (d *DB) runCompaction(
 			}
 		}
 
+		// Write the range keys which start before key, truncating those which
+		// extend past it. The remainder of a truncated range key is retained
+		// and written to the next output file.
+		var remaining []rangekey.Span
+		for i, span := range c.rangeKeys {
+			if key != nil && d.cmp(span.Start.UserKey, key) >= 0 {
+				remaining = append(remaining, c.rangeKeys[i:]...)
+				break
+			}
+			if key != nil && d.cmp(span.End, key) > 0 {
+				rest := span
+				rest.Start.UserKey = key
+				remaining = append(remaining, rest)
+				span.End = key
+			}
+			if tw == nil {
+				if err := newOutput(); err != nil {
+					return err
+				}
+			}
+			if err := tw.Add(span.Start, span.EncodedValue()); err != nil {
+				return err
+			}
+		}
+		c.rangeKeys = remaining
+
 		if tw == nil {
 			return nil
 		}
@@ -1343,6 +1710,8 @@ func (d *DB) runCompaction(
 		meta.Size = writerMeta.Size
 		meta.SmallestSeqNum = writerMeta.SmallestSeqNum
 		meta.LargestSeqNum = writerMeta.LargestSeqNum
+		meta.HasRangeKeys = writerMeta.SmallestRangeKey.UserKey != nil
+		meta.BlobReferences = sep.takeReferences()
 
 		if c.flushing == nil {
 			metrics.TablesCompacted++
@@ -1400,6 +1769,25 @@ func (d *DB) runCompaction(
 					writerMeta.SmallestRange.SetSeqNum(prevMeta.Largest.SeqNum() - 1)
 				}
 			}
+			if writerMeta.SmallestRangeKey.UserKey != nil {
+				// Range keys straddling the previous table are subject to the same
+				// boundary adjustment as range tombstones.
+				c := d.cmp(writerMeta.SmallestRangeKey.UserKey, prevMeta.Largest.UserKey)
+				if c < 0 {
+					return errors.Errorf(
+						"pebble: smallest range key start key is less than previous sstable largest key: %s < %s",
+						writerMeta.SmallestRangeKey.Pretty(d.opts.Comparer.Format),
+						prevMeta.Largest.Pretty(d.opts.Comparer.Format))
+				}
+				if c == 0 && prevMeta.Largest.SeqNum() <= writerMeta.SmallestRangeKey.SeqNum() {
+					if prevMeta.Largest.SeqNum() == 0 {
+						return errors.Errorf(
+							"pebble: previous sstable largest key unexpectedly has 0 seqnum: %s",
+							prevMeta.Largest.Pretty(d.opts.Comparer.Format))
+					}
+					writerMeta.SmallestRangeKey.SetSeqNum(prevMeta.Largest.SeqNum() - 1)
+				}
+			}
 		}
 
 		if key != nil && writerMeta.LargestRange.UserKey != nil {
@@ -1453,6 +1841,7 @@ func (d *DB) runCompaction(
 					c.largest.Pretty(d.opts.Comparer.Format))
 			}
 		}
+		c.deletionHints = appendDeleteCompactionHints(c.deletionHints, d.cmp, meta, tombstones)
 		return nil
 	}
 
@@ -1464,9 +1853,13 @@ func (d *DB) runCompaction(
 	// to a grandparent file largest key, or nil. Taken together, these
 	// progress guarantees ensure that eventually the input iterator will be
 	// exhausted and the range tombstone fragments will all be flushed.
-	for key, val := iter.First(); key != nil || !c.rangeDelFrag.Empty(); {
+	for key, val := iter.First(); key != nil || !c.rangeDelFrag.Empty() || len(c.rangeKeys) > 0; {
 		var limit []byte
-		if c.rangeDelFrag.Empty() {
+		if key == nil && c.rangeDelFrag.Empty() {
+			// Only range keys remain. They are all written to the final output
+			// file.
+			limit = nil
+		} else if c.rangeDelFrag.Empty() {
 			// In this case, `limit` will be a larger user key than `key.UserKey`, or
 			// nil. In either case, the inner loop will execute at least once to
 			// process `key`, and the input iterator will be advanced.
@@ -1512,7 +1905,11 @@ func (d *DB) runCompaction(
 			// as b#RANGEDEL,3 which sorts before b#SET,0. Normally we just adjust
 			// the seqnum of this key, but that isn't possible for seqnum 0.
 			if passedGrandparentLimit || (limit != nil && c.cmp(key.UserKey, limit) > 0) {
-				if prevPointSeqNum != 0 || c.rangeDelFrag.Empty() {
+				l := limit
+				if passedGrandparentLimit {
+					l = key.UserKey
+				}
+				if prevPointSeqNum != 0 || (c.rangeDelFrag.Empty() && !c.rangeKeysStraddle(l)) {
 					if passedGrandparentLimit {
 						limit = key.UserKey
 					}
@@ -1551,14 +1948,20 @@ func (d *DB) runCompaction(
 					return nil, pendingOutputs, err
 				}
 			}
-			if err := tw.Add(*key, val); err != nil {
+			kind, val, err := sep.add(key, val)
+			if err != nil {
+				return nil, pendingOutputs, err
+			}
+			outKey := *key
+			outKey.SetKind(kind)
+			if err := tw.Add(outKey, val); err != nil {
 				return nil, pendingOutputs, err
 			}
 			prevPointSeqNum = key.SeqNum()
 		}
 
 		switch {
-		case key == nil && prevPointSeqNum == 0 && !c.rangeDelFrag.Empty():
+		case key == nil && prevPointSeqNum == 0 && (!c.rangeDelFrag.Empty() || len(c.rangeKeys) > 0):
 			// We ran out of keys and the last key added to the sstable has a zero
 			// seqnum and there are buffered range tombstones, so we're unable to use
 			// the grandparent limit for the sstable boundary. See the example in the
@@ -1585,24 +1988,45 @@ func (d *DB) runCompaction(
 	}
 
 	for i := range c.inputs {
-		level := c.startLevel
-		if i == 1 {
-			level = c.outputLevel
-		}
 		for _, f := range c.inputs[i] {
 			ve.DeletedFiles[deletedFileEntry{
-				Level:   level,
+				Level:   c.inputLevel(i),
 				FileNum: f.FileNum,
 			}] = true
 		}
 	}
 
+	blobFiles, err := sep.finish()
+	if err != nil {
+		return nil, pendingOutputs, err
+	}
+	ve.NewBlobFiles = blobFiles
+
 	if err := d.dataDir.Sync(); err != nil {
 		return nil, pendingOutputs, err
 	}
+	c.filterInfo = iter.filterInfo
 	return ve, pendingOutputs, nil
 }
 
+// addObsoletePendingOutputsLocked adds the outputs of a flush or compaction
+// which could not be installed to the obsolete tables and blob files.
+//
+// d.mu must be held when calling this.
+func (d *DB) addObsoletePendingOutputsLocked(ve *versionEdit, pendingOutputs []FileNum) {
+	blobFiles := make(map[FileNum]bool, len(ve.NewBlobFiles))
+	for _, meta := range ve.NewBlobFiles {
+		blobFiles[meta.FileNum] = true
+	}
+	for _, fileNum := range pendingOutputs {
+		if blobFiles[fileNum] {
+			d.mu.versions.obsoleteBlobFiles = append(d.mu.versions.obsoleteBlobFiles, fileNum)
+		} else {
+			d.mu.versions.obsoleteTables = append(d.mu.versions.obsoleteTables, fileNum)
+		}
+	}
+}
+
 // scanObsoleteFiles scans the filesystem for files that are no longer needed
 // and adds those to the internal lists of obsolete files. Note that the files
 // are not actually deleted by this method. A subsequent call to
@@ -1620,6 +2044,7 @@ func (d *DB) scanObsoleteFiles(list []string) {
 
 	var obsoleteLogs []FileNum
 	var obsoleteTables []FileNum
+	var obsoleteBlobFiles []FileNum
 	var obsoleteManifests []FileNum
 	var obsoleteOptions []FileNum
 
@@ -1649,15 +2074,25 @@ func (d *DB) scanObsoleteFiles(list []string) {
 				continue
 			}
 			obsoleteTables = append(obsoleteTables, fileNum)
+		case fileTypeBlob:
+			if _, ok := liveFileNums[fileNum]; ok {
+				continue
+			}
+			obsoleteBlobFiles = append(obsoleteBlobFiles, fileNum)
 		default:
 			// Don't delete files we don't know about.
 			continue
 		}
 	}
 
+	if d.opts.WALRetentionPeriod > 0 {
+		d.retainScannedLogsLocked(obsoleteLogs)
+		obsoleteLogs = nil
+	}
 	d.mu.log.queue = merge(d.mu.log.queue, obsoleteLogs)
 	d.mu.versions.metrics.WAL.Files += int64(len(obsoleteLogs))
 	d.mu.versions.obsoleteTables = merge(d.mu.versions.obsoleteTables, obsoleteTables)
+	d.mu.versions.obsoleteBlobFiles = merge(d.mu.versions.obsoleteBlobFiles, obsoleteBlobFiles)
 	d.mu.versions.obsoleteManifests = merge(d.mu.versions.obsoleteManifests, obsoleteManifests)
 	d.mu.versions.obsoleteOptions = merge(d.mu.versions.obsoleteOptions, obsoleteOptions)
 }
@@ -1756,10 +2191,19 @@ func (d *DB) doDeleteObsoleteFiles(jobID int) {
 			break
 		}
 	}
+	// Obsolete logs are retained until they are no longer needed by change
+	// feeds.
+	if len(obsoleteLogs) > 0 {
+		d.retainObsoleteLogsLocked(obsoleteLogs, d.getEarliestUnflushedSeqNumLocked())
+	}
+	obsoleteLogs = d.releaseRetainedLogsLocked()
 
 	obsoleteTables = d.mu.versions.obsoleteTables
 	d.mu.versions.obsoleteTables = nil
 
+	obsoleteBlobFiles := d.mu.versions.obsoleteBlobFiles
+	d.mu.versions.obsoleteBlobFiles = nil
+
 	obsoleteManifests := d.mu.versions.obsoleteManifests
 	d.mu.versions.obsoleteManifests = nil
 
@@ -1771,12 +2215,13 @@ func (d *DB) doDeleteObsoleteFiles(jobID int) {
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
-	files := [4]struct {
+	files := [5]struct {
 		fileType fileType
 		obsolete []FileNum
 	}{
 		{fileTypeLog, obsoleteLogs},
 		{fileTypeTable, obsoleteTables},
+		{fileTypeBlob, obsoleteBlobFiles},
 		{fileTypeManifest, obsoleteManifests},
 		{fileTypeOptions, obsoleteOptions},
 	}
@@ -1797,6 +2242,8 @@ func (d *DB) doDeleteObsoleteFiles(jobID int) {
 				dir = d.walDirname
 			case fileTypeTable:
 				d.tableCache.evict(fileNum)
+			case fileTypeBlob:
+				d.blobFiles.evict(fileNum)
 			}
 
 			path := base.MakeFilename(d.opts.FS, dir, f.fileType, fileNum)
@@ -1809,7 +2256,7 @@ func (d *DB) maybeScheduleObsoleteTableDeletion() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if len(d.mu.versions.obsoleteTables) == 0 {
+	if len(d.mu.versions.obsoleteTables) == 0 && len(d.mu.versions.obsoleteBlobFiles) == 0 {
 		return
 	}
 	if !d.acquireCleaningTurn(false) {
@@ -0,0 +1,164 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble/internal/manifest"
+	"github.com/cockroachdb/pebble/internal/rangedel"
+)
+
+// deleteCompactionHint records a range tombstone which was written to a table
+// by a flush or compaction. The tables beneath the tombstone whose keys are
+// all deleted by it can be dropped without being read or rewritten by a
+// delete-only compaction. See DB.pickDeleteOnlyCompactionLocked.
+//
+// Hints are held in memory and are lost when the DB is closed. The tombstones
+// they record are still applied by the ordinary compactions of the tables
+// beneath them.
+type deleteCompactionHint struct {
+	// The table containing the tombstone. The hint is discarded once the table
+	// is no longer part of the current version.
+	tombstoneFile FileNum
+	// The user key bounds [start, end) of the tombstone, truncated to the
+	// bounds of the table.
+	start, end []byte
+	// The sequence number of the tombstone.
+	seqNum uint64
+}
+
+func (h deleteCompactionHint) String() string {
+	return fmt.Sprintf("%s: [%s-%s)#%d", h.tombstoneFile, h.start, h.end, h.seqNum)
+}
+
+// appendDeleteCompactionHints appends hints for the range tombstones written
+// to the table meta. The tombstones are fragmented, and contiguous fragments
+// of the same tombstone are coalesced into a single hint.
+func appendDeleteCompactionHints(
+	hints []deleteCompactionHint, cmp Compare, meta *fileMetadata, tombstones []rangedel.Tombstone,
+) []deleteCompactionHint {
+	first := len(hints)
+	for _, t := range tombstones {
+		start, end := t.Start.UserKey, t.End
+		// The tombstones which straddle the boundary with the next table are not
+		// truncated. Truncate them to the table's bounds.
+		if cmp(start, meta.Smallest.UserKey) < 0 {
+			start = meta.Smallest.UserKey
+		}
+		if meta.Largest.Trailer == InternalKeyRangeDeleteSentinel &&
+			cmp(end, meta.Largest.UserKey) > 0 {
+			end = meta.Largest.UserKey
+		}
+		if cmp(start, end) >= 0 {
+			continue
+		}
+		seqNum := t.Start.SeqNum()
+		coalesced := false
+		for i := len(hints) - 1; i >= first; i-- {
+			h := &hints[i]
+			if h.seqNum == seqNum && cmp(h.end, start) == 0 {
+				h.end = append([]byte(nil), end...)
+				coalesced = true
+				break
+			}
+		}
+		if !coalesced {
+			hints = append(hints, deleteCompactionHint{
+				tombstoneFile: meta.FileNum,
+				start:         append([]byte(nil), start...),
+				end:           append([]byte(nil), end...),
+				seqNum:        seqNum,
+			})
+		}
+	}
+	return hints
+}
+
+// canDelete returns true if the tombstone of the hint deletes every key in the
+// table f, and no snapshot can observe the keys of f without also observing
+// the tombstone. The table must lie beneath the tombstone in the LSM.
+func (h *deleteCompactionHint) canDelete(cmp Compare, f *fileMetadata, snapshots []uint64) bool {
+	if f.Compacting || f.HasRangeKeys || f.LargestSeqNum >= h.seqNum {
+		// Range tombstones do not delete range keys.
+		return false
+	}
+	if cmp(f.Smallest.UserKey, h.start) < 0 {
+		return false
+	}
+	if v := cmp(f.Largest.UserKey, h.end); v > 0 ||
+		(v == 0 && f.Largest.Trailer != InternalKeyRangeDeleteSentinel) {
+		return false
+	}
+	// A snapshot in (f.SmallestSeqNum, h.seqNum] can observe some of the keys
+	// in f, but not the tombstone.
+	i := sort.Search(len(snapshots), func(i int) bool {
+		return snapshots[i] > f.SmallestSeqNum
+	})
+	return i == len(snapshots) || snapshots[i] > h.seqNum
+}
+
+// pickDeleteOnlyCompactionLocked picks a delete-only compaction of the tables
+// in a level which are fully covered by the range tombstones recorded in
+// d.mu.compact.deletionHints. A delete-only compaction removes its input
+// tables from the LSM with a manifest update, without reading or writing any
+// tables. Hints whose tombstone tables are no longer part of the current
+// version are discarded. Returns nil if there is no such compaction.
+//
+// d.mu must be held when calling this.
+func (d *DB) pickDeleteOnlyCompactionLocked() *compaction {
+	if d.opts.disableDeleteOnlyCompactions || len(d.mu.compact.deletionHints) == 0 {
+		return nil
+	}
+
+	vers := d.mu.versions.currentVersion()
+	tombstoneLevels := make(map[FileNum]int)
+	for level := range vers.Files {
+		for _, f := range vers.Files[level] {
+			tombstoneLevels[f.FileNum] = level
+		}
+	}
+	hints := d.mu.compact.deletionHints[:0]
+	for _, h := range d.mu.compact.deletionHints {
+		if _, ok := tombstoneLevels[h.tombstoneFile]; ok {
+			hints = append(hints, h)
+		}
+	}
+	d.mu.compact.deletionHints = hints
+
+	snapshots := d.mu.snapshots.toSlice()
+	for level := 0; level < numLevels; level++ {
+		var inputs []*fileMetadata
+		for _, f := range vers.Files[level] {
+			for i := range hints {
+				// Only the tables in the levels beneath the tombstone are
+				// candidates. The tables beneath the tombstone which overlap it are
+				// older than it.
+				if level > tombstoneLevels[hints[i].tombstoneFile] &&
+					hints[i].canDelete(d.cmp, f, snapshots) {
+					inputs = append(inputs, f)
+					break
+				}
+			}
+		}
+		if len(inputs) == 0 {
+			continue
+		}
+		c := &compaction{
+			cmp:         d.cmp,
+			format:      d.opts.Comparer.Format,
+			logger:      d.opts.Logger,
+			version:     vers,
+			startLevel:  level,
+			outputLevel: level,
+			deleteOnly:  true,
+		}
+		c.inputs[0] = inputs
+		c.smallest, c.largest = manifest.KeyRange(c.cmp, inputs, nil)
+		return c
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/rangedel"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteCompactionHints(t *testing.T) {
+	cmp := DefaultComparer.Compare
+	meta := &fileMetadata{
+		FileNum:  1,
+		Smallest: base.ParseInternalKey("b.RANGEDEL.10"),
+		Largest:  base.MakeRangeDeleteSentinelKey([]byte("m")),
+	}
+	tombstones := []rangedel.Tombstone{
+		{Start: base.ParseInternalKey("a.RANGEDEL.10"), End: []byte("d")},
+		{Start: base.ParseInternalKey("d.RANGEDEL.10"), End: []byte("g")},
+		{Start: base.ParseInternalKey("d.RANGEDEL.5"), End: []byte("g")},
+		{Start: base.ParseInternalKey("g.RANGEDEL.10"), End: []byte("z")},
+	}
+	// The contiguous fragments of the tombstone at seqnum 10 are coalesced, and
+	// the tombstones are truncated to the bounds of the table.
+	hints := appendDeleteCompactionHints(nil, cmp, meta, tombstones)
+	require.Equal(t, "[000001: [b-m)#10 000001: [d-g)#5]", fmt.Sprint(hints))
+
+	parseMeta := func(smallest, largest string, smallestSeqNum, largestSeqNum uint64) *fileMetadata {
+		return &fileMetadata{
+			Smallest:       base.ParseInternalKey(smallest),
+			Largest:        base.ParseInternalKey(largest),
+			SmallestSeqNum: smallestSeqNum,
+			LargestSeqNum:  largestSeqNum,
+		}
+	}
+	h := hints[0]
+	testCases := []struct {
+		f         *fileMetadata
+		snapshots []uint64
+		expected  bool
+	}{
+		{parseMeta("c.SET.3", "k.SET.4", 3, 4), nil, true},
+		{parseMeta("b.SET.3", "m.RANGEDEL.72057594037927935", 3, 4), nil, true},
+		// The table extends beyond the tombstone.
+		{parseMeta("a.SET.3", "k.SET.4", 3, 4), nil, false},
+		{parseMeta("c.SET.3", "m.SET.4", 3, 4), nil, false},
+		// The table contains keys newer than the tombstone.
+		{parseMeta("c.SET.3", "k.SET.10", 3, 10), nil, false},
+		// A snapshot can observe the keys of the table, but not the tombstone.
+		{parseMeta("c.SET.3", "k.SET.4", 3, 4), []uint64{4}, false},
+		{parseMeta("c.SET.3", "k.SET.4", 3, 4), []uint64{10}, false},
+		// The snapshots observe neither the keys of the table nor the
+		// tombstone, or both.
+		{parseMeta("c.SET.3", "k.SET.4", 3, 4), []uint64{2, 11}, true},
+	}
+	for i, tc := range testCases {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			require.Equal(t, tc.expected, h.canDelete(cmp, tc.f, tc.snapshots))
+		})
+	}
+}
+
+func TestDeleteOnlyCompaction(t *testing.T) {
+	var mu sync.Mutex
+	var deleteOnly []CompactionInfo
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+		EventListener: EventListener{
+			CompactionEnd: func(info CompactionInfo) {
+				if info.Reason == "delete-only" {
+					mu.Lock()
+					deleteOnly = append(deleteOnly, info)
+					mu.Unlock()
+				}
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// Write a table per key to L6.
+	keys := []string{"a", "c", "e", "g", "i"}
+	for _, k := range keys {
+		require.NoError(t, d.Set([]byte(k), []byte(k), nil))
+		require.NoError(t, d.Compact([]byte(k), []byte(k)))
+	}
+
+	waitForCompactions := func() {
+		d.mu.Lock()
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+		d.mu.Unlock()
+	}
+	lsm := func() string {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.mu.versions.currentVersion().String()
+	}
+	require.Equal(t, "6:\n  000005:[a-a]\n  000007:[c-c]\n  000009:[e-e]\n  000011:[g-g]\n  000013:[i-i]\n", lsm())
+
+	// Delete a range of keys while a snapshot which can observe them is open.
+	// The tables covered by the tombstone are not deleted.
+	snap := d.NewSnapshot()
+	require.NoError(t, d.DeleteRange([]byte("b"), []byte("h"), nil))
+	require.NoError(t, d.Flush())
+	waitForCompactions()
+	mu.Lock()
+	require.Equal(t, 0, len(deleteOnly))
+	mu.Unlock()
+
+	// Releasing the snapshot triggers a delete-only compaction of the tables
+	// covered by the tombstone.
+	require.NoError(t, snap.Close())
+	waitForCompactions()
+	mu.Lock()
+	require.Equal(t, 1, len(deleteOnly))
+	info := deleteOnly[0]
+	mu.Unlock()
+	require.Equal(t, 6, info.Input.Level)
+	require.Equal(t, tablesTotalSize(info.Input.Tables[0]), info.ReclaimedBytes)
+	require.Regexp(t, `delete-only compacted L6 \[000007 000009 000011\], reclaimed .*`, info.String())
+	require.Equal(t, "0:\n  000015:[b-h]\n6:\n  000005:[a-a]\n  000013:[i-i]\n", lsm())
+
+	for _, k := range keys {
+		v, closer, err := d.Get([]byte(k))
+		if k == "a" || k == "i" {
+			require.NoError(t, err)
+			require.Equal(t, k, string(v))
+			require.NoError(t, closer.Close())
+		} else {
+			require.Equal(t, ErrNotFound, err)
+		}
+	}
+	require.NoError(t, d.Close())
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "fmt"
+
+// CompactionFilterDecision is the decision made by a CompactionFilter for a
+// key.
+type CompactionFilterDecision int8
+
+const (
+	// CompactionFilterKeep keeps the key and its value unchanged.
+	CompactionFilterKeep CompactionFilterDecision = iota
+	// CompactionFilterRemove removes the key. The key is replaced with a point
+	// deletion tombstone so that older versions of the key, in lower levels or
+	// older snapshot stripes, are not exposed. The tombstone itself is elided
+	// if it is known not to shadow any data.
+	CompactionFilterRemove
+	// CompactionFilterChangeValue replaces the value of the key with the value
+	// returned by the filter.
+	CompactionFilterChangeValue
+)
+
+// String implements fmt.Stringer.
+func (d CompactionFilterDecision) String() string {
+	switch d {
+	case CompactionFilterKeep:
+		return "keep"
+	case CompactionFilterRemove:
+		return "remove"
+	case CompactionFilterChangeValue:
+		return "change-value"
+	default:
+		return fmt.Sprintf("unknown decision: %d", int8(d))
+	}
+}
+
+// CompactionFilterContext describes the compaction for which a
+// CompactionFilter is created.
+type CompactionFilterContext struct {
+	// StartLevel is the level being compacted.
+	StartLevel int
+	// OutputLevel is the level that the compaction outputs tables to.
+	OutputLevel int
+}
+
+// CompactionFilter is a hook which allows the keys output by a compaction to
+// be removed, or their values changed. This can be used to implement TTLs or
+// garbage collection of old MVCC versions without issuing deletions. A new
+// CompactionFilter is created for each compaction by
+// Options.CompactionFilter. The filter is not applied to flushes.
+//
+// The filter is called for every SET and for the result of every series of
+// MERGE operations output by the compaction, in key order. Deletions and
+// range deletions are not presented to the filter. Keys which are visible to
+// an open Snapshot are never presented to the filter: only the most recent
+// version of a key, newer than all of the open snapshots, can be removed or
+// changed.
+type CompactionFilter interface {
+	// Name returns the name of the filter, which is reported in
+	// CompactionInfo.
+	Name() string
+
+	// Filter returns the decision for the specified key and value. If the
+	// decision is CompactionFilterChangeValue, newValue is the value which
+	// replaces the existing value. The key, value and newValue must not be
+	// modified, and newValue must remain valid until the next call to Filter.
+	// An error fails the compaction.
+	Filter(key, value []byte) (decision CompactionFilterDecision, newValue []byte, err error)
+}
+
+// CompactionFilterInfo contains the statistics of the CompactionFilter used
+// by a compaction.
+type CompactionFilterInfo struct {
+	// Name is the name of the filter, or empty if no filter was used.
+	Name string
+	// KeysRemoved is the number of keys removed by the filter.
+	KeysRemoved int64
+	// KeysChanged is the number of keys whose value was changed by the filter.
+	KeysChanged int64
+}
+
+func (i CompactionFilterInfo) String() string {
+	return fmt.Sprintf("filter %s removed %d changed %d", i.Name, i.KeysRemoved, i.KeysChanged)
+}
@@ -120,6 +120,23 @@ import (
 // to take the range tombstones into consideration when outputting normal
 // keys. Just as with point deletions, a range deletion covering an entry can
 // cause the entry to be elided.
+//
+// 5. Compaction Filters
+//
+// A CompactionFilter can remove a key or change its value. The filter is only
+// consulted for a key in the most recent snapshot stripe, as the entries in
+// the other stripes are visible to open snapshots. A removed key is replaced
+// by a point deletion tombstone, as dropping it outright could expose an older
+// entry for the key. Following the rules for deletion tombstones, the
+// tombstone is elided if it is in the last snapshot stripe and elideTombstone
+// permits.
+//
+// 6. Blob Index Keys
+//
+// A BLOBINDEX key is a SET whose value is stored in a blob file, and is
+// treated as a SET. The value in the blob file is only read when it is needed:
+// when the BLOBINDEX is merged with newer MERGE operands, or presented to the
+// compaction filter. Otherwise, the handle for the value is output unchanged.
 type compactionIter struct {
 	cmp   Compare
 	merge Merge
@@ -175,6 +192,14 @@ type compactionIter struct {
 	allowZeroSeqNum     bool
 	elideTombstone      func(key []byte) bool
 	elideRangeTombstone func(start, end []byte) bool
+	// The compaction filter, or nil.
+	filter CompactionFilter
+	// Statistics for the compaction filter.
+	filterInfo CompactionFilterInfo
+	// fetchBlobValue reads the value referenced by the handle of a BLOBINDEX
+	// key into buf. It is nil if the input contains no BLOBINDEX keys.
+	fetchBlobValue func(encodedHandle, buf []byte) ([]byte, error)
+	blobValueBuf   []byte
 }
 
 func newCompactionIter(
@@ -186,6 +211,7 @@ func newCompactionIter(
 	allowZeroSeqNum bool,
 	elideTombstone func(key []byte) bool,
 	elideRangeTombstone func(start, end []byte) bool,
+	filter CompactionFilter,
 ) *compactionIter {
 	i := &compactionIter{
 		cmp:                 cmp,
@@ -196,6 +222,10 @@ func newCompactionIter(
 		allowZeroSeqNum:     allowZeroSeqNum,
 		elideTombstone:      elideTombstone,
 		elideRangeTombstone: elideRangeTombstone,
+		filter:              filter,
+	}
+	if filter != nil {
+		i.filterInfo.Name = filter.Name()
 	}
 	i.rangeDelFrag.Cmp = cmp
 	i.rangeDelFrag.Emit = i.emitRangeDelChunk
@@ -288,11 +318,21 @@ func (i *compactionIter) Next() (*InternalKey, []byte) {
 				continue
 			}
 
-		case InternalKeyKindSet:
+		case InternalKeyKindSet, InternalKeyKindBlobIndex:
 			i.saveKey()
 			i.value = i.iterValue
 			i.valid = true
 			i.skip = true
+			switch i.applyFilter(i.curSnapshotIdx) {
+			case filterFailed:
+				return nil, nil
+			case filterDropped:
+				i.valid = false
+				i.skipInStripe()
+				continue
+			case filterConverted:
+				return &i.key, i.value
+			}
 			i.maybeZeroSeqnum(i.curSnapshotIdx)
 			return &i.key, i.value
 
@@ -310,6 +350,23 @@ func (i *compactionIter) Next() (*InternalKey, []byte) {
 				i.value, i.err = valueMerger.Finish()
 			}
 			if i.err == nil {
+				switch i.applyFilter(origSnapshotIdx) {
+				case filterFailed:
+					return nil, nil
+				case filterDropped:
+					i.valid = false
+					if change == sameStripeSkippable {
+						// The iterator is positioned at an older entry in the stripe
+						// which has been merged. Skip the remainder of the stripe.
+						i.skipInStripe()
+					} else {
+						// The iterator is already positioned at the next entry.
+						i.pos = iterPosCur
+					}
+					continue
+				case filterConverted:
+					return &i.key, i.value
+				}
 				// A non-skippable entry does not necessarily cover later merge
 				// operands, so we must not zero the current merge result's seqnum.
 				//
@@ -337,6 +394,69 @@ func (i *compactionIter) Next() (*InternalKey, []byte) {
 	return nil, nil
 }
 
+// filterResult is the outcome of applying the compaction filter to a key.
+type filterResult int8
+
+const (
+	// filterKept indicates that the key is kept, possibly with a changed value.
+	filterKept filterResult = iota
+	// filterConverted indicates that the key was removed by the filter and has
+	// been converted to a point deletion tombstone.
+	filterConverted
+	// filterDropped indicates that the key was removed by the filter and can be
+	// dropped entirely.
+	filterDropped
+	// filterFailed indicates that the filter returned an error, which is
+	// stored in i.err.
+	filterFailed
+)
+
+// applyFilter applies the compaction filter to the current key and value,
+// which are either a SET or the result of a merge. snapshotIdx is the index of
+// the key's snapshot stripe.
+func (i *compactionIter) applyFilter(snapshotIdx int) filterResult {
+	if i.filter == nil || snapshotIdx < len(i.snapshots) {
+		// The key is visible to an open snapshot.
+		return filterKept
+	}
+	value := i.value
+	if i.key.Kind() == InternalKeyKindBlobIndex {
+		if value = i.readBlobValue(value); value == nil && i.err != nil {
+			i.valid = false
+			return filterFailed
+		}
+	}
+	decision, newValue, err := i.filter.Filter(i.key.UserKey, value)
+	if err != nil {
+		i.err = err
+		i.valid = false
+		return filterFailed
+	}
+	switch decision {
+	case CompactionFilterKeep:
+		return filterKept
+	case CompactionFilterRemove:
+		i.filterInfo.KeysRemoved++
+		if snapshotIdx == 0 && i.elideTombstone(i.key.UserKey) {
+			return filterDropped
+		}
+		i.key.SetKind(InternalKeyKindDelete)
+		i.value = nil
+		return filterConverted
+	case CompactionFilterChangeValue:
+		i.filterInfo.KeysChanged++
+		if i.key.Kind() == InternalKeyKindBlobIndex {
+			i.key.SetKind(InternalKeyKindSet)
+		}
+		i.value = newValue
+		return filterKept
+	default:
+		i.err = errors.Errorf("pebble: invalid compaction filter decision: %d", errors.Safe(decision))
+		i.valid = false
+		return filterFailed
+	}
+}
+
 // snapshotIndex returns the index of the first sequence number in snapshots
 // which is greater than or equal to seq.
 func snapshotIndex(seq uint64, snapshots []uint64) (int, uint64) {
@@ -440,7 +560,7 @@ func (i *compactionIter) mergeNext(valueMerger ValueMerger) stripeChangeType {
 			i.skip = true
 			return sameStripeSkippable
 
-		case InternalKeyKindSet:
+		case InternalKeyKindSet, InternalKeyKindBlobIndex:
 			if i.rangeDelFrag.Deleted(*key, i.curSnapshotSeqNum) {
 				// We change the kind of the result key to a Set so that it shadows
 				// keys in lower levels. That is, MERGE+RANGEDEL -> SET. This isn't
@@ -454,7 +574,13 @@ func (i *compactionIter) mergeNext(valueMerger ValueMerger) stripeChangeType {
 			// We've hit a Set value. Merge with the existing value and return. We
 			// change the kind of the resulting key to a Set so that it shadows keys
 			// in lower levels. That is, MERGE+SET -> SET.
-			i.err = valueMerger.MergeOlder(i.iterValue)
+			value := i.iterValue
+			if key.Kind() == InternalKeyKindBlobIndex {
+				if value = i.readBlobValue(value); i.err != nil {
+					return sameStripeSkippable
+				}
+			}
+			i.err = valueMerger.MergeOlder(value)
 			if i.err != nil {
 				return sameStripeSkippable
 			}
@@ -508,7 +634,7 @@ func (i *compactionIter) singleDeleteNext() bool {
 			i.skip = true
 			return true
 
-		case InternalKeyKindSet:
+		case InternalKeyKindSet, InternalKeyKindBlobIndex:
 			i.nextInStripe()
 			i.valid = false
 			return false
@@ -523,6 +649,17 @@ func (i *compactionIter) singleDeleteNext() bool {
 	}
 }
 
+// readBlobValue returns the value referenced by the handle of a BLOBINDEX
+// key. If the value cannot be read, i.err is set and nil is returned.
+func (i *compactionIter) readBlobValue(handle []byte) []byte {
+	if i.fetchBlobValue == nil {
+		i.err = errors.New("pebble: unexpected blob index key")
+		return nil
+	}
+	i.blobValueBuf, i.err = i.fetchBlobValue(handle, i.blobValueBuf)
+	return i.blobValueBuf
+}
+
 func (i *compactionIter) saveKey() {
 	i.keyBuf = append(i.keyBuf[:0], i.iterKey.UserKey...)
 	i.key.UserKey = i.keyBuf
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/datadriven"
 	"github.com/cockroachdb/pebble/internal/rangedel"
@@ -47,12 +48,35 @@ func TestSnapshotIndex(t *testing.T) {
 	}
 }
 
+// valueCompactionFilter is a CompactionFilter which removes the keys with the
+// value "rm" and changes the value "chg" to "changed".
+type valueCompactionFilter struct{}
+
+func (valueCompactionFilter) Name() string {
+	return "value-filter"
+}
+
+func (valueCompactionFilter) Filter(
+	key, value []byte,
+) (CompactionFilterDecision, []byte, error) {
+	switch string(value) {
+	case "rm":
+		return CompactionFilterRemove, nil, nil
+	case "chg":
+		return CompactionFilterChangeValue, []byte("changed"), nil
+	case "err":
+		return CompactionFilterKeep, nil, errors.New("filter error")
+	}
+	return CompactionFilterKeep, nil, nil
+}
+
 func TestCompactionIter(t *testing.T) {
 	var keys []InternalKey
 	var vals [][]byte
 	var snapshots []uint64
 	var elideTombstones bool
 	var allowZeroSeqnum bool
+	var filter CompactionFilter
 
 	newIter := func() *compactionIter {
 		return newCompactionIter(
@@ -68,6 +92,7 @@ func TestCompactionIter(t *testing.T) {
 			func(_, _ []byte) bool {
 				return elideTombstones
 			},
+			filter,
 		)
 	}
 
@@ -87,6 +112,7 @@ func TestCompactionIter(t *testing.T) {
 			snapshots = snapshots[:0]
 			elideTombstones = false
 			allowZeroSeqnum = false
+			filter = nil
 			for _, arg := range d.CmdArgs {
 				switch arg.Key {
 				case "snapshots":
@@ -109,6 +135,14 @@ func TestCompactionIter(t *testing.T) {
 					if err != nil {
 						return err.Error()
 					}
+				case "filter":
+					enabled, err := strconv.ParseBool(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+					if enabled {
+						filter = valueCompactionFilter{}
+					}
 				default:
 					return fmt.Sprintf("%s: unknown arg: %s", d.Cmd, arg.Key)
 				}
@@ -140,6 +174,9 @@ func TestCompactionIter(t *testing.T) {
 					}
 					fmt.Fprintf(&b, ".\n")
 					continue
+				case "filter-info":
+					fmt.Fprintf(&b, "%s\n", iter.filterInfo)
+					continue
 				default:
 					return fmt.Sprintf("unknown op: %s", parts[0])
 				}
@@ -19,6 +19,10 @@ type compactionEnv struct {
 	bytesCompacted          *uint64
 	earliestUnflushedSeqNum uint64
 	inProgressCompactions   []compactionInfo
+	readCompactions         *readCompactionQueue
+	// now is the current time in seconds since the epoch, against which the
+	// age of a table is measured.
+	now int64
 }
 
 type compactionPicker interface {
@@ -37,7 +41,8 @@ type compactionPicker interface {
 type compactionInfo struct {
 	startLevel  int
 	outputLevel int
-	inputs      [2][]*fileMetadata
+	extraLevel  int
+	inputs      [3][]*fileMetadata
 }
 
 type sortCompactionLevelsDecreasingScore []pickedCompactionInfo
@@ -58,6 +63,12 @@ func (s sortCompactionLevelsDecreasingScore) Swap(i, j int) {
 func newCompactionPicker(
 	v *version, opts *Options, inProgressCompactions []compactionInfo,
 ) compactionPicker {
+	switch opts.CompactionStyle {
+	case CompactionStyleTiered:
+		return newCompactionPickerTiered(v, opts)
+	case CompactionStyleFIFO:
+		return newCompactionPickerFIFO(v, opts)
+	}
 	p := &compactionPickerByScore{
 		opts: opts,
 		vers: v,
@@ -107,8 +118,7 @@ type compactionPickerByScore struct {
 	sizeAdjust [numLevels]int64
 
 	// Per-level compaction scores. The score for L0 is the score for an
-	// L0->Lbase compaction if there is not one in-progress, or the score for an
-	// intra-L0 compaction if there is in-progress L0->Lbase compaction.
+	// L0->Lbase compaction, computed from the L0 sublevels. See initL0Score.
 	scores [numLevels]pickedCompactionInfo
 }
 
@@ -279,10 +289,17 @@ func (p *compactionPickerByScore) initSizeAdjust(inProgressCompactions []compact
 		size := int64(totalSize(c.inputs[0]))
 		p.sizeAdjust[c.startLevel] -= size
 		p.sizeAdjust[c.outputLevel] += size
+		if c.extraLevel != 0 {
+			// The inputs from the intermediate level of a multi-level compaction
+			// move to the output level as well.
+			size = int64(totalSize(c.inputs[2]))
+			p.sizeAdjust[c.extraLevel] -= size
+			p.sizeAdjust[c.outputLevel] += size
+		}
 	}
 }
 
-func (p *compactionPickerByScore) initScores(inProgressCompactions []compactionInfo) {
+func (p *compactionPickerByScore) initScores() {
 	for i := range p.scores {
 		p.scores[i].level = i
 		p.scores[i].outputLevel = i + 1
@@ -290,7 +307,7 @@ func (p *compactionPickerByScore) initScores(inProgressCompactions []compactionI
 	}
 
 	p.scores[0].outputLevel = p.baseLevel
-	p.initL0Score(inProgressCompactions)
+	p.initL0Score()
 
 	for level := 1; level < numLevels-1; level++ {
 		size := int64(totalSize(p.vers.Files[level])) + p.sizeAdjust[level]
@@ -300,76 +317,26 @@ func (p *compactionPickerByScore) initScores(inProgressCompactions []compactionI
 	sort.Sort(sortCompactionLevelsDecreasingScore(p.scores[:]))
 }
 
-func (p *compactionPickerByScore) initL0Score(inProgressCompactions []compactionInfo) {
-	// TODO(peter): The current scoring logic precludes concurrent L0->Lbase
-	// compactions in most cases because if there is an in-progress L0->Lbase
-	// compaction we'll instead preferentially score an intra-L0 compaction. One
-	// possible way out is to score both by increasing the size of the "scores"
-	// array by one and adding entries for both L0->Lbase and intra-L0
-	// compactions.
-
-	// We treat level-0 specially by bounding the number of files instead of
-	// number of bytes for two reasons:
+func (p *compactionPickerByScore) initL0Score() {
+	// We treat level-0 specially by bounding the number of sublevels instead
+	// of number of bytes for two reasons:
 	//
 	// (1) With larger write-buffer sizes, it is nice not to do too many
 	// level-0 compactions.
 	//
-	// (2) The files in level-0 are merged on every read and therefore we
-	// wish to avoid too many files when the individual file size is small
+	// (2) The sublevels in level-0 are merged on every read and therefore we
+	// wish to avoid too many sublevels when the individual file size is small
 	// (perhaps because of a small write-buffer setting, or very high
 	// compression ratios, or lots of overwrites/deletions).
-
-	// Score an L0->Lbase compaction by counting the number of idle
-	// (non-compacting) files in L0.
-	var idleL0Count int
-	for _, f := range p.vers.Files[0] {
-		if !f.Compacting {
-			idleL0Count++
-		}
-	}
-	p.scores[0].score = float64(idleL0Count) / float64(p.opts.L0CompactionThreshold)
-
-	// Only start an intra-L0 compaction if there is an existing L0->Lbase
-	// compaction.
-	var l0Compaction bool
-	for i := range inProgressCompactions {
-		if inProgressCompactions[i].startLevel == 0 &&
-			inProgressCompactions[i].outputLevel != 0 {
-			l0Compaction = true
-			break
-		}
-	}
-	if !l0Compaction {
-		return
-	}
-
-	l0Files := p.vers.Files[0]
-	if len(l0Files) < p.opts.L0CompactionThreshold+2 {
-		// If L0 isn't accumulating many files beyond the regular L0 trigger,
-		// don't resort to an intra-L0 compaction yet. This matches the RocksDB
-		// heuristic.
-		return
-	}
-	var end = len(l0Files)
-	for ; end >= 1; end-- {
-		if l0Files[end-1].Compacting {
-			break
-		}
-	}
-
-	intraL0Count := len(l0Files) - end
-	if intraL0Count < minIntraL0Count {
-		// Not enough idle L0 files to perform an intra-L0 compaction. This
-		// matches the RocksDB heuristic. Note that if another file is flushed
-		// or ingested to L0, a new compaction picker will be created and we'll
-		// reexamine the intra-L0 score.
-		return
-	}
-
-	// Score the intra-L0 compaction using the number of files that are
-	// possibly in the compaction.
-	p.scores[0].score = float64(intraL0Count) / float64(p.opts.L0CompactionThreshold)
-	p.scores[0].outputLevel = 0
+	//
+	// Score an L0->Lbase compaction by the number of sublevels formed by the
+	// idle (non-compacting) files in L0, which is the read amplification of L0
+	// once the in-progress compactions complete. An in-progress L0->Lbase
+	// compaction of one part of the key space therefore does not lower the
+	// score of another part, which may be compacted concurrently.
+	sublevels := p.vers.L0Sublevels(p.opts.Comparer.Compare)
+	p.scores[0].score = float64(sublevels.NumSublevelsAfterOngoingCompactions()) /
+		float64(p.opts.L0CompactionThreshold)
 }
 
 func (p *compactionPickerByScore) pickFile(level int) int {
@@ -393,19 +360,25 @@ func (p *compactionPickerByScore) pickFile(level int) int {
 	// - Sequential write
 	// - Sequential write+delete (queue)
 
-	// The current heuristic matches the RocksDB kOldestSmallestSeqFirst
-	// heuristic.
+	// The file whose deletions are estimated to reclaim the most space is
+	// picked, so that deletions are propagated to the bottom level in a timely
+	// fashion. If no file has loaded stats reporting deletions, the current
+	// heuristic matches the RocksDB kOldestSmallestSeqFirst heuristic.
 	//
 	// TODO(peter): For concurrent compactions, we may want to try harder to pick
 	// a seed file whose resulting compaction bounds do not overlap with an
 	// in-progress compaction.
+	var maxReclaim uint64
 	smallestSeqNum := uint64(math.MaxUint64)
 	file := -1
 	for i, f := range p.vers.Files[level] {
 		if f.Compacting {
 			continue
 		}
-		if smallestSeqNum > f.SmallestSeqNum {
+		reclaim := deletionsReclaimEstimate(f)
+		if reclaim > maxReclaim ||
+			(reclaim == maxReclaim && smallestSeqNum > f.SmallestSeqNum) {
+			maxReclaim = reclaim
 			smallestSeqNum = f.SmallestSeqNum
 			file = i
 		}
@@ -413,6 +386,22 @@ func (p *compactionPickerByScore) pickFile(level int) int {
 	return file
 }
 
+// deletionsReclaimEstimate returns an estimate of the number of bytes which
+// compacting the table f would reclaim by dropping the keys deleted by the
+// point and range deletions in f. Returns 0 if the stats of f have not been
+// loaded. The point deletions are estimated to reclaim the fraction of the
+// table's size they account for.
+func deletionsReclaimEstimate(f *fileMetadata) uint64 {
+	if !f.StatsValid {
+		return 0
+	}
+	estimate := f.Stats.RangeDeletionsBytesEstimate
+	if f.Stats.NumEntries > 0 {
+		estimate += uint64(float64(f.Size) * float64(f.Stats.NumDeletions) / float64(f.Stats.NumEntries))
+	}
+	return estimate
+}
+
 // pickAuto picks the best compaction, if any.
 //
 // On each call, pickAuto computes per-level size adjustments based on
@@ -421,12 +410,15 @@ func (p *compactionPickerByScore) pickFile(level int) int {
 // anchored at that level.
 //
 // If a score-based compaction cannot be found, pickAuto falls back to looking
-// for a forced compaction (identified by FileMetadata.MarkedForCompaction).
+// for a forced compaction (identified by FileMetadata.MarkedForCompaction), a
+// read-triggered compaction, a periodic compaction (see
+// Options.PeriodicCompactionSeconds) and a blob file garbage collection, in
+// that order.
 func (p *compactionPickerByScore) pickAuto(env compactionEnv) (c *compaction) {
 	const highPriorityThreshold = 1.5
 
 	p.initSizeAdjust(env.inProgressCompactions)
-	p.initScores(env.inProgressCompactions)
+	p.initScores()
 
 	// Check for a score-based compaction. "scores" has been sorted in order of
 	// decreasing score. For each level with a score >= 1, we attempt to find a
@@ -442,6 +434,14 @@ func (p *compactionPickerByScore) pickAuto(env compactionEnv) (c *compaction) {
 			break
 		}
 
+		if info.level == 0 {
+			if c := p.pickL0(env, *info); c != nil {
+				c.score = info.score
+				return c
+			}
+			continue
+		}
+
 		info.file = p.pickFile(info.level)
 		if info.file == -1 {
 			continue
@@ -455,33 +455,41 @@ func (p *compactionPickerByScore) pickAuto(env compactionEnv) (c *compaction) {
 		}
 	}
 
-	// Check for forced compactions. These are lower priority than score-based
+	// Check for forced compactions of the tables marked by
+	// DB.MarkForCompaction. These are lower priority than score-based
 	// compactions. Note that this loop only runs if we haven't already found a
 	// score-based compaction.
 	//
 	// TODO(peter): MarkedForCompaction is almost never set, making this
 	// extremely wasteful in the common case. Could we maintain a
 	// MarkedForCompaction map from fileNum to level?
-	for level := 0; level < numLevels-1; level++ {
+	for level := 0; level < numLevels; level++ {
 		for file, f := range p.vers.Files[level] {
-			if !f.MarkedForCompaction {
+			if !f.MarkedForCompaction || f.Compacting {
 				continue
 			}
-			for i := range p.scores {
-				if p.scores[i].level != level {
-					continue
-				}
-				info := &p.scores[i]
-				info.file = file
-				c := pickAutoHelper(env, p.opts, p.vers, *info, p.baseLevel)
-				// Fail-safe to protect against compacting the same sstable concurrently.
-				if c != nil && !inputAlreadyCompacting(c) {
-					c.score = info.score
-					return c
-				}
-				break
+			if c := pickFileCompaction(env, p.opts, p.vers, p.baseLevel, level, file); c != nil {
+				c.marked = true
+				return c
 			}
-			break
+		}
+	}
+
+	// Check for read-triggered compactions. These are lower priority than
+	// score-based and forced compactions.
+	if c := pickReadTriggeredCompaction(env, p.opts, p.vers, p.baseLevel); c != nil {
+		return c
+	}
+
+	// Check for periodic compactions and blob file garbage collection. These
+	// are the lowest priority compactions, and are only started if no other
+	// compaction is running.
+	if len(env.inProgressCompactions) == 0 {
+		if c := pickPeriodicCompaction(env, p.opts, p.vers, p.baseLevel); c != nil {
+			return c
+		}
+		if c := pickBlobFileGC(env, p.opts, p.vers, p.baseLevel); c != nil {
+			return c
 		}
 	}
 
@@ -491,13 +499,178 @@ func (p *compactionPickerByScore) pickAuto(env compactionEnv) (c *compaction) {
 	return nil
 }
 
+// pickBlobFileGC picks a compaction of a table which references a blob file
+// whose fraction of live values is below Options.BlobFileGCThreshold. The
+// compaction rewrites the table in place, moving the values it references in
+// the blob file to a new blob file. Once every table referencing the blob
+// file has been rewritten, the blob file is deleted. Tables in L0 are not
+// considered as they are compacted into Lbase quickly.
+func pickBlobFileGC(env compactionEnv, opts *Options, vers *version, baseLevel int) *compaction {
+	gc := blobFilesToGC(vers, opts.BlobFileGCThreshold)
+	if len(gc) == 0 {
+		return nil
+	}
+	for level := baseLevel; level < numLevels; level++ {
+		files := vers.Files[level]
+		for i, f := range files {
+			if f.Compacting || !referencesBlobFiles(f, gc) {
+				continue
+			}
+			return newRewriteCompaction(env, opts, vers, baseLevel, level, i)
+		}
+	}
+	return nil
+}
+
+// newRewriteCompaction returns a compaction which rewrites the file'th table
+// of level in place, without merging it with the tables of any other level.
+func newRewriteCompaction(
+	env compactionEnv, opts *Options, vers *version, baseLevel, level, file int,
+) *compaction {
+	c := newCompaction(opts, vers, level, baseLevel, env.bytesCompacted)
+	c.outputLevel = level
+	c.inputs[0] = vers.Files[level][file : file+1]
+	c.smallest, c.largest = manifest.KeyRange(c.cmp, c.inputs[0], nil)
+	c.setupInuseKeyRanges()
+	c.maxOutputFileSize = uint64(opts.Level(1 + level - baseLevel).TargetFileSize)
+	c.maxOverlapBytes = math.MaxUint64
+	c.maxExpandedBytes = math.MaxUint64
+	return c
+}
+
+// pickFileCompaction picks a compaction of the file'th table of level into
+// the next level. A table in the bottom level is rewritten in place. Returns
+// nil if the compaction would include a table which is already being
+// compacted.
+func pickFileCompaction(
+	env compactionEnv, opts *Options, vers *version, baseLevel, level, file int,
+) *compaction {
+	var c *compaction
+	if level == numLevels-1 {
+		c = newRewriteCompaction(env, opts, vers, baseLevel, level, file)
+	} else {
+		outputLevel := level + 1
+		if level == 0 {
+			outputLevel = baseLevel
+		}
+		info := pickedCompactionInfo{level: level, outputLevel: outputLevel, file: file}
+		c = pickAutoHelper(env, opts, vers, info, baseLevel)
+	}
+	// Fail-safe to protect against compacting the same sstable concurrently.
+	if c == nil || inputAlreadyCompacting(c) {
+		return nil
+	}
+	return c
+}
+
+// pickPeriodicCompaction picks a compaction of the oldest table whose age
+// exceeds Options.PeriodicCompactionSeconds. The table is compacted into the
+// next level, or rewritten in place if it is in the bottom level. If the
+// compaction of a table cannot be picked, as it would include a table which
+// is already being compacted, the next oldest table is tried. Returns nil if
+// there is no such table.
+func pickPeriodicCompaction(
+	env compactionEnv, opts *Options, vers *version, baseLevel int,
+) *compaction {
+	if opts.PeriodicCompactionSeconds <= 0 {
+		return nil
+	}
+	type candidate struct {
+		level, file  int
+		creationTime int64
+	}
+	var candidates []candidate
+	for l := range vers.Files {
+		for i, f := range vers.Files[l] {
+			// Tables without a creation time are never compacted periodically.
+			if f.Compacting || f.CreationTime <= 0 ||
+				env.now-f.CreationTime < opts.PeriodicCompactionSeconds {
+				continue
+			}
+			candidates = append(candidates, candidate{level: l, file: i, creationTime: f.CreationTime})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].creationTime < candidates[j].creationTime
+	})
+	for _, cand := range candidates {
+		if c := pickFileCompaction(env, opts, vers, baseLevel, cand.level, cand.file); c != nil {
+			c.periodic = true
+			return c
+		}
+	}
+	return nil
+}
+
+func referencesBlobFiles(f *fileMetadata, blobFiles map[FileNum]bool) bool {
+	for _, ref := range f.BlobReferences {
+		if blobFiles[ref.FileNum] {
+			return true
+		}
+	}
+	return false
+}
+
+// pickL0 picks an L0->Lbase compaction. Each idle L0 file is tried as the
+// seed of the compaction, oldest first. The L0 inputs of the compaction are
+// the seed and the L0 files which transitively overlap it, and a seed whose
+// inputs include a file which is already being compacted is skipped. This
+// allows L0->Lbase compactions of disjoint parts of the key space to run
+// concurrently.
+//
+// If no L0->Lbase compaction can be picked while one is in progress, pickL0
+// falls back to an intra-L0 compaction in order to reduce the number of L0
+// sublevels.
+func (p *compactionPickerByScore) pickL0(
+	env compactionEnv, info pickedCompactionInfo,
+) *compaction {
+	files := p.vers.Files[0]
+	tried := make(map[*fileMetadata]bool, len(files))
+	for i, f := range files {
+		if f.Compacting || tried[f] {
+			continue
+		}
+		info.file = i
+		c := pickAutoHelper(env, p.opts, p.vers, info, p.baseLevel)
+		for _, g := range c.inputs[0] {
+			tried[g] = true
+		}
+		// Fail-safe to protect against compacting the same sstable concurrently.
+		if !inputAlreadyCompacting(c) {
+			return c
+		}
+	}
+
+	// Only start an intra-L0 compaction if there is an existing L0->Lbase
+	// compaction.
+	var l0Compaction bool
+	for i := range env.inProgressCompactions {
+		if env.inProgressCompactions[i].startLevel == 0 &&
+			env.inProgressCompactions[i].outputLevel != 0 {
+			l0Compaction = true
+			break
+		}
+	}
+	if !l0Compaction {
+		return nil
+	}
+	sublevels := p.vers.L0Sublevels(p.opts.Comparer.Compare)
+	if len(sublevels.Levels) < p.opts.L0CompactionThreshold+2 {
+		// If L0 isn't accumulating many sublevels beyond the regular L0
+		// trigger, don't resort to an intra-L0 compaction yet. This matches the
+		// RocksDB heuristic.
+		return nil
+	}
+	c := pickIntraL0(env, p.opts, p.vers)
+	if c == nil || inputAlreadyCompacting(c) {
+		return nil
+	}
+	return c
+}
+
 func pickAutoHelper(
 	env compactionEnv, opts *Options, vers *version, cInfo pickedCompactionInfo, baseLevel int,
 ) (c *compaction) {
-	if cInfo.outputLevel == 0 {
-		return pickIntraL0(env, opts, vers)
-	}
-
 	c = newCompaction(opts, vers, cInfo.level, baseLevel, env.bytesCompacted)
 	if c.outputLevel != cInfo.outputLevel {
 		panic("pebble: compaction picked unexpected output level")
@@ -514,9 +687,67 @@ func pickAutoHelper(
 	}
 
 	c.setupInputs()
+	if mc := pickMultiLevel(env, opts, vers, c, baseLevel); mc != nil {
+		return mc
+	}
 	return c
 }
 
+// pickMultiLevel returns a multi-level compaction which extends the
+// compaction c by the level beneath its output level, if doing so lowers the
+// estimated write amplification of the compaction (see predictedWriteAmp).
+// The multi-level compaction compacts the inputs of c from c.startLevel into
+// the level beneath c.outputLevel, merging the inputs of c from c.outputLevel
+// in the same pass. This avoids writing the data from c.startLevel twice when
+// the overlapping data in c.outputLevel is large relative to it. Returns nil
+// if c should not be extended.
+//
+// Compactions from L0 are not extended, as L0->Lbase compactions need to be
+// prompt and are kept small so that they can run concurrently.
+func pickMultiLevel(
+	env compactionEnv, opts *Options, vers *version, c *compaction, baseLevel int,
+) *compaction {
+	if !opts.MultiLevelCompactions || c.startLevel == 0 ||
+		c.outputLevel+1 >= numLevels || len(c.inputs[1]) == 0 {
+		return nil
+	}
+	outputLevel := c.outputLevel + 1
+	// Don't extend the compaction into a level which an in-progress compaction
+	// is writing to or reading from. The in-progress compaction may be writing
+	// tables which overlap the outputs of the multi-level compaction.
+	if conflictsWithInProgress(c.outputLevel, outputLevel, env.inProgressCompactions) {
+		return nil
+	}
+
+	mc := newCompaction(opts, vers, c.startLevel, baseLevel, env.bytesCompacted)
+	mc.setOutputLevel(opts, outputLevel, baseLevel)
+	mc.extraLevel = c.outputLevel
+	mc.inputs[0] = c.inputs[0]
+	mc.inputs[2] = c.inputs[1]
+	mc.smallest, mc.largest = manifest.KeyRange(mc.cmp, mc.inputs[0], mc.inputs[2])
+	mc.inputs[1] = vers.Overlaps(outputLevel, mc.cmp, mc.smallest.UserKey, mc.largest.UserKey)
+	mc.inputs[1] = mc.expandInputs(outputLevel, mc.inputs[1])
+	for _, f := range mc.inputs[1] {
+		if f.Compacting {
+			return nil
+		}
+	}
+	if totalSize(mc.inputs[0])+totalSize(mc.inputs[1])+totalSize(mc.inputs[2]) >= mc.maxExpandedBytes {
+		return nil
+	}
+	if mc.predictedWriteAmp() >= c.predictedWriteAmp() {
+		return nil
+	}
+
+	upper := append(append([]*fileMetadata(nil), mc.inputs[0]...), mc.inputs[2]...)
+	mc.smallest, mc.largest = manifest.KeyRange(mc.cmp, upper, mc.inputs[1])
+	if outputLevel+1 < numLevels {
+		mc.grandparents = vers.Overlaps(outputLevel+1, mc.cmp, mc.smallest.UserKey, mc.largest.UserKey)
+	}
+	mc.setupInuseKeyRanges()
+	return mc
+}
+
 func pickIntraL0(env compactionEnv, opts *Options, vers *version) (c *compaction) {
 	l0Files := vers.Files[0]
 	end := len(l0Files)
@@ -598,10 +829,10 @@ func pickIntraL0(env compactionEnv, opts *Options, vers *version) (c *compaction
 	c.inputs[0] = l0Files[begin:end]
 	c.smallest, c.largest = manifest.KeyRange(c.cmp, c.inputs[0], nil)
 	c.setupInuseKeyRanges()
-	// Output only a single sstable for intra-L0 compactions. There is no current
-	// benefit to outputting multiple tables, because other parts of the code
-	// (i.e. iterators and comapction) expect L0 sstables to overlap and will
-	// thus read all of the L0 sstables anyways, even if they are partitioned.
+	// Output only a single sstable for intra-L0 compactions. There is no
+	// benefit to outputting multiple tables, as the inputs are the newest L0
+	// tables which overlap one another, and partitioned outputs would occupy
+	// the same L0 sublevel as a single output.
 	c.maxOutputFileSize = math.MaxUint64
 	c.maxOverlapBytes = math.MaxUint64
 	c.maxExpandedBytes = math.MaxUint64
@@ -614,11 +845,18 @@ func (p *compactionPickerByScore) pickManual(
 	if p == nil {
 		return nil, false
 	}
+	return pickManualForBaseLevel(env, p.opts, p.vers, p.baseLevel, manual)
+}
 
+// pickManualForBaseLevel picks the compaction for a manual compaction, for a
+// picker which compacts L0 into baseLevel.
+func pickManualForBaseLevel(
+	env compactionEnv, opts *Options, vers *version, baseLevel int, manual *manualCompaction,
+) (c *compaction, retryLater bool) {
 	outputLevel := manual.level + 1
 	if manual.level == 0 {
-		outputLevel = p.baseLevel
-	} else if manual.level < p.baseLevel {
+		outputLevel = baseLevel
+	} else if manual.level < baseLevel {
 		// The start level for a compaction must be >= Lbase. A manual
 		// compaction could have been created adhering to that condition, and
 		// then an automatic compaction came in and compacted all of the
@@ -632,7 +870,7 @@ func (p *compactionPickerByScore) pickManual(
 	if conflictsWithInProgress(manual.level, outputLevel, env.inProgressCompactions) {
 		return nil, true
 	}
-	c = pickManualHelper(env, p.opts, manual, p.vers, p.baseLevel)
+	c = pickManualHelper(env, opts, manual, vers, baseLevel)
 	if c == nil {
 		return nil, false
 	}
@@ -686,6 +924,9 @@ func conflictsWithInProgress(
 			outputLevel == c.outputLevel {
 			return true
 		}
+		if c.extraLevel != 0 && (level == c.extraLevel || outputLevel == c.extraLevel) {
+			return true
+		}
 	}
 	return false
 }
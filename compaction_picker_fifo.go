@@ -0,0 +1,157 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/pebble/internal/manifest"
+)
+
+// compactionPickerFIFO picks compactions for CompactionStyleFIFO. Flushed and
+// ingested tables are added to L0, and are never compacted into lower levels.
+// Once the total size of the tables exceeds
+// FIFOCompactionOptions.MaxTableFilesSize, or the oldest tables are older than
+// FIFOCompactionOptions.TTL, the oldest tables are dropped by a delete-only
+// compaction.
+//
+// The levels beneath L0 only hold data after a switch from another
+// compaction style. They are older than L0, and are dropped first, starting
+// with the bottom level.
+type compactionPickerFIFO struct {
+	opts *Options
+	vers *version
+
+	// The first non-empty level beneath L0, or the bottom level. See
+	// firstNonEmptyLevel.
+	baseLevel int
+}
+
+var _ compactionPicker = &compactionPickerFIFO{}
+
+func newCompactionPickerFIFO(v *version, opts *Options) *compactionPickerFIFO {
+	return &compactionPickerFIFO{
+		opts:      opts,
+		vers:      v,
+		baseLevel: firstNonEmptyLevel(v),
+	}
+}
+
+func (p *compactionPickerFIFO) getBaseLevel() int {
+	return p.baseLevel
+}
+
+// getEstimatedMaxWAmp returns the estimated maximum write amp per byte that
+// is added to L0. FIFO compaction only rewrites the data of L0 when the
+// number of L0 sublevels needs to be reduced.
+func (p *compactionPickerFIFO) getEstimatedMaxWAmp() float64 {
+	return 1
+}
+
+func (p *compactionPickerFIFO) getLevelMaxBytes() [numLevels]int64 {
+	return unboundedLevelMaxBytes()
+}
+
+// estimatedCompactionDebt returns 0, as dropping tables does not require any
+// data to be compacted.
+func (p *compactionPickerFIFO) estimatedCompactionDebt(l0ExtraSize uint64) uint64 {
+	return 0
+}
+
+func (p *compactionPickerFIFO) forceBaseLevel1() {}
+
+// pickManual returns no compaction. The tables are never compacted into
+// lower levels by FIFO compaction.
+func (p *compactionPickerFIFO) pickManual(
+	env compactionEnv, manual *manualCompaction,
+) (c *compaction, retryLater bool) {
+	return nil, false
+}
+
+// pickAuto picks a compaction dropping the oldest tables, if the size or age
+// bound is exceeded. Otherwise, if the number of L0 sublevels has reached
+// Options.L0CompactionThreshold, it picks an intra-L0 compaction of the
+// newest L0 tables to bound the read amplification of L0. The outputs of the
+// intra-L0 compaction keep the creation time of the oldest of its inputs, so
+// that its data expires no later than it would have otherwise.
+func (p *compactionPickerFIFO) pickAuto(env compactionEnv) *compaction {
+	if len(env.inProgressCompactions) > 0 {
+		return nil
+	}
+	if c := p.pickDrop(env); c != nil {
+		return c
+	}
+	sublevels := p.vers.L0Sublevels(p.opts.Comparer.Compare)
+	if len(sublevels.Levels) < p.opts.L0CompactionThreshold {
+		return nil
+	}
+	c := pickIntraL0(env, p.opts, p.vers)
+	if c == nil || inputAlreadyCompacting(c) {
+		return nil
+	}
+	c.score = float64(len(sublevels.Levels)) / float64(p.opts.L0CompactionThreshold)
+	c.keepCreationTime = true
+	return c
+}
+
+// pickDrop picks a delete-only compaction of the oldest tables, while the
+// total size of the tables exceeds FIFOCompactionOptions.MaxTableFilesSize or
+// the oldest table is older than FIFOCompactionOptions.TTL. Only the tables of
+// the oldest non-empty level are considered, as dropping the tables of a
+// higher level would expose older versions of their keys in the levels
+// beneath. Returns nil if no table needs to be dropped.
+func (p *compactionPickerFIFO) pickDrop(env compactionEnv) *compaction {
+	var size uint64
+	for level := range p.vers.Files {
+		size += totalSize(p.vers.Files[level])
+	}
+	maxSize := p.opts.FIFOCompaction.MaxTableFilesSize
+	ttl := int64(p.opts.FIFOCompaction.TTL / time.Second)
+	expired := func(f *fileMetadata) bool {
+		// Tables without a creation time never expire.
+		return ttl > 0 && f.CreationTime > 0 && env.now-f.CreationTime >= ttl
+	}
+
+	for level := numLevels - 1; level >= 0; level-- {
+		files := p.vers.Files[level]
+		if len(files) == 0 {
+			continue
+		}
+		if level > 0 {
+			// The tables of the levels beneath L0 are sorted by key. Drop them
+			// in the order of their age.
+			files = append([]*fileMetadata(nil), files...)
+			sort.SliceStable(files, func(i, j int) bool {
+				return files[i].LargestSeqNum < files[j].LargestSeqNum
+			})
+		}
+		var inputs []*fileMetadata
+		for _, f := range files {
+			if f.Compacting || (size <= maxSize && !expired(f)) {
+				break
+			}
+			inputs = append(inputs, f)
+			size -= f.Size
+		}
+		if len(inputs) == 0 {
+			return nil
+		}
+		c := &compaction{
+			cmp:         p.opts.Comparer.Compare,
+			format:      p.opts.Comparer.Format,
+			logger:      p.opts.Logger,
+			version:     p.vers,
+			startLevel:  level,
+			outputLevel: level,
+			deleteOnly:  true,
+			fifo:        true,
+		}
+		c.inputs[0] = inputs
+		c.smallest, c.largest = manifest.KeyRange(c.cmp, inputs, nil)
+		return c
+	}
+	return nil
+}
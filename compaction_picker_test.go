@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
@@ -51,8 +52,14 @@ func loadVersion(d *datadriven.TestData) (*version, *Options, string) {
 			}
 			for i := uint64(1); i <= size; i++ {
 				key := base.MakeInternalKey([]byte(fmt.Sprintf("%04d", i)), i, InternalKeyKindSet)
+				smallest := key
+				if level == 0 {
+					// Make the L0 files overlap one another so that each file forms its
+					// own sublevel.
+					smallest = base.MakeInternalKey([]byte("0001"), i, InternalKeyKindSet)
+				}
 				vers.Files[level] = append(vers.Files[level], &fileMetadata{
-					Smallest:       key,
+					Smallest:       smallest,
 					Largest:        key,
 					SmallestSeqNum: key.SeqNum(),
 					LargestSeqNum:  key.SeqNum(),
@@ -319,6 +326,111 @@ func TestCompactionPickerEstimatedCompactionDebt(t *testing.T) {
 		})
 }
 
+func TestCompactionPickerPickFile(t *testing.T) {
+	newFile := func(fileNum FileNum, smallestSeqNum uint64, stats *tableStats) *fileMetadata {
+		f := &fileMetadata{
+			FileNum:        fileNum,
+			Size:           1000,
+			SmallestSeqNum: smallestSeqNum,
+			LargestSeqNum:  smallestSeqNum,
+		}
+		if stats != nil {
+			f.Stats = *stats
+			f.StatsValid = true
+		}
+		return f
+	}
+
+	testCases := []struct {
+		files    []*fileMetadata
+		expected FileNum
+	}{
+		// Without stats, the file with the oldest data is picked.
+		{[]*fileMetadata{newFile(1, 5, nil), newFile(2, 3, nil)}, 2},
+		{[]*fileMetadata{newFile(1, 5, nil), newFile(2, 3, &tableStats{NumEntries: 10})}, 2},
+		// The file whose deletions reclaim the most space is picked.
+		{[]*fileMetadata{
+			newFile(1, 5, &tableStats{NumEntries: 10, NumDeletions: 5}),
+			newFile(2, 3, &tableStats{NumEntries: 10, NumDeletions: 1}),
+		}, 1},
+		{[]*fileMetadata{
+			newFile(1, 5, &tableStats{NumEntries: 10, NumDeletions: 5}),
+			newFile(2, 3, &tableStats{NumEntries: 10, RangeDeletionsBytesEstimate: 2000}),
+		}, 2},
+	}
+	for _, tc := range testCases {
+		t.Run("", func(t *testing.T) {
+			vers := &version{}
+			vers.Files[5] = tc.files
+			p := &compactionPickerByScore{vers: vers}
+			i := p.pickFile(5)
+			require.Equal(t, tc.expected, vers.Files[5][i].FileNum)
+		})
+	}
+}
+
+func TestCompactionPickerConcurrentL0(t *testing.T) {
+	opts := (&Options{}).EnsureDefaults()
+
+	// Define two disjoint key ranges in L0, each containing 8 overlapping
+	// files which form 8 sublevels.
+	vers := &version{}
+	var seqNum uint64
+	for i := 0; i < 8; i++ {
+		for _, r := range [][2]string{{"a", "c"}, {"x", "z"}} {
+			seqNum++
+			vers.Files[0] = append(vers.Files[0], &fileMetadata{
+				FileNum:        FileNum(seqNum),
+				Size:           1,
+				Smallest:       base.MakeInternalKey([]byte(r[0]), seqNum, InternalKeyKindSet),
+				Largest:        base.MakeInternalKey([]byte(r[1]), seqNum, InternalKeyKindSet),
+				SmallestSeqNum: seqNum,
+				LargestSeqNum:  seqNum,
+			})
+		}
+	}
+	require.Equal(t, 8, len(vers.L0Sublevels(opts.Comparer.Compare).Levels))
+
+	p := newCompactionPicker(vers, opts, nil).(*compactionPickerByScore)
+	env := compactionEnv{earliestUnflushedSeqNum: InternalKeySeqNumMax}
+	keyRange := func(c *compaction) string {
+		smallest, largest := manifest.KeyRange(opts.Comparer.Compare, c.inputs[0], nil)
+		return fmt.Sprintf("L%d->L%d: %s-%s %d files",
+			c.startLevel, c.outputLevel, smallest.UserKey, largest.UserKey, len(c.inputs[0]))
+	}
+
+	// The first compaction compacts one of the key ranges into Lbase.
+	c1 := p.pickAuto(env)
+	require.NotNil(t, c1)
+	require.Equal(t, "L0->L6: a-c 8 files", keyRange(c1))
+	for _, f := range c1.inputs[0] {
+		f.Compacting = true
+	}
+	env.inProgressCompactions = append(env.inProgressCompactions, compactionInfo{
+		startLevel:  c1.startLevel,
+		outputLevel: c1.outputLevel,
+		inputs:      c1.inputs,
+	})
+
+	// The files being compacted do not count towards the score of L0, and the
+	// other key range can be compacted concurrently.
+	c2 := p.pickAuto(env)
+	require.NotNil(t, c2)
+	require.Equal(t, "L0->L6: x-z 8 files", keyRange(c2))
+	require.Equal(t, 2.0, c2.score)
+	for _, f := range c2.inputs[0] {
+		f.Compacting = true
+	}
+	env.inProgressCompactions = append(env.inProgressCompactions, compactionInfo{
+		startLevel:  c2.startLevel,
+		outputLevel: c2.outputLevel,
+		inputs:      c2.inputs,
+	})
+
+	// All of the L0 files are being compacted.
+	require.Nil(t, p.pickAuto(env))
+}
+
 func TestCompactionPickerIntraL0(t *testing.T) {
 	opts := &Options{}
 	opts = opts.EnsureDefaults()
@@ -416,3 +528,166 @@ func TestCompactionPickerIntraL0(t *testing.T) {
 			}
 		})
 }
+
+func TestCompactionPickerStyles(t *testing.T) {
+	var vers *version
+	var opts *Options
+
+	parseMeta := func(s string) (*fileMetadata, error) {
+		fields := strings.Fields(s)
+		if len(fields) < 2 {
+			return nil, errors.Errorf("malformed table spec: %s", s)
+		}
+		index := strings.Index(fields[0], ":")
+		if index == -1 {
+			return nil, errors.Errorf("malformed table spec: %s", s)
+		}
+		fn, err := strconv.ParseUint(fields[0][:index], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.Split(fields[0][index+1:], "-")
+		if len(parts) != 2 {
+			return nil, errors.Errorf("malformed table spec: %s", s)
+		}
+		m := &fileMetadata{
+			FileNum:  FileNum(fn),
+			Smallest: base.ParseInternalKey(parts[0]),
+			Largest:  base.ParseInternalKey(parts[1]),
+		}
+		m.SmallestSeqNum = m.Smallest.SeqNum()
+		m.LargestSeqNum = m.Largest.SeqNum()
+		if m.SmallestSeqNum > m.LargestSeqNum {
+			m.SmallestSeqNum, m.LargestSeqNum = m.LargestSeqNum, m.SmallestSeqNum
+		}
+		if m.Size, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return nil, err
+		}
+		for _, field := range fields[2:] {
+			switch {
+			case field == "compacting":
+				m.Compacting = true
+			case strings.HasPrefix(field, "created="):
+				if m.CreationTime, err = strconv.ParseInt(field[len("created="):], 10, 64); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, errors.Errorf("malformed table spec: %s", s)
+			}
+		}
+		return m, nil
+	}
+
+	datadriven.RunTest(t, "testdata/compaction_picker_styles",
+		func(d *datadriven.TestData) string {
+			switch d.Cmd {
+			case "define":
+				opts = (&Options{}).EnsureDefaults()
+				for _, arg := range d.CmdArgs {
+					if arg.Key == "style" {
+						switch arg.Vals[0] {
+						case "tiered":
+							opts.CompactionStyle = CompactionStyleTiered
+						case "fifo":
+							opts.CompactionStyle = CompactionStyleFIFO
+						default:
+							return fmt.Sprintf("unknown style: %s", arg.Vals[0])
+						}
+						continue
+					}
+					v, err := strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+					switch arg.Key {
+					case "l0-compaction-threshold":
+						opts.L0CompactionThreshold = v
+					case "max-size-amp":
+						opts.TieredCompaction.MaxSizeAmplificationPercent = v
+					case "min-merge-width":
+						opts.TieredCompaction.MinMergeWidth = v
+					case "size-ratio":
+						opts.TieredCompaction.SizeRatio = v
+					case "max-size":
+						opts.FIFOCompaction.MaxTableFilesSize = uint64(v)
+					case "ttl":
+						opts.FIFOCompaction.TTL = time.Duration(v) * time.Second
+					case "periodic":
+						opts.PeriodicCompactionSeconds = int64(v)
+					default:
+						return fmt.Sprintf("unknown arg: %s", arg.Key)
+					}
+				}
+
+				vers = &version{}
+				level := -1
+				for _, data := range strings.Split(d.Input, "\n") {
+					data = strings.TrimSpace(data)
+					if data == "" {
+						continue
+					}
+					if strings.HasPrefix(data, "L") {
+						var err error
+						if level, err = strconv.Atoi(data[1:]); err != nil {
+							return err.Error()
+						}
+						continue
+					}
+					m, err := parseMeta(data)
+					if err != nil {
+						return err.Error()
+					}
+					vers.Files[level] = append(vers.Files[level], m)
+				}
+				manifest.SortBySeqNum(vers.Files[0])
+				for level := 1; level < numLevels; level++ {
+					manifest.SortBySmallest(vers.Files[level], opts.Comparer.Compare)
+				}
+				return fmt.Sprintf("base: %d", newCompactionPicker(vers, opts, nil).getBaseLevel())
+
+			case "pick":
+				env := compactionEnv{earliestUnflushedSeqNum: InternalKeySeqNumMax}
+				for _, arg := range d.CmdArgs {
+					v, err := strconv.ParseInt(arg.Vals[0], 10, 64)
+					if err != nil {
+						return err.Error()
+					}
+					switch arg.Key {
+					case "earliest-unflushed":
+						env.earliestUnflushedSeqNum = uint64(v)
+					case "now":
+						env.now = v
+					case "ongoing":
+						env.inProgressCompactions = []compactionInfo{{startLevel: int(v), outputLevel: int(v)}}
+					default:
+						return fmt.Sprintf("unknown arg: %s", arg.Key)
+					}
+				}
+
+				c := newCompactionPicker(vers, opts, nil).pickAuto(env)
+				if c == nil {
+					return "no compaction"
+				}
+				var buf bytes.Buffer
+				if c.deleteOnly {
+					fmt.Fprintf(&buf, "drop L%d:", c.startLevel)
+				} else {
+					fmt.Fprintf(&buf, "L%d->L%d:", c.startLevel, c.outputLevel)
+				}
+				for _, f := range c.inputs[0] {
+					fmt.Fprintf(&buf, " %s", f.FileNum)
+				}
+				if len(c.inputs[1]) > 0 {
+					fmt.Fprintf(&buf, " +")
+					for _, f := range c.inputs[1] {
+						fmt.Fprintf(&buf, " %s", f.FileNum)
+					}
+				}
+				fmt.Fprintf(&buf, "\n")
+				return buf.String()
+
+			default:
+				return fmt.Sprintf("unknown command: %s", d.Cmd)
+			}
+		})
+}
@@ -0,0 +1,264 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"math"
+
+	"github.com/cockroachdb/pebble/internal/manifest"
+)
+
+// sortedRun is a set of tables whose keys do not overlap, and which are
+// merged by tiered compactions as a unit.
+type sortedRun struct {
+	level int
+	files []*fileMetadata
+	size  uint64
+}
+
+// compactionPickerTiered picks compactions for CompactionStyleTiered. The
+// data is kept in sorted runs ordered by age: each table in L0 is a sorted
+// run, and the bottom level is the oldest sorted run. A compaction merges a
+// contiguous sequence of the newest sorted runs into a single sorted run. The
+// output is written to L0, or to the bottom level if the oldest sorted run is
+// one of the inputs.
+//
+// The levels between L0 and the bottom level only hold data after a switch
+// from CompactionStyleLeveled. Their tables are compacted into the bottom
+// level before any tiered compaction is picked.
+type compactionPickerTiered struct {
+	opts *Options
+	vers *version
+
+	// The level to target for L0 compactions: the first non-empty level
+	// beneath L0, or the bottom level.
+	baseLevel int
+}
+
+var _ compactionPicker = &compactionPickerTiered{}
+
+func newCompactionPickerTiered(v *version, opts *Options) *compactionPickerTiered {
+	return &compactionPickerTiered{
+		opts:      opts,
+		vers:      v,
+		baseLevel: firstNonEmptyLevel(v),
+	}
+}
+
+// firstNonEmptyLevel returns the first non-empty level beneath L0, or the
+// bottom level if every level beneath L0 is empty.
+func firstNonEmptyLevel(v *version) int {
+	for level := 1; level < numLevels-1; level++ {
+		if len(v.Files[level]) > 0 {
+			return level
+		}
+	}
+	return numLevels - 1
+}
+
+func (p *compactionPickerTiered) getBaseLevel() int {
+	return p.baseLevel
+}
+
+// getEstimatedMaxWAmp returns the estimated maximum write amp per byte that
+// is added to L0. A byte is rewritten roughly once per merge of the sorted
+// runs it is part of.
+func (p *compactionPickerTiered) getEstimatedMaxWAmp() float64 {
+	return float64(p.opts.L0CompactionThreshold)
+}
+
+func (p *compactionPickerTiered) getLevelMaxBytes() [numLevels]int64 {
+	return unboundedLevelMaxBytes()
+}
+
+// unboundedLevelMaxBytes returns the max bytes of the levels for the pickers
+// which do not compact levels by size.
+func unboundedLevelMaxBytes() [numLevels]int64 {
+	var levelMaxBytes [numLevels]int64
+	for level := range levelMaxBytes {
+		levelMaxBytes[level] = math.MaxInt64
+	}
+	return levelMaxBytes
+}
+
+// estimatedCompactionDebt estimates the number of bytes which need to be
+// compacted before the LSM tree becomes stable. Every sorted run is
+// eventually merged into the bottom level.
+func (p *compactionPickerTiered) estimatedCompactionDebt(l0ExtraSize uint64) uint64 {
+	debt := l0ExtraSize
+	for level := 0; level < numLevels-1; level++ {
+		debt += totalSize(p.vers.Files[level])
+	}
+	return debt
+}
+
+func (p *compactionPickerTiered) forceBaseLevel1() {}
+
+func (p *compactionPickerTiered) pickManual(
+	env compactionEnv, manual *manualCompaction,
+) (c *compaction, retryLater bool) {
+	return pickManualForBaseLevel(env, p.opts, p.vers, p.baseLevel, manual)
+}
+
+// pickAuto picks a tiered compaction once the number of sorted runs reaches
+// Options.L0CompactionThreshold. In order of preference, it picks:
+//
+//   - A compaction of every sorted run into the bottom level, if the size of
+//     the sorted runs newer than the bottom level exceeds
+//     TieredCompactionOptions.MaxSizeAmplificationPercent of its size.
+//   - A compaction of the newest sorted runs whose sizes are similar, where
+//     each run is at most TieredCompactionOptions.SizeRatio percent larger than
+//     the total size of the newer runs, if there are at least
+//     TieredCompactionOptions.MinMergeWidth such runs.
+//   - A compaction of the newest sorted runs which reduces the number of sorted
+//     runs below the threshold.
+//
+// Tiered compactions span most of the key space, so only one runs at a time.
+func (p *compactionPickerTiered) pickAuto(env compactionEnv) *compaction {
+	if len(env.inProgressCompactions) > 0 {
+		return nil
+	}
+	if p.baseLevel < numLevels-1 {
+		return p.pickMigration(env)
+	}
+
+	runs := p.sortedRuns(env)
+	threshold := p.opts.L0CompactionThreshold
+	if len(runs) < threshold {
+		return nil
+	}
+
+	var n int
+	if p.sizeAmplificationExceeded(runs) {
+		n = len(runs)
+	} else if n = p.sizeRatioWidth(runs); n < p.opts.TieredCompaction.MinMergeWidth {
+		n = len(runs) - threshold + 2
+	}
+	if n > len(runs) {
+		n = len(runs)
+	}
+	if n < 2 {
+		return nil
+	}
+	c := p.newCompaction(env, runs[:n], n == len(runs))
+	c.score = float64(len(runs)) / float64(threshold)
+	return c
+}
+
+// sortedRuns returns the sorted runs, from newest to oldest. The L0 tables
+// containing sequence numbers which are not older than the earliest
+// unflushed sequence number are excluded (see pickIntraL0).
+func (p *compactionPickerTiered) sortedRuns(env compactionEnv) []sortedRun {
+	l0Files := p.vers.Files[0]
+	end := len(l0Files)
+	for end > 0 && l0Files[end-1].LargestSeqNum >= env.earliestUnflushedSeqNum {
+		end--
+	}
+	runs := make([]sortedRun, 0, end+1)
+	for i := end - 1; i >= 0; i-- {
+		runs = append(runs, sortedRun{level: 0, files: l0Files[i : i+1], size: l0Files[i].Size})
+	}
+	if files := p.vers.Files[numLevels-1]; len(files) > 0 {
+		runs = append(runs, sortedRun{level: numLevels - 1, files: files, size: totalSize(files)})
+	}
+	return runs
+}
+
+// sizeAmplificationExceeded returns true if the size of the sorted runs newer
+// than the bottom level exceeds TieredCompactionOptions.MaxSizeAmplificationPercent
+// of the size of the bottom level.
+func (p *compactionPickerTiered) sizeAmplificationExceeded(runs []sortedRun) bool {
+	oldest := runs[len(runs)-1]
+	if oldest.level != numLevels-1 {
+		return false
+	}
+	var newer uint64
+	for _, r := range runs[:len(runs)-1] {
+		newer += r.size
+	}
+	return newer*100 > uint64(p.opts.TieredCompaction.MaxSizeAmplificationPercent)*oldest.size
+}
+
+// sizeRatioWidth returns the number of the newest sorted runs whose sizes are
+// similar: each run is at most TieredCompactionOptions.SizeRatio percent
+// larger than the total size of the newer runs.
+func (p *compactionPickerTiered) sizeRatioWidth(runs []sortedRun) int {
+	ratio := uint64(100 + p.opts.TieredCompaction.SizeRatio)
+	accumulated := runs[0].size
+	n := 1
+	for ; n < len(runs); n++ {
+		if runs[n].size*100 > accumulated*ratio {
+			break
+		}
+		accumulated += runs[n].size
+	}
+	return n
+}
+
+// newCompaction returns a compaction merging the sorted runs, which are a
+// prefix of the sorted runs returned by sortedRuns. If bottom is true, the
+// runs include the oldest sorted run, and the output is written to the
+// bottom level. Otherwise, the runs are L0 tables, and the output is written
+// to a single L0 table.
+func (p *compactionPickerTiered) newCompaction(
+	env compactionEnv, runs []sortedRun, bottom bool,
+) *compaction {
+	var l0Count int
+	for _, r := range runs {
+		if r.level == 0 {
+			l0Count++
+		}
+	}
+	// The L0 tables of the runs are contiguous in sequence number order.
+	end := 0
+	if l0Count > 0 {
+		end = len(p.vers.Files[0])
+		for end > 0 && p.vers.Files[0][end-1] != runs[0].files[0] {
+			end--
+		}
+	}
+	l0Files := p.vers.Files[0][end-l0Count : end]
+
+	if !bottom {
+		c := newCompaction(p.opts, p.vers, 0, 0, env.bytesCompacted)
+		c.inputs[0] = l0Files
+		c.smallest, c.largest = manifest.KeyRange(c.cmp, c.inputs[0], nil)
+		c.setupInuseKeyRanges()
+		// A sorted run in L0 is a single table.
+		c.maxOutputFileSize = math.MaxUint64
+		c.maxOverlapBytes = math.MaxUint64
+		c.maxExpandedBytes = math.MaxUint64
+		return c
+	}
+
+	c := newCompaction(p.opts, p.vers, 0, numLevels-1, env.bytesCompacted)
+	c.inputs[0] = l0Files
+	c.smallest, c.largest = manifest.KeyRange(c.cmp, c.inputs[0], nil)
+	c.inputs[1] = p.vers.Overlaps(numLevels-1, c.cmp, c.smallest.UserKey, c.largest.UserKey)
+	c.inputs[1] = c.expandInputs(numLevels-1, c.inputs[1])
+	c.smallest, c.largest = manifest.KeyRange(c.cmp, c.inputs[0], c.inputs[1])
+	c.setupInuseKeyRanges()
+	c.maxOverlapBytes = math.MaxUint64
+	c.maxExpandedBytes = math.MaxUint64
+	return c
+}
+
+// pickMigration picks a compaction which moves the data in the levels
+// between L0 and the bottom level, left behind by CompactionStyleLeveled,
+// towards the bottom level a table at a time. L0 is compacted into the first
+// of these levels if the number of its sublevels reaches the compaction
+// threshold, to avoid stalling writes until the migration completes.
+func (p *compactionPickerTiered) pickMigration(env compactionEnv) *compaction {
+	sublevels := p.vers.L0Sublevels(p.opts.Comparer.Compare)
+	info := pickedCompactionInfo{level: p.baseLevel, outputLevel: p.baseLevel + 1}
+	if len(sublevels.Levels) >= p.opts.L0CompactionThreshold {
+		info = pickedCompactionInfo{level: 0, outputLevel: p.baseLevel}
+	}
+	c := pickAutoHelper(env, p.opts, p.vers, info, p.baseLevel)
+	if c == nil || inputAlreadyCompacting(c) {
+		return nil
+	}
+	return c
+}
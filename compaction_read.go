@@ -0,0 +1,185 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// maxReadCompactions is the maximum number of read-triggered compactions
+// which may be queued. Further tables whose allowed seeks are exhausted are
+// dropped until the queued compactions have been picked.
+const maxReadCompactions = 16
+
+// readCompaction records a table whose allowed seeks were exhausted by the
+// sampled reads of iterators. See Options.ReadCompactionRate.
+type readCompaction struct {
+	level   int
+	fileNum FileNum
+}
+
+// readCompactionQueue is a bounded FIFO queue of read-triggered compactions.
+// Protected by DB.mu.
+type readCompactionQueue struct {
+	queue []readCompaction
+}
+
+// add queues the read-triggered compaction rc, unless the table is already
+// queued or the queue is full. Returns true if rc was queued.
+func (q *readCompactionQueue) add(rc readCompaction) bool {
+	if len(q.queue) >= maxReadCompactions {
+		return false
+	}
+	for i := range q.queue {
+		if q.queue[i].fileNum == rc.fileNum {
+			return false
+		}
+	}
+	q.queue = append(q.queue, rc)
+	return true
+}
+
+// remove removes and returns the oldest queued read-triggered compaction.
+// The queue must not be empty.
+func (q *readCompactionQueue) remove() readCompaction {
+	rc := q.queue[0]
+	q.queue = q.queue[1:]
+	return rc
+}
+
+func (q *readCompactionQueue) empty() bool {
+	return q == nil || len(q.queue) == 0
+}
+
+// pickReadTriggeredCompaction picks a compaction of the table of the oldest
+// queued read-triggered compaction into the next level. Entries whose tables
+// are no longer in the level they were queued for, or which are already
+// being compacted, are discarded. Returns nil if there is no such compaction.
+func pickReadTriggeredCompaction(
+	env compactionEnv, opts *Options, vers *version, baseLevel int,
+) *compaction {
+	for !env.readCompactions.empty() {
+		rc := env.readCompactions.remove()
+		if rc.level >= numLevels-1 {
+			continue
+		}
+		file := -1
+		for i, f := range vers.Files[rc.level] {
+			if f.FileNum == rc.fileNum {
+				file = i
+				break
+			}
+		}
+		if file == -1 || vers.Files[rc.level][file].Compacting {
+			continue
+		}
+		outputLevel := rc.level + 1
+		if rc.level == 0 {
+			outputLevel = baseLevel
+		}
+		info := pickedCompactionInfo{level: rc.level, outputLevel: outputLevel, file: file}
+		c := pickAutoHelper(env, opts, vers, info, baseLevel)
+		// Fail-safe to protect against compacting the same sstable concurrently.
+		if c != nil && !inputAlreadyCompacting(c) {
+			c.readTriggered = true
+			return c
+		}
+	}
+	return nil
+}
+
+// readSampling is the state of the sampling of the keys read by an Iterator
+// for read-triggered compactions. See Options.ReadSamplingMultiplier.
+type readSampling struct {
+	// period is the average number of bytes read between samples. Sampling is
+	// disabled if period is zero.
+	period int64
+	// bytesUntilSample is the number of bytes which remain to be read before
+	// the next read is sampled.
+	bytesUntilSample int64
+}
+
+func (s *readSampling) init(multiplier int64) {
+	if multiplier <= 0 {
+		*s = readSampling{}
+		return
+	}
+	s.period = multiplier << 20
+	s.bytesUntilSample = s.randomPeriod()
+}
+
+// randomPeriod returns the number of bytes to read before the next sample,
+// chosen uniformly so that samples are taken once per period on average.
+func (s *readSampling) randomPeriod() int64 {
+	return rand.Int63n(2 * s.period)
+}
+
+// maybeSampleRead charges the key and value at the iterator's position to the
+// read sampling budget, and samples the read once the budget is exhausted.
+// It returns valid, so that it may wrap the result of the positioning
+// methods.
+func (i *Iterator) maybeSampleRead(valid bool) bool {
+	if !valid || i.readSampling.period == 0 {
+		return valid
+	}
+	i.readSampling.bytesUntilSample -= int64(len(i.key) + len(i.value))
+	if i.readSampling.bytesUntilSample > 0 {
+		return valid
+	}
+	i.readSampling.bytesUntilSample += i.readSampling.randomPeriod()
+	i.sampleRead()
+	return valid
+}
+
+// sampleRead records a sampled read of the key at the iterator's position.
+// If the key lies within the bounds of more than one table, a read of the
+// key may have to examine each of them, and the table in the highest level
+// of the LSM is charged for the read. A table whose allowed seeks are
+// exhausted is queued for a read-triggered compaction, which reduces the
+// number of tables future reads of its keys need to examine.
+func (i *Iterator) sampleRead() {
+	if i.readState == nil || i.readState.db == nil {
+		return
+	}
+	d := i.readState.db
+	v := i.readState.current
+	key := i.key
+
+	var topFile *fileMetadata
+	var topLevel, numOverlaps int
+	// The L0 tables are sorted by sequence number, so the newest table
+	// containing the key is found first when they are examined in reverse.
+	for j := len(v.Files[0]) - 1; j >= 0; j-- {
+		f := v.Files[0][j]
+		if d.cmp(f.Smallest.UserKey, key) <= 0 && d.cmp(key, f.Largest.UserKey) <= 0 {
+			if topFile == nil {
+				topFile, topLevel = f, 0
+			}
+			numOverlaps++
+		}
+	}
+	for level := 1; level < numLevels; level++ {
+		files := v.Overlaps(level, d.cmp, key, key)
+		if len(files) == 0 {
+			continue
+		}
+		if topFile == nil {
+			topFile, topLevel = files[0], level
+		}
+		numOverlaps++
+	}
+	if numOverlaps < 2 {
+		return
+	}
+	if atomic.AddInt64(&topFile.AllowedSeeks, -1) != 0 {
+		return
+	}
+	d.mu.Lock()
+	if d.mu.compact.readCompactions.add(readCompaction{level: topLevel, fileNum: topFile.FileNum}) {
+		d.maybeScheduleCompaction()
+	}
+	d.mu.Unlock()
+}
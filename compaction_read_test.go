@@ -0,0 +1,99 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCompactionQueue(t *testing.T) {
+	var q readCompactionQueue
+	require.True(t, q.empty())
+	require.True(t, q.add(readCompaction{level: 0, fileNum: 1}))
+	// A table is only queued once.
+	require.False(t, q.add(readCompaction{level: 0, fileNum: 1}))
+	for i := 2; i <= maxReadCompactions; i++ {
+		require.True(t, q.add(readCompaction{level: 1, fileNum: FileNum(i)}))
+	}
+	// The queue is bounded.
+	require.False(t, q.add(readCompaction{level: 1, fileNum: maxReadCompactions + 1}))
+
+	for i := 1; i <= maxReadCompactions; i++ {
+		require.False(t, q.empty())
+		require.Equal(t, FileNum(i), q.remove().fileNum)
+	}
+	require.True(t, q.empty())
+}
+
+func TestReadTriggeredCompaction(t *testing.T) {
+	var mu sync.Mutex
+	var reads []CompactionInfo
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+		EventListener: EventListener{
+			CompactionEnd: func(info CompactionInfo) {
+				if info.Reason == "read" {
+					mu.Lock()
+					reads = append(reads, info)
+					mu.Unlock()
+				}
+			},
+		},
+		disableTableStats: true,
+	})
+	require.NoError(t, err)
+
+	// Write the keys to L6, and then overwrite them in a table in L0, so that
+	// a read of any of the keys overlaps both tables.
+	for _, v := range []string{"1", "2"} {
+		for c := 'a'; c <= 'z'; c++ {
+			require.NoError(t, d.Set([]byte{byte(c)}, []byte(v), nil))
+		}
+		require.NoError(t, d.Flush())
+		if v == "1" {
+			require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+		}
+	}
+	lsm := func() string {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.mu.versions.currentVersion().String()
+	}
+	require.Equal(t, "0:\n  000007:[a-z]\n6:\n  000005:[a-z]\n", lsm())
+
+	// Sample every read, exhausting the allowed seeks of the L0 table.
+	iter := d.NewIter(nil)
+	iter.readSampling = readSampling{period: 1}
+	for i := 0; i < 10; i++ {
+		n := 0
+		for valid := iter.First(); valid; valid = iter.Next() {
+			require.Equal(t, "2", string(iter.Value()))
+			n++
+		}
+		require.Equal(t, 26, n)
+	}
+	require.NoError(t, iter.Close())
+
+	d.mu.Lock()
+	for d.mu.compact.compactingCount > 0 {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+
+	mu.Lock()
+	require.Equal(t, 1, len(reads))
+	info := reads[0]
+	mu.Unlock()
+	require.Equal(t, 0, info.Input.Level)
+	require.Equal(t, 6, info.Output.Level)
+	require.Equal(t, "000007", formatFileNums(info.Input.Tables[0]))
+	require.Equal(t, int64(1), d.Metrics().Compact.ReadCount)
+	require.Equal(t, "6:\n  000008:[a-z]\n", lsm())
+	require.NoError(t, d.Close())
+}
@@ -12,6 +12,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,6 +21,7 @@ import (
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/datadriven"
 	"github.com/cockroachdb/pebble/internal/manifest"
+	"github.com/cockroachdb/pebble/internal/record"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/stretchr/testify/require"
@@ -861,12 +864,15 @@ func TestCompaction(t *testing.T) {
 		{"+D", "D", "Aa.BC.Bb."},
 		{"-a", "Da", "Aa.BC.Bb."},
 		{"+d", "Dad", "Aa.BC.Bb."},
-		// The next addition creates the fourth level-0 table, and l0CompactionTrigger == 4,
+		// The next addition creates the fourth level-0 table. The table does not
+		// overlap the BC table, so the two share a sublevel and there are only
+		// three sublevels.
+		{"+E", "E", "Aa.BC.Bb.Dad."},
+		{"+e", "Ee", "Aa.BC.Bb.Dad."},
+		// The next addition creates a fourth sublevel, and l0CompactionTrigger == 4,
 		// so this triggers a non-trivial compaction into one level-1 table. Note that the
-		// keys in this one larger table are interleaved from the four smaller ones.
-		{"+E", "E", "ABCDbd."},
-		{"+e", "Ee", "ABCDbd."},
-		{"+F", "F", "ABCDbd.Ee."},
+		// keys in this one larger table are interleaved from the five smaller ones.
+		{"+F", "F", "ABCDEbde."},
 	}
 	for _, tc := range testCases {
 		if key := tc.key[1:]; tc.key[0] == '+' {
@@ -935,6 +941,8 @@ func TestManualCompaction(t *testing.T) {
 		d, err = Open("", &Options{
 			FS:         mem,
 			DebugCheck: DebugCheckLevels,
+
+			disableDeleteOnlyCompactions: true,
 		})
 		require.NoError(t, err)
 	}
@@ -976,7 +984,8 @@ func TestManualCompaction(t *testing.T) {
 			}
 
 			var err error
-			if d, err = runDBDefineCmd(td, nil /* options */); err != nil {
+			opts := &Options{disableDeleteOnlyCompactions: true}
+			if d, err = runDBDefineCmd(td, opts); err != nil {
 				return err.Error()
 			}
 			mem = d.opts.FS
@@ -1747,6 +1756,64 @@ func TestFlushInvariant(t *testing.T) {
 	}
 }
 
+func TestFlushSplit(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{
+		FS:              mem,
+		DebugCheck:      DebugCheckLevels,
+		FlushSplitBytes: 1,
+	})
+	require.NoError(t, err)
+
+	// Create two tables in the base level.
+	for _, k := range []string{"b", "m"} {
+		require.NoError(t, d.Set([]byte(k), nil, nil))
+		require.NoError(t, d.Compact([]byte(k), []byte(k)))
+	}
+	d.mu.Lock()
+	v := d.mu.versions.currentVersion()
+	baseLevel := d.mu.versions.picker.getBaseLevel()
+	require.Equal(t, 2, len(v.Files[baseLevel]))
+	d.mu.Unlock()
+
+	// The flushed keys are split at the boundaries of the base level tables,
+	// and the resulting L0 tables form a single sublevel. The range deletion
+	// straddles the tables.
+	require.NoError(t, d.DeleteRange([]byte("d"), []byte("p"), nil))
+	for _, k := range []string{"a", "c", "n", "z"} {
+		require.NoError(t, d.Set([]byte(k), []byte(k), nil))
+	}
+	require.NoError(t, d.Flush())
+	d.mu.Lock()
+	v = d.mu.versions.currentVersion()
+	require.Equal(t, 3, len(v.Files[0]))
+	require.Equal(t, 1, len(v.L0Sublevels(d.cmp).Levels))
+	d.mu.Unlock()
+
+	check := func() {
+		for _, k := range []string{"a", "c", "n", "z"} {
+			val, closer, err := d.Get([]byte(k))
+			require.NoError(t, err)
+			require.Equal(t, k, string(val))
+			require.NoError(t, closer.Close())
+		}
+		_, _, err := d.Get([]byte("m"))
+		require.Equal(t, ErrNotFound, err)
+	}
+	check()
+
+	// Compact L0 in pieces, verifying the range deletion continues to apply to
+	// the keys of each table.
+	for _, k := range []string{"c", "z", "a"} {
+		require.NoError(t, d.Compact([]byte(k), []byte(k)))
+		check()
+	}
+	d.mu.Lock()
+	require.Equal(t, 0, len(d.mu.versions.currentVersion().Files[0]))
+	d.mu.Unlock()
+	require.NoError(t, d.Close())
+}
+
 func TestCompactFlushQueuedMemTable(t *testing.T) {
 	// Verify that manual compaction forces a flush of a queued memtable.
 
@@ -1789,13 +1856,463 @@ func TestCompactFlushQueuedLargeBatch(t *testing.T) {
 	// size in order to more easily create a situation where a large batch is
 	// queued but not automatically flushed.
 	d.mu.Lock()
-	d.largeBatchThreshold = d.opts.MemTableSize / 8
+	d.largeBatchThreshold = int64(d.opts.MemTableSize / 8)
 	d.mu.Unlock()
 
 	// Set a record with a large value. This will be transformed into a large
 	// batch and placed in the flushable queue.
-	require.NoError(t, d.Set([]byte("a"), bytes.Repeat([]byte("v"), d.largeBatchThreshold), nil))
+	require.NoError(t, d.Set([]byte("a"), bytes.Repeat([]byte("v"), int(d.largeBatchThreshold)), nil))
 
 	require.NoError(t, d.Compact([]byte("a"), []byte("a")))
 	require.NoError(t, d.Close())
 }
+
+func TestCompactionFilter(t *testing.T) {
+	var ctxs []CompactionFilterContext
+	var infos []CompactionInfo
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+		CompactionFilter: func(ctx CompactionFilterContext) CompactionFilter {
+			ctxs = append(ctxs, ctx)
+			return valueCompactionFilter{}
+		},
+		EventListener: EventListener{
+			CompactionEnd: func(info CompactionInfo) {
+				infos = append(infos, info)
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// Write two overlapping tables so that the compaction is not a move.
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Set([]byte("c"), []byte("1"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Set([]byte("a"), []byte("rm"), nil))
+	require.NoError(t, d.Set([]byte("b"), []byte("chg"), nil))
+	require.NoError(t, d.Set([]byte("c"), []byte("keep"), nil))
+	// Flushes are not filtered.
+	require.NoError(t, d.Flush())
+	require.Equal(t, 0, len(ctxs))
+
+	require.NoError(t, d.Compact([]byte("a"), []byte("d")))
+	require.Equal(t, []CompactionFilterContext{{StartLevel: 0, OutputLevel: 6}}, ctxs)
+	require.Equal(t, 1, len(infos))
+	require.Equal(t, CompactionFilterInfo{
+		Name:        "value-filter",
+		KeysRemoved: 1,
+		KeysChanged: 1,
+	}, infos[0].Filter)
+
+	expected := map[string]string{"b": "changed", "c": "keep"}
+	iter := d.NewIter(nil)
+	actual := make(map[string]string)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		actual[string(iter.Key())] = string(iter.Value())
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, expected, actual)
+	require.NoError(t, d.Close())
+}
+
+func TestMultiLevelCompaction(t *testing.T) {
+	var d *DB
+	defer func() {
+		if d != nil {
+			require.NoError(t, d.Close())
+		}
+	}()
+
+	datadriven.RunTest(t, "testdata/multi_level_compaction", func(td *datadriven.TestData) string {
+		switch td.Cmd {
+		case "define":
+			if d != nil {
+				if err := d.Close(); err != nil {
+					return err.Error()
+				}
+			}
+			opts := &Options{MultiLevelCompactions: true}
+			// The remaining arguments are handled by runDBDefineCmd.
+			var args []datadriven.CmdArg
+			for _, arg := range td.CmdArgs {
+				switch arg.Key {
+				case "multi-level":
+					var err error
+					opts.MultiLevelCompactions, err = strconv.ParseBool(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+				case "max-subcompactions":
+					var err error
+					opts.MaxSubcompactions, err = strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+				default:
+					args = append(args, arg)
+				}
+			}
+			td.CmdArgs = args
+
+			var err error
+			if d, err = runDBDefineCmd(td, opts); err != nil {
+				return err.Error()
+			}
+			d.mu.Lock()
+			s := d.mu.versions.currentVersion().String()
+			d.mu.Unlock()
+			return s
+
+		case "compact":
+			// Run the compaction picked for the first table of the specified
+			// level.
+			if len(td.CmdArgs) != 1 {
+				return fmt.Sprintf("%s expects 1 argument", td.Cmd)
+			}
+			level, err := strconv.Atoi(td.CmdArgs[0].String())
+			if err != nil {
+				return err.Error()
+			}
+
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			env := compactionEnv{
+				bytesCompacted:          &d.bytesCompacted,
+				earliestUnflushedSeqNum: d.getEarliestUnflushedSeqNumLocked(),
+			}
+			info := pickedCompactionInfo{level: level, outputLevel: level + 1}
+			c := pickAutoHelper(env, d.opts, d.mu.versions.currentVersion(), info,
+				d.mu.versions.picker.getBaseLevel())
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "L%d", c.startLevel)
+			if c.extraLevel != 0 {
+				fmt.Fprintf(&buf, " + L%d", c.extraLevel)
+			}
+			fmt.Fprintf(&buf, " -> L%d\n", c.outputLevel)
+
+			d.addInProgressCompaction(c)
+			if err := d.compact1(c, nil); err != nil {
+				return err.Error()
+			}
+			// The tables from the start level and the intermediate level are
+			// both incoming bytes of the output level.
+			require.Equal(t, totalSize(c.inputs[0])+totalSize(c.inputs[2]),
+				c.metrics[c.outputLevel].BytesIn)
+			if n := len(c.subcompactions); n > 0 {
+				fmt.Fprintf(&buf, "%d subcompactions\n", n)
+			}
+			buf.WriteString(d.mu.versions.currentVersion().String())
+			return buf.String()
+
+		case "iter":
+			snap := Snapshot{
+				db:     d,
+				seqNum: InternalKeySeqNumMax,
+			}
+			iter := snap.NewIter(nil)
+			defer iter.Close()
+			return runIterCmd(td, iter)
+
+		default:
+			return fmt.Sprintf("unknown command: %s", td.Cmd)
+		}
+	})
+}
+
+func TestCompactionStyles(t *testing.T) {
+	waitForCompactions := func(d *DB) {
+		d.mu.Lock()
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+		d.mu.Unlock()
+	}
+
+	t.Run("tiered", func(t *testing.T) {
+		d, err := Open("", &Options{
+			FS:              vfs.NewMem(),
+			CompactionStyle: CompactionStyleTiered,
+		})
+		require.NoError(t, err)
+		for i := 0; i < 20; i++ {
+			for c := 'a'; c <= 'z'; c++ {
+				require.NoError(t, d.Set([]byte{byte(c)}, []byte(strconv.Itoa(i)), nil))
+			}
+			require.NoError(t, d.Flush())
+		}
+		waitForCompactions(d)
+
+		// The sorted runs are kept in L0 and the bottom level.
+		m := d.Metrics()
+		for level := 1; level < numLevels-1; level++ {
+			require.Equal(t, int64(0), m.Levels[level].NumFiles)
+		}
+		require.True(t, m.Levels[0].NumFiles < int64(d.opts.L0CompactionThreshold))
+		require.True(t, m.Compact.Count > 0)
+
+		iter := d.NewIter(nil)
+		n := 0
+		for valid := iter.First(); valid; valid = iter.Next() {
+			require.Equal(t, "19", string(iter.Value()))
+			n++
+		}
+		require.Equal(t, 26, n)
+		require.NoError(t, iter.Close())
+		require.NoError(t, d.Close())
+	})
+
+	t.Run("fifo", func(t *testing.T) {
+		const maxSize = 16 << 10
+		d, err := Open("", &Options{
+			FS:              vfs.NewMem(),
+			CompactionStyle: CompactionStyleFIFO,
+			FIFOCompaction:  FIFOCompactionOptions{MaxTableFilesSize: maxSize},
+		})
+		require.NoError(t, err)
+		value := bytes.Repeat([]byte("x"), 100)
+		for i := 0; i < 50; i++ {
+			for j := 0; j < 10; j++ {
+				require.NoError(t, d.Set([]byte(fmt.Sprintf("%02d-%d", i, j)), value, nil))
+			}
+			require.NoError(t, d.Flush())
+		}
+		waitForCompactions(d)
+
+		// The oldest tables are dropped, and the tables are never compacted
+		// beneath L0.
+		m := d.Metrics()
+		for level := 1; level < numLevels; level++ {
+			require.Equal(t, int64(0), m.Levels[level].NumFiles)
+		}
+		require.True(t, m.Levels[0].Size <= maxSize)
+
+		_, _, err = d.Get([]byte("00-0"))
+		require.Equal(t, ErrNotFound, err)
+		v, closer, err := d.Get([]byte("49-9"))
+		require.NoError(t, err)
+		require.Equal(t, value, v)
+		require.NoError(t, closer.Close())
+		require.NoError(t, d.Close())
+	})
+}
+
+func TestMarkForCompaction(t *testing.T) {
+	var mu sync.Mutex
+	var reasons []string
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{
+		FS: mem,
+		EventListener: EventListener{
+			CompactionEnd: func(info CompactionInfo) {
+				mu.Lock()
+				reasons = append(reasons, fmt.Sprintf("%s: L%d -> L%d",
+					info.Reason, info.Input.Level, info.Output.Level))
+				mu.Unlock()
+			},
+		},
+		disableTableStats: true,
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+
+	lsm := func() string {
+		d.mu.Lock()
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+		defer d.mu.Unlock()
+		return d.mu.versions.currentVersion().String()
+	}
+	compactions := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		r := reasons
+		reasons = nil
+		return r
+	}
+
+	for c := 'a'; c <= 'z'; c++ {
+		require.NoError(t, d.Set([]byte{byte(c)}, []byte("1"), nil))
+	}
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	require.NoError(t, d.Set([]byte("m"), []byte("2"), nil))
+	require.NoError(t, d.Flush())
+	require.Equal(t, "0:\n  000007:[m-m]\n6:\n  000005:[a-z]\n", lsm())
+	compactions()
+
+	// Marking a range which no table overlaps does not write to the MANIFEST.
+	d.mu.Lock()
+	manifestFileNum := d.mu.versions.manifestFileNum
+	d.mu.Unlock()
+	require.NoError(t, d.MarkForCompaction([]byte("0"), []byte("1")))
+	require.Equal(t, "0:\n  000007:[m-m]\n6:\n  000005:[a-z]\n", lsm())
+	d.mu.Lock()
+	require.Equal(t, manifestFileNum, d.mu.versions.manifestFileNum)
+	d.mu.Unlock()
+
+	// A marked table in L0 is compacted into the next level. The table in L6
+	// is marked as well, and is an input of the same compaction.
+	require.NoError(t, d.MarkForCompaction([]byte("m"), []byte("m")))
+	require.Equal(t, "6:\n  000009:[a-z]\n", lsm())
+	require.Equal(t, []string{"marked: L0 -> L6"}, compactions())
+
+	// The marks are recorded by the snapshot at the start of the new MANIFEST.
+	d.mu.Lock()
+	require.NotEqual(t, manifestFileNum, d.mu.versions.manifestFileNum)
+	manifestFileNum = d.mu.versions.manifestFileNum
+	d.mu.Unlock()
+	f, err := mem.Open(base.MakeFilename(mem, "", fileTypeManifest, manifestFileNum))
+	require.NoError(t, err)
+	r, err := record.NewReader(f, 0 /* logNum */).Next()
+	require.NoError(t, err)
+	var ve versionEdit
+	require.NoError(t, ve.Decode(r))
+	require.NoError(t, f.Close())
+	marked := make(map[FileNum]bool)
+	for _, nf := range ve.NewFiles {
+		marked[nf.Meta.FileNum] = nf.Meta.MarkedForCompaction
+	}
+	require.Equal(t, map[FileNum]bool{5: true, 7: true}, marked)
+
+	// A marked table in the bottom level is rewritten in place.
+	require.NoError(t, d.MarkForCompaction([]byte("a"), []byte("b")))
+	require.Equal(t, "6:\n  000011:[a-z]\n", lsm())
+	require.Equal(t, []string{"marked: L6 -> L6"}, compactions())
+
+	iter := d.NewIter(nil)
+	n := 0
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if string(iter.Key()) == "m" {
+			require.Equal(t, "2", string(iter.Value()))
+		} else {
+			require.Equal(t, "1", string(iter.Value()))
+		}
+		n++
+	}
+	require.Equal(t, 26, n)
+	require.NoError(t, iter.Close())
+}
+
+func TestPeriodicCompaction(t *testing.T) {
+	var mu sync.Mutex
+	var reasons []string
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+		EventListener: EventListener{
+			CompactionEnd: func(info CompactionInfo) {
+				mu.Lock()
+				reasons = append(reasons, fmt.Sprintf("%s: L%d -> L%d",
+					info.Reason, info.Input.Level, info.Output.Level))
+				mu.Unlock()
+			},
+		},
+		PeriodicCompactionSeconds: 100,
+		disableTableStats:         true,
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+	now := int64(1000)
+	d.timeNow = func() time.Time {
+		return time.Unix(atomic.LoadInt64(&now), 0)
+	}
+
+	// advance advances the clock by the specified number of seconds, and
+	// returns the compactions which were scheduled as a result.
+	advance := func(secs int64) []string {
+		atomic.AddInt64(&now, secs)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.maybeScheduleCompaction()
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		r := reasons
+		reasons = nil
+		return r
+	}
+
+	for c := 'a'; c <= 'z'; c++ {
+		require.NoError(t, d.Set([]byte{byte(c)}, []byte("1"), nil))
+	}
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	require.Equal(t, []string{": L0 -> L6"}, advance(0))
+
+	require.Equal(t, []string(nil), advance(99))
+	require.Equal(t, []string{"periodic: L6 -> L6"}, advance(1))
+	// The rewritten table is created at the current time.
+	require.Equal(t, []string(nil), advance(99))
+	require.Equal(t, []string{"periodic: L6 -> L6"}, advance(1))
+	require.Equal(t, int64(3), d.Metrics().Compact.Count)
+}
+
+func TestFIFOCompactionTTL(t *testing.T) {
+	var mu sync.Mutex
+	var reasons []string
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+		EventListener: EventListener{
+			CompactionEnd: func(info CompactionInfo) {
+				mu.Lock()
+				reasons = append(reasons, fmt.Sprintf("%s: L%d -> L%d",
+					info.Reason, info.Input.Level, info.Output.Level))
+				mu.Unlock()
+			},
+		},
+		CompactionStyle:       CompactionStyleFIFO,
+		FIFOCompaction:        FIFOCompactionOptions{TTL: 100 * time.Second},
+		L0CompactionThreshold: 4,
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+	now := int64(1000)
+	d.timeNow = func() time.Time {
+		return time.Unix(atomic.LoadInt64(&now), 0)
+	}
+
+	// advance advances the clock by the specified number of seconds, and
+	// returns the compactions which were scheduled as a result.
+	advance := func(secs int64) []string {
+		atomic.AddInt64(&now, secs)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.maybeScheduleCompaction()
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		r := reasons
+		reasons = nil
+		return r
+	}
+
+	// Four overlapping tables are compacted into one by an intra-L0
+	// compaction, which runs after the last of them is flushed.
+	for i := 0; i < 4; i++ {
+		if i == 3 {
+			atomic.AddInt64(&now, 50)
+		}
+		for c := 'a'; c <= 'z'; c++ {
+			require.NoError(t, d.Set([]byte{byte(c)}, []byte(fmt.Sprint(i)), nil))
+		}
+		require.NoError(t, d.Flush())
+	}
+	require.Equal(t, []string{": L0 -> L0"}, advance(0))
+	require.Equal(t, int64(1), d.Metrics().Levels[0].NumFiles)
+
+	// The output of the intra-L0 compaction expires along with the oldest of
+	// its inputs.
+	require.Equal(t, []string(nil), advance(49))
+	require.Equal(t, []string{"fifo: L0 -> L0"}, advance(1))
+	require.Equal(t, int64(0), d.Metrics().Levels[0].NumFiles)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/cockroachdb/pebble/internal/rangekey"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 )
@@ -117,7 +118,18 @@ func runIterCmd(d *datadriven.TestData, iter *Iterator) string {
 		} else if valid != iter.Valid() {
 			fmt.Fprintf(&b, "mismatched valid states: %t vs %t\n", valid, iter.Valid())
 		} else if valid {
-			fmt.Fprintf(&b, "%s:%s\n", iter.Key(), iter.Value())
+			fmt.Fprintf(&b, "%s:%s", iter.Key(), iter.Value())
+			if _, hasRange := iter.HasPointAndRange(); hasRange {
+				start, end := iter.RangeBounds()
+				fmt.Fprintf(&b, " [%s-%s)", start, end)
+				for i, r := range iter.RangeKeys() {
+					if i > 0 {
+						b.WriteString(",")
+					}
+					fmt.Fprintf(&b, " %s=%s", r.Suffix, r.Value)
+				}
+			}
+			b.WriteString("\n")
 		} else {
 			fmt.Fprintf(&b, ".\n")
 		}
@@ -239,6 +251,21 @@ func runBatchDefineCmd(d *datadriven.TestData, b *Batch) error {
 				return errors.Errorf("%s expects 2 arguments", parts[0])
 			}
 			err = b.Merge([]byte(parts[1]), []byte(parts[2]), nil)
+		case "range-key-set":
+			if len(parts) != 5 {
+				return errors.Errorf("%s expects 4 arguments", parts[0])
+			}
+			err = b.RangeKeySet([]byte(parts[1]), []byte(parts[2]), []byte(parts[3]), []byte(parts[4]), nil)
+		case "range-key-unset":
+			if len(parts) != 4 {
+				return errors.Errorf("%s expects 3 arguments", parts[0])
+			}
+			err = b.RangeKeyUnset([]byte(parts[1]), []byte(parts[2]), []byte(parts[3]), nil)
+		case "range-key-del":
+			if len(parts) != 3 {
+				return errors.Errorf("%s expects 2 arguments", parts[0])
+			}
+			err = b.RangeKeyDelete([]byte(parts[1]), []byte(parts[2]), nil)
 		default:
 			return errors.Errorf("unknown op: %s", parts[0])
 		}
@@ -284,6 +311,22 @@ func runBuildCmd(td *datadriven.TestData, d *DB, fs vfs.FS) error {
 			return err
 		}
 	}
+	// The range keys in an sstable must be fragmented.
+	if iter := b.newRangeKeyIter(nil); iter != nil {
+		spans, err := rangekey.Collect(nil, iter)
+		if err != nil {
+			return err
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		for _, s := range rangekey.Fragment(d.cmp, spans) {
+			s.Start.SetSeqNum(0)
+			if err := w.Add(s.Start, s.EncodedValue()); err != nil {
+				return err
+			}
+		}
+	}
 	return w.Close()
 }
 
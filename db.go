@@ -29,6 +29,11 @@ const (
 	// numNonTableCacheFiles is an approximation for the number of MaxOpenFiles
 	// that we don't use for table caches.
 	numNonTableCacheFiles = 10
+
+	// blobFileCacheFraction is the fraction of the table cache's share of
+	// MaxOpenFiles which is used for open blob files. A blob file is typically
+	// referenced by many tables, so fewer blob files than tables are open.
+	blobFileCacheFraction = 8
 )
 
 var (
@@ -41,6 +46,15 @@ var (
 	// ErrReadOnly is returned when a write operation is performed on a read-only
 	// database.
 	ErrReadOnly = errors.New("pebble: read-only")
+	// ErrFollower is returned when a write operation other than ApplyAtSeqNum
+	// is performed on a follower database. See Options.Follower.
+	ErrFollower = errors.New("pebble: follower")
+	// ErrNotFollower is returned when ApplyAtSeqNum is called on a database
+	// which is not a follower.
+	ErrNotFollower = errors.New("pebble: not a follower")
+	// ErrOutOfOrderSeqNum is returned by ApplyAtSeqNum when the sequence number
+	// of a batch is not the next sequence number of the database.
+	ErrOutOfOrderSeqNum = errors.New("pebble: batch sequence number out of order")
 )
 
 // Reader is a readable key/value store.
@@ -124,6 +138,27 @@ type Writer interface {
 	// It is safe to modify the contents of the arguments after Merge returns.
 	Merge(key, value []byte, o *WriteOptions) error
 
+	// RangeKeySet sets the range key with the specified suffix to value over
+	// the key span [start,end).
+	//
+	// It is safe to modify the contents of the arguments after RangeKeySet
+	// returns.
+	RangeKeySet(start, end, suffix, value []byte, o *WriteOptions) error
+
+	// RangeKeyUnset removes the range key with the specified suffix over the
+	// key span [start,end).
+	//
+	// It is safe to modify the contents of the arguments after RangeKeyUnset
+	// returns.
+	RangeKeyUnset(start, end, suffix []byte, o *WriteOptions) error
+
+	// RangeKeyDelete removes all of the range keys over the key span
+	// [start,end).
+	//
+	// It is safe to modify the contents of the arguments after RangeKeyDelete
+	// returns.
+	RangeKeyDelete(start, end []byte, o *WriteOptions) error
+
 	// Set sets the value for the given key. It overwrites any previous value
 	// for that key; a DB is not a multi-map.
 	//
@@ -168,10 +203,14 @@ type DB struct {
 	split          Split
 	abbreviatedKey AbbreviatedKey
 	// The threshold for determining when a batch is "large" and will skip being
-	// inserted into a memtable.
-	largeBatchThreshold int
+	// inserted into a memtable. Updated atomically, as it is changed by
+	// SetOptions.
+	largeBatchThreshold int64
 	// The current OPTIONS file number.
 	optionsFileNum FileNum
+	// The spans recorded in a span-restricted checkpoint which is being opened
+	// for the first time. Only used during Open.
+	checkpointSpans []CheckpointSpan
 
 	fileLock io.Closer
 	dataDir  vfs.File
@@ -179,8 +218,12 @@ type DB struct {
 
 	tableCache tableCache
 	newIters   tableNewIters
+	blobFiles  blobFileCache
 
 	commit *commitPipeline
+	// txnCommitMu serializes the validation and commit of transactions. See
+	// Txn.Commit.
+	txnCommitMu sync.Mutex
 
 	// readState provides access to the state needed for reading without needing
 	// to acquire DB.mu.
@@ -195,6 +238,17 @@ type DB struct {
 	// updates.
 	logRecycler logRecycler
 
+	// feeds holds the state shared by the open change feeds. The mutex
+	// protects the live batch queues of the feeds, and is ordered after DB.mu.
+	// See ChangeFeed.
+	feeds struct {
+		sync.Mutex
+		cond   sync.Cond
+		closed bool
+		// count is the number of open change feeds. Updated atomically.
+		count int32
+	}
+
 	closed int32 // updated atomically
 
 	// The count and size of referenced memtables. This includes memtables
@@ -256,6 +310,14 @@ type DB struct {
 			// commitPipeline.mu and DB.mu to be held when rotating the WAL/memtable
 			// (i.e. makeRoomForWrite).
 			*record.LogWriter
+			// The obsolete logs which are retained for change feeds, oldest first.
+			// See Options.WALRetentionPeriod.
+			retained []retainedLog
+			// The sequence number below which batches may have been in logs that
+			// were deleted. Change feeds cannot start before this sequence number.
+			discardedSeqNum uint64
+			// The open change feeds.
+			feeds map[*ChangeFeed]struct{}
 		}
 
 		mem struct {
@@ -294,6 +356,12 @@ type DB struct {
 			manual []*manualCompaction
 			// inProgress is the set of in-progress flushes and compactions.
 			inProgress map[*compaction]struct{}
+			// deletionHints holds the hints for the range tombstones written by
+			// flushes and compactions, used to pick delete-only compactions.
+			deletionHints []deleteCompactionHint
+			// readCompactions holds the tables queued for read-triggered
+			// compactions by the read sampling of iterators.
+			readCompactions readCompactionQueue
 		}
 
 		cleaner struct {
@@ -310,8 +378,37 @@ type DB struct {
 			disabled int
 		}
 
+		tableStats struct {
+			// Condition variable used to signal the completion of a load of table
+			// stats.
+			cond sync.Cond
+			// True when the stats of the tables are being loaded.
+			loading bool
+			// True once the stats of the tables present when the DB was opened
+			// have been loaded.
+			loadedInitial bool
+			// True when tables without stats have been added to the LSM since the
+			// start of the last load. See DB.maybeCollectTableStatsLocked.
+			pending bool
+		}
+
 		// The list of active snapshots.
 		snapshots snapshotList
+
+		excise struct {
+			// The number of excises which have been sequenced by the commit
+			// pipeline, and the number of those which have since been applied (or
+			// have failed). Excises are applied in the order they are sequenced.
+			// Waiters are signaled via compact.cond.
+			sequenced int
+			applied   int
+			// installing is true while an excise which has checked the open
+			// snapshots (see checkExciseSnapshotsLocked) is installing its version
+			// edit and publishing its sequence number. Snapshots are not created
+			// in the meantime, as they would be sequenced before the excise but
+			// would not retain the excised data.
+			installing bool
+		}
 	}
 
 	// Normally equal to time.Now() but may be overridden in tests.
@@ -360,12 +457,13 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, io.Closer,
 	get.logger = d.opts.Logger
 	get.cmp = d.cmp
 	get.equal = d.equal
+	get.split = d.split
 	get.newIters = d.newIters
 	get.snapshot = seqNum
 	get.key = key
 	get.batch = b
 	get.mem = readState.memtables
-	get.l0 = readState.current.Files[0]
+	get.l0 = readState.current.L0Sublevels(d.cmp).Levels
 	get.version = readState.current
 
 	// Strip off memtables which cannot possibly contain the seqNum being read
@@ -385,6 +483,7 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, io.Closer,
 	i.split = d.split
 	i.iter = get
 	i.readState = readState
+	i.blobFiles = &d.blobFiles
 
 	if !i.First() {
 		err := i.Close()
@@ -457,6 +556,56 @@ func (d *DB) DeleteRange(start, end []byte, opts *WriteOptions) error {
 	return nil
 }
 
+// RangeKeySet sets the range key with the specified suffix to value over the
+// key span [start,end). Range keys are stored separately from point keys and
+// are surfaced by iterators configured with IterOptions.KeyTypes. Range keys
+// require the DB to be at FormatRangeKeys or newer.
+//
+// It is safe to modify the contents of the arguments after RangeKeySet
+// returns.
+func (d *DB) RangeKeySet(start, end, suffix, value []byte, opts *WriteOptions) error {
+	b := newBatch(d)
+	_ = b.RangeKeySet(start, end, suffix, value, opts)
+	if err := d.Apply(b, opts); err != nil {
+		return err
+	}
+	// Only release the batch on success.
+	b.release()
+	return nil
+}
+
+// RangeKeyUnset removes the range key with the specified suffix over the key
+// span [start,end).
+//
+// It is safe to modify the contents of the arguments after RangeKeyUnset
+// returns.
+func (d *DB) RangeKeyUnset(start, end, suffix []byte, opts *WriteOptions) error {
+	b := newBatch(d)
+	_ = b.RangeKeyUnset(start, end, suffix, opts)
+	if err := d.Apply(b, opts); err != nil {
+		return err
+	}
+	// Only release the batch on success.
+	b.release()
+	return nil
+}
+
+// RangeKeyDelete removes all of the range keys over the key span
+// [start,end).
+//
+// It is safe to modify the contents of the arguments after RangeKeyDelete
+// returns.
+func (d *DB) RangeKeyDelete(start, end []byte, opts *WriteOptions) error {
+	b := newBatch(d)
+	_ = b.RangeKeyDelete(start, end, opts)
+	if err := d.Apply(b, opts); err != nil {
+		return err
+	}
+	// Only release the batch on success.
+	b.release()
+	return nil
+}
+
 // Merge adds an action to the DB that merges the value at key with the new
 // value. The details of the merge are dependent upon the configured merge
 // operator.
@@ -502,6 +651,54 @@ func (d *DB) Apply(batch *Batch, opts *WriteOptions) error {
 	if d.opts.ReadOnly {
 		return ErrReadOnly
 	}
+	if d.opts.Follower {
+		return ErrFollower
+	}
+	return d.applyInternal(batch, 0 /* seqNum */, opts)
+}
+
+// ApplyAtSeqNum applies the operations contained in the batch to a follower
+// DB, at the sequence number seqNum. The batch is typically a batch committed
+// by the leader DB, which was copied using Batch.Repr and Batch.SetRepr, and
+// seqNum is the sequence number assigned to it by the leader (see
+// Batch.SeqNum). Batches must be applied in sequence number order, without
+// gaps: seqNum must be equal to NextSeqNum, otherwise an error wrapping
+// ErrOutOfOrderSeqNum is returned and the batch is not applied. Note that the
+// leader must not ingest sstables, as ingestions are assigned sequence
+// numbers which are not reflected in its batches.
+//
+// The applied position is persisted along with the batch: when the follower
+// is reopened, NextSeqNum follows the last batch which was applied and
+// recovered. Use a WriteOptions with Sync set to make the position durable
+// when ApplyAtSeqNum returns.
+//
+// It is safe to modify the contents of the arguments after ApplyAtSeqNum
+// returns.
+func (d *DB) ApplyAtSeqNum(batch *Batch, seqNum uint64, opts *WriteOptions) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if !d.opts.Follower {
+		return ErrNotFollower
+	}
+	if seqNum == 0 {
+		// Sequence number 0 is never assigned to a batch.
+		return errors.Wrapf(ErrOutOfOrderSeqNum, "pebble: batch sequence number 0")
+	}
+	return d.applyInternal(batch, seqNum, opts)
+}
+
+// NextSeqNum returns the sequence number which will be assigned to the next
+// batch committed to the DB. For a follower, this is the sequence number at
+// which the next batch must be applied by ApplyAtSeqNum.
+func (d *DB) NextSeqNum() uint64 {
+	return atomic.LoadUint64(&d.mu.versions.logSeqNum)
+}
+
+func (d *DB) applyInternal(batch *Batch, seqNum uint64, opts *WriteOptions) error {
 	if batch.db != nil && batch.db != d {
 		panic(fmt.Sprintf("pebble: batch db mismatch: %p != %p", batch.db, d))
 	}
@@ -514,14 +711,28 @@ func (d *DB) Apply(batch *Batch, opts *WriteOptions) error {
 	if batch.db == nil {
 		batch.refreshMemTableSize()
 	}
-	if int(batch.memTableSize) >= d.largeBatchThreshold {
+	if batch.hasRangeKeys {
+		if err := d.checkFormatMajorVersion(FormatRangeKeys, "range keys"); err != nil {
+			return err
+		}
+	}
+	if int64(batch.memTableSize) >= atomic.LoadInt64(&d.largeBatchThreshold) {
 		batch.flushable = newFlushableBatch(batch, d.opts.Comparer)
 	}
-	if err := d.commit.Commit(batch, sync); err != nil {
+	if seqNum != 0 {
+		if err := d.commit.CommitAtSeqNum(batch, seqNum, sync); err != nil {
+			if errors.Is(err, ErrOutOfOrderSeqNum) {
+				batch.flushable = nil
+				return err
+			}
+			d.opts.Logger.Fatalf("%v", err)
+		}
+	} else if err := d.commit.Commit(batch, sync); err != nil {
 		// There isn't much we can do on an error here. The commit pipeline will be
 		// horked at this point.
 		d.opts.Logger.Fatalf("%v", err)
 	}
+	d.notifyChangeFeeds()
 	// If this is a large batch, we need to clear the batch contents as the
 	// flushable batch may still be present in the flushables queue.
 	//
@@ -583,6 +794,9 @@ func (d *DB) commitWrite(b *Batch, syncWG *sync.WaitGroup, syncErr *error) (*mem
 
 	if err == nil && !d.opts.DisableWAL {
 		d.mu.log.bytesIn += uint64(len(repr))
+		if len(d.mu.log.feeds) > 0 {
+			d.queueChangeFeedBatchLocked(repr)
+		}
 	}
 
 	// Grab a reference to the memtable while holding DB.mu. Note that for
@@ -625,9 +839,14 @@ var iterAllocPool = sync.Pool{
 }
 
 // newIterInternal constructs a new iterator, merging in batchIter as an extra
-// level.
+// level. The range keys in batchRangeKeyIter are surfaced along with the range
+// keys in the DB if the iterator is configured to iterate over range keys.
 func (d *DB) newIterInternal(
-	batchIter internalIterator, batchRangeDelIter internalIterator, s *Snapshot, o *IterOptions,
+	batchIter internalIterator,
+	batchRangeDelIter internalIterator,
+	batchRangeKeyIter internalIterator,
+	s *Snapshot,
+	o *IterOptions,
 ) *Iterator {
 	if atomic.LoadInt32(&d.closed) != 0 {
 		panic(ErrClosed)
@@ -659,12 +878,28 @@ func (d *DB) newIterInternal(
 		merge:     d.merge,
 		split:     d.split,
 		readState: readState,
+		blobFiles: &d.blobFiles,
 	}
+	dbi.readSampling.init(d.opts.ReadSamplingMultiplier)
 	if o != nil {
 		dbi.opts = *o
 	}
 	dbi.opts.logger = d.opts.Logger
 
+	if dbi.opts.KeyTypes != IterKeyTypePointsOnly {
+		spans, err := d.collectRangeKeys(batchRangeKeyIter, readState, seqNum, &dbi.opts)
+		if err != nil {
+			buf.merging.init(&dbi.opts, d.cmp)
+			_ = dbi.Close()
+			return &Iterator{err: err}
+		}
+		dbi.rangeKey = &iteratorRangeKeyState{
+			memSpans: spans,
+			newIter:  d.tableCache.newRangeKeyIter,
+			seqNum:   seqNum,
+		}
+	}
+
 	mlevels := buf.mlevels[:0]
 	if batchIter != nil {
 		mlevels = append(mlevels, mergingIterLevel{
@@ -687,34 +922,16 @@ func (d *DB) newIterInternal(
 		})
 	}
 
-	// The level 0 files need to be added from newest to oldest.
-	//
-	// Note that level 0 files do not contain untruncated tombstones, even in the presence of
-	// L0=>L0 compactions since such compactions output a single file. Therefore, we do not
-	// need to wrap level 0 files individually in level iterators.
-	current := readState.current
-	for i := len(current.Files[0]) - 1; i >= 0; i-- {
-		f := current.Files[0][i]
-		iter, rangeDelIter, err := d.newIters(f, &dbi.opts, nil)
-		if err != nil {
-			// Ensure the mergingIter is initialized so Iterator.Close will properly
-			// close any sstable iterators that have been opened.
-			buf.merging.init(&dbi.opts, d.cmp, mlevels...)
-			_ = dbi.Close()
-			// Return a new alloced Iterator structure, because dbi.Close will
-			// return dbi to a sync.Pool.
-			return &Iterator{err: err}
-		}
-		mlevels = append(mlevels, mergingIterLevel{
-			iter:         iter,
-			rangeDelIter: rangeDelIter,
-		})
-	}
-
 	// Determine the final size for mlevels so that we can avoid any more
 	// reallocations. This is important because each levelIter will hold a
-	// reference to elements in mlevels.
+	// reference to elements in mlevels. The files in L0 are organized into
+	// sublevels, each of which is iterated over by a levelIter.
+	current := readState.current
+	l0Sublevels := current.L0Sublevels(d.cmp).Levels
 	start := len(mlevels)
+	for range l0Sublevels {
+		mlevels = append(mlevels, mergingIterLevel{})
+	}
 	for level := 1; level < len(current.Files); level++ {
 		if len(current.Files[level]) == 0 {
 			continue
@@ -724,13 +941,8 @@ func (d *DB) newIterInternal(
 	finalMLevels := mlevels
 	mlevels = mlevels[start:]
 
-	// Add level iterators for the remaining files.
 	levels := buf.levels[:]
-	for level := 1; level < len(current.Files); level++ {
-		if len(current.Files[level]) == 0 {
-			continue
-		}
-
+	addLevelIterForFiles := func(files []*fileMetadata, level int) {
 		var li *levelIter
 		if len(levels) > 0 {
 			li = &levels[0]
@@ -739,7 +951,7 @@ func (d *DB) newIterInternal(
 			li = &levelIter{}
 		}
 
-		li.init(dbi.opts, d.cmp, d.newIters, current.Files[level], level, nil)
+		li.init(dbi.opts, d.cmp, d.split, d.newIters, files, level, nil)
 		li.initRangeDel(&mlevels[0].rangeDelIter)
 		li.initSmallestLargestUserKey(&mlevels[0].smallestUserKey, &mlevels[0].largestUserKey,
 			&mlevels[0].isLargestUserKeyRangeDelSentinel)
@@ -747,6 +959,19 @@ func (d *DB) newIterInternal(
 		mlevels = mlevels[1:]
 	}
 
+	// The L0 sublevels need to be added from newest to oldest.
+	for i := len(l0Sublevels) - 1; i >= 0; i-- {
+		addLevelIterForFiles(l0Sublevels[i], 0)
+	}
+
+	// Add level iterators for the remaining files.
+	for level := 1; level < len(current.Files); level++ {
+		if len(current.Files[level]) == 0 {
+			continue
+		}
+		addLevelIterForFiles(current.Files[level], level)
+	}
+
 	buf.merging.init(&dbi.opts, d.cmp, finalMLevels...)
 	buf.merging.snapshot = seqNum
 	buf.merging.elideRangeTombstones = true
@@ -778,7 +1003,7 @@ func (d *DB) NewIndexedBatch() *Batch {
 // point-in-time snapshots which avoids these problems.
 func (d *DB) NewIter(o *IterOptions) *Iterator {
 	return d.newIterInternal(nil, /* batchIter */
-		nil /* batchRangeDelIter */, nil /* snapshot */, o)
+		nil /* batchRangeDelIter */, nil /* batchRangeKeyIter */, nil /* snapshot */, o)
 }
 
 // NewSnapshot returns a point-in-time view of the current DB state. Iterators
@@ -794,11 +1019,14 @@ func (d *DB) NewSnapshot() *Snapshot {
 		panic(ErrClosed)
 	}
 
+	d.mu.Lock()
+	for d.mu.excise.installing {
+		d.mu.compact.cond.Wait()
+	}
 	s := &Snapshot{
 		db:     d,
 		seqNum: atomic.LoadUint64(&d.mu.versions.visibleSeqNum),
 	}
-	d.mu.Lock()
 	d.mu.snapshots.pushBack(s)
 	d.mu.Unlock()
 	return s
@@ -816,17 +1044,22 @@ func (d *DB) Close() error {
 		panic(ErrClosed)
 	}
 	atomic.StoreInt32(&d.closed, 1)
+	d.closeChangeFeeds()
 
 	defer d.opts.Cache.Unref()
 
 	for d.mu.compact.compactingCount > 0 || d.mu.compact.flushing {
 		d.mu.compact.cond.Wait()
 	}
+	for d.mu.tableStats.loading {
+		d.mu.tableStats.cond.Wait()
+	}
 	var err error
 	if n := len(d.mu.compact.inProgress); n > 0 {
 		err = errors.Errorf("pebble: %d unexpected in-progress compactions", errors.Safe(n))
 	}
 	err = firstError(err, d.tableCache.Close())
+	err = firstError(err, d.blobFiles.close())
 	if !d.opts.ReadOnly {
 		err = firstError(err, d.mu.log.Close())
 	} else if d.mu.log.LogWriter != nil {
@@ -961,6 +1194,59 @@ func (d *DB) Compact(
 	return nil
 }
 
+// MarkForCompaction marks the tables which overlap the specified range of
+// keys for compaction. Unlike Compact, it does not wait for the tables to be
+// compacted: the marked tables are compacted in the background once no
+// compaction picked by level score is needed. A marked table is compacted
+// into the next level, or rewritten in place if it is in the bottom level.
+// The marks are persisted in the MANIFEST. Marked tables are only compacted
+// under CompactionStyleLeveled.
+func (d *DB) MarkForCompaction(start, end []byte) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The tables are marked while holding the manifest lock, as the MANIFEST
+	// may be written without holding DB.mu.
+	d.mu.versions.logLock()
+	var marked bool
+	cur := d.mu.versions.currentVersion()
+	for level := range cur.Files {
+		for _, f := range cur.Overlaps(level, d.cmp, start, end) {
+			if !f.MarkedForCompaction {
+				f.MarkedForCompaction = true
+				marked = true
+			}
+		}
+	}
+	if !marked {
+		d.mu.versions.logUnlock()
+		return nil
+	}
+
+	// A table is only written to the MANIFEST when it is added to the LSM, so
+	// the marks are persisted by writing a new MANIFEST, which begins with a
+	// snapshot of the current version.
+	d.mu.versions.rotateManifest = true
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	if err := d.mu.versions.logAndApply(jobID, &versionEdit{}, nil, d.dataDir, func() []compactionInfo {
+		return d.getInProgressCompactionInfoLocked(nil)
+	}); err != nil {
+		return err
+	}
+	d.updateReadStateLocked(d.opts.DebugCheck)
+	d.deleteObsoleteFiles(jobID)
+	d.maybeScheduleCompaction()
+	return nil
+}
+
 func (d *DB) manualCompact(manual *manualCompaction) error {
 	d.mu.Lock()
 	d.mu.compact.manual = append(d.mu.compact.manual, manual)
@@ -1017,14 +1303,14 @@ func (d *DB) Metrics() *Metrics {
 	metrics.MemTable.Count = int64(len(d.mu.mem.queue))
 	metrics.MemTable.ZombieCount = atomic.LoadInt64(&d.memTableCount) - metrics.MemTable.Count
 	metrics.MemTable.ZombieSize = uint64(atomic.LoadInt64(&d.memTableReserved)) - metrics.MemTable.Size
-	metrics.WAL.ObsoleteFiles = int64(recycledLogs)
+	metrics.WAL.ObsoleteFiles = int64(recycledLogs + len(d.mu.log.retained))
 	metrics.WAL.Size = atomic.LoadUint64(&d.mu.log.size)
 	metrics.WAL.BytesIn = d.mu.log.bytesIn // protected by d.mu
 	for i, n := 0, len(d.mu.mem.queue)-1; i < n; i++ {
 		metrics.WAL.Size += d.mu.mem.queue[i].logSize
 	}
 	metrics.WAL.BytesWritten = metrics.Levels[0].BytesIn + metrics.WAL.Size
-	metrics.Levels[0].Score = float64(metrics.Levels[0].NumFiles) / float64(d.opts.L0CompactionThreshold)
+	metrics.Levels[0].Score = float64(metrics.Levels[0].Sublevels) / float64(d.opts.L0CompactionThreshold)
 	if p := d.mu.versions.picker; p != nil {
 		levelMaxBytes := p.getLevelMaxBytes()
 		for level := 1; level < numLevels; level++ {
@@ -1035,6 +1321,18 @@ func (d *DB) Metrics() *Metrics {
 	for _, size := range d.mu.versions.zombieTables {
 		metrics.Table.ZombieSize += size
 	}
+	for level, files := range d.mu.versions.currentVersion().Files {
+		for _, f := range files {
+			if !f.StatsValid {
+				metrics.Table.PendingStatsCount++
+				continue
+			}
+			metrics.Table.NumDeletions += f.Stats.NumDeletions
+			metrics.Table.RangeDeletionsBytesEstimate += f.Stats.RangeDeletionsBytesEstimate
+			metrics.Levels[level].CompressionInputSize += f.Stats.CompressionInputSize
+			metrics.Levels[level].CompressionOutputSize += f.Stats.CompressionOutputSize
+		}
+	}
 	d.mu.Unlock()
 
 	metrics.BlockCache = d.opts.Cache.Metrics()
@@ -1242,12 +1540,13 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 				continue
 			}
 		}
-		if len(d.mu.versions.currentVersion().Files[0]) >= d.opts.L0StopWritesThreshold {
-			// There are too many level-0 files, so we wait.
+		l0Sublevels := d.mu.versions.currentVersion().L0Sublevels(d.cmp)
+		if len(l0Sublevels.Levels) >= d.opts.L0StopWritesThreshold {
+			// There are too many level-0 sublevels, so we wait.
 			if !stalled {
 				stalled = true
 				d.opts.EventListener.WriteStallBegin(WriteStallBeginInfo{
-					Reason: "L0 file count limit exceeded",
+					Reason: "L0 sublevel count limit exceeded",
 				})
 			}
 			d.mu.compact.cond.Wait()
@@ -1263,6 +1562,8 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 			jobID := d.mu.nextJobID
 			d.mu.nextJobID++
 			newLogNum = d.mu.versions.getNextFileNum()
+			// MemTableSize may be changed by SetOptions, which holds d.mu.
+			preallocateSize := d.walPreallocateSize()
 			d.mu.mem.switching = true
 			d.mu.Unlock()
 
@@ -1296,7 +1597,7 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 				} else {
 					newLogFile = vfs.NewSyncingFile(newLogFile, vfs.SyncingFileOptions{
 						BytesPerSync:    d.opts.BytesPerSync,
-						PreallocateSize: d.walPreallocateSize(),
+						PreallocateSize: preallocateSize,
 					})
 				}
 			}
@@ -1419,6 +1720,7 @@ func (d *DB) getInProgressCompactionInfoLocked(finishing *compaction) (rv []comp
 			rv = append(rv, compactionInfo{
 				startLevel:  c.startLevel,
 				outputLevel: c.outputLevel,
+				extraLevel:  c.extraLevel,
 				inputs:      c.inputs,
 			})
 		}
@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/bloom"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
@@ -447,6 +448,94 @@ func TestGetNoCache(t *testing.T) {
 	require.NoError(t, d.Close())
 }
 
+func TestGetTableFormatPebblev1(t *testing.T) {
+	d, err := Open("", &Options{
+		FS:          vfs.NewMem(),
+		TableFormat: TableFormatPebblev1,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		require.NoError(t, d.Set(key, key, nil))
+		if i%100 == 0 {
+			require.NoError(t, d.Flush())
+		}
+	}
+	require.NoError(t, d.Compact([]byte("0000"), []byte("1000")))
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		verifyGet(t, d, key, key)
+	}
+	_, _, err = d.Get([]byte("1000"))
+	require.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, d.Close())
+}
+
+func TestGetPrefixFilter(t *testing.T) {
+	// The prefix of a key is the portion before the '@' separating the version.
+	comparer := *DefaultComparer
+	comparer.Split = func(a []byte) int {
+		if i := bytes.IndexByte(a, '@'); i >= 0 {
+			return i
+		}
+		return len(a)
+	}
+	d, err := Open("", &Options{
+		FS:       vfs.NewMem(),
+		Comparer: &comparer,
+		Levels:   []LevelOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+	})
+	require.NoError(t, err)
+
+	// Each version of the even keys is written to a separate table.
+	for v := 1; v <= 3; v++ {
+		for i := 0; i < 1000; i += 2 {
+			key := []byte(fmt.Sprintf("%04d@%d", i, v))
+			require.NoError(t, d.Set(key, key, nil))
+		}
+		require.NoError(t, d.Flush())
+	}
+
+	filterHits := func() int64 {
+		return d.Metrics().Filter.Hits
+	}
+
+	// Gets of the versions of the odd keys are ruled out by the filters.
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%04d@2", i))
+		if i%2 == 0 {
+			verifyGet(t, d, key, key)
+		} else {
+			verifyGetNotFound(t, d, key)
+		}
+	}
+	require.True(t, filterHits() > 1400, "%d", filterHits())
+
+	// The filters contain the prefixes, so they can't rule out versions of the
+	// even keys which do not exist.
+	hits := filterHits()
+	verifyGetNotFound(t, d, []byte("0010@4"))
+	require.Equal(t, hits, filterHits())
+
+	require.NoError(t, d.Compact([]byte("0000"), []byte("1000")))
+	iter := d.NewIter(nil)
+	hits = filterHits()
+	for i := 1; i < 1000; i += 2 {
+		require.False(t, iter.SeekPrefixGE([]byte(fmt.Sprintf("%04d", i))))
+	}
+	require.True(t, filterHits()-hits > 450, "%d", filterHits()-hits)
+	var versions []string
+	for valid := iter.SeekPrefixGE([]byte("0010@2")); valid; valid = iter.Next() {
+		versions = append(versions, string(iter.Key()))
+	}
+	require.Equal(t, []string{"0010@2", "0010@3"}, versions)
+	require.NoError(t, iter.Close())
+
+	require.NoError(t, d.Close())
+}
+
 func TestGetMerge(t *testing.T) {
 	d, err := Open("", &Options{
 		FS: vfs.NewMem(),
@@ -759,6 +848,9 @@ func TestCacheEvict(t *testing.T) {
 	}
 
 	require.NoError(t, d.Compact([]byte("0"), []byte("1")))
+	// The tables are evicted from the cache once they're deleted, which may be
+	// delayed by a load of their stats.
+	d.waitTableStats()
 
 	if size := cache.Size(); size != 0 {
 		t.Fatalf("expected empty cache, but found %d", size)
@@ -987,6 +1079,95 @@ func TestDBApplyBatchMismatch(t *testing.T) {
 	require.NoError(t, applyDB.Close())
 }
 
+func TestDBFollower(t *testing.T) {
+	leader, err := Open("", &Options{FS: vfs.NewMem()})
+	require.NoError(t, err)
+	defer leader.Close()
+
+	followerFS := vfs.NewMem()
+	followerOpts := &Options{FS: followerFS, Follower: true}
+	follower, err := Open("", followerOpts)
+	require.NoError(t, err)
+
+	// A follower only accepts writes via ApplyAtSeqNum.
+	require.Equal(t, ErrFollower, follower.Set([]byte("a"), nil, nil))
+	require.Equal(t, ErrNotFollower, leader.ApplyAtSeqNum(leader.NewBatch(), 1, nil))
+
+	type committed struct {
+		repr   []byte
+		seqNum uint64
+	}
+	var batches []committed
+	commit := func(f func(b *Batch)) {
+		b := leader.NewBatch()
+		f(b)
+		require.NoError(t, b.Commit(nil))
+		batches = append(batches, committed{append([]byte(nil), b.Repr()...), b.SeqNum()})
+		require.NoError(t, b.Close())
+	}
+	commit(func(b *Batch) {
+		require.NoError(t, b.Set([]byte("a"), []byte("1"), nil))
+		require.NoError(t, b.Set([]byte("b"), []byte("2"), nil))
+	})
+	commit(func(b *Batch) { require.NoError(t, b.Merge([]byte("a"), []byte("3"), nil)) })
+	leaderSnap := leader.NewSnapshot()
+	defer leaderSnap.Close()
+	commit(func(b *Batch) { require.NoError(t, b.DeleteRange([]byte("a"), []byte("b"), nil)) })
+	commit(func(b *Batch) { require.NoError(t, b.LogData([]byte("log"), nil)) })
+	commit(func(b *Batch) { require.NoError(t, b.Set([]byte("c"), []byte("4"), nil)) })
+
+	apply := func(c committed, seqNum uint64) error {
+		b := follower.NewBatch()
+		require.NoError(t, b.SetRepr(c.repr))
+		return follower.ApplyAtSeqNum(b, seqNum, Sync)
+	}
+	scan := func(r Reader) string {
+		iter := r.NewIter(nil)
+		var keys []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+		}
+		require.NoError(t, iter.Close())
+		return strings.Join(keys, " ")
+	}
+
+	require.Equal(t, uint64(1), follower.NextSeqNum())
+	require.NoError(t, apply(batches[0], batches[0].seqNum))
+	// Gaps and reordering are rejected.
+	require.True(t, errors.Is(apply(batches[2], batches[2].seqNum), ErrOutOfOrderSeqNum))
+	require.True(t, errors.Is(apply(batches[0], batches[0].seqNum), ErrOutOfOrderSeqNum))
+	require.True(t, errors.Is(apply(batches[1], 0), ErrOutOfOrderSeqNum))
+	require.NoError(t, apply(batches[1], batches[1].seqNum))
+
+	// A snapshot of the follower at the same position as a snapshot of the
+	// leader reads the same state.
+	followerSnap := follower.NewSnapshot()
+	require.Equal(t, leaderSnap.seqNum, followerSnap.seqNum)
+	for _, c := range batches[2:] {
+		require.NoError(t, apply(c, c.seqNum))
+	}
+	require.Equal(t, "a:13 b:2", scan(leaderSnap))
+	require.Equal(t, scan(leaderSnap), scan(followerSnap))
+	require.NoError(t, followerSnap.Close())
+	require.Equal(t, "b:2 c:4", scan(leader))
+	require.Equal(t, scan(leader), scan(follower))
+	require.Equal(t, leader.NextSeqNum(), follower.NextSeqNum())
+
+	// The applied position is persisted, both in the WAL and when the applied
+	// batches are flushed.
+	for _, flush := range []bool{false, true} {
+		if flush {
+			require.NoError(t, follower.Flush())
+		}
+		require.NoError(t, follower.Close())
+		follower, err = Open("", followerOpts)
+		require.NoError(t, err)
+		require.Equal(t, leader.NextSeqNum(), follower.NextSeqNum())
+		require.Equal(t, scan(leader), scan(follower))
+	}
+	require.NoError(t, follower.Close())
+}
+
 func TestCloseCleanerRace(t *testing.T) {
 	mem := vfs.NewMem()
 	for i := 0; i < 20; i++ {
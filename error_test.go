@@ -120,9 +120,11 @@ func TestErrors(t *testing.T) {
 		if err := d.Flush(); err != nil {
 			return err
 		}
+		d.waitTableStats()
 		if err := d.Compact(nil, nil); err != nil {
 			return err
 		}
+		d.waitTableStats()
 
 		iter := d.NewIter(nil)
 		for valid := iter.First(); valid; valid = iter.Next() {
@@ -194,6 +196,9 @@ func TestRequireReadError(t *testing.T) {
 6:
   000005:[a1#1,SET-a2#2,SET]
 `, d, t)
+		// The load of the stats of the flushed table must not consume the
+		// injected errors.
+		d.waitTableStats()
 
 		// Now perform foreground ops with error injection enabled.
 		inj.SetIndex(index)
@@ -279,6 +284,9 @@ func TestCorruptReadError(t *testing.T) {
 6:
   000005:[a1#1,SET-a2#2,SET]
 `, d, t)
+		// The load of the stats of the flushed table must not consume the
+		// injected errors.
+		d.waitTableStats()
 
 		// Now perform foreground ops with corruption injection enabled.
 		atomic.StoreInt32(&fs.index, index)
@@ -40,7 +40,11 @@ func formatFileNums(tables []TableInfo) string {
 type CompactionInfo struct {
 	// JobID is the ID of the compaction job.
 	JobID int
-	// Reason is the reason for the compaction.
+	// Reason is the reason for the compaction. It is "read" for a compaction
+	// triggered by the sampled reads of iterators (see
+	// Options.ReadCompactionRate), "marked" for a compaction of a table marked
+	// by DB.MarkForCompaction, and "periodic" for a compaction of a table
+	// older than Options.PeriodicCompactionSeconds.
 	Reason string
 	// Input contains the input tables for the compaction. A compaction is
 	// performed from Input.Level to Input.Level+1. Input.Tables[0] contains the
@@ -50,15 +54,38 @@ type CompactionInfo struct {
 		Level  int
 		Tables [2][]TableInfo
 	}
+	// Intermediate contains the input tables from the intermediate level of a
+	// multi-level compaction, which compacts Input.Level into Output.Level and
+	// merges the tables of the level in between them in the same pass.
+	// Intermediate.Level is zero for a compaction of two levels.
+	Intermediate struct {
+		Level  int
+		Tables []TableInfo
+	}
 	// Output contains the output tables generated by the compaction. The output
 	// tables are empty for the compaction begin event.
 	Output struct {
 		Level  int
 		Tables []TableInfo
 	}
-	Duration time.Duration
-	Done     bool
-	Err      error
+	// Filter contains the statistics of the Options.CompactionFilter for the
+	// compaction. It is only populated for the compaction end event.
+	Filter CompactionFilterInfo
+	// ReclaimedBytes is the size of the input tables which were deleted by a
+	// delete-only compaction, whose Reason is "delete-only". A delete-only
+	// compaction removes tables whose keys are all deleted by a range
+	// tombstone without reading or writing any tables. The oldest tables
+	// dropped under CompactionStyleFIFO are reported in the same way, with the
+	// Reason "fifo". It is only populated for the compaction end event.
+	ReclaimedBytes uint64
+	// Subcompactions contains the info for each of the subcompactions the
+	// compaction was split into, in key order. It is empty if the compaction
+	// was not split, and is only populated for the compaction end event. See
+	// Options.MaxSubcompactions.
+	Subcompactions []SubcompactionInfo
+	Duration       time.Duration
+	Done           bool
+	Err            error
 }
 
 func (i CompactionInfo) String() string {
@@ -67,23 +94,59 @@ func (i CompactionInfo) String() string {
 			i.JobID, i.Output.Level, i.Err)
 	}
 
+	if i.Reason == "delete-only" || i.Reason == "fifo" {
+		if !i.Done {
+			return fmt.Sprintf("[JOB %d] %s compacting L%d [%s] (%s)",
+				i.JobID,
+				i.Reason,
+				i.Input.Level,
+				formatFileNums(i.Input.Tables[0]),
+				humanize.Uint64(tablesTotalSize(i.Input.Tables[0])))
+		}
+		return fmt.Sprintf("[JOB %d] %s compacted L%d [%s], reclaimed %s, in %.1fs",
+			i.JobID,
+			i.Reason,
+			i.Input.Level,
+			formatFileNums(i.Input.Tables[0]),
+			humanize.Uint64(i.ReclaimedBytes),
+			i.Duration.Seconds())
+	}
+
+	var intermediate string
+	if i.Intermediate.Level != 0 {
+		intermediate = fmt.Sprintf(" + L%d [%s] (%s)",
+			i.Intermediate.Level,
+			formatFileNums(i.Intermediate.Tables),
+			humanize.Uint64(tablesTotalSize(i.Intermediate.Tables)))
+	}
+
 	if !i.Done {
-		return fmt.Sprintf("[JOB %d] compacting L%d [%s] (%s) + L%d [%s] (%s)",
+		return fmt.Sprintf("[JOB %d] compacting L%d [%s] (%s)%s + L%d [%s] (%s)",
 			i.JobID,
 			i.Input.Level,
 			formatFileNums(i.Input.Tables[0]),
 			humanize.Uint64(tablesTotalSize(i.Input.Tables[0])),
+			intermediate,
 			i.Output.Level,
 			formatFileNums(i.Input.Tables[1]),
 			humanize.Uint64(tablesTotalSize(i.Input.Tables[1])))
 	}
 
 	outputSize := tablesTotalSize(i.Output.Tables)
-	return fmt.Sprintf("[JOB %d] compacted L%d [%s] (%s) + L%d [%s] (%s) -> L%d [%s] (%s), in %.1fs, output rate %s/s",
+	var filter string
+	if i.Filter.Name != "" {
+		filter = ", " + i.Filter.String()
+	}
+	var subcompactions string
+	if len(i.Subcompactions) > 0 {
+		subcompactions = fmt.Sprintf(", %d subcompactions", len(i.Subcompactions))
+	}
+	return fmt.Sprintf("[JOB %d] compacted L%d [%s] (%s)%s + L%d [%s] (%s) -> L%d [%s] (%s), in %.1fs, output rate %s/s%s%s",
 		i.JobID,
 		i.Input.Level,
 		formatFileNums(i.Input.Tables[0]),
 		humanize.Uint64(tablesTotalSize(i.Input.Tables[0])),
+		intermediate,
 		i.Output.Level,
 		formatFileNums(i.Input.Tables[1]),
 		humanize.Uint64(tablesTotalSize(i.Input.Tables[1])),
@@ -91,7 +154,28 @@ func (i CompactionInfo) String() string {
 		formatFileNums(i.Output.Tables),
 		humanize.Uint64(outputSize),
 		i.Duration.Seconds(),
-		humanize.Uint64(uint64(float64(outputSize)/i.Duration.Seconds())))
+		humanize.Uint64(uint64(float64(outputSize)/i.Duration.Seconds())),
+		filter,
+		subcompactions)
+}
+
+// SubcompactionInfo contains the info for one of the subcompactions a
+// compaction was split into.
+type SubcompactionInfo struct {
+	// Start and End are the user key bounds [Start, End) of the
+	// subcompaction. The Start bound of the first subcompaction and the End
+	// bound of the last subcompaction are nil, denoting an unbounded range.
+	Start []byte
+	End   []byte
+	// Output contains the output tables generated by the subcompaction.
+	Output   []TableInfo
+	Duration time.Duration
+}
+
+func (i SubcompactionInfo) String() string {
+	return fmt.Sprintf("[%q, %q) -> [%s] (%s), in %.1fs",
+		i.Start, i.End, formatFileNums(i.Output),
+		humanize.Uint64(tablesTotalSize(i.Output)), i.Duration.Seconds())
 }
 
 // FlushInfo contains the info for a flush event.
@@ -267,6 +351,31 @@ func (i WriteStallBeginInfo) String() string {
 	return fmt.Sprintf("write stall beginning: %s", i.Reason)
 }
 
+// TableStatsInfo contains the info for a table stats loaded event.
+type TableStatsInfo struct {
+	// JobID is the ID of the job that loaded the stats.
+	JobID int
+	// Initial is true for the load of the stats of the tables present when the
+	// DB was opened.
+	Initial bool
+	// Tables is the number of tables whose stats were loaded.
+	Tables int
+	// NumDeletions is the total number of point deletions in the tables.
+	NumDeletions uint64
+	// RangeDeletionsBytesEstimate is the total estimated number of bytes in
+	// lower levels covered by the range deletions in the tables.
+	RangeDeletionsBytesEstimate uint64
+}
+
+func (i TableStatsInfo) String() string {
+	var initial string
+	if i.Initial {
+		initial = "initial "
+	}
+	return fmt.Sprintf("[JOB %d] loaded %sstats for %d tables: %d point deletions, %s covered by range deletions",
+		i.JobID, initial, i.Tables, i.NumDeletions, humanize.Uint64(i.RangeDeletionsBytesEstimate))
+}
+
 // EventListener contains a set of functions that will be invoked when various
 // significant DB events occur. Note that the functions should not run for an
 // excessive amount of time as they are invoked synchronously by the DB and may
@@ -309,6 +418,11 @@ type EventListener struct {
 	// ingested via a call to DB.Ingest().
 	TableIngested func(TableIngestInfo)
 
+	// TableStatsLoaded is invoked after the stats of tables have been loaded
+	// in the background. It is always invoked once the stats of the tables
+	// present when the DB was opened have been loaded.
+	TableStatsLoaded func(TableStatsInfo)
+
 	// WALCreated is invoked after a WAL has been created.
 	WALCreated func(WALCreateInfo)
 
@@ -359,6 +473,9 @@ func (l *EventListener) EnsureDefaults(logger Logger) {
 	if l.TableIngested == nil {
 		l.TableIngested = func(info TableIngestInfo) {}
 	}
+	if l.TableStatsLoaded == nil {
+		l.TableStatsLoaded = func(info TableStatsInfo) {}
+	}
 	if l.WALCreated == nil {
 		l.WALCreated = func(info WALCreateInfo) {}
 	}
@@ -411,6 +528,9 @@ func MakeLoggingEventListener(logger Logger) EventListener {
 		TableIngested: func(info TableIngestInfo) {
 			logger.Infof("%s", info.String())
 		},
+		TableStatsLoaded: func(info TableStatsInfo) {
+			logger.Infof("%s", info.String())
+		},
 		WALCreated: func(info WALCreateInfo) {
 			logger.Infof("%s", info.String())
 		},
@@ -149,6 +149,7 @@ func TestEventListener(t *testing.T) {
 			if err != nil {
 				return err.Error()
 			}
+			d.waitTableStats()
 			return buf.String()
 
 		case "close":
@@ -166,6 +167,7 @@ func TestEventListener(t *testing.T) {
 			if err := d.Flush(); err != nil {
 				return err.Error()
 			}
+			d.waitTableStats()
 			return buf.String()
 
 		case "compact":
@@ -173,6 +175,12 @@ func TestEventListener(t *testing.T) {
 			if err := d.Set([]byte("a"), nil, nil); err != nil {
 				return err.Error()
 			}
+			// Flush before compacting, so that the load of the stats of the
+			// flushed table is not concurrent with the compaction.
+			if err := d.Flush(); err != nil {
+				return err.Error()
+			}
+			d.waitTableStats()
 			t := time.Now()
 			d.timeNow = func() time.Time {
 				t = t.Add(time.Second)
@@ -181,6 +189,7 @@ func TestEventListener(t *testing.T) {
 			if err := d.Compact([]byte("a"), []byte("b")); err != nil {
 				return err.Error()
 			}
+			d.waitTableStats()
 			return buf.String()
 
 		case "checkpoint":
@@ -227,6 +236,7 @@ func TestEventListener(t *testing.T) {
 			if err := d.Ingest([]string{"ext/0"}); err != nil {
 				return err.Error()
 			}
+			d.waitTableStats()
 			return buf.String()
 
 		case "metrics":
@@ -261,7 +271,7 @@ func TestWriteStallEvents(t *testing.T) {
 		expected   string
 	}{
 		{true, "memtable count limit reached"},
-		{false, "L0 file count limit exceeded"},
+		{false, "L0 sublevel count limit exceeded"},
 	}
 
 	for _, c := range testCases {
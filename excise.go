@@ -0,0 +1,511 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/manifest"
+	"github.com/cockroachdb/pebble/internal/private"
+	"github.com/cockroachdb/pebble/internal/rangekey"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// KeyRange is a span of user keys [Start, End).
+type KeyRange struct {
+	Start []byte
+	End   []byte
+}
+
+// exciseOverlaps returns true if the bounds of the table overlap the span.
+func exciseOverlaps(cmp Compare, span KeyRange, meta *fileMetadata) bool {
+	if cmp(meta.Smallest.UserKey, span.End) >= 0 {
+		return false
+	}
+	c := cmp(meta.Largest.UserKey, span.Start)
+	return c > 0 || (c == 0 && meta.Largest.Trailer != InternalKeyRangeDeleteSentinel)
+}
+
+// exciseContains returns true if the bounds of the table lie within the span.
+func exciseContains(cmp Compare, span KeyRange, meta *fileMetadata) bool {
+	if cmp(meta.Smallest.UserKey, span.Start) < 0 {
+		return false
+	}
+	c := cmp(meta.Largest.UserKey, span.End)
+	return c < 0 || (c == 0 && meta.Largest.Trailer == InternalKeyRangeDeleteSentinel)
+}
+
+// excise computes the version edit which removes the data in span from the
+// current version. Tables lying entirely within the span are deleted, and
+// tables straddling a boundary of the span are replaced by virtual tables
+// referencing only their data outside of the span. An L0 table with data on
+// both sides of the span is instead rewritten, as two L0 tables cannot share
+// the same largest sequence number. The data in span must
+// have sequence numbers less than seqNum: the caller must have flushed the
+// memtables filled before the excise was sequenced, and held back the flush
+// of those filled afterwards.
+//
+// The tables being excised are marked as compacting, which prevents new
+// compactions from picking them, and excise waits for the in-progress
+// compactions of overlapping tables to finish. The caller must pass the
+// returned tables to exciseDone once the version edit has been applied (or
+// has failed to apply).
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) excise(
+	jobID int, span KeyRange, seqNum uint64,
+) (ve *versionEdit, excised []*fileMetadata, err error) {
+	// Wait for any compaction of a table overlapping the span to finish. A
+	// compaction's outputs would otherwise reintroduce the excised data.
+	for {
+		compacting := false
+		current := d.mu.versions.currentVersion()
+		for level := range current.Files {
+			for _, f := range current.Files[level] {
+				if f.Compacting && exciseOverlaps(d.cmp, span, f) {
+					compacting = true
+				}
+			}
+		}
+		if !compacting {
+			break
+		}
+		d.mu.compact.cond.Wait()
+	}
+
+	ve = &versionEdit{
+		DeletedFiles: map[deletedFileEntry]bool{},
+	}
+	type straddling struct {
+		level int
+		meta  *fileMetadata
+	}
+	var rewrite []straddling
+	current := d.mu.versions.currentVersion()
+	for level := range current.Files {
+		for _, f := range current.Files[level] {
+			if !exciseOverlaps(d.cmp, span, f) {
+				continue
+			}
+			if f.LargestSeqNum >= seqNum {
+				return nil, excised, errors.AssertionFailedf(
+					"pebble: table %s is newer than the excise sequence number %d", f.FileNum, errors.Safe(seqNum))
+			}
+			f.Compacting = true
+			excised = append(excised, f)
+			ve.DeletedFiles[deletedFileEntry{Level: level, FileNum: f.FileNum}] = true
+			if !exciseContains(d.cmp, span, f) {
+				rewrite = append(rewrite, straddling{level: level, meta: f})
+			}
+		}
+	}
+	if len(rewrite) == 0 {
+		return ve, excised, nil
+	}
+
+	// Read the straddling tables without holding DB.mu. The excised tables are
+	// marked as compacting, so the current version's tables which overlap the
+	// span cannot change in the meantime.
+	d.mu.Unlock()
+	defer d.mu.Lock()
+
+	var filenames []string
+	defer func() {
+		if err != nil {
+			for _, filename := range filenames {
+				_ = d.opts.FS.Remove(filename)
+			}
+		}
+	}()
+	for _, s := range rewrite {
+		// The table has data on both sides of the span if it is not contained
+		// by either of the spans [smallest, span.End) or [span.Start, largest].
+		physical := s.level == 0 &&
+			d.cmp(s.meta.Smallest.UserKey, span.Start) < 0 &&
+			!exciseContains(d.cmp, KeyRange{Start: s.meta.Smallest.UserKey, End: span.End}, s.meta)
+		for _, bounds := range [2]KeyRange{{End: span.Start}, {Start: span.End}} {
+			var meta *fileMetadata
+			if physical {
+				var filename string
+				meta, filename, err = d.exciseRewrite(jobID, s.level, s.meta, bounds)
+				if filename != "" {
+					filenames = append(filenames, filename)
+				}
+			} else {
+				meta, err = d.exciseVirtual(s.meta, bounds)
+			}
+			if err != nil {
+				return nil, excised, err
+			}
+			if meta != nil {
+				ve.NewFiles = append(ve.NewFiles, newFileEntry{Level: s.level, Meta: meta})
+			}
+		}
+	}
+	if len(filenames) > 0 {
+		if err := d.dataDir.Sync(); err != nil {
+			return nil, excised, err
+		}
+	}
+	return ve, excised, nil
+}
+
+// exciseVersion returns the version resulting from applying the excise's
+// version edit to v. The returned version is only suitable for examining the
+// tables in each level: it does not hold references to its tables and is not
+// added to the version list.
+func exciseVersion(cmp Compare, v *version, ve *versionEdit) *version {
+	nv := &version{}
+	for level := range v.Files {
+		for _, f := range v.Files[level] {
+			if !ve.DeletedFiles[deletedFileEntry{Level: level, FileNum: f.FileNum}] {
+				nv.Files[level] = append(nv.Files[level], f)
+			}
+		}
+	}
+	for _, nf := range ve.NewFiles {
+		nv.Files[nf.Level] = append(nv.Files[nf.Level], nf.Meta)
+	}
+	for level := range nv.Files {
+		if level == 0 {
+			manifest.SortBySeqNum(nv.Files[level])
+		} else {
+			manifest.SortBySmallest(nv.Files[level], cmp)
+		}
+	}
+	return nv
+}
+
+// checkExciseSnapshotsLocked returns an error if an open snapshot sequenced
+// before the excise with the specified sequence number can read the data in
+// any of the tables returned by excise, as the excise does not retain it. A
+// snapshot cannot read a table whose data was all written after the snapshot
+// was created.
+//
+// d.mu must be held when calling this.
+func (d *DB) checkExciseSnapshotsLocked(excised []*fileMetadata, seqNum uint64) error {
+	// The newest snapshot sequenced before the excise can read the most data.
+	var snapshot uint64
+	for s := d.mu.snapshots.root.next; s != &d.mu.snapshots.root; s = s.next {
+		if s.seqNum <= seqNum && s.seqNum > snapshot {
+			snapshot = s.seqNum
+		}
+	}
+	for _, f := range excised {
+		if f.SmallestSeqNum < snapshot {
+			return errors.Errorf("pebble: cannot excise table %s, which is visible to an open snapshot",
+				f.FileNum)
+		}
+	}
+	return nil
+}
+
+// exciseDone clears the compacting state of the tables returned by excise.
+//
+// d.mu must be held when calling this.
+func (d *DB) exciseDone(excised []*fileMetadata) {
+	for _, f := range excised {
+		f.Compacting = false
+	}
+	d.mu.compact.cond.Broadcast()
+}
+
+// exciseVirtual returns a virtual table referencing the data of the table
+// meta which lies within bounds, where a nil bound is unbounded. The bounds
+// of the virtual table are tight: they are the smallest and largest of the
+// point keys, range deletions and range keys within bounds. Returns a nil
+// table if there is no such data.
+func (d *DB) exciseVirtual(meta *fileMetadata, bounds KeyRange) (_ *fileMetadata, retErr error) {
+	var smallest, largest InternalKey
+	extend := func(start, end InternalKey) {
+		if smallest.UserKey == nil || base.InternalCompare(d.cmp, start, smallest) < 0 {
+			smallest = start
+		}
+		if largest.UserKey == nil || base.InternalCompare(d.cmp, end, largest) > 0 {
+			largest = end
+		}
+	}
+	// truncate truncates the span [start, end) to the bounds, returning false
+	// if the truncated span is empty.
+	truncate := func(start, end []byte) ([]byte, []byte, bool) {
+		if bounds.Start != nil && d.cmp(start, bounds.Start) < 0 {
+			start = bounds.Start
+		}
+		if bounds.End != nil && d.cmp(end, bounds.End) > 0 {
+			end = bounds.End
+		}
+		return start, end, d.cmp(start, end) < 0
+	}
+
+	iter, rangeDelIter, err := d.newIters(meta, nil /* iter options */, nil /* bytes iterated */)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		retErr = firstError(retErr, iter.Close())
+		if rangeDelIter != nil {
+			retErr = firstError(retErr, rangeDelIter.Close())
+		}
+	}()
+
+	// The point keys extend from the first key at or after the start bound (or
+	// the table's smallest key) to the last key before the end bound (or the
+	// table's largest key).
+	first, last := meta.Smallest, meta.Largest
+	if bounds.Start != nil {
+		first = InternalKey{}
+		if key, _ := iter.SeekGE(bounds.Start); key != nil {
+			first = key.Clone()
+		}
+	}
+	if bounds.End != nil && first.UserKey != nil {
+		last = InternalKey{}
+		if key, _ := iter.SeekLT(bounds.End); key != nil {
+			last = key.Clone()
+		}
+	}
+	if first.UserKey != nil && last.UserKey != nil && base.InternalCompare(d.cmp, first, last) <= 0 {
+		extend(first, last)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if rangeDelIter != nil {
+		for key, val := rangeDelIter.First(); key != nil; key, val = rangeDelIter.Next() {
+			if start, end, ok := truncate(key.UserKey, val); ok {
+				extend(InternalKey{UserKey: append([]byte(nil), start...), Trailer: key.Trailer},
+					base.MakeRangeDeleteSentinelKey(append([]byte(nil), end...)))
+			}
+		}
+		if err := rangeDelIter.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	if meta.HasRangeKeys {
+		rangeKeyIter, err := d.tableCache.newRangeKeyIter(meta)
+		if err != nil {
+			return nil, err
+		}
+		if rangeKeyIter != nil {
+			spans, err := rangekey.Collect(nil, rangeKeyIter)
+			if err = firstError(err, rangeKeyIter.Close()); err != nil {
+				return nil, err
+			}
+			for _, s := range spans {
+				if start, end, ok := truncate(s.Start.UserKey, s.End); ok {
+					extend(InternalKey{UserKey: start, Trailer: s.Start.Trailer},
+						base.MakeRangeDeleteSentinelKey(end))
+				}
+			}
+		}
+	}
+
+	if smallest.UserKey == nil {
+		return nil, nil
+	}
+	d.mu.Lock()
+	fileNum := d.mu.versions.getNextFileNum()
+	d.mu.Unlock()
+	// NB: The virtual table conservatively retains the blob references of the
+	// table, and inherits the table's sequence numbers.
+	v := &fileMetadata{
+		FileNum:        fileNum,
+		CreationTime:   meta.CreationTime,
+		Smallest:       smallest,
+		Largest:        largest,
+		SmallestSeqNum: meta.SmallestSeqNum,
+		LargestSeqNum:  meta.LargestSeqNum,
+		HasRangeKeys:   meta.HasRangeKeys,
+		BlobReferences: meta.BlobReferences,
+		Virtual:        true,
+		FileBacking:    meta.FileBacking,
+	}
+	if v.Size, err = d.tableCache.estimateDiskUsage(v, smallest.UserKey, largest.UserKey); err != nil {
+		return nil, err
+	}
+	if len(meta.BlobReferences) > 0 && meta.Size > 0 {
+		// The values referenced by the virtual table are not known without
+		// reading it. Attribute a share of the referenced values proportional
+		// to the size of the virtual table, so that the virtual tables sharing
+		// a backing do not count the backing's references more than once.
+		v.BlobReferences = make([]manifest.BlobReference, len(meta.BlobReferences))
+		for i, ref := range meta.BlobReferences {
+			ref.ValueSize = ref.ValueSize * v.Size / meta.Size
+			v.BlobReferences[i] = ref
+		}
+	}
+	return v, nil
+}
+
+// exciseRewrite writes a new table containing the data of the table meta
+// which lies within bounds, where a nil bound is unbounded. The point keys,
+// range deletions and range keys are copied with their sequence numbers
+// intact. Returns a nil table if there is no such data.
+func (d *DB) exciseRewrite(
+	jobID int, level int, meta *fileMetadata, bounds KeyRange,
+) (_ *fileMetadata, filename string, retErr error) {
+	iter, rangeDelIter, err := d.newIters(meta, nil /* iter options */, nil /* bytes iterated */)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		retErr = firstError(retErr, iter.Close())
+		if rangeDelIter != nil {
+			retErr = firstError(retErr, rangeDelIter.Close())
+		}
+	}()
+	var rangeKeys []rangekey.Span
+	if meta.HasRangeKeys {
+		rangeKeyIter, err := d.tableCache.newRangeKeyIter(meta)
+		if err != nil {
+			return nil, "", err
+		}
+		if rangeKeyIter != nil {
+			rangeKeys, err = rangekey.Collect(nil, rangeKeyIter)
+			if err = firstError(err, rangeKeyIter.Close()); err != nil {
+				return nil, "", err
+			}
+			rangeKeys = rangekey.Truncate(d.cmp, rangekey.Fragment(d.cmp, rangeKeys),
+				bounds.Start, bounds.End)
+		}
+	}
+
+	var (
+		tw      *sstable.Writer
+		outMeta *fileMetadata
+		sep     valueSeparator
+	)
+	defer func() {
+		if tw != nil {
+			retErr = firstError(retErr, tw.Close())
+		}
+	}()
+	ensureOutput := func() error {
+		if tw != nil {
+			return nil
+		}
+		d.mu.Lock()
+		fileNum := d.mu.versions.getNextFileNum()
+		// The level options may be changed by DB.SetOptions, which holds d.mu.
+		writerOpts := d.opts.MakeWriterOptions(level)
+		d.mu.Unlock()
+
+		filename = base.MakeFilename(d.opts.FS, d.dirname, fileTypeTable, fileNum)
+		file, err := d.opts.FS.Create(filename)
+		if err != nil {
+			filename = ""
+			return err
+		}
+		d.opts.EventListener.TableCreated(TableCreateInfo{
+			JobID:   jobID,
+			Reason:  "excising",
+			Path:    filename,
+			FileNum: fileNum,
+		})
+		file = vfs.NewSyncingFile(file, vfs.SyncingFileOptions{
+			BytesPerSync: d.opts.BytesPerSync,
+		})
+		cacheOpts := private.SSTableCacheOpts(d.cacheID, fileNum).(sstable.WriterOption)
+		internalTableOpt := private.SSTableInternalTableOpt.(sstable.WriterOption)
+		tw = sstable.NewWriter(file, writerOpts, cacheOpts, internalTableOpt)
+		outMeta = &fileMetadata{
+			FileNum:      fileNum,
+			CreationTime: time.Now().Unix(),
+		}
+		return nil
+	}
+
+	// Copy the point keys within the bounds.
+	var key *InternalKey
+	var val []byte
+	if bounds.Start != nil {
+		key, val = iter.SeekGE(bounds.Start)
+	} else {
+		key, val = iter.First()
+	}
+	for ; key != nil; key, val = iter.Next() {
+		if bounds.End != nil && d.cmp(key.UserKey, bounds.End) >= 0 {
+			break
+		}
+		if err := ensureOutput(); err != nil {
+			return nil, filename, err
+		}
+		// The value separator only tracks the blob files referenced by the
+		// table, as its threshold is zero.
+		if _, _, err := sep.add(key, val); err != nil {
+			return nil, filename, err
+		}
+		if err := tw.Add(*key, val); err != nil {
+			return nil, filename, err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, filename, err
+	}
+
+	// Copy the range deletions, truncated to the bounds. The range deletions
+	// in a table are fragmented, so truncation preserves their order.
+	if rangeDelIter != nil {
+		for key, val := rangeDelIter.First(); key != nil; key, val = rangeDelIter.Next() {
+			start, end := *key, val
+			if bounds.Start != nil && d.cmp(start.UserKey, bounds.Start) < 0 {
+				start.UserKey = bounds.Start
+			}
+			if bounds.End != nil && d.cmp(end, bounds.End) > 0 {
+				end = bounds.End
+			}
+			if d.cmp(start.UserKey, end) >= 0 {
+				continue
+			}
+			if err := ensureOutput(); err != nil {
+				return nil, filename, err
+			}
+			if err := tw.Add(start, end); err != nil {
+				return nil, filename, err
+			}
+		}
+		if err := rangeDelIter.Error(); err != nil {
+			return nil, filename, err
+		}
+	}
+
+	// Copy the range keys, truncated to the bounds.
+	for _, span := range rangeKeys {
+		if err := ensureOutput(); err != nil {
+			return nil, filename, err
+		}
+		if err := tw.Add(span.Start, span.EncodedValue()); err != nil {
+			return nil, filename, err
+		}
+	}
+
+	if tw == nil {
+		return nil, "", nil
+	}
+	err = tw.Close()
+	w := tw
+	tw = nil
+	if err != nil {
+		return nil, filename, err
+	}
+	writerMeta, err := w.Metadata()
+	if err != nil {
+		return nil, filename, err
+	}
+	outMeta.Size = writerMeta.Size
+	outMeta.SmallestSeqNum = writerMeta.SmallestSeqNum
+	outMeta.LargestSeqNum = writerMeta.LargestSeqNum
+	outMeta.HasRangeKeys = writerMeta.SmallestRangeKey.UserKey != nil
+	outMeta.BlobReferences = sep.takeReferences()
+	outMeta.Smallest = writerMeta.Smallest(d.cmp)
+	outMeta.Largest = writerMeta.Largest(d.cmp)
+	return outMeta, filename, nil
+}
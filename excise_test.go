@@ -0,0 +1,282 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExciseVirtualTables(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{FS: mem}
+	d, err := Open("", opts)
+	require.NoError(t, err)
+
+	keys := func(it *Iterator, reverse bool) string {
+		t.Helper()
+		var parts []string
+		valid := it.First()
+		if reverse {
+			valid = it.Last()
+		}
+		for valid {
+			parts = append(parts, string(it.Key()))
+			if reverse {
+				valid = it.Prev()
+			} else {
+				valid = it.Next()
+			}
+		}
+		require.NoError(t, it.Close())
+		return strings.Join(parts, " ")
+	}
+	files := func(level int) []*fileMetadata {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.mu.versions.currentVersion().Files[level]
+	}
+	tableExists := func(fileNum FileNum) bool {
+		_, err := mem.Stat(base.MakeFilename(mem, "", fileTypeTable, fileNum))
+		return err == nil
+	}
+
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		require.NoError(t, d.Set([]byte(k), nil, nil))
+	}
+	require.NoError(t, d.DeleteRange([]byte("g"), []byte("i"), nil))
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	require.Len(t, files(numLevels-1), 1)
+	backing := files(numLevels - 1)[0].FileNum
+
+	// The L6 table is replaced by two virtual tables with tight bounds.
+	require.NoError(t, d.IngestAndExcise(nil, KeyRange{Start: []byte("c"), End: []byte("e")}))
+	l6 := files(numLevels - 1)
+	require.Len(t, l6, 2)
+	for _, f := range l6 {
+		require.True(t, f.Virtual)
+		require.Equal(t, backing, f.BackingFileNum())
+	}
+	require.Equal(t, "a", string(l6[0].Smallest.UserKey))
+	require.Equal(t, "b", string(l6[0].Largest.UserKey))
+	require.Equal(t, "e", string(l6[1].Smallest.UserKey))
+	require.Equal(t, base.MakeRangeDeleteSentinelKey([]byte("i")), l6[1].Largest)
+	require.True(t, tableExists(backing))
+
+	check := func() {
+		t.Helper()
+		require.Equal(t, "a b e f", keys(d.NewIter(nil), false))
+		require.Equal(t, "f e b a", keys(d.NewIter(nil), true))
+		it := d.NewIter(nil)
+		require.True(t, it.SeekGE([]byte("c")))
+		require.Equal(t, "e", string(it.Key()))
+		require.True(t, it.SeekLT([]byte("e")))
+		require.Equal(t, "b", string(it.Key()))
+		require.NoError(t, it.Close())
+		it = d.NewIter(&IterOptions{LowerBound: []byte("b"), UpperBound: []byte("f")})
+		require.Equal(t, "b e", keys(it, false))
+	}
+	check()
+
+	// The virtual tables are recorded in the manifest, and share their backing
+	// once more when the DB is reopened.
+	require.NoError(t, d.Close())
+	d, err = Open("", opts)
+	require.NoError(t, err)
+	l6 = files(numLevels - 1)
+	require.Len(t, l6, 2)
+	require.True(t, l6[0].FileBacking == l6[1].FileBacking)
+	check()
+
+	// Compacting the virtual tables writes physical tables, after which the
+	// backing is deleted.
+	require.NoError(t, d.Set([]byte("a"), nil, nil))
+	require.NoError(t, d.Set([]byte("f"), nil, nil))
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	for _, f := range files(numLevels - 1) {
+		require.False(t, f.Virtual)
+	}
+	// The load of the stats of the virtual tables when the DB was opened may
+	// delay the deletion of the backing.
+	d.waitTableStats()
+	require.False(t, tableExists(backing))
+	require.Equal(t, int64(0), d.Metrics().Table.ZombieCount)
+	check()
+
+	// An L0 table with data on either side of the span is rewritten.
+	require.NoError(t, d.Set([]byte("a"), []byte("new"), nil))
+	require.NoError(t, d.Set([]byte("m"), nil, nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.IngestAndExcise(nil, KeyRange{Start: []byte("b"), End: []byte("l")}))
+	l0 := files(0)
+	require.Len(t, l0, 2)
+	for _, f := range l0 {
+		require.False(t, f.Virtual)
+	}
+	require.Equal(t, "a m", keys(d.NewIter(nil), false))
+	v, closer, err := d.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(v))
+	require.NoError(t, closer.Close())
+	require.NoError(t, d.Close())
+}
+
+func TestExciseVirtualTableBlobReferences(t *testing.T) {
+	d, err := Open("", &Options{FS: vfs.NewMem(), ValueSeparationThreshold: 10})
+	require.NoError(t, err)
+	liveSize := func() uint64 {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var size uint64
+		for _, s := range d.mu.versions.currentVersion().BlobFileLiveSizes() {
+			size += s
+		}
+		return size
+	}
+
+	value := []byte(strings.Repeat("x", 100))
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		require.NoError(t, d.Set([]byte(k), value, nil))
+	}
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	before := liveSize()
+	require.NotZero(t, before)
+
+	// The virtual tables which share the backing of the excised table divide
+	// its references to the blob file between them.
+	require.NoError(t, d.IngestAndExcise(nil, KeyRange{Start: []byte("c"), End: []byte("e")}))
+	d.mu.Lock()
+	l6 := d.mu.versions.currentVersion().Files[numLevels-1]
+	d.mu.Unlock()
+	require.Len(t, l6, 2)
+	for _, f := range l6 {
+		require.True(t, f.Virtual)
+		require.Len(t, f.BlobReferences, 1)
+	}
+	after := liveSize()
+	require.NotZero(t, after)
+	require.True(t, after < before, "%d >= %d", after, before)
+	require.NoError(t, d.Close())
+}
+
+func TestExciseCompactVirtualTableExclusiveBound(t *testing.T) {
+	d, err := Open("", &Options{FS: vfs.NewMem()})
+	require.NoError(t, err)
+
+	require.NoError(t, d.DeleteRange([]byte("b"), []byte("d"), nil))
+	for _, k := range []string{"a", "c", "d", "e"} {
+		require.NoError(t, d.Set([]byte(k), nil, nil))
+	}
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	require.NoError(t, d.IngestAndExcise(nil, KeyRange{Start: []byte("c"), End: []byte("e")}))
+
+	// The virtual table to the left of the span has an exclusive upper bound.
+	// Compacting it must not read the keys of the backing table beyond that
+	// bound.
+	require.NoError(t, d.Set([]byte("a"), nil, nil))
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	var keys []string
+	it := d.NewIter(nil)
+	for valid := it.First(); valid; valid = it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	require.NoError(t, it.Close())
+	require.Equal(t, []string{"a", "e"}, keys)
+	require.NoError(t, d.Close())
+}
+
+func TestExciseConcurrentFlush(t *testing.T) {
+	var blocking int32
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	opts := &Options{
+		FS:                          vfs.NewMem(),
+		MemTableSize:                256 << 10,
+		MemTableStopWritesThreshold: 4,
+	}
+	opts.EventListener.TableCreated = func(TableCreateInfo) {
+		if atomic.CompareAndSwapInt32(&blocking, 1, 0) {
+			close(blocked)
+			<-unblock
+		}
+	}
+	d, err := Open("", opts)
+	require.NoError(t, err)
+
+	// Stall a flush while the memtable holding the data in the excise span is
+	// queued behind it.
+	require.NoError(t, d.Set([]byte("a"), nil, nil))
+	atomic.StoreInt32(&blocking, 1)
+	flushed, err := d.AsyncFlush()
+	require.NoError(t, err)
+	<-blocked
+	require.NoError(t, d.Set([]byte("k"), nil, nil))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.IngestAndExcise(nil, KeyRange{Start: []byte("k"), End: []byte("l")})
+	}()
+	for sequenced := false; !sequenced; {
+		d.mu.Lock()
+		sequenced = d.mu.excise.sequenced == 1
+		d.mu.Unlock()
+	}
+	// A snapshot can be created while the excise is pending.
+	require.NoError(t, d.NewSnapshot().Close())
+
+	// Commit a large batch, which is queued as a flushable after the memtable
+	// holding the data in the span. It must not be flushed together with that
+	// memtable, as the flushed table would straddle the sequence number of the
+	// excise. The commit completes once the excise has been applied.
+	queued := func() int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.mu.mem.queue)
+	}
+	n := queued()
+	value := make([]byte, 200<<10)
+	setCh := make(chan error, 1)
+	go func() {
+		setCh <- d.Set([]byte("k1"), value, nil)
+	}()
+	for queued() == n {
+	}
+	close(unblock)
+	<-flushed
+	require.NoError(t, <-errCh)
+	require.NoError(t, <-setCh)
+
+	_, _, err = d.Get([]byte("k"))
+	require.Equal(t, ErrNotFound, err)
+	v, closer, err := d.Get([]byte("k1"))
+	require.NoError(t, err)
+	require.Equal(t, value, v)
+	require.NoError(t, closer.Close())
+
+	// An excise is rejected if an open snapshot can read the excised data, but
+	// not if the data was written after the snapshot was created.
+	s := d.NewSnapshot()
+	require.NoError(t, d.Set([]byte("c"), nil, nil))
+	require.NoError(t, d.Flush())
+	err = d.IngestAndExcise(nil, KeyRange{Start: []byte("a"), End: []byte("b")})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "visible to an open snapshot")
+	require.NoError(t, d.IngestAndExcise(nil, KeyRange{Start: []byte("c"), End: []byte("d")}))
+	v, closer, err = s.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Empty(t, v)
+	require.NoError(t, closer.Close())
+	require.NoError(t, s.Close())
+	require.NoError(t, d.IngestAndExcise(nil, KeyRange{Start: []byte("a"), End: []byte("b")}))
+	_, _, err = d.Get([]byte("a"))
+	require.Equal(t, ErrNotFound, err)
+	_, _, err = d.Get([]byte("c"))
+	require.Equal(t, ErrNotFound, err)
+	require.NoError(t, d.Close())
+}
@@ -24,6 +24,7 @@ const (
 	fileTypeCurrent  = base.FileTypeCurrent
 	fileTypeOptions  = base.FileTypeOptions
 	fileTypeTemp     = base.FileTypeTemp
+	fileTypeBlob     = base.FileTypeBlob
 )
 
 func setCurrentFile(dirname string, fs vfs.FS, fileNum FileNum) error {
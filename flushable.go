@@ -14,6 +14,7 @@ type flushable interface {
 	newIter(o *IterOptions) internalIterator
 	newFlushIter(o *IterOptions, bytesFlushed *uint64) internalIterator
 	newRangeDelIter(o *IterOptions) internalIterator
+	newRangeKeyIter(o *IterOptions) internalIterator
 	// inuseBytes returns the number of inuse bytes by the flushable.
 	inuseBytes() uint64
 	// totalBytes returns the total number of bytes allocated by the flushable.
@@ -33,6 +34,11 @@ type flushableEntry struct {
 	// flushForced indicates whether a flush was forced on this memtable (either
 	// manual, or due to ingestion). Protected by DB.mu.
 	flushForced bool
+	// flushHold is the number of pending excises which prevent the receiver,
+	// and the flushables queued after it, from being flushed. The data written
+	// after an excise is sequenced must not reach the sstables until the excise
+	// has been applied. Protected by DB.mu.
+	flushHold int
 	// logNum corresponds to the WAL that contains the records present in the
 	// receiver.
 	logNum FileNum
@@ -0,0 +1,96 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+)
+
+// FormatMajorVersion is a constant controlling the format of persisted data.
+// Backwards incompatible changes to the persisted data, such as the
+// introduction of new key kinds, are gated behind new format major versions.
+//
+// A DB's format major version is recorded in its MANIFEST, and only ever
+// increases. Once a DB has been ratcheted past FormatMostCompatible, older
+// versions of Pebble are unable to open it.
+type FormatMajorVersion uint64
+
+const (
+	// FormatDefault leaves the format major version unspecified. The
+	// FormatDefault constant may be ratcheted upwards over time.
+	FormatDefault FormatMajorVersion = iota
+	// FormatMostCompatible maintains the most backwards compatibility,
+	// maintaining bi-directional compatibility with RocksDB and earlier
+	// versions of Pebble.
+	FormatMostCompatible
+	// FormatRangeKeys is a format major version that introduces range keys
+	// (see Batch.RangeKeySet, Batch.RangeKeyUnset and Batch.RangeKeyDelete),
+	// which are written with the InternalKeyKindRangeKey* key kinds.
+	FormatRangeKeys
+	// FormatNewest always contains the most recent format major version.
+	FormatNewest FormatMajorVersion = FormatRangeKeys
+)
+
+// String implements fmt.Stringer.
+func (v FormatMajorVersion) String() string {
+	if v == FormatDefault {
+		return "(default)"
+	}
+	return fmt.Sprintf("%03d", uint64(v))
+}
+
+// FormatMajorVersion returns the DB's active format major version.
+func (d *DB) FormatMajorVersion() FormatMajorVersion {
+	return FormatMajorVersion(atomic.LoadUint64(&d.mu.versions.formatMajorVersion))
+}
+
+// RatchetFormatMajorVersion ratchets the opened database's format major
+// version to the provided version. It errors if the provided format major
+// version is below the database's current version, or is not supported.
+// Ratcheting to the current version is a no-op.
+func (d *DB) RatchetFormatMajorVersion(fmv FormatMajorVersion) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if fmv > FormatNewest {
+		return errors.Errorf("pebble: unsupported format major version %d", errors.Safe(uint64(fmv)))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if current := d.FormatMajorVersion(); fmv < current {
+		return errors.Errorf("pebble: database already at format major version %s", errors.Safe(current))
+	} else if fmv == current {
+		return nil
+	}
+
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	d.mu.versions.logLock()
+	if err := d.mu.versions.logAndApply(jobID, &versionEdit{FormatMajorVersion: uint64(fmv)},
+		nil /* metrics */, d.dataDir, func() []compactionInfo {
+			return d.getInProgressCompactionInfoLocked(nil)
+		}); err != nil {
+		return err
+	}
+	d.updateReadStateLocked(d.opts.DebugCheck)
+	return nil
+}
+
+// checkFormatMajorVersion returns an error if the DB's format major version
+// is below fmv, which is required by the named feature.
+func (d *DB) checkFormatMajorVersion(fmv FormatMajorVersion, feature string) error {
+	if current := d.FormatMajorVersion(); current < fmv {
+		return errors.Errorf("pebble: %s require at least format major version %s (current: %s)",
+			errors.Safe(feature), errors.Safe(fmv), errors.Safe(current))
+	}
+	return nil
+}
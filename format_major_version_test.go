@@ -0,0 +1,59 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatMajorVersion(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{FS: mem})
+	require.NoError(t, err)
+	require.Equal(t, FormatMostCompatible, d.FormatMajorVersion())
+
+	// Range keys are rejected until the DB is ratcheted to FormatRangeKeys.
+	require.Error(t, d.RangeKeySet([]byte("a"), []byte("c"), []byte("@1"), []byte("v"), nil))
+	require.NoError(t, d.RatchetFormatMajorVersion(FormatRangeKeys))
+	require.Equal(t, FormatRangeKeys, d.FormatMajorVersion())
+	require.NoError(t, d.RangeKeySet([]byte("a"), []byte("c"), []byte("@1"), []byte("v"), nil))
+
+	// The format major version cannot be lowered, and unknown versions are
+	// rejected. Ratcheting to the current version is a no-op.
+	require.Error(t, d.RatchetFormatMajorVersion(FormatMostCompatible))
+	require.Error(t, d.RatchetFormatMajorVersion(FormatNewest+1))
+	require.NoError(t, d.RatchetFormatMajorVersion(FormatRangeKeys))
+	require.NoError(t, d.Close())
+
+	// The format major version persists across a reopen, including across
+	// the MANIFEST rotation performed when opening.
+	for i := 0; i < 2; i++ {
+		d, err = Open("", &Options{FS: mem})
+		require.NoError(t, err)
+		require.Equal(t, FormatRangeKeys, d.FormatMajorVersion())
+		require.NoError(t, d.Close())
+	}
+
+	// A DB is created at, or ratcheted up to, the configured version.
+	d, err = Open("new", &Options{FS: mem, FormatMajorVersion: FormatRangeKeys})
+	require.NoError(t, err)
+	require.Equal(t, FormatRangeKeys, d.FormatMajorVersion())
+	require.NoError(t, d.Close())
+
+	require.NoError(t, mem.MkdirAll("old", 0755))
+	d, err = Open("old", &Options{FS: mem})
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	d, err = Open("old", &Options{FS: mem, FormatMajorVersion: FormatRangeKeys})
+	require.NoError(t, err)
+	require.Equal(t, FormatRangeKeys, d.FormatMajorVersion())
+	require.NoError(t, d.Close())
+
+	_, err = Open("newest", &Options{FS: mem, FormatMajorVersion: FormatNewest + 1})
+	require.Error(t, err)
+}
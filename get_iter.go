@@ -19,9 +19,11 @@ type getIter struct {
 	logger       Logger
 	cmp          Compare
 	equal        Equal
+	split        Split
 	newIters     tableNewIters
 	snapshot     uint64
 	key          []byte
+	prefix       []byte
 	iter         internalIterator
 	rangeDelIter internalIterator
 	tombstone    rangedel.Tombstone
@@ -29,7 +31,7 @@ type getIter struct {
 	level        int
 	batch        *Batch
 	mem          flushableList
-	l0           []*fileMetadata
+	l0           [][]*fileMetadata
 	version      *version
 	iterKey      *InternalKey
 	iterValue    []byte
@@ -137,18 +139,15 @@ func (g *getIter) Next() (*InternalKey, []byte) {
 		}
 
 		if g.level == 0 {
-			// Create iterators from L0 from newest to oldest.
+			// Create iterators from the L0 sublevels from newest to oldest.
 			if n := len(g.l0); n > 0 {
-				l := g.l0[n-1]
-				g.iter, g.rangeDelIter, g.err = g.newIters(
-					l,
-					nil, /* iter options */
-					nil /* bytes iterated */)
-				if g.err != nil {
-					return nil, nil
-				}
+				files := g.l0[n-1]
 				g.l0 = g.l0[:n-1]
-				g.iterKey, g.iterValue = g.iter.SeekGE(g.key)
+				iterOpts := IterOptions{logger: g.logger}
+				g.levelIter.init(iterOpts, g.cmp, g.split, g.newIters, files, 0, nil)
+				g.levelIter.initRangeDel(&g.rangeDelIter)
+				g.iter = &g.levelIter
+				g.iterKey, g.iterValue = g.iter.SeekPrefixGE(g.keyPrefix(), g.key)
 				continue
 			}
 			g.level++
@@ -163,12 +162,26 @@ func (g *getIter) Next() (*InternalKey, []byte) {
 		}
 
 		iterOpts := IterOptions{logger: g.logger}
-		g.levelIter.init(iterOpts, g.cmp, g.newIters, g.version.Files[g.level], g.level, nil)
+		g.levelIter.init(iterOpts, g.cmp, g.split, g.newIters, g.version.Files[g.level], g.level, nil)
 		g.levelIter.initRangeDel(&g.rangeDelIter)
 		g.level++
 		g.iter = &g.levelIter
-		g.iterKey, g.iterValue = g.iter.SeekGE(g.key)
+		g.iterKey, g.iterValue = g.iter.SeekPrefixGE(g.keyPrefix(), g.key)
+	}
+}
+
+// keyPrefix returns the prefix of the key being looked up, which is used to
+// seek the sstables so that their filters are consulted. Without a split
+// function the prefix is the whole key, matching the whole key filters that
+// the sstables are then written with.
+func (g *getIter) keyPrefix() []byte {
+	if g.prefix == nil {
+		g.prefix = g.key
+		if g.split != nil {
+			g.prefix = g.key[:g.split(g.key)]
+		}
 	}
+	return g.prefix
 }
 
 func (g *getIter) Prev() (*InternalKey, []byte) {
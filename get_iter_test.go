@@ -539,7 +539,7 @@ func TestGetIter(t *testing.T) {
 			get.equal = equal
 			get.newIters = newIter
 			get.key = ikey.UserKey
-			get.l0 = v.Files[0]
+			get.l0 = v.L0Sublevels(cmp).Levels
 			get.version = v
 			get.snapshot = ikey.SeqNum() + 1
 
@@ -12,6 +12,7 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/private"
+	"github.com/cockroachdb/pebble/internal/rangekey"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 )
@@ -116,6 +117,7 @@ func ingestLoad1(
 			if !smallestSet ||
 				base.InternalCompare(opts.Comparer.Compare, meta.Smallest, *key) > 0 {
 				meta.Smallest = key.Clone()
+				smallestSet = true
 			}
 		}
 		if err := iter.Error(); err != nil {
@@ -130,10 +132,55 @@ func ingestLoad1(
 			if !largestSet ||
 				base.InternalCompare(opts.Comparer.Compare, meta.Largest, end) < 0 {
 				meta.Largest = end.Clone()
+				largestSet = true
 			}
 		}
 	}
 
+	rangeKeyIter, err := r.NewRangeKeyIter()
+	if err != nil {
+		return nil, err
+	}
+	if rangeKeyIter != nil {
+		defer rangeKeyIter.Close()
+		// The range keys in an sstable are fragmented, so the last range key has
+		// the largest end key.
+		if key, _ := rangeKeyIter.First(); key != nil {
+			if err := ingestValidateKey(opts, key); err != nil {
+				return nil, err
+			}
+			empty = false
+			meta.HasRangeKeys = true
+			if !smallestSet ||
+				base.InternalCompare(opts.Comparer.Compare, meta.Smallest, *key) > 0 {
+				meta.Smallest = key.Clone()
+				smallestSet = true
+			}
+		}
+		if err := rangeKeyIter.Error(); err != nil {
+			return nil, err
+		}
+		if key, val := rangeKeyIter.Last(); key != nil {
+			if err := ingestValidateKey(opts, key); err != nil {
+				return nil, err
+			}
+			end, _, _, ok := rangekey.DecodeValue(val)
+			if !ok {
+				return nil, errors.Errorf("pebble: external sstable has corrupted range key: %s",
+					key.Pretty(opts.Comparer.Format))
+			}
+			largest := base.MakeRangeDeleteSentinelKey(end)
+			if !largestSet ||
+				base.InternalCompare(opts.Comparer.Compare, meta.Largest, largest) < 0 {
+				meta.Largest = largest.Clone()
+				largestSet = true
+			}
+		}
+		if err := rangeKeyIter.Error(); err != nil {
+			return nil, err
+		}
+	}
+
 	if empty {
 		return nil, nil
 	}
@@ -279,6 +326,23 @@ func ingestMemtableOverlaps(cmp Compare, mem flushable, meta []*fileMetadata) bo
 			return true
 		}
 	}
+
+	if rangeKeyIter := mem.newRangeKeyIter(nil); rangeKeyIter != nil {
+		defer rangeKeyIter.Close()
+		// The range keys in a memtable are not fragmented, so every range key
+		// needs to be examined.
+		for key, value := rangeKeyIter.First(); key != nil; key, value = rangeKeyIter.Next() {
+			end, _, _, ok := rangekey.DecodeValue(value)
+			if !ok {
+				continue
+			}
+			for _, m := range meta {
+				if cmp(key.UserKey, m.Largest.UserKey) <= 0 && cmp(end, m.Smallest.UserKey) > 0 {
+					return true
+				}
+			}
+		}
+	}
 	return false
 }
 
@@ -405,7 +469,7 @@ func ingestTargetLevel(
 
 	level := baseLevel
 	for ; level < numLevels; level++ {
-		levelIter := newLevelIter(iterOps, cmp, newIters, v.Files[level], level, nil)
+		levelIter := newLevelIter(iterOps, cmp, nil /* split */, newIters, v.Files[level], level, nil)
 		var rangeDelIter internalIterator
 		// Pass in a non-nil pointer to rangeDelIter so that levelIter.findFileGE sets it up for the target file.
 		levelIter.initRangeDel(&rangeDelIter)
@@ -486,6 +550,49 @@ func (d *DB) Ingest(paths []string) error {
 	if d.opts.ReadOnly {
 		return ErrReadOnly
 	}
+	if d.opts.Follower {
+		return ErrFollower
+	}
+	return d.ingest(paths, nil /* exciseSpan */)
+}
+
+// IngestAndExcise ingests a set of sstables into the DB while atomically
+// removing all of the existing data in exciseSpan, as if the ingestion were
+// preceded by a DeleteRange and RangeKeyDelete of the span in the same batch.
+// The sstables being ingested must lie within exciseSpan. See Ingest for the
+// requirements on the sstables.
+//
+// Rather than writing tombstones which compactions must later process, the
+// excise is performed in the same version edit which adds the ingested
+// sstables: sstables lying within the span are dropped, and sstables
+// straddling a boundary of the span are replaced by sstables containing only
+// their data outside of the span. The memtables are flushed first. As the
+// span is then empty, the ingested sstables can usually be placed in the
+// bottommost level of the LSM.
+//
+// An excise does not retain the data in the span for open snapshots. If a
+// snapshot created before the excise could read any of the data being
+// excised, an error is returned and nothing is ingested or excised. Snapshots
+// which cannot read the excised data, such as those created before all of
+// it was written, do not prevent the excise, nor do snapshots created
+// afterwards.
+func (d *DB) IngestAndExcise(paths []string, exciseSpan KeyRange) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if d.opts.Follower {
+		return ErrFollower
+	}
+	if d.cmp(exciseSpan.Start, exciseSpan.End) >= 0 {
+		return errors.New("pebble: excise span start key must be less than end key")
+	}
+	return d.ingest(paths, &exciseSpan)
+}
+
+func (d *DB) ingest(paths []string, exciseSpan *KeyRange) error {
 
 	// Allocate file numbers for all of the files being ingested and mark them as
 	// pending in order to prevent them from being deleted. Note that this causes
@@ -507,15 +614,30 @@ func (d *DB) Ingest(paths []string) error {
 	if err != nil {
 		return err
 	}
-	if len(meta) == 0 {
+	if len(meta) == 0 && exciseSpan == nil {
 		// All of the sstables to be ingested were empty. Nothing to do.
 		return nil
 	}
+	for i := range meta {
+		if meta[i].HasRangeKeys {
+			if err := d.checkFormatMajorVersion(FormatRangeKeys, "range keys"); err != nil {
+				return err
+			}
+			break
+		}
+	}
 
 	// Verify the sstables do not overlap.
 	if err := ingestSortAndVerify(d.cmp, meta, paths); err != nil {
 		return err
 	}
+	if exciseSpan != nil {
+		for i, m := range meta {
+			if !exciseContains(d.cmp, *exciseSpan, m) {
+				return errors.Errorf("pebble: external sstable %s is not within the excise span", paths[i])
+			}
+		}
+	}
 
 	// Hard link the sstables into the DB directory. Since the sstables aren't
 	// referenced by a version, they won't be used. If the hard linking fails
@@ -534,12 +656,43 @@ func (d *DB) Ingest(paths []string) error {
 	}
 
 	var mem *flushableEntry
+	// The excises sequenced before this ingestion, which must be applied first.
+	var excisesBefore int
+	// The memtable holding the data written after the excise is sequenced,
+	// which must not be flushed until the excise has been applied.
+	var hold *flushableEntry
 	prepare := func() {
 		// Note that d.commit.mu is held by commitPipeline when calling prepare.
 
 		d.mu.Lock()
 		defer d.mu.Unlock()
 
+		excisesBefore = d.mu.excise.sequenced
+		if exciseSpan != nil {
+			d.mu.excise.sequenced++
+			// All of the data in the excise span must be in sstables when the
+			// excise is applied, and none of the data written after the excise is
+			// sequenced may be. Rotate the mutable memtable so that the memtables
+			// preceding the new one contain only older data, flush them, and hold
+			// back the flush of the new memtable (and of those queued after it)
+			// until the excise has been applied. An empty memtable which a batch
+			// has reserved space in, but not yet been applied to, is rotated too.
+			mutable := d.mu.mem.mutable
+			if n := len(d.mu.mem.queue); !mutable.empty() || atomic.LoadInt32(&mutable.writerRefs) > 1 {
+				mem = d.mu.mem.queue[n-1]
+				err = d.makeRoomForWrite(nil)
+			} else if n > 1 {
+				mem = d.mu.mem.queue[n-2]
+			}
+			hold = d.mu.mem.queue[len(d.mu.mem.queue)-1]
+			hold.flushHold++
+			if mem != nil {
+				mem.flushForced = true
+				d.maybeScheduleFlush()
+			}
+			return
+		}
+
 		// Check to see if any files overlap with any of the memtables. The queue
 		// is ordered from oldest to newest with the mutable memtable being the
 		// last element in the slice. We want to wait for the newest table that
@@ -560,6 +713,15 @@ func (d *DB) Ingest(paths []string) error {
 
 	var ve *versionEdit
 	apply := func(seqNum uint64) {
+		// Wait for the excises sequenced before this ingestion to be applied. A
+		// table ingested first could otherwise be compacted together with the
+		// data being excised.
+		d.mu.Lock()
+		for d.mu.excise.applied < excisesBefore {
+			d.mu.compact.cond.Wait()
+		}
+		d.mu.Unlock()
+
 		if err != nil {
 			// An error occurred during prepare.
 			return
@@ -579,10 +741,30 @@ func (d *DB) Ingest(paths []string) error {
 
 		// Assign the sstables to the correct level in the LSM and apply the
 		// version edit.
-		ve, err = d.ingestApply(jobID, meta)
+		ve, err = d.ingestApply(jobID, meta, exciseSpan, seqNum)
 	}
 
-	d.commit.AllocateSeqNum(len(meta), prepare, apply)
+	// NB: An excise without any sstables to ingest still needs a sequence
+	// number to order it with respect to the memtables.
+	count := len(meta)
+	if count == 0 {
+		count = 1
+	}
+	d.commit.AllocateSeqNum(count, prepare, apply)
+
+	if exciseSpan != nil {
+		// The excise is released once its sequence number has been published, so
+		// that a new snapshot cannot precede it.
+		d.mu.Lock()
+		if hold != nil {
+			hold.flushHold--
+		}
+		d.mu.excise.applied++
+		d.mu.excise.installing = false
+		d.mu.compact.cond.Broadcast()
+		d.maybeScheduleFlush()
+		d.mu.Unlock()
+	}
 
 	if err != nil {
 		if err2 := ingestCleanup(d.opts.FS, d.dirname, meta); err2 != nil {
@@ -597,16 +779,20 @@ func (d *DB) Ingest(paths []string) error {
 	}
 
 	info := TableIngestInfo{
-		JobID:        jobID,
-		GlobalSeqNum: meta[0].SmallestSeqNum,
-		Err:          err,
+		JobID: jobID,
+		Err:   err,
+	}
+	if len(meta) > 0 {
+		info.GlobalSeqNum = meta[0].SmallestSeqNum
 	}
 	if ve != nil {
+		// NB: The version edit's new files begin with the ingested sstables,
+		// which are followed by the sstables written by an excise.
 		info.Tables = make([]struct {
 			TableInfo
 			Level int
-		}, len(ve.NewFiles))
-		for i := range ve.NewFiles {
+		}, len(meta))
+		for i := range meta {
 			e := &ve.NewFiles[i]
 			info.Tables[i].Level = e.Level
 			info.Tables[i].TableInfo = e.Meta.TableInfo()
@@ -617,10 +803,23 @@ func (d *DB) Ingest(paths []string) error {
 	return err
 }
 
-func (d *DB) ingestApply(jobID int, meta []*fileMetadata) (*versionEdit, error) {
+func (d *DB) ingestApply(
+	jobID int, meta []*fileMetadata, exciseSpan *KeyRange, seqNum uint64,
+) (*versionEdit, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	var exciseVE *versionEdit
+	var excised []*fileMetadata
+	if exciseSpan != nil {
+		var err error
+		exciseVE, excised, err = d.excise(jobID, *exciseSpan, seqNum)
+		defer d.exciseDone(excised)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	ve := &versionEdit{
 		NewFiles: make([]newFileEntry, len(meta)),
 	}
@@ -634,6 +833,12 @@ func (d *DB) ingestApply(jobID int, meta []*fileMetadata) (*versionEdit, error)
 	// returns must unlock the manifest.
 	d.mu.versions.logLock()
 	current := d.mu.versions.currentVersion()
+	if exciseVE != nil {
+		// The sstables are placed in the LSM as it will be once the excise is
+		// applied.
+		current = exciseVersion(d.cmp, current, exciseVE)
+		ve.DeletedFiles = exciseVE.DeletedFiles
+	}
 	baseLevel := d.mu.versions.picker.getBaseLevel()
 	iterOps := IterOptions{logger: d.opts.Logger}
 	for i := range meta {
@@ -641,11 +846,18 @@ func (d *DB) ingestApply(jobID int, meta []*fileMetadata) (*versionEdit, error)
 		// overlap any existing files in the level.
 		m := meta[i]
 		f := &ve.NewFiles[i]
-		var err error
-		f.Level, err = ingestTargetLevel(d.newIters, iterOps, d.cmp, current, baseLevel, d.mu.compact.inProgress, m)
-		if err != nil {
-			d.mu.versions.logUnlock()
-			return nil, err
+		if d.opts.CompactionStyle == CompactionStyleFIFO {
+			// FIFO compaction drops the oldest tables of L0 first, and never
+			// compacts them into the levels beneath, so ingested tables are
+			// always added to L0.
+			f.Level = 0
+		} else {
+			var err error
+			f.Level, err = ingestTargetLevel(d.newIters, iterOps, d.cmp, current, baseLevel, d.mu.compact.inProgress, m)
+			if err != nil {
+				d.mu.versions.logUnlock()
+				return nil, err
+			}
 		}
 		f.Meta = m
 		levelMetrics := metrics[f.Level]
@@ -656,12 +868,39 @@ func (d *DB) ingestApply(jobID int, meta []*fileMetadata) (*versionEdit, error)
 		levelMetrics.BytesIngested += m.Size
 		levelMetrics.TablesIngested++
 	}
+	// exciseFailed marks the sstables written by the excise obsolete, as they
+	// are no longer needed.
+	exciseFailed := func() {
+		var fileNums []FileNum
+		for _, nf := range exciseVE.NewFiles {
+			if !nf.Meta.Virtual {
+				fileNums = append(fileNums, nf.Meta.FileNum)
+			}
+		}
+		d.addObsoletePendingOutputsLocked(exciseVE, fileNums)
+	}
+	if exciseVE != nil {
+		ve.NewFiles = append(ve.NewFiles, exciseVE.NewFiles...)
+		// The open snapshots are checked only now, as d.mu may have been dropped
+		// since the excise was computed. No snapshot is created from here until
+		// the excise's sequence number is published.
+		if err := d.checkExciseSnapshotsLocked(excised, seqNum); err != nil {
+			d.mu.versions.logUnlock()
+			exciseFailed()
+			return nil, err
+		}
+		d.mu.excise.installing = true
+	}
 	if err := d.mu.versions.logAndApply(jobID, ve, metrics, d.dataDir, func() []compactionInfo {
 		return d.getInProgressCompactionInfoLocked(nil)
 	}); err != nil {
+		if exciseVE != nil {
+			exciseFailed()
+		}
 		return nil, err
 	}
 	d.updateReadStateLocked(d.opts.DebugCheck)
+	d.maybeCollectTableStatsLocked()
 	d.deleteObsoleteFiles(jobID)
 	// The ingestion may have pushed a level over the threshold for compaction,
 	// so check to see if one is necessary and schedule it.
@@ -502,6 +502,8 @@ func TestIngest(t *testing.T) {
 			L0CompactionThreshold: 100,
 			L0StopWritesThreshold: 100,
 			DebugCheck:            DebugCheckLevels,
+
+			disableDeleteOnlyCompactions: true,
 		})
 		require.NoError(t, err)
 	}
@@ -578,6 +580,7 @@ func TestIngestError(t *testing.T) {
 		require.NoError(t, d.Set([]byte("a"), nil, nil))
 		require.NoError(t, d.Set([]byte("d"), nil, nil))
 		require.NoError(t, d.Flush())
+		d.waitTableStats()
 
 		t.Run(fmt.Sprintf("index-%d", i), func(t *testing.T) {
 			defer func() {
@@ -597,6 +600,7 @@ func TestIngestError(t *testing.T) {
 			inj.SetIndex(i)
 			err1 := d.Ingest([]string{"ext0"})
 			err2 := d.Ingest([]string{"ext1"})
+			d.waitTableStats()
 			err := firstError(err1, err2)
 			if err != nil && !errors.Is(err, errorfs.ErrInjected) {
 				t.Fatal(err)
@@ -876,12 +880,12 @@ func TestIngestFlushQueuedLargeBatch(t *testing.T) {
 	// size in order to more easily create a situation where a large batch is
 	// queued but not automatically flushed.
 	d.mu.Lock()
-	d.largeBatchThreshold = d.opts.MemTableSize / 8
+	d.largeBatchThreshold = int64(d.opts.MemTableSize / 8)
 	d.mu.Unlock()
 
 	// Set a record with a large value. This will be transformed into a large
 	// batch and placed in the flushable queue.
-	require.NoError(t, d.Set([]byte("a"), bytes.Repeat([]byte("v"), d.largeBatchThreshold), nil))
+	require.NoError(t, d.Set([]byte("a"), bytes.Repeat([]byte("v"), int(d.largeBatchThreshold)), nil))
 
 	ingest := func(keys ...string) {
 		t.Helper()
@@ -900,3 +904,87 @@ func TestIngestFlushQueuedLargeBatch(t *testing.T) {
 
 	require.NoError(t, d.Close())
 }
+
+func TestIngestAndExcise(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{
+		FS: mem,
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+
+	set := func(keys ...string) {
+		t.Helper()
+		for _, k := range keys {
+			require.NoError(t, d.Set([]byte(k), []byte("old"), nil))
+		}
+	}
+	writeExternal := func(name string, keys ...string) {
+		t.Helper()
+		f, err := mem.Create(name)
+		require.NoError(t, err)
+		w := sstable.NewWriter(f, sstable.WriterOptions{})
+		for _, k := range keys {
+			require.NoError(t, w.Set([]byte(k), []byte("new")))
+		}
+		require.NoError(t, w.Close())
+	}
+	contents := func() string {
+		t.Helper()
+		iter := d.NewIter(nil)
+		var buf strings.Builder
+		for valid := iter.First(); valid; valid = iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s ", iter.Key(), iter.Value())
+		}
+		require.NoError(t, iter.Close())
+		return strings.TrimSpace(buf.String())
+	}
+	span := func(start, end string) KeyRange {
+		return KeyRange{Start: []byte(start), End: []byte(end)}
+	}
+
+	// An L6 table and an L0 table straddle the excise span, and the memtable
+	// contains a key within the span.
+	set("a", "b", "c", "d", "e")
+	require.NoError(t, d.Compact([]byte("a"), []byte("f")))
+	set("c2", "m")
+	require.NoError(t, d.Flush())
+	set("c1")
+
+	writeExternal("ext1", "b", "cc")
+	require.NoError(t, d.IngestAndExcise([]string{"ext1"}, span("b", "d")))
+	require.Equal(t, "a:old b:new cc:new d:old e:old m:old", contents())
+
+	// The keys outside of the span are retained by replacing the straddling
+	// tables with virtual tables, which frees the lowest level for the ingested
+	// table.
+	d.mu.Lock()
+	v := d.mu.versions.currentVersion()
+	var ingested bool
+	for _, f := range v.Files[numLevels-1] {
+		if string(f.Smallest.UserKey) == "b" && string(f.Largest.UserKey) == "cc" {
+			ingested = true
+		}
+	}
+	for level := range v.Files {
+		for _, f := range v.Files[level] {
+			require.False(t, f.Compacting)
+		}
+	}
+	d.mu.Unlock()
+	require.True(t, ingested)
+
+	// An excise without any tables to ingest deletes the span.
+	require.NoError(t, d.IngestAndExcise(nil, span("a", "c")))
+	require.Equal(t, "cc:new d:old e:old m:old", contents())
+
+	// The ingested tables must lie within the span.
+	writeExternal("ext2", "d", "z")
+	require.EqualError(t, d.IngestAndExcise([]string{"ext2"}, span("d", "z")),
+		"pebble: external sstable ext2 is not within the excise span")
+	require.EqualError(t, d.IngestAndExcise(nil, span("d", "d")),
+		"pebble: excise span start key must be less than end key")
+	require.Equal(t, "cc:new d:old e:old m:old", contents())
+}
@@ -30,6 +30,7 @@ const (
 	FileTypeCurrent
 	FileTypeOptions
 	FileTypeTemp
+	FileTypeBlob
 )
 
 // MakeFilename builds a filename from components.
@@ -49,6 +50,8 @@ func MakeFilename(fs vfs.FS, dirname string, fileType FileType, fileNum FileNum)
 		return fs.PathJoin(dirname, fmt.Sprintf("OPTIONS-%s", fileNum))
 	case FileTypeTemp:
 		return fs.PathJoin(dirname, fmt.Sprintf("CURRENT.%s.dbtmp", fileNum))
+	case FileTypeBlob:
+		return fs.PathJoin(dirname, fmt.Sprintf("%s.blob", fileNum))
 	}
 	panic("unreachable")
 }
@@ -94,6 +97,8 @@ func ParseFilename(fs vfs.FS, filename string) (fileType FileType, fileNum FileN
 			return FileTypeTable, fileNum, true
 		case "log":
 			return FileTypeLog, fileNum, true
+		case "blob":
+			return FileTypeBlob, fileNum, true
 		}
 	}
 	return 0, fileNum, false
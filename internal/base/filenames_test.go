@@ -19,6 +19,8 @@ func TestParseFilename(t *testing.T) {
 		"abcdef.log":           false,
 		"000001ldb":            false,
 		"000001.sst":           true,
+		"000001.blob":          true,
+		"000001.blb":           false,
 		"CURRENT":              true,
 		"CURRaNT":              false,
 		"LOCK":                 true,
@@ -58,6 +60,7 @@ func TestFilenameRoundTrip(t *testing.T) {
 		FileTypeTable:    true,
 		FileTypeOptions:  true,
 		FileTypeTemp:     true,
+		FileTypeBlob:     true,
 	}
 	fs := vfs.NewMem()
 	for fileType, numbered := range testCases {
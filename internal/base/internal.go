@@ -36,6 +36,21 @@ const (
 	// InternalKeyKindColumnFamilyBlobIndex                    = 16
 	// InternalKeyKindBlobIndex                                = 17
 
+	// InternalKeyKindBlobIndex is a SET whose value is stored in a blob file.
+	// The value stored in the sstable is an encoded handle for the value in
+	// the blob file. Blob index keys only appear in sstables. RocksDB uses 17
+	// for its blob index kind, which Pebble uses for index separators.
+	InternalKeyKindBlobIndex = 18
+
+	// InternalKeyKindRangeKeyDelete removes all range keys within a key span.
+	// InternalKeyKindRangeKeyUnset and InternalKeyKindRangeKeySet remove and
+	// set, respectively, the range key with a particular suffix within a key
+	// span. Range keys are stored separately from point keys and range
+	// deletion tombstones.
+	InternalKeyKindRangeKeyDelete = 19
+	InternalKeyKindRangeKeyUnset  = 20
+	InternalKeyKindRangeKeySet    = 21
+
 	// This maximum value isn't part of the file format. It's unlikely,
 	// but future extensions may increase this value.
 	//
@@ -45,7 +60,13 @@ const (
 	// which sorts 'less than or equal to' any other valid internalKeyKind, when
 	// searching for any kind of internal key formed by a certain user key and
 	// seqNum.
-	InternalKeyKindMax InternalKeyKind = 17
+	InternalKeyKindMax InternalKeyKind = 21
+
+	// InternalKeyKindSeparator is the kind used for the separator and successor
+	// keys written to sstable indexes. It is the value RocksDB uses for seek
+	// keys and predates the range key kinds. It is retained so that the index
+	// blocks of newly written sstables are unchanged.
+	InternalKeyKindSeparator InternalKeyKind = 17
 
 	// A marker for an invalid key.
 	InternalKeyKindInvalid InternalKeyKind = 255
@@ -66,14 +87,18 @@ const (
 )
 
 var internalKeyKindNames = []string{
-	InternalKeyKindDelete:       "DEL",
-	InternalKeyKindSet:          "SET",
-	InternalKeyKindMerge:        "MERGE",
-	InternalKeyKindLogData:      "LOGDATA",
-	InternalKeyKindSingleDelete: "SINGLEDEL",
-	InternalKeyKindRangeDelete:  "RANGEDEL",
-	InternalKeyKindMax:          "MAX",
-	InternalKeyKindInvalid:      "INVALID",
+	InternalKeyKindDelete:         "DEL",
+	InternalKeyKindSet:            "SET",
+	InternalKeyKindMerge:          "MERGE",
+	InternalKeyKindLogData:        "LOGDATA",
+	InternalKeyKindSingleDelete:   "SINGLEDEL",
+	InternalKeyKindRangeDelete:    "RANGEDEL",
+	InternalKeyKindSeparator:      "SEPARATOR",
+	InternalKeyKindBlobIndex:      "BLOBINDEX",
+	InternalKeyKindRangeKeyDelete: "RANGEKEYDEL",
+	InternalKeyKindRangeKeyUnset:  "RANGEKEYUNSET",
+	InternalKeyKindRangeKeySet:    "RANGEKEYSET",
+	InternalKeyKindInvalid:        "INVALID",
 }
 
 func (k InternalKeyKind) String() string {
@@ -130,13 +155,18 @@ func MakeRangeDeleteSentinelKey(userKey []byte) InternalKey {
 }
 
 var kindsMap = map[string]InternalKeyKind{
-	"DEL":       InternalKeyKindDelete,
-	"SINGLEDEL": InternalKeyKindSingleDelete,
-	"RANGEDEL":  InternalKeyKindRangeDelete,
-	"SET":       InternalKeyKindSet,
-	"MERGE":     InternalKeyKindMerge,
-	"INVALID":   InternalKeyKindInvalid,
-	"MAX":       InternalKeyKindMax,
+	"DEL":           InternalKeyKindDelete,
+	"SINGLEDEL":     InternalKeyKindSingleDelete,
+	"RANGEDEL":      InternalKeyKindRangeDelete,
+	"SET":           InternalKeyKindSet,
+	"MERGE":         InternalKeyKindMerge,
+	"BLOBINDEX":     InternalKeyKindBlobIndex,
+	"RANGEKEYDEL":   InternalKeyKindRangeKeyDelete,
+	"RANGEKEYUNSET": InternalKeyKindRangeKeyUnset,
+	"RANGEKEYSET":   InternalKeyKindRangeKeySet,
+	"INVALID":       InternalKeyKindInvalid,
+	"MAX":           InternalKeyKindMax,
+	"SEPARATOR":     InternalKeyKindSeparator,
 }
 
 // ParseInternalKey parses the string representation of an internal key. The
@@ -224,7 +254,7 @@ func (k InternalKey) Separator(
 		// any sequence number and kind here to create a valid separator key. We
 		// use the max sequence number to match the behavior of LevelDB and
 		// RocksDB.
-		return MakeInternalKey(buf, InternalKeySeqNumMax, InternalKeyKindMax)
+		return MakeInternalKey(buf, InternalKeySeqNumMax, InternalKeyKindSeparator)
 	}
 	return k
 }
@@ -241,7 +271,7 @@ func (k InternalKey) Successor(cmp Compare, succ Successor, buf []byte) Internal
 		// any sequence number and kind here to create a valid separator key. We
 		// use the max sequence number to match the behavior of LevelDB and
 		// RocksDB.
-		return MakeInternalKey(buf, InternalKeySeqNumMax, InternalKeyKindMax)
+		return MakeInternalKey(buf, InternalKeySeqNumMax, InternalKeyKindSeparator)
 	}
 	return k
 }
@@ -39,7 +39,7 @@ func TestInvalidInternalKey(t *testing.T) {
 		"\x01\x02\x03\x04\x05\x06\x07",
 		"foo",
 		"foo\x08\x07\x06\x05\x04\x03\x02",
-		"foo\x12\x07\x06\x05\x04\x03\x02\x01",
+		"foo\x16\x07\x06\x05\x04\x03\x02\x01",
 	}
 	for _, tc := range testCases {
 		k := DecodeInternalKey([]byte(tc))
@@ -126,12 +126,12 @@ func TestInternalKeySeparator(t *testing.T) {
 		{"foo.SET.100", "foo.DEL.100", "foo.SET.100"},
 		{"foo.SET.100", "foo.SET.101", "foo.SET.100"},
 		{"foo.SET.100", "bar.SET.99", "foo.SET.100"},
-		{"foo.SET.100", "hello.SET.200", "g.MAX.72057594037927935"},
-		{"ABC1AAAAA.SET.100", "ABC2ABB.SET.200", "ABC2.MAX.72057594037927935"},
-		{"AAA1AAA.SET.100", "AAA2AA.SET.200", "AAA2.MAX.72057594037927935"},
-		{"AAA1AAA.SET.100", "AAA4.SET.200", "AAA2.MAX.72057594037927935"},
-		{"AAA1AAA.SET.100", "AAA2.SET.200", "AAA1B.MAX.72057594037927935"},
-		{"AAA1AAA.SET.100", "AAA2A.SET.200", "AAA2.MAX.72057594037927935"},
+		{"foo.SET.100", "hello.SET.200", "g.SEPARATOR.72057594037927935"},
+		{"ABC1AAAAA.SET.100", "ABC2ABB.SET.200", "ABC2.SEPARATOR.72057594037927935"},
+		{"AAA1AAA.SET.100", "AAA2AA.SET.200", "AAA2.SEPARATOR.72057594037927935"},
+		{"AAA1AAA.SET.100", "AAA4.SET.200", "AAA2.SEPARATOR.72057594037927935"},
+		{"AAA1AAA.SET.100", "AAA2.SET.200", "AAA1B.SEPARATOR.72057594037927935"},
+		{"AAA1AAA.SET.100", "AAA2A.SET.200", "AAA2.SEPARATOR.72057594037927935"},
 		{"AAA1.SET.100", "AAA2.SET.200", "AAA1.SET.100"},
 		{"foo.SET.100", "foobar.SET.200", "foo.SET.100"},
 		{"foobar.SET.100", "foo.SET.200", "foobar.SET.100"},
@@ -0,0 +1,109 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble/internal/base"
+)
+
+// L0Sublevels organizes the files in L0 into sublevels. The files within a
+// sublevel do not overlap in user key range and are sorted by smallest key,
+// which allows a sublevel to be read like any other level. A file is placed
+// in the sublevel above the highest sublevel containing an older file it
+// overlaps. For any user key, the files in a higher sublevel therefore
+// contain newer versions of the key than the files in a lower sublevel.
+//
+// Reads from L0 need to examine one file per sublevel rather than every L0
+// file, and disjoint sets of L0 files can be compacted concurrently. The
+// number of sublevels is the read amplification of L0.
+type L0Sublevels struct {
+	// Levels holds the files in each sublevel, from the oldest sublevel (0)
+	// to the newest.
+	Levels [][]*FileMetadata
+
+	cmp   Compare
+	files []*FileMetadata
+}
+
+// NewL0Sublevels organizes the supplied L0 files into sublevels. The files
+// must be sorted by sequence number (see SortBySeqNum).
+func NewL0Sublevels(files []*FileMetadata, cmp Compare) *L0Sublevels {
+	s := &L0Sublevels{cmp: cmp, files: files}
+	for _, f := range files {
+		sublevel := 0
+		for i := len(s.Levels) - 1; i >= 0; i-- {
+			if s.overlaps(s.Levels[i], f) {
+				sublevel = i + 1
+				break
+			}
+		}
+		if sublevel == len(s.Levels) {
+			s.Levels = append(s.Levels, nil)
+		}
+		level := s.Levels[sublevel]
+		j := sort.Search(len(level), func(i int) bool {
+			return cmp(level[i].Smallest.UserKey, f.Smallest.UserKey) > 0
+		})
+		level = append(level, nil)
+		copy(level[j+1:], level[j:])
+		level[j] = f
+		s.Levels[sublevel] = level
+	}
+	return s
+}
+
+// overlaps returns true if f overlaps any of the files in a sublevel. The
+// files must be sorted by smallest key and must not overlap one another.
+func (s *L0Sublevels) overlaps(files []*FileMetadata, f *FileMetadata) bool {
+	// Find the first file which does not end before f starts.
+	i := sort.Search(len(files), func(i int) bool {
+		return !endsBefore(s.cmp, files[i], f.Smallest.UserKey)
+	})
+	return i < len(files) && !endsBefore(s.cmp, f, files[i].Smallest.UserKey)
+}
+
+// endsBefore returns true if all of the keys in f are less than key. The
+// largest key of a table is exclusive if it is a range deletion sentinel, as
+// it is for a table whose range deletions were split at the boundary with the
+// next table of a flush or compaction.
+func endsBefore(cmp Compare, f *FileMetadata, key []byte) bool {
+	c := cmp(f.Largest.UserKey, key)
+	return c < 0 || (c == 0 && f.Largest.Trailer == base.InternalKeyRangeDeleteSentinel)
+}
+
+// NumSublevelsAfterOngoingCompactions returns the number of sublevels L0
+// will contain once the in-progress compactions of L0 files have completed,
+// i.e. the number of sublevels formed by the files which are not being
+// compacted.
+func (s *L0Sublevels) NumSublevelsAfterOngoingCompactions() int {
+	var idle []*FileMetadata
+	for _, f := range s.files {
+		if !f.Compacting {
+			idle = append(idle, f)
+		}
+	}
+	if len(idle) == len(s.files) {
+		return len(s.Levels)
+	}
+	return len(NewL0Sublevels(idle, s.cmp).Levels)
+}
+
+// String returns a string representation of the sublevels, with the newest
+// sublevel first.
+func (s *L0Sublevels) String() string {
+	var buf bytes.Buffer
+	for i := len(s.Levels) - 1; i >= 0; i-- {
+		fmt.Fprintf(&buf, "0.%d:", i)
+		for _, f := range s.Levels[i] {
+			fmt.Fprintf(&buf, " %s", f.FileNum)
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+	return buf.String()
+}
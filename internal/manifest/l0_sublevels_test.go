@@ -0,0 +1,64 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package manifest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/datadriven"
+)
+
+func TestL0Sublevels(t *testing.T) {
+	parseMeta := func(s string) *FileMetadata {
+		fields := strings.Fields(s)
+		parts := strings.Split(fields[0], "-")
+		if len(parts) != 2 {
+			t.Fatalf("malformed table spec: %s", s)
+		}
+		m := &FileMetadata{
+			Smallest: base.ParseInternalKey(strings.TrimSpace(parts[0])),
+			Largest:  base.ParseInternalKey(strings.TrimSpace(parts[1])),
+		}
+		m.SmallestSeqNum = m.Smallest.SeqNum()
+		m.LargestSeqNum = m.Largest.SeqNum()
+		if m.Largest.Trailer == base.InternalKeyRangeDeleteSentinel {
+			m.LargestSeqNum = m.SmallestSeqNum
+		}
+		if m.SmallestSeqNum > m.LargestSeqNum {
+			m.SmallestSeqNum, m.LargestSeqNum = m.LargestSeqNum, m.SmallestSeqNum
+		}
+		for _, field := range fields[1:] {
+			switch field {
+			case "compacting":
+				m.Compacting = true
+			default:
+				t.Fatalf("malformed table spec: %s", s)
+			}
+		}
+		return m
+	}
+
+	datadriven.RunTest(t, "testdata/l0_sublevels",
+		func(d *datadriven.TestData) string {
+			switch d.Cmd {
+			case "define":
+				var files []*FileMetadata
+				for i, data := range strings.Split(d.Input, "\n") {
+					m := parseMeta(data)
+					m.FileNum = base.FileNum(i + 1)
+					files = append(files, m)
+				}
+				SortBySeqNum(files)
+				s := NewL0Sublevels(files, base.DefaultComparer.Compare)
+				return fmt.Sprintf("%safter-compactions: %d\n", s, s.NumSublevelsAfterOngoingCompactions())
+
+			default:
+				return fmt.Sprintf("unknown command: %s", d.Cmd)
+			}
+		})
+}
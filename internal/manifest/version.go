@@ -39,6 +39,11 @@ type TableInfo struct {
 
 // FileMetadata holds the metadata for an on-disk table.
 type FileMetadata struct {
+	// AllowedSeeks is the number of sampled reads of the table which may
+	// overlap the tables in lower levels before the table is queued for a
+	// read-triggered compaction. Accessed atomically. It is the first field
+	// of the struct to ensure 64-bit alignment.
+	AllowedSeeks int64
 	// Reference count for the file: incremented when a file is added to a
 	// version and decremented when the version is unreferenced. The file is
 	// obsolete when the reference count falls to zero.
@@ -60,11 +65,129 @@ type FileMetadata struct {
 	LargestSeqNum  uint64
 	// True if user asked us to compact this file.
 	MarkedForCompaction bool
+	// True if the file contains range keys. Range keys are stored in a
+	// separate block which only needs to be read for files with this set.
+	HasRangeKeys bool
+	// BlobReferences are the blob files referenced by the blob index keys in
+	// the table, sorted by file number.
+	BlobReferences []BlobReference
+	// True if the table is a virtual table: a sub-range of the keys in the
+	// physical sstable described by FileBacking. The Smallest and Largest
+	// bounds of a virtual table are tight, and iteration over the table is
+	// constrained to them. A virtual table inherits the sequence numbers of
+	// its backing table, and Size is an estimate of the size of the data
+	// within the bounds.
+	Virtual bool
+	// FileBacking is the physical sstable which holds the table's data. For a
+	// physical table, the backing is the table's own file and is set when the
+	// table is first added to a version. A backing is shared by every virtual
+	// table constructed from it.
+	FileBacking *FileBacking
 	// True if the file is actively being compacted. Protected by DB.mu.
 	Compacting bool
+	// Stats describe the contents of the table. Stats are loaded
+	// asynchronously after the table is added to the LSM, and are only valid
+	// if StatsValid is true. Protected by DB.mu.
+	Stats TableStats
+	// True if Stats have been loaded. Protected by DB.mu.
+	StatsValid bool
+}
+
+// TableStats contains statistics on a table used to prioritize compactions
+// which reclaim space, and to report the metrics of the levels.
+type TableStats struct {
+	// The total number of entries in the table.
+	NumEntries uint64
+	// The number of point deletions in the table.
+	NumDeletions uint64
+	// An estimate of the number of bytes in the tables in lower levels which
+	// are covered by the range deletions in the table, and would be reclaimed
+	// by compacting the table to the bottom of the LSM.
+	RangeDeletionsBytesEstimate uint64
+	// The total size of the blocks of the table for which compression was
+	// attempted, before compression and as stored in the table. Zero if the
+	// table does not record its compression statistics.
+	CompressionInputSize  uint64
+	CompressionOutputSize uint64
+}
+
+// FileBacking describes a physical sstable which backs one or more tables in
+// the LSM.
+type FileBacking struct {
+	// Reference count for the backing: the number of referenced tables backed
+	// by the file. The file is obsolete when the reference count falls to
+	// zero.
+	refs int32
+	// FileNum is the file number of the physical sstable.
+	FileNum base.FileNum
+	// Size is the size of the physical sstable, in bytes.
+	Size uint64
+}
+
+// BackingFileNum returns the file number of the physical sstable holding the
+// table's data.
+func (m *FileMetadata) BackingFileNum() base.FileNum {
+	if m.FileBacking != nil {
+		return m.FileBacking.FileNum
+	}
+	return m.FileNum
+}
+
+// ref increments the reference count of the table. The first reference to
+// the table also references its backing.
+func (m *FileMetadata) ref() {
+	if atomic.AddInt32(&m.refs, 1) == 1 {
+		if m.FileBacking == nil {
+			m.FileBacking = &FileBacking{FileNum: m.FileNum, Size: m.Size}
+		}
+		atomic.AddInt32(&m.FileBacking.refs, 1)
+	}
+}
+
+// unref decrements the reference count of the table, and returns true if the
+// table's backing is no longer referenced by any table.
+func (m *FileMetadata) unref() bool {
+	if atomic.AddInt32(&m.refs, -1) != 0 {
+		return false
+	}
+	if m.FileBacking == nil {
+		return true
+	}
+	return atomic.AddInt32(&m.FileBacking.refs, -1) == 0
+}
+
+// BlobReference records the values in a blob file which are referenced by a
+// table.
+type BlobReference struct {
+	// FileNum is the file number of the blob file.
+	FileNum base.FileNum
+	// ValueSize is the total size of the values in the blob file which are
+	// referenced by the table.
+	ValueSize uint64
+}
+
+// BlobFileMetadata holds the metadata for an on-disk blob file. A blob file
+// holds values which have been separated from the keys in the LSM. A blob file
+// is removed from the version once no table references it.
+type BlobFileMetadata struct {
+	// Reference count for the blob file: incremented when the blob file is
+	// added to a version and decremented when the version is unreferenced. The
+	// blob file is obsolete when the reference count falls to zero.
+	refs int32
+	// FileNum is the file number.
+	FileNum base.FileNum
+	// Size is the size of the file, in bytes.
+	Size uint64
+	// ValueSize is the total size of the values stored in the file. The
+	// fraction of ValueSize which is still referenced by tables determines
+	// when the blob file is rewritten.
+	ValueSize uint64
 }
 
 func (m FileMetadata) String() string {
+	if m.Virtual {
+		return fmt.Sprintf("%s(%s):%s-%s", m.FileNum, m.BackingFileNum(), m.Smallest, m.Largest)
+	}
 	return fmt.Sprintf("%s:%s-%s", m.FileNum, m.Smallest, m.Largest)
 }
 
@@ -184,9 +307,22 @@ type Version struct {
 
 	Files [NumLevels][]*FileMetadata
 
+	// l0Sublevels organizes the files in L0 into sublevels. It is computed by
+	// BulkVersionEdit.Apply. See L0Sublevels.
+	l0Sublevels *L0Sublevels
+
+	// BlobFiles are the blob files referenced by the tables in the version,
+	// keyed by file number.
+	BlobFiles map[base.FileNum]*BlobFileMetadata
+
+	// virtualBackings are the backings of the virtual tables in the version,
+	// keyed by the backing file number.
+	virtualBackings map[base.FileNum]virtualBacking
+
 	// The callback to invoke when the last reference to a version is
-	// removed. Will be called with list.mu held.
-	Deleted func(obsolete []base.FileNum)
+	// removed. Will be called with list.mu held. The obsolete tables and blob
+	// files are passed separately.
+	Deleted func(obsolete, obsoleteBlobFiles []base.FileNum)
 
 	// The list the version is linked into.
 	list *VersionList
@@ -195,6 +331,13 @@ type Version struct {
 	prev, next *Version
 }
 
+// virtualBacking records the number of virtual tables in a version which are
+// backed by a physical sstable.
+type virtualBacking struct {
+	backing *FileBacking
+	count   int
+}
+
 func (v *Version) String() string {
 	return v.Pretty(base.DefaultFormatter)
 }
@@ -234,6 +377,17 @@ func (v *Version) DebugString(format base.Formatter) string {
 	return buf.String()
 }
 
+// L0Sublevels returns the files in L0 organized into sublevels. The
+// sublevels are computed when the version is created by
+// BulkVersionEdit.Apply, and on demand for a version which was constructed
+// directly.
+func (v *Version) L0Sublevels(cmp Compare) *L0Sublevels {
+	if v.l0Sublevels != nil {
+		return v.l0Sublevels
+	}
+	return NewL0Sublevels(v.Files[0], cmp)
+}
+
 // Refs returns the number of references to the version.
 func (v *Version) Refs() int32 {
 	return atomic.LoadInt32(&v.refs)
@@ -250,11 +404,11 @@ func (v *Version) Ref() {
 // locked.
 func (v *Version) Unref() {
 	if atomic.AddInt32(&v.refs, -1) == 0 {
-		obsolete := v.unrefFiles()
+		obsolete, obsoleteBlobFiles := v.unrefFiles()
 		l := v.list
 		l.mu.Lock()
 		l.Remove(v)
-		v.Deleted(obsolete)
+		v.Deleted(obsolete, obsoleteBlobFiles)
 		l.mu.Unlock()
 	}
 }
@@ -270,17 +424,38 @@ func (v *Version) UnrefLocked() {
 	}
 }
 
-func (v *Version) unrefFiles() []base.FileNum {
-	var obsolete []base.FileNum
+func (v *Version) unrefFiles() (obsolete, obsoleteBlobFiles []base.FileNum) {
 	for _, files := range v.Files {
 		for i := range files {
 			f := files[i]
-			if atomic.AddInt32(&f.refs, -1) == 0 {
-				obsolete = append(obsolete, f.FileNum)
+			if f.unref() {
+				obsolete = append(obsolete, f.BackingFileNum())
+			}
+		}
+	}
+	for _, b := range v.BlobFiles {
+		if atomic.AddInt32(&b.refs, -1) == 0 {
+			obsoleteBlobFiles = append(obsoleteBlobFiles, b.FileNum)
+		}
+	}
+	return obsolete, obsoleteBlobFiles
+}
+
+// BlobFileLiveSizes returns the total size of the values in each blob file
+// which are referenced by the tables in the version.
+func (v *Version) BlobFileLiveSizes() map[base.FileNum]uint64 {
+	if len(v.BlobFiles) == 0 {
+		return nil
+	}
+	live := make(map[base.FileNum]uint64, len(v.BlobFiles))
+	for _, files := range v.Files {
+		for _, f := range files {
+			for _, ref := range f.BlobReferences {
+				live[ref.FileNum] += ref.ValueSize
 			}
 		}
 	}
-	return obsolete
+	return live
 }
 
 // Next returns the next version in the list of versions.
@@ -478,17 +653,20 @@ func CheckOrdering(cmp Compare, format base.Formatter, level int, files []*FileM
 		// flushes.
 		//
 		// Since these types of SSTables violate most other sequence number
-		// overlap invariants, and handling this case is important for compatibility
-		// with future versions of pebble, this method relaxes most L0 invariant
-		// checks except for those concerning ingested SSTables.
+		// overlap invariants, the checks below are only applied to files which
+		// overlap in user key range. Files which do not overlap may share
+		// sequence numbers.
 
 		// The largest sequence number of any file. Increasing.
 		var largestSeqNum uint64
 
-		// The ingested file sequence numbers that have not yet been checked to be compatible with
+		// The files with a largest sequence number equal to largestSeqNum.
+		var sameLargestSeqNum []*FileMetadata
+
+		// The ingested files that have not yet been checked to be compatible with
 		// flushed files.
 		// They are checked when largestFlushedSeqNum advances past them.
-		var uncheckedIngestedSeqNums []uint64
+		var uncheckedIngested []*FileMetadata
 
 		for i := range files {
 			f := files[i]
@@ -510,29 +688,38 @@ func CheckOrdering(cmp Compare, format base.Formatter, level int, files []*FileM
 				continue
 			}
 			if i > 0 && largestSeqNum >= f.LargestSeqNum {
-				return errors.Errorf("L0 file %s does not have strictly increasing "+
-					"largest seqnum: <#%d-#%d> vs <?-#%d>",
-					errors.Safe(f.FileNum), errors.Safe(f.SmallestSeqNum),
-					errors.Safe(f.LargestSeqNum), errors.Safe(largestSeqNum))
+				// Files with the same largest sequence number are the partitioned
+				// output of a single flush or compaction, which do not overlap.
+				for _, g := range sameLargestSeqNum {
+					if largestSeqNum > f.LargestSeqNum || overlapsUserKeys(cmp, f, g) {
+						return errors.Errorf("L0 file %s does not have strictly increasing "+
+							"largest seqnum: <#%d-#%d> vs <?-#%d>",
+							errors.Safe(f.FileNum), errors.Safe(f.SmallestSeqNum),
+							errors.Safe(f.LargestSeqNum), errors.Safe(largestSeqNum))
+					}
+				}
+			} else {
+				sameLargestSeqNum = sameLargestSeqNum[:0]
 			}
 			largestSeqNum = f.LargestSeqNum
+			sameLargestSeqNum = append(sameLargestSeqNum, f)
 			if f.SmallestSeqNum == f.LargestSeqNum {
 				// Ingested file.
-				uncheckedIngestedSeqNums = append(uncheckedIngestedSeqNums, f.LargestSeqNum)
+				uncheckedIngested = append(uncheckedIngested, f)
 			} else {
 				// Flushed file.
 				// Check that unchecked ingested sequence numbers are not coincident with f.SmallestSeqNum.
 				// We do not need to check that they are not coincident with f.LargestSeqNum because we
 				// have already confirmed that LargestSeqNums were increasing.
-				for _, seq := range uncheckedIngestedSeqNums {
-					if seq == f.SmallestSeqNum {
+				for _, g := range uncheckedIngested {
+					if g.LargestSeqNum == f.SmallestSeqNum && overlapsUserKeys(cmp, f, g) {
 						return errors.Errorf("L0 flushed file %s has smallest sequence number coincident with an ingested file "+
 							": <#%d-#%d> vs <#%d-#%d>",
 							errors.Safe(f.FileNum), errors.Safe(f.SmallestSeqNum),
-							errors.Safe(f.LargestSeqNum), errors.Safe(seq), errors.Safe(seq))
+							errors.Safe(f.LargestSeqNum), errors.Safe(g.LargestSeqNum), errors.Safe(g.LargestSeqNum))
 					}
 				}
-				uncheckedIngestedSeqNums = uncheckedIngestedSeqNums[:0]
+				uncheckedIngested = uncheckedIngested[:0]
 			}
 		}
 	} else {
@@ -562,3 +749,8 @@ func CheckOrdering(cmp Compare, format base.Formatter, level int, files []*FileM
 	}
 	return nil
 }
+
+// overlapsUserKeys returns true if the user key ranges of a and b overlap.
+func overlapsUserKeys(cmp Compare, a, b *FileMetadata) bool {
+	return !endsBefore(cmp, a, b.Smallest.UserKey) && !endsBefore(cmp, b, a.Smallest.UserKey)
+}
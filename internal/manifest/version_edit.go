@@ -49,12 +49,24 @@ const (
 	tagColumnFamilyDrop = 202
 	tagMaxColumnFamily  = 203
 
+	// Pebble tags.
+	tagNewBlobFile        = 105
+	tagDeletedBlobFile    = 106
+	tagFormatMajorVersion = 107
+
 	// The custom tags sub-format used by tagNewFile4.
 	customTagTerminate         = 1
 	customTagNeedsCompaction   = 2
 	customTagCreationTime      = 6
 	customTagPathID            = 65
 	customTagNonSafeIgnoreMask = 1 << 6
+
+	// Pebble specific custom tags. These must have customTagNonSafeIgnoreMask
+	// set as older versions are not able to interpret the file correctly
+	// without them.
+	customTagRangeKeys      = 66
+	customTagBlobReferences = 67
+	customTagVirtual        = 68
 )
 
 // DeletedFileEntry holds the state for a file deletion from a level. The file
@@ -106,6 +118,21 @@ type VersionEdit struct {
 	// found that there was no overlapping file at the higher level).
 	DeletedFiles map[DeletedFileEntry]bool
 	NewFiles     []NewFileEntry
+
+	// NewBlobFiles are the blob files created by the edit, and
+	// DeletedBlobFiles are the blob files which are no longer referenced by
+	// any table.
+	NewBlobFiles     []*BlobFileMetadata
+	DeletedBlobFiles map[base.FileNum]bool
+
+	// FormatMajorVersion is the format major version of the DB, which is set
+	// in the first VersionEdit of a manifest and when the DB's format major
+	// version is ratcheted. See pebble.FormatMajorVersion.
+	//
+	// This is an optional field, and 0 represents it is not set. It is not
+	// set for DBs at the most compatible format major version, which older
+	// versions of Pebble and RocksDB are able to open.
+	FormatMajorVersion uint64
 }
 
 // Decode decodes an edit from the specified reader.
@@ -216,6 +243,9 @@ func (v *VersionEdit) Decode(r io.Reader) error {
 				}
 			}
 			var markedForCompaction bool
+			var hasRangeKeys bool
+			var blobRefs []BlobReference
+			var backing *FileBacking
 			var creationTime uint64
 			if tag == tagNewFile4 {
 				for {
@@ -247,6 +277,24 @@ func (v *VersionEdit) Decode(r io.Reader) error {
 					case customTagPathID:
 						return errors.New("new-file4: path-id field not supported")
 
+					case customTagRangeKeys:
+						if len(field) != 1 {
+							return errors.New("new-file4: range-keys field wrong size")
+						}
+						hasRangeKeys = (field[0] == 1)
+
+					case customTagBlobReferences:
+						blobRefs, err = decodeBlobReferences(field)
+						if err != nil {
+							return err
+						}
+
+					case customTagVirtual:
+						backing, err = decodeFileBacking(field)
+						if err != nil {
+							return err
+						}
+
 					default:
 						if (customTag & customTagNonSafeIgnoreMask) != 0 {
 							return errors.Errorf("new-file4: custom field not supported: %d", customTag)
@@ -265,9 +313,49 @@ func (v *VersionEdit) Decode(r io.Reader) error {
 					SmallestSeqNum:      smallestSeqNum,
 					LargestSeqNum:       largestSeqNum,
 					MarkedForCompaction: markedForCompaction,
+					HasRangeKeys:        hasRangeKeys,
+					BlobReferences:      blobRefs,
+					Virtual:             backing != nil,
+					FileBacking:         backing,
 				},
 			})
 
+		case tagNewBlobFile:
+			fileNum, err := d.readFileNum()
+			if err != nil {
+				return err
+			}
+			size, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			valueSize, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			v.NewBlobFiles = append(v.NewBlobFiles, &BlobFileMetadata{
+				FileNum:   fileNum,
+				Size:      size,
+				ValueSize: valueSize,
+			})
+
+		case tagDeletedBlobFile:
+			fileNum, err := d.readFileNum()
+			if err != nil {
+				return err
+			}
+			if v.DeletedBlobFiles == nil {
+				v.DeletedBlobFiles = make(map[base.FileNum]bool)
+			}
+			v.DeletedBlobFiles[fileNum] = true
+
+		case tagFormatMajorVersion:
+			n, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			v.FormatMajorVersion = n
+
 		case tagPrevLogNumber:
 			n, err := d.readUvarint()
 			if err != nil {
@@ -319,7 +407,8 @@ func (v *VersionEdit) Encode(w io.Writer) error {
 	}
 	for _, x := range v.NewFiles {
 		var customFields bool
-		if x.Meta.MarkedForCompaction || x.Meta.CreationTime != 0 {
+		if x.Meta.MarkedForCompaction || x.Meta.CreationTime != 0 || x.Meta.HasRangeKeys ||
+			len(x.Meta.BlobReferences) > 0 || x.Meta.Virtual {
 			customFields = true
 			e.writeUvarint(tagNewFile4)
 		} else {
@@ -343,13 +432,108 @@ func (v *VersionEdit) Encode(w io.Writer) error {
 				e.writeUvarint(customTagNeedsCompaction)
 				e.writeBytes([]byte{1})
 			}
+			if x.Meta.HasRangeKeys {
+				e.writeUvarint(customTagRangeKeys)
+				e.writeBytes([]byte{1})
+			}
+			if len(x.Meta.BlobReferences) > 0 {
+				e.writeUvarint(customTagBlobReferences)
+				e.writeBytes(encodeBlobReferences(x.Meta.BlobReferences))
+			}
+			if x.Meta.Virtual {
+				e.writeUvarint(customTagVirtual)
+				e.writeBytes(encodeFileBacking(x.Meta.FileBacking))
+			}
 			e.writeUvarint(customTagTerminate)
 		}
 	}
+	for _, x := range v.NewBlobFiles {
+		e.writeUvarint(tagNewBlobFile)
+		e.writeUvarint(uint64(x.FileNum))
+		e.writeUvarint(x.Size)
+		e.writeUvarint(x.ValueSize)
+	}
+	for fileNum := range v.DeletedBlobFiles {
+		e.writeUvarint(tagDeletedBlobFile)
+		e.writeUvarint(uint64(fileNum))
+	}
+	if v.FormatMajorVersion != 0 {
+		e.writeUvarint(tagFormatMajorVersion)
+		e.writeUvarint(v.FormatMajorVersion)
+	}
 	_, err := w.Write(e.Bytes())
 	return err
 }
 
+// encodeBlobReferences encodes the blob references of a table as the count of
+// references followed by the file number and value size of each reference.
+func encodeBlobReferences(refs []BlobReference) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*(1+2*len(refs)))
+	var tmp [binary.MaxVarintLen64]byte
+	put := func(u uint64) {
+		n := binary.PutUvarint(tmp[:], u)
+		buf = append(buf, tmp[:n]...)
+	}
+	put(uint64(len(refs)))
+	for _, ref := range refs {
+		put(uint64(ref.FileNum))
+		put(ref.ValueSize)
+	}
+	return buf
+}
+
+func decodeBlobReferences(field []byte) ([]BlobReference, error) {
+	errInvalid := errors.New("new-file4: invalid blob references")
+	get := func() (uint64, bool) {
+		u, n := binary.Uvarint(field)
+		if n <= 0 {
+			return 0, false
+		}
+		field = field[n:]
+		return u, true
+	}
+	count, ok := get()
+	if !ok || count > uint64(len(field)) {
+		return nil, errInvalid
+	}
+	refs := make([]BlobReference, count)
+	for i := range refs {
+		fileNum, ok1 := get()
+		valueSize, ok2 := get()
+		if !ok1 || !ok2 {
+			return nil, errInvalid
+		}
+		refs[i] = BlobReference{FileNum: base.FileNum(fileNum), ValueSize: valueSize}
+	}
+	if len(field) != 0 {
+		return nil, errInvalid
+	}
+	return refs, nil
+}
+
+// encodeFileBacking encodes the backing of a virtual table as the file number
+// and size of the physical sstable.
+func encodeFileBacking(b *FileBacking) []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(b.FileNum))
+	n += binary.PutUvarint(buf[n:], b.Size)
+	return buf[:n]
+}
+
+func decodeFileBacking(field []byte) (*FileBacking, error) {
+	errInvalid := errors.New("new-file4: invalid virtual table backing")
+	fileNum, n := binary.Uvarint(field)
+	if n <= 0 {
+		return nil, errInvalid
+	}
+	field = field[n:]
+	size, n := binary.Uvarint(field)
+	if n <= 0 || n != len(field) {
+		return nil, errInvalid
+	}
+	return &FileBacking{FileNum: base.FileNum(fileNum), Size: size}, nil
+}
+
 type versionEditDecoder struct {
 	byteReader
 }
@@ -432,6 +616,9 @@ func (e versionEditEncoder) writeUvarint(u uint64) {
 type BulkVersionEdit struct {
 	Added   [NumLevels][]*FileMetadata
 	Deleted [NumLevels]map[base.FileNum]bool
+
+	AddedBlobFiles   []*BlobFileMetadata
+	DeletedBlobFiles map[base.FileNum]bool
 }
 
 // Accumulate adds the file addition and deletions in the specified version
@@ -456,6 +643,14 @@ func (b *BulkVersionEdit) Accumulate(ve *VersionEdit) {
 		}
 		b.Added[nf.Level] = append(b.Added[nf.Level], nf.Meta)
 	}
+
+	for fileNum := range ve.DeletedBlobFiles {
+		if b.DeletedBlobFiles == nil {
+			b.DeletedBlobFiles = make(map[base.FileNum]bool)
+		}
+		b.DeletedBlobFiles[fileNum] = true
+	}
+	b.AddedBlobFiles = append(b.AddedBlobFiles, ve.NewBlobFiles...)
 }
 
 // Apply applies the delta b to the current version to produce a new version. The
@@ -470,21 +665,53 @@ func (b *BulkVersionEdit) Accumulate(ve *VersionEdit) {
 func (b *BulkVersionEdit) Apply(
 	curr *Version, cmp Compare, format base.Formatter,
 ) (_ *Version, zombies map[base.FileNum]uint64, _ error) {
-	addZombie := func(fileNum base.FileNum, size uint64) {
+	// Zombies are tracked by the physical sstable backing a deleted table, as
+	// the backing remains on disk until no table uses it.
+	addZombie := func(f *FileMetadata) {
 		if zombies == nil {
 			zombies = make(map[base.FileNum]uint64)
 		}
-		zombies[fileNum] = size
+		if f.FileBacking != nil {
+			zombies[f.FileBacking.FileNum] = f.FileBacking.Size
+		} else {
+			zombies[f.FileNum] = f.Size
+		}
 	}
 	// The remove zombie function is used to handle tables that are moved from
 	// one level to another during a version edit (i.e. a "move" compaction).
-	removeZombie := func(fileNum base.FileNum) {
+	removeZombie := func(f *FileMetadata) {
 		if zombies != nil {
-			delete(zombies, fileNum)
+			delete(zombies, f.BackingFileNum())
 		}
 	}
 
 	v := new(Version)
+
+	// Virtual tables which share a backing must share the same FileBacking, as
+	// the backing's reference count tracks the tables using it. Tables decoded
+	// from different version edits have distinct FileBackings which are
+	// replaced here by the backing already known to the version.
+	if curr != nil && len(curr.virtualBackings) > 0 {
+		v.virtualBackings = make(map[base.FileNum]virtualBacking, len(curr.virtualBackings))
+		for fileNum, vb := range curr.virtualBackings {
+			v.virtualBackings[fileNum] = vb
+		}
+	}
+	for level := range b.Added {
+		for _, f := range b.Added[level] {
+			if !f.Virtual {
+				continue
+			}
+			if v.virtualBackings == nil {
+				v.virtualBackings = make(map[base.FileNum]virtualBacking)
+			}
+			if vb, ok := v.virtualBackings[f.FileBacking.FileNum]; !ok {
+				v.virtualBackings[f.FileBacking.FileNum] = virtualBacking{backing: f.FileBacking}
+			} else if vb.backing != f.FileBacking {
+				f.FileBacking = vb.backing
+			}
+		}
+	}
 	for level := range v.Files {
 		if len(b.Added[level]) == 0 && len(b.Deleted[level]) == 0 {
 			// There are no edits on this level.
@@ -493,9 +720,12 @@ func (b *BulkVersionEdit) Apply(
 			}
 			files := curr.Files[level]
 			v.Files[level] = files
+			if level == 0 {
+				v.l0Sublevels = curr.l0Sublevels
+			}
 			// We still have to bump the ref count for all files.
 			for i := range files {
-				atomic.AddInt32(&files[i].refs, 1)
+				files[i].ref()
 			}
 			continue
 		}
@@ -539,10 +769,10 @@ func (b *BulkVersionEdit) Apply(
 				for i := range ff {
 					f := ff[i]
 					if deletedMap[f.FileNum] {
-						addZombie(f.FileNum, f.Size)
+						addZombie(f)
 						continue
 					}
-					atomic.AddInt32(&f.refs, 1)
+					f.ref()
 					v.Files[level] = append(v.Files[level], f)
 				}
 			}
@@ -550,6 +780,7 @@ func (b *BulkVersionEdit) Apply(
 			if err := CheckOrdering(cmp, format, 0, v.Files[level]); err != nil {
 				return nil, nil, errors.Wrap(err, "pebble: internal error")
 			}
+			v.l0Sublevels = NewL0Sublevels(v.Files[level], cmp)
 			continue
 		}
 
@@ -561,11 +792,11 @@ func (b *BulkVersionEdit) Apply(
 		for i := range addedFiles {
 			f := addedFiles[i]
 			if deletedMap[f.FileNum] {
-				addZombie(f.FileNum, f.Size)
+				addZombie(f)
 				continue
 			}
-			removeZombie(f.FileNum)
-			atomic.AddInt32(&f.refs, 1)
+			removeZombie(f)
+			f.ref()
 			// We need to add f. Find the first file in currFiles such that its smallest key
 			// is > f.Largest. This file (if it is kept) will be the immediate successor of f.
 			// The files in currFiles before this file (if they are kept) will precede f.
@@ -581,11 +812,11 @@ func (b *BulkVersionEdit) Apply(
 			for k := 0; k < j; k++ {
 				cf := currFiles[k]
 				if deletedMap[cf.FileNum] {
-					addZombie(cf.FileNum, cf.Size)
+					addZombie(cf)
 					continue
 				}
-				removeZombie(cf.FileNum)
-				atomic.AddInt32(&cf.refs, 1)
+				removeZombie(cf)
+				cf.ref()
 				v.Files[level] = append(v.Files[level], cf)
 			}
 			currFiles = currFiles[j:]
@@ -614,13 +845,116 @@ func (b *BulkVersionEdit) Apply(
 		for i := range currFiles {
 			f := currFiles[i]
 			if deletedMap[f.FileNum] {
-				addZombie(f.FileNum, f.Size)
+				addZombie(f)
 				continue
 			}
-			removeZombie(f.FileNum)
-			atomic.AddInt32(&f.refs, 1)
+			removeZombie(f)
+			f.ref()
 			v.Files[level] = append(v.Files[level], f)
 		}
 	}
+
+	// Count the virtual tables of each backing in the edited levels. A backing
+	// used by a virtual table in the new version is not a zombie.
+	for level := range v.Files {
+		if len(b.Added[level]) == 0 && len(b.Deleted[level]) == 0 {
+			continue
+		}
+		adjust := func(files []*FileMetadata, delta int) {
+			for _, f := range files {
+				if f.Virtual {
+					vb := v.virtualBackings[f.FileBacking.FileNum]
+					vb.count += delta
+					v.virtualBackings[f.FileBacking.FileNum] = vb
+				}
+			}
+		}
+		if curr != nil {
+			adjust(curr.Files[level], -1)
+		}
+		adjust(v.Files[level], +1)
+	}
+	for fileNum, vb := range v.virtualBackings {
+		if vb.count == 0 {
+			delete(v.virtualBackings, fileNum)
+		} else {
+			delete(zombies, fileNum)
+		}
+	}
+
+	if v.l0Sublevels == nil {
+		v.l0Sublevels = NewL0Sublevels(v.Files[0], cmp)
+	}
+
+	// Apply the blob file additions and deletions. Blob files are not tracked
+	// as zombies: they are deleted from disk once no version references them.
+	var currBlobFiles map[base.FileNum]*BlobFileMetadata
+	if curr != nil {
+		currBlobFiles = curr.BlobFiles
+	}
+	if n := len(currBlobFiles) + len(b.AddedBlobFiles); n > 0 {
+		v.BlobFiles = make(map[base.FileNum]*BlobFileMetadata, n)
+		for fileNum, f := range currBlobFiles {
+			v.BlobFiles[fileNum] = f
+		}
+		for _, f := range b.AddedBlobFiles {
+			v.BlobFiles[f.FileNum] = f
+		}
+		for fileNum := range b.DeletedBlobFiles {
+			delete(v.BlobFiles, fileNum)
+		}
+		for _, f := range v.BlobFiles {
+			atomic.AddInt32(&f.refs, 1)
+		}
+	}
 	return v, zombies, nil
 }
+
+// UnreferencedBlobFiles returns the blob files in curr, or added by ve, which
+// are not referenced by any table once ve has been applied to curr. These are
+// the blob files which ve should delete. Returns nil if there are no such blob
+// files.
+func UnreferencedBlobFiles(curr *Version, ve *VersionEdit) map[base.FileNum]bool {
+	var currBlobFiles map[base.FileNum]*BlobFileMetadata
+	if curr != nil {
+		currBlobFiles = curr.BlobFiles
+	}
+	if len(currBlobFiles) == 0 && len(ve.NewBlobFiles) == 0 {
+		return nil
+	}
+	referenced := make(map[base.FileNum]bool)
+	addRefs := func(f *FileMetadata) {
+		for _, ref := range f.BlobReferences {
+			referenced[ref.FileNum] = true
+		}
+	}
+	if curr != nil {
+		for level, files := range curr.Files {
+			for _, f := range files {
+				if !ve.DeletedFiles[DeletedFileEntry{Level: level, FileNum: f.FileNum}] {
+					addRefs(f)
+				}
+			}
+		}
+	}
+	for _, nf := range ve.NewFiles {
+		addRefs(nf.Meta)
+	}
+	var unreferenced map[base.FileNum]bool
+	add := func(fileNum base.FileNum) {
+		if referenced[fileNum] || ve.DeletedBlobFiles[fileNum] {
+			return
+		}
+		if unreferenced == nil {
+			unreferenced = make(map[base.FileNum]bool)
+		}
+		unreferenced[fileNum] = true
+	}
+	for fileNum := range currBlobFiles {
+		add(fileNum)
+	}
+	for _, f := range ve.NewBlobFiles {
+		add(f.FileNum)
+	}
+	return unreferenced
+}
@@ -14,6 +14,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/cockroachdb/errors"
@@ -84,7 +85,54 @@ func TestVersionEditRoundTrip(t *testing.T) {
 						MarkedForCompaction: true,
 					},
 				},
+				{
+					Level: 6,
+					Meta: &FileMetadata{
+						FileNum:        807,
+						Size:           8070,
+						Smallest:       base.DecodeInternalKey([]byte("a\x00\x01\x02\x03\x04\x05\x06\x07")),
+						Largest:        base.DecodeInternalKey([]byte("z\x0f\xff\xff\xff\xff\xff\xff\xff")),
+						SmallestSeqNum: 7,
+						LargestSeqNum:  9,
+						HasRangeKeys:   true,
+					},
+				},
+				{
+					Level: 6,
+					Meta: &FileMetadata{
+						FileNum:        808,
+						Size:           8080,
+						Smallest:       base.DecodeInternalKey([]byte("b\x00\x01\x02\x03\x04\x05\x06\x07")),
+						Largest:        base.DecodeInternalKey([]byte("y\x0f\xff\xff\xff\xff\xff\xff\xff")),
+						SmallestSeqNum: 10,
+						LargestSeqNum:  11,
+						BlobReferences: []BlobReference{
+							{FileNum: 901, ValueSize: 9010},
+							{FileNum: 902, ValueSize: 9020},
+						},
+					},
+				},
+				{
+					Level: 6,
+					Meta: &FileMetadata{
+						FileNum:        809,
+						Size:           4040,
+						Smallest:       base.DecodeInternalKey([]byte("c\x00\x01\x02\x03\x04\x05\x06\x07")),
+						Largest:        base.DecodeInternalKey([]byte("x\x0f\xff\xff\xff\xff\xff\xff\xff")),
+						SmallestSeqNum: 10,
+						LargestSeqNum:  11,
+						Virtual:        true,
+						FileBacking:    &FileBacking{FileNum: 808, Size: 8080},
+					},
+				},
 			},
+			NewBlobFiles: []*BlobFileMetadata{
+				{FileNum: 902, Size: 9200, ValueSize: 9100},
+			},
+			DeletedBlobFiles: map[base.FileNum]bool{
+				900: true,
+			},
+			FormatMajorVersion: 2,
 		},
 	}
 	for _, tc := range testCases {
@@ -355,3 +403,167 @@ func TestVersionEditApply(t *testing.T) {
 			}
 		})
 }
+
+func TestVersionEditBlobFiles(t *testing.T) {
+	newTable := func(fileNum base.FileNum, blobFileNums ...base.FileNum) *FileMetadata {
+		m := &FileMetadata{
+			FileNum:  fileNum,
+			Smallest: base.ParseInternalKey(fmt.Sprintf("%d.SET.1", fileNum)),
+			Largest:  base.ParseInternalKey(fmt.Sprintf("%d.SET.1", fileNum)),
+		}
+		for _, n := range blobFileNums {
+			m.BlobReferences = append(m.BlobReferences, BlobReference{FileNum: n, ValueSize: 10})
+		}
+		return m
+	}
+	apply := func(v *Version, ve *VersionEdit) *Version {
+		ve.DeletedBlobFiles = UnreferencedBlobFiles(v, ve)
+		var bve BulkVersionEdit
+		bve.Accumulate(ve)
+		newv, _, err := bve.Apply(v, base.DefaultComparer.Compare, base.DefaultFormatter)
+		require.NoError(t, err)
+		return newv
+	}
+	blobFileNums := func(v *Version) []base.FileNum {
+		var nums []base.FileNum
+		for fileNum := range v.BlobFiles {
+			nums = append(nums, fileNum)
+		}
+		sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+		return nums
+	}
+
+	// Two tables referencing two blob files.
+	v1 := apply(nil, &VersionEdit{
+		NewFiles: []NewFileEntry{
+			{Level: 6, Meta: newTable(1, 10)},
+			{Level: 6, Meta: newTable(2, 10, 11)},
+		},
+		NewBlobFiles: []*BlobFileMetadata{
+			{FileNum: 10, Size: 100, ValueSize: 20},
+			{FileNum: 11, Size: 100, ValueSize: 20},
+		},
+	})
+	require.Equal(t, []base.FileNum{10, 11}, blobFileNums(v1))
+	require.Equal(t, map[base.FileNum]uint64{10: 20, 11: 10}, v1.BlobFileLiveSizes())
+
+	// Deleting table 2 leaves blob file 11 unreferenced.
+	ve := &VersionEdit{
+		DeletedFiles: map[DeletedFileEntry]bool{{Level: 6, FileNum: 2}: true},
+	}
+	v2 := apply(v1, ve)
+	require.Equal(t, map[base.FileNum]bool{11: true}, ve.DeletedBlobFiles)
+	require.Equal(t, []base.FileNum{10}, blobFileNums(v2))
+
+	// Moving table 1 to another level retains its reference.
+	ve = &VersionEdit{
+		DeletedFiles: map[DeletedFileEntry]bool{{Level: 6, FileNum: 1}: true},
+		NewFiles:     []NewFileEntry{{Level: 5, Meta: v2.Files[6][0]}},
+	}
+	v3 := apply(v2, ve)
+	require.Nil(t, ve.DeletedBlobFiles)
+	require.Equal(t, []base.FileNum{10}, blobFileNums(v3))
+
+	// The blob files are obsolete once the versions referencing them are
+	// unreferenced.
+	var obsoleteBlobFiles []base.FileNum
+	var l VersionList
+	var mu sync.Mutex
+	l.Init(&mu)
+	for _, v := range []*Version{v1, v2, v3} {
+		v.Deleted = func(_, obsolete []base.FileNum) {
+			obsoleteBlobFiles = append(obsoleteBlobFiles, obsolete...)
+		}
+		v.Ref()
+		l.PushBack(v)
+	}
+	v1.Unref()
+	require.Equal(t, []base.FileNum{11}, obsoleteBlobFiles)
+	v2.Unref()
+	v3.Unref()
+	require.Equal(t, []base.FileNum{11, 10}, obsoleteBlobFiles)
+}
+
+func TestVersionEditVirtualTables(t *testing.T) {
+	newTable := func(fileNum base.FileNum, smallest, largest string) *FileMetadata {
+		return &FileMetadata{
+			FileNum:  fileNum,
+			Size:     100,
+			Smallest: base.ParseInternalKey(smallest + ".SET.1"),
+			Largest:  base.ParseInternalKey(largest + ".SET.1"),
+		}
+	}
+	newVirtual := func(fileNum base.FileNum, backing *FileBacking, smallest, largest string) *FileMetadata {
+		m := newTable(fileNum, smallest, largest)
+		m.Size = 10
+		m.Virtual = true
+		m.FileBacking = backing
+		return m
+	}
+	var l VersionList
+	var mu sync.Mutex
+	l.Init(&mu)
+	var obsolete []base.FileNum
+	apply := func(v *Version, ve *VersionEdit) (*Version, map[base.FileNum]uint64) {
+		var bve BulkVersionEdit
+		bve.Accumulate(ve)
+		newv, zombies, err := bve.Apply(v, base.DefaultComparer.Compare, base.DefaultFormatter)
+		require.NoError(t, err)
+		newv.Deleted = func(tables, _ []base.FileNum) {
+			obsolete = append(obsolete, tables...)
+		}
+		newv.Ref()
+		l.PushBack(newv)
+		return newv, zombies
+	}
+
+	v1, _ := apply(nil, &VersionEdit{
+		NewFiles: []NewFileEntry{{Level: 6, Meta: newTable(1, "a", "z")}},
+	})
+	backing := v1.Files[6][0].FileBacking
+	require.Equal(t, &FileBacking{refs: 1, FileNum: 1, Size: 100}, backing)
+
+	// Replacing the physical table with virtual tables does not make the
+	// physical table a zombie.
+	v2, zombies := apply(v1, &VersionEdit{
+		DeletedFiles: map[DeletedFileEntry]bool{{Level: 6, FileNum: 1}: true},
+		NewFiles: []NewFileEntry{
+			{Level: 6, Meta: newVirtual(2, backing, "a", "c")},
+			{Level: 6, Meta: newVirtual(3, backing, "x", "z")},
+		},
+	})
+	require.Empty(t, zombies)
+	v3, zombies := apply(v2, &VersionEdit{
+		DeletedFiles: map[DeletedFileEntry]bool{{Level: 6, FileNum: 2}: true},
+	})
+	require.Empty(t, zombies)
+
+	// Deleting the last virtual table makes its backing a zombie.
+	v4, zombies := apply(v3, &VersionEdit{
+		DeletedFiles: map[DeletedFileEntry]bool{{Level: 6, FileNum: 3}: true},
+	})
+	require.Equal(t, map[base.FileNum]uint64{1: 100}, zombies)
+
+	// The backing is obsolete once no table using it is referenced.
+	v1.Unref()
+	v2.Unref()
+	require.Empty(t, obsolete)
+	v3.Unref()
+	require.Equal(t, []base.FileNum{1}, obsolete)
+	v4.Unref()
+
+	// Virtual tables decoded from separate version edits share their backing.
+	var bve BulkVersionEdit
+	for _, m := range []*FileMetadata{newVirtual(2, backing, "a", "c"), newVirtual(3, backing, "x", "z")} {
+		var buf bytes.Buffer
+		require.NoError(t, (&VersionEdit{NewFiles: []NewFileEntry{{Level: 6, Meta: m}}}).Encode(&buf))
+		var ve VersionEdit
+		require.NoError(t, ve.Decode(&buf))
+		bve.Accumulate(&ve)
+	}
+	v, _, err := bve.Apply(nil, base.DefaultComparer.Compare, base.DefaultFormatter)
+	require.NoError(t, err)
+	require.True(t, v.Files[6][0].Virtual)
+	require.True(t, v.Files[6][0].FileBacking == v.Files[6][1].FileBacking)
+	require.Equal(t, &FileBacking{refs: 2, FileNum: 1, Size: 100}, v.Files[6][0].FileBacking)
+}
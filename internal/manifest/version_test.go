@@ -261,7 +261,7 @@ func TestOverlaps(t *testing.T) {
 func TestVersionUnref(t *testing.T) {
 	list := &VersionList{}
 	list.Init(&sync.Mutex{})
-	v := &Version{Deleted: func([]base.FileNum) {}}
+	v := &Version{Deleted: func(_, _ []base.FileNum) {}}
 	v.Ref()
 	list.PushBack(v)
 	v.Unref()
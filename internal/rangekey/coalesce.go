@@ -0,0 +1,106 @@
+// Copyright 2020 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package rangekey
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble/internal/base"
+)
+
+// SuffixValue is the value of a range key for a particular suffix.
+type SuffixValue struct {
+	Suffix []byte
+	Value  []byte
+}
+
+// CoalescedSpan is the logical state of the range keys over the user key span
+// [Start,End): the set of suffixes which are set within the span and their
+// values.
+type CoalescedSpan struct {
+	Start []byte
+	End   []byte
+	// Items is sorted by suffix.
+	Items []SuffixValue
+}
+
+func (s CoalescedSpan) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s-%s:", s.Start, s.End)
+	for i, item := range s.Items {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, " %s=%s", item.Suffix, item.Value)
+	}
+	return buf.String()
+}
+
+// Coalesce computes the logical state of a set of fragments produced by
+// Fragment, considering only the range keys for which visible returns
+// true. The most recent range key for a suffix determines whether the suffix
+// is set, and a RANGEKEYDEL removes every older range key. Spans without any
+// set suffix are omitted, and adjacent spans with identical contents are
+// merged.
+func Coalesce(
+	cmp base.Compare, frags []Span, visible func(seqNum uint64) bool,
+) []CoalescedSpan {
+	var res []CoalescedSpan
+	for i := 0; i < len(frags); {
+		j := i + 1
+		for j < len(frags) && cmp(frags[i].Start.UserKey, frags[j].Start.UserKey) == 0 {
+			j++
+		}
+
+		var items []SuffixValue
+		seen := make(map[string]struct{})
+	group:
+		for _, f := range frags[i:j] {
+			if !visible(f.Start.SeqNum()) {
+				continue
+			}
+			switch f.Kind() {
+			case base.InternalKeyKindRangeKeyDelete:
+				break group
+			case base.InternalKeyKindRangeKeyUnset, base.InternalKeyKindRangeKeySet:
+				if _, ok := seen[string(f.Suffix)]; ok {
+					continue
+				}
+				seen[string(f.Suffix)] = struct{}{}
+				if f.Kind() == base.InternalKeyKindRangeKeySet {
+					items = append(items, SuffixValue{Suffix: f.Suffix, Value: f.Value})
+				}
+			}
+		}
+
+		if len(items) > 0 {
+			sort.Slice(items, func(a, b int) bool {
+				return cmp(items[a].Suffix, items[b].Suffix) < 0
+			})
+			start, end := frags[i].Start.UserKey, frags[i].End
+			if n := len(res); n > 0 && cmp(res[n-1].End, start) == 0 && equalItems(res[n-1].Items, items) {
+				res[n-1].End = end
+			} else {
+				res = append(res, CoalescedSpan{Start: start, End: end, Items: items})
+			}
+		}
+		i = j
+	}
+	return res
+}
+
+func equalItems(a, b []SuffixValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Suffix, b[i].Suffix) || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
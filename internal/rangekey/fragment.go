@@ -0,0 +1,138 @@
+// Copyright 2020 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package rangekey
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/pebble/internal/base"
+)
+
+// Sort sorts the spans by start key, and in decreasing order of sequence
+// number (and kind) for identical start keys.
+func Sort(cmp base.Compare, spans []Span) {
+	sort.SliceStable(spans, func(i, j int) bool {
+		return base.InternalCompare(cmp, spans[i].Start, spans[j].Start) < 0
+	})
+}
+
+// Fragment splits the supplied spans at every start and end key such that
+// any two of the returned spans either have identical bounds or do not
+// overlap. Empty spans are discarded. The returned spans are sorted by Sort.
+// The input slice is not modified.
+func Fragment(cmp base.Compare, spans []Span) []Span {
+	if len(spans) == 0 {
+		return nil
+	}
+	bounds := make([][]byte, 0, 2*len(spans))
+	for i := range spans {
+		bounds = append(bounds, spans[i].Start.UserKey, spans[i].End)
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return cmp(bounds[i], bounds[j]) < 0
+	})
+	n := 1
+	for i := 1; i < len(bounds); i++ {
+		if cmp(bounds[n-1], bounds[i]) != 0 {
+			bounds[n] = bounds[i]
+			n++
+		}
+	}
+	bounds = bounds[:n]
+
+	var frags []Span
+	for _, s := range spans {
+		if cmp(s.Start.UserKey, s.End) >= 0 {
+			continue
+		}
+		start := s.Start.UserKey
+		i := sort.Search(len(bounds), func(i int) bool {
+			return cmp(bounds[i], start) > 0
+		})
+		for ; i < len(bounds) && cmp(bounds[i], s.End) <= 0; i++ {
+			f := s
+			f.Start.UserKey = start
+			f.End = bounds[i]
+			frags = append(frags, f)
+			start = bounds[i]
+		}
+	}
+	Sort(cmp, frags)
+	return frags
+}
+
+// Truncate returns the spans in [lower,upper), truncating the bounds of any
+// span that straddles lower or upper. A nil bound is unbounded.
+func Truncate(cmp base.Compare, spans []Span, lower, upper []byte) []Span {
+	var res []Span
+	for _, s := range spans {
+		if lower != nil && cmp(s.Start.UserKey, lower) < 0 {
+			s.Start.UserKey = lower
+		}
+		if upper != nil && cmp(s.End, upper) > 0 {
+			s.End = upper
+		}
+		if cmp(s.Start.UserKey, s.End) < 0 {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// Elide removes the range keys which no longer need to be retained from a
+// set of fragments produced by Fragment. It is used by compactions. Within
+// each snapshot stripe a RANGEKEYDEL shadows every older range key, and a
+// RANGEKEYSET or RANGEKEYUNSET shadows older range keys with the same
+// suffix. Shadowed range keys are dropped. In the last snapshot stripe,
+// RANGEKEYDEL and RANGEKEYUNSET are dropped as well if elide returns true for
+// their span, which indicates that there is no data beneath the compaction
+// which they could remove. The snapshots must be sorted in increasing order.
+func Elide(
+	cmp base.Compare, frags []Span, snapshots []uint64, elide func(start, end []byte) bool,
+) []Span {
+	var res []Span
+	for i := 0; i < len(frags); {
+		j := i + 1
+		for j < len(frags) && cmp(frags[i].Start.UserKey, frags[j].Start.UserKey) == 0 {
+			j++
+		}
+
+		stripe := -1
+		var deleted bool
+		var seen map[string]struct{}
+		for _, f := range frags[i:j] {
+			seqNum := f.Start.SeqNum()
+			if s := sort.Search(len(snapshots), func(i int) bool {
+				return snapshots[i] > seqNum
+			}); s != stripe {
+				stripe = s
+				deleted = false
+				seen = make(map[string]struct{})
+			}
+			if deleted {
+				continue
+			}
+			switch f.Kind() {
+			case base.InternalKeyKindRangeKeyDelete:
+				deleted = true
+				if stripe == 0 && elide(f.Start.UserKey, f.End) {
+					continue
+				}
+			default:
+				if _, ok := seen[string(f.Suffix)]; ok {
+					continue
+				}
+				seen[string(f.Suffix)] = struct{}{}
+				if f.Kind() == base.InternalKeyKindRangeKeyUnset &&
+					stripe == 0 && elide(f.Start.UserKey, f.End) {
+					continue
+				}
+			}
+			res = append(res, f)
+		}
+		i = j
+	}
+	return res
+}
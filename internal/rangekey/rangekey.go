@@ -0,0 +1,170 @@
+// Copyright 2020 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package rangekey provides functionality for working with range keys. A
+// range key associates a suffix and a value with a span of user keys
+// [start,end). Range keys come in three kinds:
+//
+//   RANGEKEYSET:   sets the value for a suffix within [start,end).
+//   RANGEKEYUNSET: removes the value for a suffix within [start,end).
+//   RANGEKEYDEL:   removes all range keys within [start,end).
+//
+// A range key is stored as an internal key whose user key is the start key of
+// the span and whose kind is one of the range key kinds. The value of the
+// internal key encodes the end key, the suffix and the value (see
+// EncodeValue). Range keys are stored separately from point keys and range
+// deletion tombstones: in their own skiplists in batches and memtables, and in
+// their own block in sstables.
+package rangekey // import "github.com/cockroachdb/pebble/internal/rangekey"
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+)
+
+// ErrCorrupt is returned when a range key value cannot be decoded.
+var ErrCorrupt = errors.New("pebble: corrupt range key")
+
+// IsRangeKey returns true if the specified kind is one of the range key kinds.
+func IsRangeKey(kind base.InternalKeyKind) bool {
+	switch kind {
+	case base.InternalKeyKindRangeKeySet,
+		base.InternalKeyKindRangeKeyUnset,
+		base.InternalKeyKindRangeKeyDelete:
+		return true
+	}
+	return false
+}
+
+// Span is a single range key operation over the user key span [Start,End).
+// The kind and sequence number of the operation are stored in Start. Suffix
+// is empty for RANGEKEYDEL, and Value is only non-empty for RANGEKEYSET.
+type Span struct {
+	Start  base.InternalKey
+	End    []byte
+	Suffix []byte
+	Value  []byte
+}
+
+// Kind returns the kind of the range key operation.
+func (s Span) Kind() base.InternalKeyKind {
+	return s.Start.Kind()
+}
+
+// Contains returns true if the specified key resides within the span.
+func (s Span) Contains(cmp base.Compare, key []byte) bool {
+	return cmp(s.Start.UserKey, key) <= 0 && cmp(key, s.End) < 0
+}
+
+// EncodedValue returns the encoding of the span's end key, suffix and value,
+// suitable for storing as the value of s.Start.
+func (s Span) EncodedValue() []byte {
+	return EncodeValue(nil, s.End, s.Suffix, s.Value)
+}
+
+func (s Span) String() string {
+	switch s.Kind() {
+	case base.InternalKeyKindRangeKeySet:
+		return fmt.Sprintf("%s-%s#%d,SET[%s]=%s", s.Start.UserKey, s.End, s.Start.SeqNum(), s.Suffix, s.Value)
+	case base.InternalKeyKindRangeKeyUnset:
+		return fmt.Sprintf("%s-%s#%d,UNSET[%s]", s.Start.UserKey, s.End, s.Start.SeqNum(), s.Suffix)
+	default:
+		return fmt.Sprintf("%s-%s#%d,DEL", s.Start.UserKey, s.End, s.Start.SeqNum())
+	}
+}
+
+// Pretty returns a formatter for the span.
+func (s Span) Pretty(f base.Formatter) fmt.Formatter {
+	return prettySpan{s, f}
+}
+
+type prettySpan struct {
+	Span
+	formatter base.Formatter
+}
+
+func (s prettySpan) Format(state fmt.State, c rune) {
+	fmt.Fprintf(state, "%s-%s#%d,%s", s.formatter(s.Start.UserKey), s.formatter(s.End),
+		s.Start.SeqNum(), s.Kind())
+	if s.Kind() != base.InternalKeyKindRangeKeyDelete {
+		fmt.Fprintf(state, "[%s]", s.formatter(s.Suffix))
+	}
+}
+
+// EncodedValueLen returns the length of the encoded value for the specified
+// end key, suffix and value.
+func EncodedValueLen(end, suffix, value []byte) int {
+	return varstringLen(len(end)) + varstringLen(len(suffix)) + len(value)
+}
+
+func varstringLen(n int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n)) + n
+}
+
+// EncodeValue appends the encoding of the end key, suffix and value to dst
+// and returns the result. The encoding is:
+//
+//   <end-len:uvarint><end><suffix-len:uvarint><suffix><value>
+//
+// The value is not length prefixed as it extends to the end of the encoding.
+func EncodeValue(dst, end, suffix, value []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(end)))
+	dst = append(dst, buf[:n]...)
+	dst = append(dst, end...)
+	n = binary.PutUvarint(buf[:], uint64(len(suffix)))
+	dst = append(dst, buf[:n]...)
+	dst = append(dst, suffix...)
+	return append(dst, value...)
+}
+
+// DecodeValue decodes a value encoded by EncodeValue. Returns false if the
+// encoding is corrupt.
+func DecodeValue(data []byte) (end, suffix, value []byte, ok bool) {
+	end, data, ok = decodeVarstring(data)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	suffix, data, ok = decodeVarstring(data)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	return end, suffix, data, true
+}
+
+func decodeVarstring(data []byte) (s, rest []byte, ok bool) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < v {
+		return nil, nil, false
+	}
+	data = data[n:]
+	return data[:v:v], data[v:], true
+}
+
+// Decode decodes the internal key and encoded value of a range key into a
+// Span. Returns false if the value is corrupt.
+func Decode(key base.InternalKey, value []byte) (Span, bool) {
+	end, suffix, v, ok := DecodeValue(value)
+	if !ok {
+		return Span{}, false
+	}
+	return Span{Start: key, End: end, Suffix: suffix, Value: v}, true
+}
+
+// Collect decodes the range keys in the supplied iterator, appending them to
+// spans. The iterator is not closed.
+func Collect(spans []Span, iter base.InternalIterator) ([]Span, error) {
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		s, ok := Decode(key.Clone(), append([]byte(nil), value...))
+		if !ok {
+			return spans, ErrCorrupt
+		}
+		spans = append(spans, s)
+	}
+	return spans, iter.Error()
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package rangekey
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/stretchr/testify/require"
+)
+
+// parseSpans parses spans of the form:
+//
+//   <seqnum>: <start>-<end> set <suffix> <value>
+//   <seqnum>: <start>-<end> unset <suffix>
+//   <seqnum>: <start>-<end> del
+func parseSpans(t *testing.T, input string) []Span {
+	var spans []Span
+	for _, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		seqNum, err := strconv.ParseUint(strings.TrimSuffix(fields[0], ":"), 10, 64)
+		require.NoError(t, err)
+		bounds := strings.Split(fields[1], "-")
+		require.Equal(t, 2, len(bounds), line)
+		s := Span{End: []byte(bounds[1])}
+		switch fields[2] {
+		case "set":
+			require.Equal(t, 5, len(fields), line)
+			s.Start = base.MakeInternalKey([]byte(bounds[0]), seqNum, base.InternalKeyKindRangeKeySet)
+			s.Suffix = []byte(fields[3])
+			s.Value = []byte(fields[4])
+		case "unset":
+			require.Equal(t, 4, len(fields), line)
+			s.Start = base.MakeInternalKey([]byte(bounds[0]), seqNum, base.InternalKeyKindRangeKeyUnset)
+			s.Suffix = []byte(fields[3])
+		case "del":
+			s.Start = base.MakeInternalKey([]byte(bounds[0]), seqNum, base.InternalKeyKindRangeKeyDelete)
+		default:
+			t.Fatalf("unknown range key operation: %s", line)
+		}
+		spans = append(spans, s)
+	}
+	return spans
+}
+
+func formatSpans(spans []Span) string {
+	var buf bytes.Buffer
+	for _, s := range spans {
+		fmt.Fprintf(&buf, "%s\n", s)
+	}
+	return buf.String()
+}
+
+func TestEncodeValue(t *testing.T) {
+	for _, c := range []struct {
+		end, suffix, value string
+	}{
+		{"", "", ""},
+		{"z", "", ""},
+		{"zz", "@1", ""},
+		{"zzz", "@12", "value"},
+	} {
+		enc := EncodeValue(nil, []byte(c.end), []byte(c.suffix), []byte(c.value))
+		require.Equal(t, EncodedValueLen([]byte(c.end), []byte(c.suffix), []byte(c.value)), len(enc))
+		end, suffix, value, ok := DecodeValue(enc)
+		require.True(t, ok)
+		require.Equal(t, c.end, string(end))
+		require.Equal(t, c.suffix, string(suffix))
+		require.Equal(t, c.value, string(value))
+		if len(enc) > 1 {
+			_, _, _, ok = DecodeValue(enc[:1])
+			require.False(t, ok)
+		}
+	}
+}
+
+func TestRangeKeys(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	var frags []Span
+
+	datadriven.RunTest(t, "testdata/range_keys", func(d *datadriven.TestData) string {
+		switch d.Cmd {
+		case "fragment":
+			frags = Fragment(cmp, parseSpans(t, d.Input))
+			return formatSpans(frags)
+
+		case "coalesce":
+			seqNum := base.InternalKeySeqNumMax
+			for _, arg := range d.CmdArgs {
+				switch arg.Key {
+				case "t":
+					var err error
+					seqNum, err = strconv.ParseUint(arg.Vals[0], 10, 64)
+					require.NoError(t, err)
+				default:
+					return fmt.Sprintf("unknown argument: %s", arg.Key)
+				}
+			}
+			spans := Coalesce(cmp, frags, func(s uint64) bool { return s < seqNum })
+			var buf bytes.Buffer
+			for _, s := range spans {
+				fmt.Fprintf(&buf, "%s\n", s)
+			}
+			return buf.String()
+
+		case "elide":
+			var snapshots []uint64
+			var elide bool
+			for _, arg := range d.CmdArgs {
+				switch arg.Key {
+				case "snapshots":
+					for _, v := range arg.Vals {
+						s, err := strconv.ParseUint(v, 10, 64)
+						require.NoError(t, err)
+						snapshots = append(snapshots, s)
+					}
+				case "elide":
+					elide = true
+				default:
+					return fmt.Sprintf("unknown argument: %s", arg.Key)
+				}
+			}
+			return formatSpans(Elide(cmp, frags, snapshots, func(start, end []byte) bool {
+				return elide
+			}))
+
+		case "truncate":
+			if len(d.CmdArgs) != 1 {
+				return fmt.Sprintf("expected 1 argument, but found %s", d.CmdArgs)
+			}
+			bounds := strings.Split(d.CmdArgs[0].Key, "-")
+			return formatSpans(Truncate(cmp, frags, []byte(bounds[0]), []byte(bounds[1])))
+
+		default:
+			return fmt.Sprintf("unknown command: %s", d.Cmd)
+		}
+	})
+}
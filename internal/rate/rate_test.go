@@ -459,3 +459,22 @@ func BenchmarkAllowN(b *testing.B) {
 		}
 	})
 }
+
+func TestSetBurst(t *testing.T) {
+	lim := NewLimiter(10, 1)
+	run(t, lim, []allow{
+		{t0, 1, true},
+		{t0, 1, false},
+		{t0, 2, false}, // burst size is 1, so n=2 always fails
+	})
+	lim.SetBurstAt(t0, 2)
+	if lim.Burst() != 2 {
+		t.Fatalf("burst = %d, want 2", lim.Burst())
+	}
+	run(t, lim, []allow{
+		{t1, 1, true},
+		{t1, 1, false},
+		{t3, 2, true}, // burst size is 2
+		{t3, 1, false},
+	})
+}
@@ -575,6 +575,23 @@ func (w *LogWriter) SyncRecord(p []byte, wg *sync.WaitGroup, err *error) (int64,
 	return offset, nil
 }
 
+// Sync writes the records written to the LogWriter to the underlying writer
+// and syncs it, blocking until the sync completes. Sync must not be called
+// concurrently with SyncRecord.
+func (w *LogWriter) Sync() error {
+	if w.err != nil {
+		return w.err
+	}
+	var wg sync.WaitGroup
+	var err error
+	wg.Add(1)
+	f := &w.flusher
+	f.syncQ.push(&wg, &err)
+	f.ready.Signal()
+	wg.Wait()
+	return err
+}
+
 // Size returns the current size of the file.
 func (w *LogWriter) Size() int64 {
 	return w.blockNum*blockSize + int64(w.block.written)
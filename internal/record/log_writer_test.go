@@ -186,6 +186,25 @@ func TestSyncRecord(t *testing.T) {
 	}
 }
 
+func TestSync(t *testing.T) {
+	f := &syncFile{}
+	w := NewLogWriter(f, 0)
+
+	for i := 0; i < 1000; i++ {
+		offset, err := w.WriteRecord([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, w.Sync())
+		if v := atomic.LoadInt64(&f.writePos); offset != v {
+			t.Fatalf("expected write pos %d, but found %d", offset, v)
+		}
+		if v := atomic.LoadInt64(&f.syncPos); offset != v {
+			t.Fatalf("expected sync pos %d, but found %d", offset, v)
+		}
+	}
+	require.NoError(t, w.Close())
+	require.Error(t, w.Sync())
+}
+
 type fakeTimer struct {
 	f func()
 }
@@ -0,0 +1,167 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package xxhash implements the 64-bit variant of the xxHash algorithm
+// (XXH64) with a seed of zero, as used by RocksDB for block checksums.
+//
+// To calculate the checksum of some data:
+//
+//	var u uint64 = xxhash.Sum64(data)
+package xxhash // import "github.com/cockroachdb/pebble/internal/xxhash"
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The primes are variables rather than constants, so that arithmetic on them
+// wraps around rather than overflowing at compile time.
+var (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// Digest computes the XXH64 hash of the data written to it. The zero value is
+// not ready to use; use New.
+type Digest struct {
+	v1, v2, v3, v4 uint64
+	// total is the number of bytes written.
+	total uint64
+	// mem buffers the bytes which do not fill a 32 byte stripe.
+	mem [32]byte
+	n   int
+}
+
+// New returns a new Digest.
+func New() *Digest {
+	d := &Digest{}
+	d.Reset()
+	return d
+}
+
+// Reset resets the Digest to its initial state.
+func (d *Digest) Reset() {
+	d.v1 = prime1 + prime2
+	d.v2 = prime2
+	d.v3 = 0
+	d.v4 = -prime1
+	d.total = 0
+	d.n = 0
+}
+
+// Write adds the bytes to the Digest. It always returns len(b), nil.
+func (d *Digest) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+
+	if d.n+n < 32 {
+		// The bytes do not fill the buffered stripe.
+		copy(d.mem[d.n:], b)
+		d.n += n
+		return n, nil
+	}
+
+	if d.n > 0 {
+		// Complete the buffered stripe.
+		c := copy(d.mem[d.n:], b)
+		d.v1 = round(d.v1, u64(d.mem[0:8]))
+		d.v2 = round(d.v2, u64(d.mem[8:16]))
+		d.v3 = round(d.v3, u64(d.mem[16:24]))
+		d.v4 = round(d.v4, u64(d.mem[24:32]))
+		b = b[c:]
+		d.n = 0
+	}
+
+	for ; len(b) >= 32; b = b[32:] {
+		d.v1 = round(d.v1, u64(b[0:8]))
+		d.v2 = round(d.v2, u64(b[8:16]))
+		d.v3 = round(d.v3, u64(b[16:24]))
+		d.v4 = round(d.v4, u64(b[24:32]))
+	}
+	d.n = copy(d.mem[:], b)
+	return n, nil
+}
+
+// WriteByte adds the byte to the Digest. It always returns nil.
+func (d *Digest) WriteByte(c byte) error {
+	var b [1]byte
+	b[0] = c
+	_, _ = d.Write(b[:])
+	return nil
+}
+
+// Sum64 returns the hash of the bytes written to the Digest.
+func (d *Digest) Sum64() uint64 {
+	var h uint64
+	if d.total >= 32 {
+		h = bits.RotateLeft64(d.v1, 1) + bits.RotateLeft64(d.v2, 7) +
+			bits.RotateLeft64(d.v3, 12) + bits.RotateLeft64(d.v4, 18)
+		h = mergeRound(h, d.v1)
+		h = mergeRound(h, d.v2)
+		h = mergeRound(h, d.v3)
+		h = mergeRound(h, d.v4)
+	} else {
+		h = prime5
+	}
+	h += d.total
+	return finalize(h, d.mem[:d.n])
+}
+
+// Sum64 returns the XXH64 hash of b.
+func Sum64(b []byte) uint64 {
+	if len(b) < 32 {
+		// Short inputs, such as keys, have no full stripes to mix in.
+		return finalize(prime5+uint64(len(b)), b)
+	}
+	var d Digest
+	d.Reset()
+	_, _ = d.Write(b)
+	return d.Sum64()
+}
+
+// finalize mixes the remaining bytes b, fewer than 32, into h, and returns
+// the avalanched hash.
+func finalize(h uint64, b []byte) uint64 {
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= round(0, u64(b))
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime1
+		h = bits.RotateLeft64(h, 23)*prime2 + prime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * prime5
+		h = bits.RotateLeft64(h, 11) * prime1
+	}
+
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}
+
+func u64(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b)
+}
+
+func round(acc, input uint64) uint64 {
+	acc += input * prime2
+	acc = bits.RotateLeft64(acc, 31)
+	acc *= prime1
+	return acc
+}
+
+func mergeRound(acc, val uint64) uint64 {
+	val = round(0, val)
+	acc ^= val
+	acc = acc*prime1 + prime4
+	return acc
+}
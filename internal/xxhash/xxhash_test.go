@@ -0,0 +1,53 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package xxhash
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSum64(t *testing.T) {
+	testCases := []struct {
+		input string
+		sum   uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"asdf", 0x415872f599cea71e},
+		{"Call me Ishmael. Some years ago--never mind how long precisely-", 0x02a2e85470d6fd96},
+	}
+	for _, c := range testCases {
+		require.Equal(t, c.sum, Sum64([]byte(c.input)), "%q", c.input)
+
+		// Writing the input a byte at a time produces the same sum.
+		d := New()
+		for i := range c.input {
+			require.NoError(t, d.WriteByte(c.input[i]))
+		}
+		require.Equal(t, c.sum, d.Sum64(), "%q", c.input)
+	}
+}
+
+func TestDigestSplitWrites(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	d := New()
+	for i := 0; i < 1000; i++ {
+		b := make([]byte, rng.Intn(200))
+		rng.Read(b)
+		want := Sum64(b)
+
+		d.Reset()
+		for rest := b; len(rest) > 0; {
+			n := rng.Intn(len(rest) + 1)
+			_, _ = d.Write(rest[:n])
+			rest = rest[n:]
+		}
+		require.Equal(t, want, d.Sum64())
+	}
+}
@@ -58,10 +58,27 @@ type Iterator struct {
 	pos       iterPos
 	alloc     *iterAlloc
 	prefix    []byte
+	// blobFiles is used to read values stored in blob files. When valueIsBlob
+	// is true, value holds the encoded handle of a value in a blob file which
+	// has yet to be read. The value is only read when Value is called, and is
+	// read into blobValueBuf.
+	blobFiles    *blobFileCache
+	valueIsBlob  bool
+	blobValueBuf []byte
+	// rangeKey is non-nil if the iterator is configured to iterate over range
+	// keys (see IterOptions.KeyTypes).
+	rangeKey *iteratorRangeKeyState
+	// readSampling is the state of the sampling of the keys read by the
+	// iterator for read-triggered compactions.
+	readSampling readSampling
+	// txn is the transaction which created the iterator, if any. The spans
+	// between the bounds set by SetBounds are added to its read set.
+	txn *Txn
 }
 
 func (i *Iterator) findNextEntry() bool {
 	i.valid = false
+	i.valueIsBlob = false
 	i.pos = iterPosCur
 
 	for i.iterKey != nil {
@@ -78,10 +95,11 @@ func (i *Iterator) findNextEntry() bool {
 			i.nextUserKey()
 			continue
 
-		case InternalKeyKindSet:
+		case InternalKeyKindSet, InternalKeyKindBlobIndex:
 			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 			i.key = i.keyBuf
 			i.value = i.iterValue
+			i.valueIsBlob = key.Kind() == InternalKeyKindBlobIndex
 			i.valid = true
 			return true
 
@@ -128,6 +146,7 @@ func (i *Iterator) nextUserKey() {
 
 func (i *Iterator) findPrevEntry() bool {
 	i.valid = false
+	i.valueIsBlob = false
 	i.pos = iterPosCur
 
 	var valueMerger ValueMerger
@@ -148,12 +167,13 @@ func (i *Iterator) findPrevEntry() bool {
 		switch key.Kind() {
 		case InternalKeyKindDelete, InternalKeyKindSingleDelete:
 			i.value = nil
+			i.valueIsBlob = false
 			i.valid = false
 			valueMerger = nil
 			i.iterKey, i.iterValue = i.iter.Prev()
 			continue
 
-		case InternalKeyKindSet:
+		case InternalKeyKindSet, InternalKeyKindBlobIndex:
 			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 			i.key = i.keyBuf
 			// iterValue is owned by i.iter and could change after the Prev()
@@ -162,6 +182,7 @@ func (i *Iterator) findPrevEntry() bool {
 			// we just point i.value to the unsafe i.iter-owned value buffer.
 			i.valueBuf = append(i.valueBuf[:0], i.iterValue...)
 			i.value = i.valueBuf
+			i.valueIsBlob = key.Kind() == InternalKeyKindBlobIndex
 			i.valid = true
 			i.iterKey, i.iterValue = i.iter.Prev()
 			valueMerger = nil
@@ -177,6 +198,9 @@ func (i *Iterator) findPrevEntry() bool {
 				}
 				i.valid = true
 			} else if valueMerger == nil {
+				if i.valueIsBlob && !i.readBlobValue() {
+					return false
+				}
 				valueMerger, i.err = i.merge(i.key, i.value)
 				if i.err == nil {
 					i.err = valueMerger.MergeNewer(i.iterValue)
@@ -256,9 +280,17 @@ func (i *Iterator) mergeNext(key InternalKey, valueMerger ValueMerger) {
 			// point.
 			return
 
-		case InternalKeyKindSet:
+		case InternalKeyKindSet, InternalKeyKindBlobIndex:
 			// We've hit a Set value. Merge with the existing value and return.
-			i.err = valueMerger.MergeOlder(i.iterValue)
+			value := i.iterValue
+			if key.Kind() == InternalKeyKindBlobIndex {
+				i.blobValueBuf, i.err = i.fetchBlobValue(value, i.blobValueBuf)
+				if i.err != nil {
+					return
+				}
+				value = i.blobValueBuf
+			}
+			i.err = valueMerger.MergeOlder(value)
 			return
 
 		case InternalKeyKindMerge:
@@ -287,8 +319,11 @@ func (i *Iterator) SeekGE(key []byte) bool {
 		key = lowerBound
 	}
 
+	if i.rangeKey != nil {
+		return i.rangeKeySeekGE(key)
+	}
 	i.iterKey, i.iterValue = i.iter.SeekGE(key)
-	return i.findNextEntry()
+	return i.maybeSampleRead(i.findNextEntry())
 }
 
 // SeekPrefixGE moves the iterator to the first key/value pair whose key is
@@ -342,8 +377,11 @@ func (i *Iterator) SeekPrefixGE(key []byte) bool {
 		key = lowerBound
 	}
 
+	if i.rangeKey != nil {
+		return i.rangeKeySeekGE(key)
+	}
 	i.iterKey, i.iterValue = i.iter.SeekPrefixGE(i.prefix, key)
-	return i.findNextEntry()
+	return i.maybeSampleRead(i.findNextEntry())
 }
 
 // SeekLT moves the iterator to the last key/value pair whose key is less than
@@ -356,8 +394,11 @@ func (i *Iterator) SeekLT(key []byte) bool {
 		key = upperBound
 	}
 
+	if i.rangeKey != nil {
+		return i.rangeKeySeekLT(key)
+	}
 	i.iterKey, i.iterValue = i.iter.SeekLT(key)
-	return i.findPrevEntry()
+	return i.maybeSampleRead(i.findPrevEntry())
 }
 
 // First moves the iterator the the first key/value pair. Returns true if the
@@ -365,12 +406,15 @@ func (i *Iterator) SeekLT(key []byte) bool {
 func (i *Iterator) First() bool {
 	i.err = nil // clear cached iteration error
 	i.prefix = nil
+	if i.rangeKey != nil {
+		return i.rangeKeySeekGE(i.opts.GetLowerBound())
+	}
 	if lowerBound := i.opts.GetLowerBound(); lowerBound != nil {
 		i.iterKey, i.iterValue = i.iter.SeekGE(lowerBound)
 	} else {
 		i.iterKey, i.iterValue = i.iter.First()
 	}
-	return i.findNextEntry()
+	return i.maybeSampleRead(i.findNextEntry())
 }
 
 // Last moves the iterator the the last key/value pair. Returns true if the
@@ -378,12 +422,15 @@ func (i *Iterator) First() bool {
 func (i *Iterator) Last() bool {
 	i.err = nil // clear cached iteration error
 	i.prefix = nil
+	if i.rangeKey != nil {
+		return i.rangeKeySeekLT(i.opts.GetUpperBound())
+	}
 	if upperBound := i.opts.GetUpperBound(); upperBound != nil {
 		i.iterKey, i.iterValue = i.iter.SeekLT(upperBound)
 	} else {
 		i.iterKey, i.iterValue = i.iter.Last()
 	}
-	return i.findPrevEntry()
+	return i.maybeSampleRead(i.findPrevEntry())
 }
 
 // Next moves the iterator to the next key/value pair. Returns true if the
@@ -392,6 +439,14 @@ func (i *Iterator) Next() bool {
 	if i.err != nil {
 		return false
 	}
+	if i.rangeKey != nil {
+		return i.rangeKeyNext()
+	}
+	return i.nextPoint()
+}
+
+// nextPoint moves the point iterator to the next point key.
+func (i *Iterator) nextPoint() bool {
 	switch i.pos {
 	case iterPosCur:
 		i.nextUserKey()
@@ -415,7 +470,7 @@ func (i *Iterator) Next() bool {
 		i.nextUserKey()
 	case iterPosNext:
 	}
-	return i.findNextEntry()
+	return i.maybeSampleRead(i.findNextEntry())
 }
 
 // Prev moves the iterator to the previous key/value pair. Returns true if the
@@ -428,6 +483,14 @@ func (i *Iterator) Prev() bool {
 		i.err = errReversePrefixIteration
 		return false
 	}
+	if i.rangeKey != nil {
+		return i.rangeKeyPrev()
+	}
+	return i.prevPoint()
+}
+
+// prevPoint moves the point iterator to the previous point key.
+func (i *Iterator) prevPoint() bool {
 	switch i.pos {
 	case iterPosCur:
 		i.prevUserKey()
@@ -451,26 +514,67 @@ func (i *Iterator) Prev() bool {
 		i.prevUserKey()
 	case iterPosPrev:
 	}
-	return i.findPrevEntry()
+	return i.maybeSampleRead(i.findPrevEntry())
 }
 
 // Key returns the key of the current key/value pair, or nil if done. The
 // caller should not modify the contents of the returned slice, and its
 // contents may change on the next call to Next.
 func (i *Iterator) Key() []byte {
+	if i.rangeKey != nil {
+		return i.rangeKey.key
+	}
 	return i.key
 }
 
 // Value returns the value of the current key/value pair, or nil if done. The
 // caller should not modify the contents of the returned slice, and its
-// contents may change on the next call to Next.
+// contents may change on the next call to Next. If the iterator is positioned
+// at a range key without a point key (see HasPointAndRange), Value returns
+// nil. Use RangeKeys to retrieve the range keys.
+//
+// If the value is stored in a blob file (see
+// Options.ValueSeparationThreshold), it is read by the first call to Value
+// at the current position. If reading the value fails, Value returns nil and
+// the error is returned by Error.
 func (i *Iterator) Value() []byte {
+	if i.rangeKey != nil && !i.rangeKey.hasPoint {
+		return nil
+	}
+	if i.valueIsBlob && !i.readBlobValue() {
+		return nil
+	}
 	return i.value
 }
 
+// readBlobValue replaces the blob handle in i.value with the value it
+// references. Returns false and sets i.err if the value cannot be read.
+func (i *Iterator) readBlobValue() bool {
+	i.valueIsBlob = false
+	var value []byte
+	value, i.err = i.fetchBlobValue(i.value, i.blobValueBuf)
+	if i.err != nil {
+		i.value = nil
+		return false
+	}
+	i.blobValueBuf = value
+	i.value = value
+	return true
+}
+
+func (i *Iterator) fetchBlobValue(handle []byte, buf []byte) ([]byte, error) {
+	if i.blobFiles == nil {
+		return nil, errors.New("pebble: unexpected blob index key")
+	}
+	return i.blobFiles.fetch(handle, buf)
+}
+
 // Valid returns true if the iterator is positioned at a valid key/value pair
 // and false otherwise.
 func (i *Iterator) Valid() bool {
+	if i.rangeKey != nil {
+		return i.rangeKey.key != nil
+	}
 	return i.valid
 }
 
@@ -519,7 +623,14 @@ func (i *Iterator) SetBounds(lower, upper []byte) {
 	i.pos = iterPosCur
 	i.valid = false
 
+	if i.txn != nil {
+		i.txn.readSpan(lower, upper)
+	}
 	i.opts.LowerBound = lower
 	i.opts.UpperBound = upper
 	i.iter.SetBounds(lower, upper)
+	if i.rangeKey != nil {
+		i.rangeKey.reset()
+		i.rangeKey.setBounds(i.cmp, lower, upper)
+	}
 }
@@ -15,6 +15,7 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/rand"
@@ -571,6 +572,103 @@ func TestIteratorTableFilter(t *testing.T) {
 	})
 }
 
+// seqNumIntervalCollector is a sstable.DataBlockIntervalCollector which
+// collects the interval of the sequence numbers in a data block.
+type seqNumIntervalCollector struct {
+	lower, upper uint64
+}
+
+func (c *seqNumIntervalCollector) Add(key InternalKey, value []byte) error {
+	if c.lower == c.upper || c.lower > key.SeqNum() {
+		c.lower = key.SeqNum()
+	}
+	if c.upper < key.SeqNum()+1 {
+		c.upper = key.SeqNum() + 1
+	}
+	return nil
+}
+
+func (c *seqNumIntervalCollector) FinishDataBlock() (lower, upper uint64, err error) {
+	lower, upper = c.lower, c.upper
+	c.lower, c.upper = 0, 0
+	return lower, upper, nil
+}
+
+func TestIteratorBlockPropertyFilter(t *testing.T) {
+	var d *DB
+	defer func() {
+		if d != nil {
+			require.NoError(t, d.Close())
+		}
+	}()
+
+	datadriven.RunTest(t, "testdata/iterator_block_property_filter", func(td *datadriven.TestData) string {
+		switch td.Cmd {
+		case "define":
+			if d != nil {
+				if err := d.Close(); err != nil {
+					return err.Error()
+				}
+			}
+
+			opts := &Options{
+				// Use tiny blocks so that each key is in its own data block.
+				Levels: []LevelOptions{{BlockSize: 1, IndexBlockSize: 4096}},
+			}
+			opts.BlockPropertyCollectors = append(opts.BlockPropertyCollectors,
+				func() BlockPropertyCollector {
+					return sstable.NewBlockIntervalCollector("seq-num", &seqNumIntervalCollector{})
+				})
+
+			var err error
+			if d, err = runDBDefineCmd(td, opts); err != nil {
+				return err.Error()
+			}
+
+			d.mu.Lock()
+			s := d.mu.versions.currentVersion().DebugString(base.DefaultFormatter)
+			d.mu.Unlock()
+			return s
+
+		case "iter":
+			iterOpts := &IterOptions{}
+			for _, arg := range td.CmdArgs {
+				if len(arg.Vals) != 2 {
+					return fmt.Sprintf("%s: %s=(<lower>,<upper>)", td.Cmd, arg.Key)
+				}
+				switch arg.Key {
+				case "filter":
+					lower, err := strconv.ParseUint(arg.Vals[0], 10, 64)
+					if err != nil {
+						return err.Error()
+					}
+					upper, err := strconv.ParseUint(arg.Vals[1], 10, 64)
+					if err != nil {
+						return err.Error()
+					}
+					iterOpts.PointKeyFilters = append(iterOpts.PointKeyFilters,
+						sstable.NewBlockIntervalFilter("seq-num", lower, upper))
+				default:
+					return fmt.Sprintf("%s: unknown arg: %s", td.Cmd, arg.Key)
+				}
+			}
+
+			// NB: runDBDefineCmd doesn't update the visible sequence number, so a
+			// snapshot with a very large sequence number is used.
+			snap := Snapshot{
+				db:     d,
+				seqNum: InternalKeySeqNumMax,
+			}
+			iter := snap.NewIter(iterOpts)
+			defer iter.Close()
+			return runIterCmd(td, iter)
+
+		default:
+			return fmt.Sprintf("unknown command: %s", td.Cmd)
+		}
+	})
+}
+
 func TestIteratorNextPrev(t *testing.T) {
 	var mem vfs.FS
 	var d *DB
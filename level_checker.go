@@ -154,7 +154,9 @@ func (m *simpleMergingIter) step() bool {
 		if m.valueMerger != nil {
 			// Ongoing series of MERGE records.
 			switch item.key.Kind() {
-			case InternalKeyKindSingleDelete, InternalKeyKindDelete:
+			case InternalKeyKindSingleDelete, InternalKeyKindDelete, InternalKeyKindBlobIndex:
+				// NB: The value of a BLOBINDEX is stored in a blob file. It isn't
+				// read, and the series of MERGE records is finished without it.
 				_, m.err = m.valueMerger.Finish()
 				m.valueMerger = nil
 			case InternalKeyKindSet:
@@ -349,32 +351,12 @@ func checkRangeTombstones(c *checkConfig) error {
 		level++
 	}
 
-	current := c.readState.current
-	for i := len(current.Files[0]) - 1; i >= 0; i-- {
-		f := current.Files[0][i]
-		iterToClose, iter, err := c.newIters(f, nil, nil)
-		if err != nil {
-			return err
-		}
-		iterToClose.Close()
-		if iter == nil {
-			continue
-		}
-		if tombstones, err = addTombstonesFromIter(iter, level, 0, f.FileNum, tombstones,
-			c.seqNum, c.cmp, c.format, nil); err != nil {
-			return err
-		}
-		level++
-	}
-	// Now the levels with untruncated tombsones.
-	for i := 1; i < len(current.Files); i++ {
-		if len(current.Files[i]) == 0 {
-			continue
-		}
-		files := &current.Files[i]
-		for j := 0; j < len(*files); j++ {
-			lower, upper := getAtomicUnitBounds(c.cmp, *files, j)
-			f := (*files)[j]
+	// The tombstones in the L0 sublevels and the other levels are untruncated,
+	// and are truncated to the atomic compaction unit bounds of their tables.
+	addLevel := func(files []*fileMetadata, lsmLevel int) error {
+		for j := 0; j < len(files); j++ {
+			lower, upper := getAtomicUnitBounds(c.cmp, files, j)
+			f := files[j]
 			iterToClose, iter, err := c.newIters(f, nil, nil)
 			if err != nil {
 				return err
@@ -396,12 +378,29 @@ func checkRangeTombstones(c *checkConfig) error {
 				}
 				return t
 			}
-			if tombstones, err = addTombstonesFromIter(iter, level, i, f.FileNum,
+			if tombstones, err = addTombstonesFromIter(iter, level, lsmLevel, f.FileNum,
 				tombstones, c.seqNum, c.cmp, c.format, truncate); err != nil {
 				return err
 			}
 		}
 		level++
+		return nil
+	}
+
+	current := c.readState.current
+	l0Sublevels := current.L0Sublevels(c.cmp).Levels
+	for i := len(l0Sublevels) - 1; i >= 0; i-- {
+		if err := addLevel(l0Sublevels[i], 0); err != nil {
+			return err
+		}
+	}
+	for i := 1; i < len(current.Files); i++ {
+		if len(current.Files[i]) == 0 {
+			continue
+		}
+		if err := addLevel(current.Files[i], i); err != nil {
+			return err
+		}
 	}
 	if c.stats != nil {
 		c.stats.NumTombstones = len(tombstones)
@@ -626,23 +625,14 @@ func checkLevelsInternal(c *checkConfig) (err error) {
 		})
 	}
 
-	// Add L0 files from newest to oldest.
-	current := c.readState.current
-	for i := len(current.Files[0]) - 1; i >= 0; i-- {
-		f := current.Files[0][i]
-		iter, rangeDelIter, err := c.newIters(f, nil, nil)
-		if err != nil {
-			return err
-		}
-		mlevels = append(mlevels, simpleMergingIterLevel{
-			iter:         iter,
-			rangeDelIter: rangeDelIter,
-		})
-	}
-
 	// Determine the final size for mlevels so that there are no more
 	// reallocations. levelIter will hold a pointer to elements in mlevels.
+	current := c.readState.current
+	l0Sublevels := current.L0Sublevels(c.cmp).Levels
 	start := len(mlevels)
+	for range l0Sublevels {
+		mlevels = append(mlevels, simpleMergingIterLevel{})
+	}
 	for level := 1; level < len(current.Files); level++ {
 		if len(current.Files[level]) == 0 {
 			continue
@@ -650,18 +640,25 @@ func checkLevelsInternal(c *checkConfig) (err error) {
 		mlevels = append(mlevels, simpleMergingIterLevel{})
 	}
 	mlevelAlloc := mlevels[start:]
-	for level := 1; level < len(current.Files); level++ {
-		if len(current.Files[level]) == 0 {
-			continue
-		}
+	addLevelIterForFiles := func(files []*fileMetadata, level int) {
 		iterOpts := IterOptions{logger: c.logger}
 		li := &levelIter{}
-		li.init(iterOpts, c.cmp, c.newIters, current.Files[level], level, nil)
+		li.init(iterOpts, c.cmp, nil /* split */, c.newIters, files, level, nil)
 		li.initRangeDel(&mlevelAlloc[0].rangeDelIter)
 		li.initSmallestLargestUserKey(&mlevelAlloc[0].smallestUserKey, nil, nil)
 		mlevelAlloc[0].iter = li
 		mlevelAlloc = mlevelAlloc[1:]
 	}
+	// Add the L0 sublevels from newest to oldest.
+	for i := len(l0Sublevels) - 1; i >= 0; i-- {
+		addLevelIterForFiles(l0Sublevels[i], 0)
+	}
+	for level := 1; level < len(current.Files); level++ {
+		if len(current.Files[level]) == 0 {
+			continue
+		}
+		addLevelIterForFiles(current.Files[level], level)
+	}
 
 	mergingIter := &simpleMergingIter{}
 	mergingIter.init(c.merge, c.cmp, c.seqNum, c.format, mlevels...)
@@ -45,6 +45,7 @@ type tableNewIters func(
 type levelIter struct {
 	logger Logger
 	cmp    Compare
+	split  Split
 	// The lower/upper bounds for iteration as specified at creation or the most
 	// recent call to SetBounds.
 	lower []byte
@@ -55,6 +56,9 @@ type levelIter struct {
 	tableOpts IterOptions
 	// The LSM level this levelIter is initialized for.
 	level int
+	// The prefix passed to the most recent SeekPrefixGE, or nil if the iterator
+	// was not positioned by SeekPrefixGE.
+	prefix []byte
 	// The current file wrt the iterator position.
 	index int
 	// The keys to return when iterating past an sstable boundary and that
@@ -141,19 +145,21 @@ var _ base.InternalIterator = (*levelIter)(nil)
 func newLevelIter(
 	opts IterOptions,
 	cmp Compare,
+	split Split,
 	newIters tableNewIters,
 	files []*fileMetadata,
 	level int,
 	bytesIterated *uint64,
 ) *levelIter {
 	l := &levelIter{}
-	l.init(opts, cmp, newIters, files, level, bytesIterated)
+	l.init(opts, cmp, split, newIters, files, level, bytesIterated)
 	return l
 }
 
 func (l *levelIter) init(
 	opts IterOptions,
 	cmp Compare,
+	split Split,
 	newIters tableNewIters,
 	files []*fileMetadata,
 	level int,
@@ -165,7 +171,10 @@ func (l *levelIter) init(
 	l.lower = opts.LowerBound
 	l.upper = opts.UpperBound
 	l.tableOpts.TableFilter = opts.TableFilter
+	l.tableOpts.PointKeyFilters = opts.PointKeyFilters
 	l.cmp = cmp
+	l.split = split
+	l.prefix = nil
 	l.index = -1
 	l.newIters = newIters
 	l.files = files
@@ -345,6 +354,7 @@ func (l *levelIter) verify(key *InternalKey, val []byte) (*InternalKey, []byte)
 
 func (l *levelIter) SeekGE(key []byte) (*InternalKey, []byte) {
 	l.err = nil // clear cached iteration error
+	l.prefix = nil
 
 	// NB: the top-level Iterator has already adjusted key based on
 	// IterOptions.LowerBound.
@@ -359,6 +369,7 @@ func (l *levelIter) SeekGE(key []byte) (*InternalKey, []byte) {
 
 func (l *levelIter) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
 	l.err = nil // clear cached iteration error
+	l.prefix = prefix
 
 	// NB: the top-level Iterator has already adjusted key based on
 	// IterOptions.LowerBound.
@@ -386,6 +397,7 @@ func (l *levelIter) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
 
 func (l *levelIter) SeekLT(key []byte) (*InternalKey, []byte) {
 	l.err = nil // clear cached iteration error
+	l.prefix = nil
 
 	// NB: the top-level Iterator has already adjusted key based on
 	// IterOptions.UpperBound.
@@ -400,6 +412,7 @@ func (l *levelIter) SeekLT(key []byte) (*InternalKey, []byte) {
 
 func (l *levelIter) First() (*InternalKey, []byte) {
 	l.err = nil // clear cached iteration error
+	l.prefix = nil
 
 	// NB: the top-level Iterator will call SeekGE if IterOptions.LowerBound is
 	// set.
@@ -414,6 +427,7 @@ func (l *levelIter) First() (*InternalKey, []byte) {
 
 func (l *levelIter) Last() (*InternalKey, []byte) {
 	l.err = nil // clear cached iteration error
+	l.prefix = nil
 
 	// NB: the top-level Iterator will call SeekLT if IterOptions.UpperBound is
 	// set.
@@ -434,6 +448,9 @@ func (l *levelIter) Next() (*InternalKey, []byte) {
 	switch {
 	case l.largestBoundary != nil:
 		// We're stepping past the boundary key, so now we can load the next file.
+		if l.prefixExhausted() {
+			return nil, nil
+		}
 		if l.loadFile(l.index+1, 1) {
 			if key, val := l.iter.First(); key != nil {
 				return l.verify(key, val)
@@ -478,6 +495,30 @@ func (l *levelIter) Prev() (*InternalKey, []byte) {
 	return l.verify(l.skipEmptyFileBackward())
 }
 
+// prefixExhausted returns true if the iterator was positioned by SeekPrefixGE
+// and none of the files after the current one can contain a key with the
+// prefix. Keys are ordered by their prefixes, so this is the case if the
+// prefix of the largest key in the current file is greater than the prefix
+// being sought. Skipping the remaining files avoids loading the next one when
+// the table filter of the current file has already ruled out the prefix.
+// Without a split function the prefix is the whole key.
+func (l *levelIter) prefixExhausted() bool {
+	if l.prefix == nil {
+		return false
+	}
+	largest := &l.files[l.index].Largest
+	if largest.Trailer == InternalKeyRangeDeleteSentinel {
+		// The exclusive end key of a range tombstone may not be a key which can
+		// be split.
+		return false
+	}
+	n := len(largest.UserKey)
+	if l.split != nil {
+		n = l.split(largest.UserKey)
+	}
+	return l.cmp(l.prefix, largest.UserKey[:n]) < 0
+}
+
 func (l *levelIter) skipEmptyFileForward() (*InternalKey, []byte) {
 	var key *InternalKey
 	var val []byte
@@ -527,8 +568,9 @@ func (l *levelIter) skipEmptyFileForward() (*InternalKey, []byte) {
 			}
 		}
 
-		// Current file was exhausted. Move to the next file.
-		if !l.loadFile(l.index+1, 1) {
+		// Current file was exhausted. Move to the next file, unless it cannot
+		// contain the prefix being sought.
+		if l.prefixExhausted() || !l.loadFile(l.index+1, 1) {
 			return nil, nil
 		}
 	}
@@ -79,7 +79,7 @@ func TestLevelIter(t *testing.T) {
 				}
 			}
 
-			iter := newLevelIter(opts, DefaultComparer.Compare, newIters, files, level, nil)
+			iter := newLevelIter(opts, DefaultComparer.Compare, nil, newIters, files, level, nil)
 			defer iter.Close()
 			// Fake up the range deletion initialization.
 			iter.initRangeDel(new(internalIterator))
@@ -119,7 +119,7 @@ func TestLevelIter(t *testing.T) {
 				return newIters(meta, opts, nil)
 			}
 
-			iter := newLevelIter(opts, DefaultComparer.Compare, newIters2, files, level, nil)
+			iter := newLevelIter(opts, DefaultComparer.Compare, nil, newIters2, files, level, nil)
 			iter.SeekGE([]byte(key))
 			lower, upper := tableOpts.GetLowerBound(), tableOpts.GetUpperBound()
 			return fmt.Sprintf("[%s,%s]\n", lower, upper)
@@ -222,6 +222,7 @@ func (lt *levelIterTest) runBuild(d *datadriven.TestData) string {
 		return err.Error()
 	}
 	r, err := sstable.NewReader(f1, sstable.ReaderOptions{
+		Comparer: &lt.cmp,
 		Filters: map[string]FilterPolicy{
 			fp.Name(): fp,
 		},
@@ -256,7 +257,7 @@ func TestLevelIterBoundaries(t *testing.T) {
 			return lt.runBuild(d)
 
 		case "iter":
-			iter := newLevelIter(IterOptions{}, DefaultComparer.Compare, lt.newIters, lt.files, level, nil)
+			iter := newLevelIter(IterOptions{}, DefaultComparer.Compare, nil, lt.newIters, lt.files, level, nil)
 			defer iter.Close()
 			// Fake up the range deletion initialization.
 			iter.initRangeDel(new(internalIterator))
@@ -330,7 +331,7 @@ func TestLevelIterSeek(t *testing.T) {
 
 		case "iter":
 			iter := &levelIterTestIter{
-				levelIter: newLevelIter(IterOptions{}, DefaultComparer.Compare, lt.newIters, lt.files, level, nil),
+				levelIter: newLevelIter(IterOptions{}, DefaultComparer.Compare, nil, lt.newIters, lt.files, level, nil),
 			}
 			defer iter.Close()
 			iter.initRangeDel(&iter.rangeDelIter)
@@ -425,7 +426,7 @@ func BenchmarkLevelIterSeekGE(b *testing.B) {
 								iter, err := readers[meta.FileNum].NewIter(nil /* lower */, nil /* upper */)
 								return iter, nil, err
 							}
-							l := newLevelIter(IterOptions{}, DefaultComparer.Compare, newIters, files, level, nil)
+							l := newLevelIter(IterOptions{}, DefaultComparer.Compare, nil, newIters, files, level, nil)
 							rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
 
 							b.ResetTimer()
@@ -454,7 +455,7 @@ func BenchmarkLevelIterNext(b *testing.B) {
 								iter, err := readers[meta.FileNum].NewIter(nil /* lower */, nil /* upper */)
 								return iter, nil, err
 							}
-							l := newLevelIter(IterOptions{}, DefaultComparer.Compare, newIters, files, level, nil)
+							l := newLevelIter(IterOptions{}, DefaultComparer.Compare, nil, newIters, files, level, nil)
 
 							b.ResetTimer()
 							for i := 0; i < b.N; i++ {
@@ -486,7 +487,7 @@ func BenchmarkLevelIterPrev(b *testing.B) {
 								iter, err := readers[meta.FileNum].NewIter(nil /* lower */, nil /* upper */)
 								return iter, nil, err
 							}
-							l := newLevelIter(IterOptions{}, DefaultComparer.Compare, newIters, files, level, nil)
+							l := newLevelIter(IterOptions{}, DefaultComparer.Compare, nil, newIters, files, level, nil)
 
 							b.ResetTimer()
 							for i := 0; i < b.N; i++ {
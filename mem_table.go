@@ -33,6 +33,17 @@ var memTableEmptySize = func() uint32 {
 	return arena.Size()
 }()
 
+// memTableEmptySkiplistSize is the amount of space allocated in the arena by
+// an empty skiplist. This space is reserved when the range key skiplist is
+// allocated.
+var memTableEmptySkiplistSize = func() uint32 {
+	var skl arenaskl.Skiplist
+	arena := arenaskl.NewArena(make([]byte, 16<<10 /* 16 KB */))
+	before := arena.Size()
+	skl.Reset(arena, bytes.Compare)
+	return arena.Size() - before
+}()
+
 // A memTable implements an in-memory layer of the LSM. A memTable is mutable,
 // but append-only. Records are added, but never removed. Deletion is supported
 // via tombstones, but it is up to higher level code (see Iterator) to support
@@ -57,13 +68,18 @@ var memTableEmptySize = func() uint32 {
 // commitPipeline serializes batch preparation, and allows batch application to
 // proceed concurrently.
 //
-// It is safe to call get, apply, newIter, and newRangeDelIter concurrently.
+// It is safe to call get, apply, newIter, newRangeDelIter and newRangeKeyIter
+// concurrently.
 type memTable struct {
 	cmp         Compare
 	equal       Equal
 	arenaBuf    []byte
 	skl         arenaskl.Skiplist
 	rangeDelSkl arenaskl.Skiplist
+	// rangeKeySkl holds a *arenaskl.Skiplist containing the range keys. Range
+	// keys are expected to be rare, so the skiplist is lazily allocated by
+	// prepare() when the first batch containing range keys is prepared.
+	rangeKeySkl atomic.Value
 	// reserved tracks the amount of space used by the memtable, both by actual
 	// data stored in the memtable as well as inflight batch commit
 	// operations. This value is incremented pessimistically by prepare() in
@@ -175,6 +191,13 @@ func (m *memTable) prepare(batch *Batch) error {
 	if batch.memTableSize > avail {
 		return arenaskl.ErrArenaFull
 	}
+	if batch.hasRangeKeys && m.rangeKeySkl.Load() == nil {
+		if batch.memTableSize+memTableEmptySkiplistSize > avail {
+			return arenaskl.ErrArenaFull
+		}
+		m.rangeKeySkl.Store(arenaskl.NewSkiplist(m.skl.Arena(), m.cmp))
+		m.reserved += memTableEmptySkiplistSize
+	}
 	m.reserved += batch.memTableSize
 
 	m.writerRef()
@@ -201,6 +224,12 @@ func (m *memTable) apply(batch *Batch, seqNum uint64) error {
 		case InternalKeyKindRangeDelete:
 			err = m.rangeDelSkl.Add(ikey, value)
 			tombstoneCount++
+		case InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeyDelete:
+			skl, _ := m.rangeKeySkl.Load().(*arenaskl.Skiplist)
+			if skl == nil {
+				return errors.New("pebble: memtable range key skiplist was not allocated by prepare")
+			}
+			err = skl.Add(ikey, value)
 		case InternalKeyKindLogData:
 			// Don't increment seqNum for LogData, since these are not applied
 			// to the memtable.
@@ -241,6 +270,21 @@ func (m *memTable) newRangeDelIter(*IterOptions) internalIterator {
 	return rangedel.NewIter(m.cmp, tombstones)
 }
 
+// newRangeKeyIter returns an iterator over the unfragmented range keys in the
+// memtable, or nil if the memtable does not contain any range keys.
+func (m *memTable) newRangeKeyIter(*IterOptions) internalIterator {
+	skl, _ := m.rangeKeySkl.Load().(*arenaskl.Skiplist)
+	if skl == nil {
+		return nil
+	}
+	it := skl.NewIter(nil, nil)
+	if key, _ := it.First(); key == nil {
+		_ = it.Close()
+		return nil
+	}
+	return it
+}
+
 func (m *memTable) availBytes() uint32 {
 	a := m.skl.Arena()
 	if atomic.LoadInt32(&m.writerRefs) == 1 {
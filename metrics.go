@@ -30,6 +30,10 @@ func formatCacheMetrics(buf *bytes.Buffer, m *CacheMetrics, name string) {
 // LevelMetrics holds per-level metrics such as the number of files and total
 // size of the files, and compaction related metrics.
 type LevelMetrics struct {
+	// The number of sublevels within the level. The sublevel count corresponds
+	// to the read amplification for the level. An empty level has a sublevel
+	// count of 0. Only L0 may have a sublevel count greater than 1.
+	Sublevels int32
 	// The total number of files in the level.
 	NumFiles int64
 	// The total size in bytes of the files in the level.
@@ -65,6 +69,12 @@ type LevelMetrics struct {
 	TablesIngested uint64
 	// The number of sstables moved to this level by a "move" compaction.
 	TablesMoved uint64
+	// The total size of the blocks of the tables in the level for which
+	// compression was attempted, before compression and as stored in the
+	// tables. Only the tables whose stats have been loaded, and which record
+	// their compression statistics, are included. See CompressionRatio.
+	CompressionInputSize  uint64
+	CompressionOutputSize uint64
 }
 
 // Add updates the counter metrics for the level.
@@ -90,10 +100,19 @@ func (m *LevelMetrics) WriteAmp() float64 {
 	return float64(m.BytesFlushed+m.BytesCompacted) / float64(m.BytesIn)
 }
 
+// CompressionRatio computes the compression ratio of the tables in the level.
+// Computed as CompressionInputSize / CompressionOutputSize.
+func (m *LevelMetrics) CompressionRatio() float64 {
+	if m.CompressionOutputSize == 0 {
+		return 0
+	}
+	return float64(m.CompressionInputSize) / float64(m.CompressionOutputSize)
+}
+
 // format generates a string of the receiver's metrics, formatting it into the
 // supplied buffer.
 func (m *LevelMetrics) format(buf *bytes.Buffer, score string) {
-	fmt.Fprintf(buf, "%9d %7s %7s %7s %7s %7s %7s %7s %7s %7s %7s %7.1f\n",
+	fmt.Fprintf(buf, "%9d %7s %7s %7s %7s %7s %7s %7s %7s %7s %7s %7d %7.1f\n",
 		m.NumFiles,
 		humanize.IEC.Uint64(m.Size),
 		score,
@@ -105,6 +124,7 @@ func (m *LevelMetrics) format(buf *bytes.Buffer, score string) {
 		humanize.IEC.Uint64(m.BytesFlushed+m.BytesCompacted),
 		humanize.SI.Uint64(m.TablesFlushed+m.TablesCompacted),
 		humanize.IEC.Uint64(m.BytesRead),
+		m.Sublevels,
 		m.WriteAmp())
 }
 
@@ -123,6 +143,8 @@ type Metrics struct {
 		// An estimate of the number of bytes that need to be compacted for the LSM
 		// to reach a stable state.
 		EstimatedDebt uint64
+		// The number of read-triggered compactions.
+		ReadCount int64
 	}
 
 	Flush struct {
@@ -153,6 +175,14 @@ type Metrics struct {
 		ZombieSize uint64
 		// The count of zombie tables.
 		ZombieCount int64
+		// The count of tables whose stats have not yet been loaded.
+		PendingStatsCount int64
+		// The number of point deletions in the tables whose stats have been
+		// loaded.
+		NumDeletions uint64
+		// An estimate of the number of bytes in lower levels covered by the
+		// range deletions in the tables whose stats have been loaded.
+		RangeDeletionsBytesEstimate uint64
 	}
 
 	TableCache CacheMetrics
@@ -182,7 +212,7 @@ func (m *Metrics) formatWAL(buf *bytes.Buffer) {
 	if m.WAL.BytesIn > 0 {
 		writeAmp = float64(m.WAL.BytesWritten) / float64(m.WAL.BytesIn)
 	}
-	fmt.Fprintf(buf, "    WAL %9d %7s %7s %7s %7s %7s %7s %7s %7s %7s %7s %7.1f\n",
+	fmt.Fprintf(buf, "    WAL %9d %7s %7s %7s %7s %7s %7s %7s %7s %7s %7s %7s %7.1f\n",
 		m.WAL.Files,
 		humanize.Uint64(m.WAL.Size),
 		notApplicable,
@@ -194,48 +224,56 @@ func (m *Metrics) formatWAL(buf *bytes.Buffer) {
 		humanize.Uint64(m.WAL.BytesWritten),
 		notApplicable,
 		notApplicable,
+		notApplicable,
 		writeAmp)
 }
 
 // Pretty-print the metrics, showing a line for the WAL, a line per-level, and
 // a total:
 //
-//   __level_____count____size___score______in__ingest(sz_cnt)____move(sz_cnt)___write(sz_cnt)____read___w-amp
-//       WAL         1    27 B       -    48 B       -       -       -       -   108 B       -       -     2.2
-//         0         2   1.6 K    0.50    81 B   825 B       1     0 B       0   2.4 K       3     0 B    30.6
-//         1         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B     0.0
-//         2         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B     0.0
-//         3         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B     0.0
-//         4         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B     0.0
-//         5         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B     0.0
-//         6         1   825 B    0.00   1.6 K     0 B       0     0 B       0   825 B       1   1.6 K     0.5
-//     total         3   2.4 K       -   933 B   825 B       1     0 B       0   4.1 K       4   1.6 K     4.5
+//   __level_____count____size___score______in__ingest(sz_cnt)____move(sz_cnt)___write(sz_cnt)____read___r-amp___w-amp
+//       WAL         1    27 B       -    48 B       -       -       -       -   108 B       -       -       -     2.2
+//         0         2   1.6 K    0.50    81 B   825 B       1     0 B       0   2.4 K       3     0 B       2    30.6
+//         1         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B       0     0.0
+//         2         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B       0     0.0
+//         3         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B       0     0.0
+//         4         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B       0     0.0
+//         5         0     0 B    0.00     0 B     0 B       0     0 B       0     0 B       0     0 B       0     0.0
+//         6         1   825 B    0.00   1.6 K     0 B       0     0 B       0   825 B       1   1.6 K       1     0.5
+//     total         3   2.4 K       -   933 B   825 B       1     0 B       0   4.1 K       4   1.6 K       3     4.5
 //     flush         3
-//   compact         1   1.6 K          (size == estimated-debt)
+//   compact         1   1.6 K       0  (size == estimated-debt, score == read-compactions)
 //    memtbl         1   4.0 M
 //   zmemtbl         0     0 B
 //      ztbl         0     0 B
+//    tstats         0     0 B       0  (count == pending, size == rangedel-covered, score == point-dels)
 //    bcache         4   752 B    7.7%  (score == hit-rate)
 //    tcache         0     0 B    0.0%  (score == hit-rate)
 //    titers         0
 //    filter         -       -    0.0%  (score == utility)
 //
-// The WAL "in" metric is the size of the batches written to the WAL. The WAL
+// The "r-amp" metric is the read amplification of a level: the number of L0
+// sublevels for L0, and 1 for a non-empty level otherwise. The WAL "in"
+// metric is the size of the batches written to the WAL. The WAL
 // "write" metric is the size of the physical data written to the WAL which
 // includes record fragment overhead. Write amplification is computed as
 // bytes-written / bytes-in, except for the total row where bytes-in is
-// replaced with WAL-bytes-written + bytes-ingested.
+// replaced with WAL-bytes-written + bytes-ingested. The "tstats" row reports
+// the number of tables whose stats have not been loaded, and the estimated
+// bytes covered by range deletions and the point deletions in the tables
+// whose stats have been loaded.
 func (m *Metrics) String() string {
 	var buf bytes.Buffer
 	var total LevelMetrics
 	fmt.Fprintf(&buf, "__level_____count____size___score______in__ingest(sz_cnt)"+
-		"____move(sz_cnt)___write(sz_cnt)____read___w-amp\n")
+		"____move(sz_cnt)___write(sz_cnt)____read___r-amp___w-amp\n")
 	m.formatWAL(&buf)
 	for level := 0; level < numLevels; level++ {
 		l := &m.Levels[level]
 		fmt.Fprintf(&buf, "%7d ", level)
 		l.format(&buf, fmt.Sprintf("%0.2f", l.Score))
 		total.Add(l)
+		total.Sublevels += l.Sublevels
 		total.NumFiles += l.NumFiles
 		total.Size += l.Size
 	}
@@ -249,10 +287,10 @@ func (m *Metrics) String() string {
 	total.format(&buf, "-")
 
 	fmt.Fprintf(&buf, "  flush %9d\n", m.Flush.Count)
-	fmt.Fprintf(&buf, "compact %9d %7s %7s  (size == estimated-debt)\n",
+	fmt.Fprintf(&buf, "compact %9d %7s %7d  (size == estimated-debt, score == read-compactions)\n",
 		m.Compact.Count,
 		humanize.IEC.Uint64(m.Compact.EstimatedDebt),
-		"")
+		m.Compact.ReadCount)
 	fmt.Fprintf(&buf, " memtbl %9d %7s\n",
 		m.MemTable.Count,
 		humanize.IEC.Uint64(m.MemTable.Size))
@@ -262,6 +300,10 @@ func (m *Metrics) String() string {
 	fmt.Fprintf(&buf, "   ztbl %9d %7s\n",
 		m.Table.ZombieCount,
 		humanize.IEC.Uint64(m.Table.ZombieSize))
+	fmt.Fprintf(&buf, " tstats %9d %7s %7s  (count == pending, size == rangedel-covered, score == point-dels)\n",
+		m.Table.PendingStatsCount,
+		humanize.IEC.Uint64(m.Table.RangeDeletionsBytesEstimate),
+		humanize.SI.Uint64(m.Table.NumDeletions))
 	formatCacheMetrics(&buf, &m.BlockCache, "bcache")
 	formatCacheMetrics(&buf, &m.TableCache, "tcache")
 	fmt.Fprintf(&buf, " titers %9d\n", m.TableIters)
@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/cockroachdb/pebble/internal/base"
@@ -22,6 +23,7 @@ func TestMetricsFormat(t *testing.T) {
 	m.BlockCache.Misses = 4
 	m.Compact.Count = 5
 	m.Compact.EstimatedDebt = 6
+	m.Compact.ReadCount = 29
 	m.Flush.Count = 7
 	m.Filter.Hits = 8
 	m.Filter.Misses = 9
@@ -31,6 +33,9 @@ func TestMetricsFormat(t *testing.T) {
 	m.MemTable.ZombieCount = 13
 	m.Table.ZombieSize = 14
 	m.Table.ZombieCount = 15
+	m.Table.PendingStatsCount = 26
+	m.Table.NumDeletions = 27
+	m.Table.RangeDeletionsBytesEstimate = 28
 	m.TableCache.Size = 16
 	m.TableCache.Count = 17
 	m.TableCache.Hits = 18
@@ -45,6 +50,7 @@ func TestMetricsFormat(t *testing.T) {
 	for i := range m.Levels {
 		l := &m.Levels[i]
 		base := uint64((i + 1) * 100)
+		l.Sublevels = int32(i + 1)
 		l.NumFiles = int64(base) + 1
 		l.Size = base + 2
 		l.Score = float64(base) + 3
@@ -61,21 +67,22 @@ func TestMetricsFormat(t *testing.T) {
 	}
 
 	const expected = `
-__level_____count____size___score______in__ingest(sz_cnt)____move(sz_cnt)___write(sz_cnt)____read___w-amp
-    WAL        21    23 B       -    24 B       -       -       -       -    25 B       -       -     1.0
-      0       101   102 B  103.00   104 B   104 B     112   106 B     113   217 B     221   107 B     2.1
-      1       201   202 B  203.00   204 B   204 B     212   206 B     213   417 B     421   207 B     2.0
-      2       301   302 B  303.00   304 B   304 B     312   306 B     313   617 B     621   307 B     2.0
-      3       401   402 B  403.00   404 B   404 B     412   406 B     413   817 B     821   407 B     2.0
-      4       501   502 B  503.00   504 B   504 B     512   506 B     513  1017 B   1.0 K   507 B     2.0
-      5       601   602 B  603.00   604 B   604 B     612   606 B     613   1.2 K   1.2 K   607 B     2.0
-      6       701   702 B  703.00   704 B   704 B     712   706 B     713   1.4 K   1.4 K   707 B     2.0
-  total      2807   2.7 K       -   2.8 K   2.8 K   2.9 K   2.8 K   2.9 K   8.4 K   5.7 K   2.8 K     3.0
+__level_____count____size___score______in__ingest(sz_cnt)____move(sz_cnt)___write(sz_cnt)____read___r-amp___w-amp
+    WAL        21    23 B       -    24 B       -       -       -       -    25 B       -       -       -     1.0
+      0       101   102 B  103.00   104 B   104 B     112   106 B     113   217 B     221   107 B       1     2.1
+      1       201   202 B  203.00   204 B   204 B     212   206 B     213   417 B     421   207 B       2     2.0
+      2       301   302 B  303.00   304 B   304 B     312   306 B     313   617 B     621   307 B       3     2.0
+      3       401   402 B  403.00   404 B   404 B     412   406 B     413   817 B     821   407 B       4     2.0
+      4       501   502 B  503.00   504 B   504 B     512   506 B     513  1017 B   1.0 K   507 B       5     2.0
+      5       601   602 B  603.00   604 B   604 B     612   606 B     613   1.2 K   1.2 K   607 B       6     2.0
+      6       701   702 B  703.00   704 B   704 B     712   706 B     713   1.4 K   1.4 K   707 B       7     2.0
+  total      2807   2.7 K       -   2.8 K   2.8 K   2.9 K   2.8 K   2.9 K   8.4 K   5.7 K   2.8 K      28     3.0
   flush         7
-compact         5     6 B          (size == estimated-debt)
+compact         5     6 B      29  (size == estimated-debt, score == read-compactions)
  memtbl        11    10 B
 zmemtbl        13    12 B
    ztbl        15    14 B
+ tstats        26    28 B      27  (count == pending, size == rangedel-covered, score == point-dels)
  bcache         2     1 B   42.9%  (score == hit-rate)
  tcache        17    16 B   48.6%  (score == hit-rate)
  titers        20
@@ -89,6 +96,8 @@ zmemtbl        13    12 B
 func TestMetrics(t *testing.T) {
 	d, err := Open("", &Options{
 		FS: vfs.NewMem(),
+
+		disableTableStats: true,
 	})
 	require.NoError(t, err)
 	defer func() {
@@ -177,3 +186,45 @@ func TestMetrics(t *testing.T) {
 		}
 	})
 }
+
+func TestMetricsCompressionRatio(t *testing.T) {
+	// L6 uses adaptive compression, which leaves the random values of the
+	// compacted table uncompressed.
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+		Levels: []LevelOptions{
+			0: {},
+			6: {AdaptiveCompression: true},
+		},
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+
+	// Write two overlapping tables, so that compacting them into L6 rewrites
+	// their data rather than moving a table written by a flush.
+	rng := rand.New(rand.NewSource(0))
+	value := make([]byte, 100)
+	for _, start := range []int{0, 500} {
+		for i := start; i < start+600; i++ {
+			rng.Read(value)
+			require.NoError(t, d.Set([]byte(fmt.Sprintf("a%04d", i)), value, nil))
+		}
+		require.NoError(t, d.Flush())
+	}
+	require.NoError(t, d.Compact([]byte("a"), []byte("b")))
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, d.Set([]byte(fmt.Sprintf("b%04d", i)), make([]byte, 100), nil))
+	}
+	require.NoError(t, d.Flush())
+	d.waitTableStats()
+
+	m := d.Metrics()
+	require.Equal(t, int64(1), m.Levels[0].NumFiles)
+	require.Equal(t, int64(1), m.Levels[6].NumFiles)
+	require.True(t, m.Levels[0].CompressionRatio() > 4)
+	require.Equal(t, m.Levels[6].CompressionInputSize, m.Levels[6].CompressionOutputSize)
+	require.Equal(t, 1.0, m.Levels[6].CompressionRatio())
+	require.Equal(t, 0.0, m.Levels[1].CompressionRatio())
+}
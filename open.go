@@ -28,8 +28,31 @@ import (
 
 const initialMemTableSize = 256 << 10 // 256 KB
 
+// largeBatchThreshold returns the size at which a batch is too large to be
+// inserted into a memtable of the given size, and is flushed on its own.
+func largeBatchThreshold(memTableSize int) int64 {
+	return int64(memTableSize-int(memTableEmptySize)) / 2
+}
+
 // Open opens a DB whose files live in the given directory.
-func Open(dirname string, opts *Options) (db *DB, _ error) {
+func Open(dirname string, opts *Options) (*DB, error) {
+	d, err := open(dirname, opts)
+	if err != nil {
+		return nil, err
+	}
+	if spans := d.checkpointSpans; spans != nil {
+		// The DB is a span-restricted checkpoint. Delete the keys outside of its
+		// spans before returning it.
+		d.checkpointSpans = nil
+		if err := d.applyCheckpointSpans(spans); err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func open(dirname string, opts *Options) (db *DB, _ error) {
 	// Make a copy of the options so that we don't mutate the passed in options.
 	opts = opts.Clone()
 	opts = opts.EnsureDefaults()
@@ -53,7 +76,7 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 		merge:               opts.Merger.Merge,
 		split:               opts.Comparer.Split,
 		abbreviatedKey:      opts.Comparer.AbbreviatedKey,
-		largeBatchThreshold: (opts.MemTableSize - int(memTableEmptySize)) / 2,
+		largeBatchThreshold: largeBatchThreshold(opts.MemTableSize),
 		logRecycler:         logRecycler{limit: opts.MemTableStopWritesThreshold + 1},
 	}
 
@@ -66,6 +89,7 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 			// tableCache have a reference and we need to release both.
 			opts.Cache.Unref()
 			opts.Cache.Unref()
+			_ = d.blobFiles.close()
 			for _, mem := range d.mu.mem.queue {
 				switch t := mem.flushable.(type) {
 				case *memTable:
@@ -86,8 +110,12 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 	if tableCacheSize < minTableCacheSize {
 		tableCacheSize = minTableCacheSize
 	}
+	// Open blob files share the table cache's budget of open files.
+	blobFileCacheSize := tableCacheSize / blobFileCacheFraction
+	tableCacheSize -= blobFileCacheSize
 	d.tableCache.init(d.cacheID, dirname, opts.FS, d.opts, tableCacheSize, defaultTableCacheHitBuffer)
 	d.newIters = d.tableCache.newIters
+	d.blobFiles.init(opts.FS, dirname, blobFileCacheSize)
 	d.commit = newCommitPipeline(commitEnv{
 		logSeqNum:     &d.mu.versions.logSeqNum,
 		visibleSeqNum: &d.mu.versions.visibleSeqNum,
@@ -104,6 +132,8 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 	d.mu.mem.cond.L = &d.mu.Mutex
 	d.mu.cleaner.cond.L = &d.mu.Mutex
 	d.mu.compact.cond.L = &d.mu.Mutex
+	d.mu.tableStats.cond.L = &d.mu.Mutex
+	d.feeds.cond.L = &d.feeds.Mutex
 	d.mu.compact.inProgress = make(map[*compaction]struct{})
 	d.mu.snapshots.init()
 	// logSeqNum is the next sequence number that will be assigned. Start
@@ -211,6 +241,17 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 	}
 	var logFiles []fileNumAndName
 	for _, filename := range ls {
+		if filename == checkpointSpansFilename {
+			if d.opts.ReadOnly || d.opts.Follower {
+				return nil, errors.Errorf(
+					"pebble: span-restricted checkpoint %q must first be opened for writing", dirname)
+			}
+			d.checkpointSpans, err = readCheckpointSpans(opts.FS, opts.FS.PathJoin(dirname, filename))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 		ft, fn, ok := base.ParseFilename(opts.FS, filename)
 		if !ok {
 			continue
@@ -254,6 +295,7 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 		}
 	}
 	d.mu.versions.visibleSeqNum = d.mu.versions.logSeqNum
+	d.mu.log.discardedSeqNum = d.mu.versions.logSeqNum
 
 	if !d.opts.ReadOnly {
 		// Create an empty .log file.
@@ -288,6 +330,11 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 		// sets MinUnflushedLogNum to max-recovered-log-num + 1. We set it to the
 		// newLogNum. There should be no difference in using either value.
 		ve.MinUnflushedLogNum = newLogNum
+		// Ratchet the format major version of an existing DB up to the
+		// configured version. A new DB is created at the configured version.
+		if opts.FormatMajorVersion > d.FormatMajorVersion() {
+			ve.FormatMajorVersion = uint64(opts.FormatMajorVersion)
+		}
 		d.mu.versions.logLock()
 		if err := d.mu.versions.logAndApply(jobID, &ve, nil, d.dataDir, func() []compactionInfo {
 			return nil
@@ -299,18 +346,7 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 
 	if !d.opts.ReadOnly {
 		// Write the current options to disk.
-		d.optionsFileNum = d.mu.versions.getNextFileNum()
-		optionsFile, err := opts.FS.Create(
-			base.MakeFilename(opts.FS, dirname, fileTypeOptions, d.optionsFileNum))
-		if err != nil {
-			return nil, err
-		}
-		if _, err := optionsFile.Write([]byte(opts.String())); err != nil {
-			return nil, err
-		}
-		_ = optionsFile.Sync()
-		_ = optionsFile.Close()
-		if err := d.dataDir.Sync(); err != nil {
+		if err := d.writeOptionsFile(opts); err != nil {
 			return nil, err
 		}
 	}
@@ -321,6 +357,7 @@ func Open(dirname string, opts *Options) (db *DB, _ error) {
 	}
 	d.maybeScheduleFlush()
 	d.maybeScheduleCompaction()
+	d.maybeCollectTableStatsLocked()
 
 	if invariants.Enabled {
 		runtime.SetFinalizer(d, func(obj interface{}) {
@@ -485,7 +522,7 @@ func (d *DB) replayWAL(
 		seqNum := b.SeqNum()
 		maxSeqNum = seqNum + uint64(b.Count())
 
-		if b.memTableSize >= uint32(d.largeBatchThreshold) {
+		if int64(b.memTableSize) >= d.largeBatchThreshold {
 			flushMem()
 			// Make a copy of the data slice since it is currently owned by buf and will
 			// be reused in the next iteration.
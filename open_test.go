@@ -470,7 +470,7 @@ func TestOpenWALReplay2(t *testing.T) {
 						require.NoError(t, d.Set([]byte("2"), largeValue, nil))
 						require.NoError(t, d.Set([]byte("3"), largeValue, nil))
 					case "large-batch":
-						largeValue := []byte(strings.Repeat("a", d.largeBatchThreshold))
+						largeValue := []byte(strings.Repeat("a", int(d.largeBatchThreshold)))
 						require.NoError(t, d.Set([]byte("1"), nil, nil))
 						require.NoError(t, d.Set([]byte("2"), largeValue, nil))
 						require.NoError(t, d.Set([]byte("3"), nil, nil))
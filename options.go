@@ -7,6 +7,7 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -53,11 +54,18 @@ type TableFormat = sstable.TableFormat
 const (
 	TableFormatRocksDBv2 = sstable.TableFormatRocksDBv2
 	TableFormatLevelDB   = sstable.TableFormatLevelDB
+	TableFormatPebblev1  = sstable.TableFormatPebblev1
 )
 
 // TablePropertyCollector exports the base.TablePropertyCollector type.
 type TablePropertyCollector = sstable.TablePropertyCollector
 
+// BlockPropertyCollector exports the sstable.BlockPropertyCollector type.
+type BlockPropertyCollector = sstable.BlockPropertyCollector
+
+// BlockPropertyFilter exports the sstable.BlockPropertyFilter type.
+type BlockPropertyFilter = sstable.BlockPropertyFilter
+
 // IterOptions hold the optional per-query parameters for NewIter.
 //
 // Like Options, a nil *IterOptions is valid and means to use the default
@@ -77,11 +85,51 @@ type IterOptions struct {
 	// iteration based on the user properties. Return true to scan the table and
 	// false to skip scanning.
 	TableFilter func(userProps map[string]string) bool
+	// PointKeyFilters can be used to skip the sstables and the data blocks
+	// within sstables whose block properties, computed by the
+	// Options.BlockPropertyCollectors with the same name, do not intersect the
+	// filters. The filters are only a hint: they do not filter the point keys
+	// in memtables, batches or the blocks which are not skipped, so the
+	// iterator may return keys which do not match the filters. A filter is
+	// ignored for sstables written without its collector.
+	PointKeyFilters []BlockPropertyFilter
+	// KeyTypes configures which types of keys to iterate over: point keys,
+	// range keys, or both. The default is to iterate over point keys only.
+	KeyTypes IterKeyType
 
 	// Internal options.
 	logger Logger
 }
 
+// IterKeyType configures which types of keys an iterator should surface.
+type IterKeyType int8
+
+const (
+	// IterKeyTypePointsOnly configures an iterator to iterate over point keys
+	// only.
+	IterKeyTypePointsOnly IterKeyType = iota
+	// IterKeyTypeRangesOnly configures an iterator to iterate over range keys
+	// only.
+	IterKeyTypeRangesOnly
+	// IterKeyTypePointsAndRanges configures an iterator to iterate over both
+	// point keys and range keys simultaneously.
+	IterKeyTypePointsAndRanges
+)
+
+// String implements fmt.Stringer.
+func (t IterKeyType) String() string {
+	switch t {
+	case IterKeyTypePointsOnly:
+		return "points-only"
+	case IterKeyTypeRangesOnly:
+		return "ranges-only"
+	case IterKeyTypePointsAndRanges:
+		return "points-and-ranges"
+	default:
+		return fmt.Sprintf("unknown key type: %d", int8(t))
+	}
+}
+
 // GetLowerBound returns the LowerBound or nil if the receiver is nil.
 func (o *IterOptions) GetLowerBound() []byte {
 	if o == nil {
@@ -159,7 +207,19 @@ type LevelOptions struct {
 	// The default value is 90
 	BlockSizeThreshold int
 
-	// Compression defines the per-block compression to use.
+	// AdaptiveCompression, if true, leaves the blocks of a table uncompressed
+	// once the first blocks of the table compressed poorly, such as for data
+	// which is already compressed or encrypted. See
+	// sstable.WriterOptions.AdaptiveCompression. The compression ratio of each
+	// level is reported by LevelMetrics.CompressionRatio.
+	//
+	// The default value is false.
+	AdaptiveCompression bool
+
+	// Compression defines the per-block compression to use. The levels may use
+	// different codecs, such as a faster codec for L0 and a stronger codec for
+	// the bottom levels. Additional codecs may be added by
+	// sstable.RegisterCompression.
 	//
 	// The default value (DefaultCompression) uses snappy compression.
 	Compression Compression
@@ -167,6 +227,10 @@ type LevelOptions struct {
 	// FilterPolicy defines a filter algorithm (such as a Bloom filter) that can
 	// reduce disk reads for Get calls.
 	//
+	// If the Comparer has a Split function, the filters contain the prefixes of
+	// the keys rather than the whole keys, so that they can also be consulted by
+	// Iterator.SeekPrefixGE and by Gets of any version of a key.
+	//
 	// One such implementation is bloom.FilterPolicy(10) from the pebble/bloom
 	// package.
 	//
@@ -211,7 +275,7 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 	if o.BlockSizeThreshold <= 0 {
 		o.BlockSizeThreshold = base.DefaultBlockSizeThreshold
 	}
-	if o.Compression <= DefaultCompression || o.Compression >= sstable.NCompression {
+	if o.Compression <= DefaultCompression {
 		o.Compression = SnappyCompression
 	}
 	if o.IndexBlockSize <= 0 {
@@ -223,10 +287,122 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 	return o
 }
 
+// CompactionStyle specifies the strategy used to pick the compactions which
+// are run automatically.
+type CompactionStyle int8
+
+const (
+	// CompactionStyleLeveled keeps each level beneath L0 at a target size
+	// which grows by a constant factor from one level to the next, compacting
+	// a level into the next level once it exceeds its target size. Leveled
+	// compaction bounds the read and space amplification of the LSM at the
+	// cost of higher write amplification.
+	CompactionStyleLeveled CompactionStyle = iota
+	// CompactionStyleTiered (also known as universal compaction) keeps the
+	// data in a number of sorted runs of increasing age and size: the tables
+	// in L0, each of which is a sorted run, and the bottom level. Adjacent
+	// sorted runs of similar size are merged once the number of sorted runs
+	// reaches Options.L0CompactionThreshold. Tiered compaction lowers write
+	// amplification for write-heavy workloads at the cost of higher read and
+	// space amplification. See TieredCompactionOptions.
+	CompactionStyleTiered
+	// CompactionStyleFIFO keeps the data in L0, and drops the oldest tables
+	// once the total size of the tables exceeds a bound, or once they are
+	// older than a time-to-live. The tables are never compacted into lower
+	// levels. FIFO compaction suits data with a limited lifetime, such as
+	// time-series data. See FIFOCompactionOptions.
+	CompactionStyleFIFO
+)
+
+// String implements fmt.Stringer.
+func (s CompactionStyle) String() string {
+	switch s {
+	case CompactionStyleLeveled:
+		return "leveled"
+	case CompactionStyleTiered:
+		return "tiered"
+	case CompactionStyleFIFO:
+		return "fifo"
+	default:
+		return fmt.Sprintf("unknown compaction style: %d", int8(s))
+	}
+}
+
+// TieredCompactionOptions holds the parameters for CompactionStyleTiered.
+type TieredCompactionOptions struct {
+	// MaxSizeAmplificationPercent is the maximum size of the sorted runs newer
+	// than the bottom level, as a percentage of the size of the bottom level.
+	// Once it is exceeded, every sorted run is compacted into the bottom
+	// level.
+	//
+	// The default value is 200.
+	MaxSizeAmplificationPercent int
+
+	// MinMergeWidth is the minimum number of sorted runs merged by a
+	// compaction picked by size ratio.
+	//
+	// The default value is 2.
+	MinMergeWidth int
+
+	// SizeRatio is the percentage by which the size of a sorted run may exceed
+	// the total size of the newer sorted runs and still be merged with them.
+	//
+	// The default value is 1.
+	SizeRatio int
+}
+
+// EnsureDefaults ensures that the default values for all of the options have
+// been initialized.
+func (o *TieredCompactionOptions) EnsureDefaults() {
+	if o.MaxSizeAmplificationPercent <= 0 {
+		o.MaxSizeAmplificationPercent = 200
+	}
+	if o.MinMergeWidth < 2 {
+		o.MinMergeWidth = 2
+	}
+	if o.SizeRatio <= 0 {
+		o.SizeRatio = 1
+	}
+}
+
+// FIFOCompactionOptions holds the parameters for CompactionStyleFIFO.
+type FIFOCompactionOptions struct {
+	// MaxTableFilesSize is the maximum total size of the tables in the DB.
+	// Once it is exceeded, the oldest tables are dropped.
+	//
+	// The default value is 1 GB.
+	MaxTableFilesSize uint64
+
+	// TTL is the age at which a table is dropped. The age of a table is
+	// measured from its creation, and is checked whenever compactions are
+	// scheduled. Note that the tables created by the intra-L0 compactions of
+	// FIFO compaction are younger than their inputs.
+	//
+	// The default value is 0, which disables dropping tables by age.
+	TTL time.Duration
+}
+
+// EnsureDefaults ensures that the default values for all of the options have
+// been initialized.
+func (o *FIFOCompactionOptions) EnsureDefaults() {
+	if o.MaxTableFilesSize == 0 {
+		o.MaxTableFilesSize = 1 << 30 // 1 GB
+	}
+}
+
 // Options holds the optional parameters for configuring pebble. These options
 // apply to the DB at large; per-query options are defined by the IterOptions
 // and WriteOptions types.
 type Options struct {
+	// BlobFileGCThreshold is the fraction of a blob file's values which must
+	// remain live for the blob file to be retained. When the fraction of live
+	// values falls below the threshold, the live values are rewritten to new
+	// blob files by compacting the tables which reference the blob file. See
+	// ValueSeparationThreshold.
+	//
+	// The default value is 0.5.
+	BlobFileGCThreshold float64
+
 	// Sync sstables and the WAL periodically in order to smooth out writes to
 	// disk. This option does not provide any persistency guarantee, but is used
 	// to avoid latency spikes if the OS automatically decides to write out a
@@ -252,6 +428,27 @@ type Options struct {
 	// The default value uses the same ordering as bytes.Compare.
 	Comparer *Comparer
 
+	// CompactionFilter, if non-nil, is invoked to create a CompactionFilter for
+	// each compaction, which can remove keys or change their values as they
+	// are compacted. The function may return nil to disable filtering for a
+	// particular compaction. Flushes are not filtered. See CompactionFilter.
+	CompactionFilter func(ctx CompactionFilterContext) CompactionFilter
+
+	// CompactionStyle specifies the strategy used to pick automatic
+	// compactions. The style is recorded in the OPTIONS file, and may be
+	// changed when the DB is reopened:
+	//
+	// - Leveled to tiered: the tables beneath L0 are compacted into the
+	//   bottom level, a table at a time, before the first tiered compaction.
+	// - Leveled or tiered to FIFO: the tables beneath L0 are dropped first,
+	//   starting with the bottom level, once the size or age bound is
+	//   exceeded. Ingested tables are added to L0.
+	// - Tiered or FIFO to leveled: the tables in L0 are compacted into Lbase
+	//   as usual, which may take a while if L0 holds a large amount of data.
+	//
+	// The default value is CompactionStyleLeveled.
+	CompactionStyle CompactionStyle
+
 	// DebugCheck is invoked, if non-nil, whenever a new version is being
 	// installed. Typically, this is set to pebble.DebugCheckLevels in tests
 	// or tools only, to check invariants over all the data in the database.
@@ -264,6 +461,9 @@ type Options struct {
 	// TODO(peter): untested
 	DisableWAL bool
 
+	// FIFOCompaction holds the parameters for CompactionStyleFIFO.
+	FIFOCompaction FIFOCompactionOptions
+
 	// ErrorIfExists is whether it is an error if the database already exists.
 	//
 	// The default value is false.
@@ -286,15 +486,44 @@ type Options struct {
 	// map during normal usage of a DB.
 	Filters map[string]FilterPolicy
 
+	// FlushSplitBytes denotes the number of bytes of overlapping data in the
+	// base level at which the output of a flush is split into a new sstable.
+	// The split points are the boundaries of the sstables in the base level,
+	// which allows the resulting L0 sstables to be compacted into the base
+	// level independently of one another, and concurrently.
+	//
+	// The default value is twice the L0 target file size.
+	FlushSplitBytes int64
+
+	// Follower opens the DB as a follower of another (leader) DB. A follower
+	// accepts writes only via DB.ApplyAtSeqNum, which applies the batches
+	// committed by the leader at the sequence numbers assigned to them by the
+	// leader. Reads from a follower at a sequence number observe the same state
+	// as reads from the leader at that sequence number.
+	//
+	// The default value is false.
+	Follower bool
+
+	// FormatMajorVersion sets the format of persisted data. A newly created DB
+	// is created at this version, and an existing DB at a lower version is
+	// ratcheted up to it when opened. Features which require a newer format,
+	// such as range keys, return an error when used with an older one. See
+	// DB.RatchetFormatMajorVersion.
+	//
+	// The default value is FormatMostCompatible.
+	FormatMajorVersion FormatMajorVersion
+
 	// FS provides the interface for persistent file storage.
 	//
 	// The default value uses the underlying operating system's file system.
 	FS vfs.FS
 
-	// The number of files necessary to trigger an L0 compaction.
+	// The number of L0 sublevels necessary to trigger an L0 compaction. Files
+	// which do not overlap one another, such as the split outputs of a flush,
+	// share a sublevel. Files being compacted are not counted.
 	L0CompactionThreshold int
 
-	// Hard limit on the number of L0 files. Writes are stopped when this
+	// Hard limit on the number of L0 sublevels. Writes are stopped when this
 	// threshold is reached.
 	L0StopWritesThreshold int
 
@@ -314,6 +543,14 @@ type Options struct {
 	// The default logger uses the Go standard library log package.
 	Logger Logger
 
+	// MaxChangeFeedBufferSize is the maximum size of the batches committed after
+	// a change feed was created which the feed buffers in memory until they are
+	// returned. A feed which falls further behind fails with
+	// ErrChangeFeedOverflow. See DB.NewChangeFeed.
+	//
+	// The default value is 64 MB.
+	MaxChangeFeedBufferSize int
+
 	// MaxManifestFileSize is the maximum size the MANIFEST file is allowed to
 	// become. When the MANIFEST exceeds this size it is rolled over and a new
 	// MANIFEST is created.
@@ -359,6 +596,50 @@ type Options struct {
 	// default is 1.
 	MaxConcurrentCompactions int
 
+	// MaxSubcompactions specifies the maximum number of subcompactions a single
+	// compaction may be split into. A subcompaction compacts a disjoint key
+	// range of the inputs to the compaction, and the subcompactions of a
+	// compaction run concurrently. The outputs of the subcompactions are
+	// installed atomically. Subcompactions are not counted towards
+	// MaxConcurrentCompactions. The default is 1, which disables
+	// subcompactions.
+	MaxSubcompactions int
+
+	// MultiLevelCompactions enables multi-level compactions. A multi-level
+	// compaction compacts the tables of a level into the level two beneath it,
+	// merging the overlapping tables of the level in between in the same pass,
+	// rather than rewriting the data of the upper level twice. A compaction is
+	// extended by an additional level when doing so lowers its estimated write
+	// amplification. Compactions from L0 are not extended. The default is
+	// false.
+	MultiLevelCompactions bool
+
+	// PeriodicCompactionSeconds is the age, in seconds, after which a table is
+	// compacted, regardless of the size of its level. Tables in the bottom
+	// level are rewritten in place, which drops the keys deleted by tombstones
+	// that were compacted into the level after the table was written, and
+	// rewrites the table in the current table format. Periodic compactions run
+	// at the lowest priority, and only while no other compaction is running.
+	// Tables without a creation time are never compacted periodically. Only
+	// used by CompactionStyleLeveled. The default is 0, which disables
+	// periodic compactions.
+	PeriodicCompactionSeconds int64
+
+	// ReadCompactionRate controls the frequency of read-triggered
+	// compactions. A table may be read by ReadCompactionRate bytes of sampled
+	// reads per byte of its size (and by at least 100 sampled reads) which
+	// also read from tables in lower levels before it is queued for a
+	// compaction. Read-triggered compactions run at a lower priority than the
+	// compactions picked by level score. The default is 16000.
+	ReadCompactionRate int64
+
+	// ReadSamplingMultiplier controls the rate at which iterators sample the
+	// keys they read for read-triggered compactions. A read is sampled, on
+	// average, once every ReadSamplingMultiplier MB read by an iterator. A
+	// negative value disables read sampling, and with it read-triggered
+	// compactions. The default is 16.
+	ReadSamplingMultiplier int64
+
 	// ReadOnly indicates that the DB should be opened in read-only mode. Writes
 	// to the DB will return an error, background compactions are disabled, and
 	// the flush that normally occurs after replaying the WAL at startup is
@@ -368,14 +649,38 @@ type Options struct {
 	// TableFormat specifies the format version for writing sstables. The default
 	// is TableFormatRocksDBv2 which creates RocksDB compatible sstables. Use
 	// TableFormatLevelDB to create LevelDB compatible sstable which can be used
-	// by a wider range of tools and libraries.
+	// by a wider range of tools and libraries. Use TableFormatPebblev1 to create
+	// sstables with data block hash indexes, which speed up point lookups but
+	// cannot be read by RocksDB or older versions of Pebble.
 	TableFormat TableFormat
 
+	// TieredCompaction holds the parameters for CompactionStyleTiered.
+	TieredCompaction TieredCompactionOptions
+
 	// TablePropertyCollectors is a list of TablePropertyCollector creation
 	// functions. A new TablePropertyCollector is created for each sstable built
 	// and lives for the lifetime of the table.
 	TablePropertyCollectors []func() TablePropertyCollector
 
+	// BlockPropertyCollectors is a list of BlockPropertyCollector creation
+	// functions. A new BlockPropertyCollector is created for each sstable
+	// built and lives for the lifetime of writing that table. The block
+	// properties allow iterators to skip sstable blocks using
+	// IterOptions.PointKeyFilters.
+	BlockPropertyCollectors []func() BlockPropertyCollector
+
+	// ValueSeparationThreshold is the minimum size of a value which is stored
+	// in a blob file, separately from its key, when it is written to an
+	// sstable by a flush or compaction. Separated values are not rewritten by
+	// subsequent compactions, reducing write amplification for large values at
+	// the cost of an additional read when the value is retrieved. Values are
+	// only read from blob files when Iterator.Value is called.
+	//
+	// The default value is 0, which disables value separation. Blob files
+	// created while value separation was enabled continue to be read and
+	// garbage collected.
+	ValueSeparationThreshold int
+
 	// WALDir specifies the directory to store write-ahead logs (WALs) in. If
 	// empty (the default), WALs will be stored in the same directory as sstables
 	// (i.e. the directory passed to pebble.Open).
@@ -387,16 +692,31 @@ type Options struct {
 	// WAL syncs can allow more operations to arrive and reduce IO operations
 	// while having a minimal impact on throughput. This option is supplied as a
 	// closure in order to allow the value to be changed dynamically. The default
-	// value is 0.
-	//
-	// TODO(peter): rather than a closure, should there be another mechanism for
-	// changing options dynamically?
+	// value is 0. Other options may be changed dynamically by DB.SetOptions.
 	WALMinSyncInterval func() time.Duration
 
+	// WALRetentionPeriod is the duration for which WAL files are retained after
+	// their contents have been flushed, allowing change feeds to read the
+	// batches they contain. See DB.NewChangeFeed. WAL files which are still
+	// needed by an open change feed are retained regardless of this period.
+	// The default value is 0, which deletes (or recycles) WAL files as soon as
+	// they are no longer needed.
+	WALRetentionPeriod time.Duration
+
 	// TODO(peter): A private option to enable flush/compaction pacing. Only used
 	// by tests. Compaction/flush pacing is disabled until we fix the impact on
 	// throughput.
 	enablePacing bool
+
+	// A private option to disable delete-only compactions. Only used by tests
+	// whose expected output would otherwise depend on the timing of the
+	// background delete-only compactions.
+	disableDeleteOnlyCompactions bool
+
+	// A private option to disable the loading of table stats. Only used by
+	// tests whose expected output would otherwise depend on the timing of the
+	// background loads.
+	disableTableStats bool
 }
 
 // DebugCheckLevels calls CheckLevels on the provided database.
@@ -412,6 +732,9 @@ func (o *Options) EnsureDefaults() *Options {
 	if o == nil {
 		o = &Options{}
 	}
+	if o.BlobFileGCThreshold <= 0 {
+		o.BlobFileGCThreshold = 0.5
+	}
 	if o.BytesPerSync <= 0 {
 		o.BytesPerSync = 512 << 10 // 512 KB
 	}
@@ -424,6 +747,11 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.FS == nil {
 		o.FS = vfs.Default
 	}
+	o.FIFOCompaction.EnsureDefaults()
+	if o.FormatMajorVersion == FormatDefault {
+		o.FormatMajorVersion = FormatMostCompatible
+	}
+	o.TieredCompaction.EnsureDefaults()
 	if o.L0CompactionThreshold <= 0 {
 		o.L0CompactionThreshold = 4
 	}
@@ -453,6 +781,12 @@ func (o *Options) EnsureDefaults() *Options {
 		o.Logger = DefaultLogger
 	}
 	o.EventListener.EnsureDefaults(o.Logger)
+	if o.FlushSplitBytes <= 0 {
+		o.FlushSplitBytes = 2 * o.Levels[0].TargetFileSize
+	}
+	if o.MaxChangeFeedBufferSize <= 0 {
+		o.MaxChangeFeedBufferSize = 64 << 20 // 64 MB
+	}
 	if o.MaxManifestFileSize == 0 {
 		o.MaxManifestFileSize = 128 << 20 // 128 MB
 	}
@@ -477,6 +811,15 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.MaxConcurrentCompactions <= 0 {
 		o.MaxConcurrentCompactions = 1
 	}
+	if o.ReadCompactionRate <= 0 {
+		o.ReadCompactionRate = 16000
+	}
+	if o.ReadSamplingMultiplier == 0 {
+		o.ReadSamplingMultiplier = 16
+	}
+	if o.MaxSubcompactions <= 0 {
+		o.MaxSubcompactions = 1
+	}
 
 	o.initMaps()
 	return o
@@ -539,22 +882,35 @@ func (o *Options) String() string {
 	fmt.Fprintf(&buf, "  pebble_version=0.1\n")
 	fmt.Fprintf(&buf, "\n")
 	fmt.Fprintf(&buf, "[Options]\n")
+	fmt.Fprintf(&buf, "  blob_file_gc_threshold=%g\n", o.BlobFileGCThreshold)
 	fmt.Fprintf(&buf, "  bytes_per_sync=%d\n", o.BytesPerSync)
 	fmt.Fprintf(&buf, "  cache_size=%d\n", cacheSize)
 	fmt.Fprintf(&buf, "  cleaner=%s\n", o.Cleaner)
 	fmt.Fprintf(&buf, "  comparer=%s\n", o.Comparer.Name)
+	fmt.Fprintf(&buf, "  compaction_style=%s\n", o.CompactionStyle)
 	fmt.Fprintf(&buf, "  disable_wal=%t\n", o.DisableWAL)
+	fmt.Fprintf(&buf, "  fifo_max_table_files_size=%d\n", o.FIFOCompaction.MaxTableFilesSize)
+	fmt.Fprintf(&buf, "  fifo_ttl=%s\n", o.FIFOCompaction.TTL)
+	fmt.Fprintf(&buf, "  flush_split_bytes=%d\n", o.FlushSplitBytes)
+	fmt.Fprintf(&buf, "  follower=%t\n", o.Follower)
+	fmt.Fprintf(&buf, "  format_major_version=%d\n", o.FormatMajorVersion)
 	fmt.Fprintf(&buf, "  l0_compaction_threshold=%d\n", o.L0CompactionThreshold)
 	fmt.Fprintf(&buf, "  l0_stop_writes_threshold=%d\n", o.L0StopWritesThreshold)
 	fmt.Fprintf(&buf, "  lbase_max_bytes=%d\n", o.LBaseMaxBytes)
+	fmt.Fprintf(&buf, "  max_change_feed_buffer_size=%d\n", o.MaxChangeFeedBufferSize)
 	fmt.Fprintf(&buf, "  max_concurrent_compactions=%d\n", o.MaxConcurrentCompactions)
 	fmt.Fprintf(&buf, "  max_manifest_file_size=%d\n", o.MaxManifestFileSize)
 	fmt.Fprintf(&buf, "  max_open_files=%d\n", o.MaxOpenFiles)
+	fmt.Fprintf(&buf, "  max_subcompactions=%d\n", o.MaxSubcompactions)
 	fmt.Fprintf(&buf, "  mem_table_size=%d\n", o.MemTableSize)
 	fmt.Fprintf(&buf, "  mem_table_stop_writes_threshold=%d\n", o.MemTableStopWritesThreshold)
 	fmt.Fprintf(&buf, "  min_compaction_rate=%d\n", o.MinCompactionRate)
 	fmt.Fprintf(&buf, "  min_flush_rate=%d\n", o.MinFlushRate)
 	fmt.Fprintf(&buf, "  merger=%s\n", o.Merger.Name)
+	fmt.Fprintf(&buf, "  multi_level_compactions=%t\n", o.MultiLevelCompactions)
+	fmt.Fprintf(&buf, "  periodic_compaction_seconds=%d\n", o.PeriodicCompactionSeconds)
+	fmt.Fprintf(&buf, "  read_compaction_rate=%d\n", o.ReadCompactionRate)
+	fmt.Fprintf(&buf, "  read_sampling_multiplier=%d\n", o.ReadSamplingMultiplier)
 	fmt.Fprintf(&buf, "  table_property_collectors=[")
 	for i := range o.TablePropertyCollectors {
 		if i > 0 {
@@ -565,12 +921,18 @@ func (o *Options) String() string {
 		fmt.Fprintf(&buf, "%s", o.TablePropertyCollectors[i]().Name())
 	}
 	fmt.Fprintf(&buf, "]\n")
+	fmt.Fprintf(&buf, "  tiered_max_size_amplification_percent=%d\n", o.TieredCompaction.MaxSizeAmplificationPercent)
+	fmt.Fprintf(&buf, "  tiered_min_merge_width=%d\n", o.TieredCompaction.MinMergeWidth)
+	fmt.Fprintf(&buf, "  tiered_size_ratio=%d\n", o.TieredCompaction.SizeRatio)
+	fmt.Fprintf(&buf, "  value_separation_threshold=%d\n", o.ValueSeparationThreshold)
 	fmt.Fprintf(&buf, "  wal_dir=%s\n", o.WALDir)
+	fmt.Fprintf(&buf, "  wal_retention_period=%s\n", o.WALRetentionPeriod)
 
 	for i := range o.Levels {
 		l := &o.Levels[i]
 		fmt.Fprintf(&buf, "\n")
 		fmt.Fprintf(&buf, "[Level \"%d\"]\n", i)
+		fmt.Fprintf(&buf, "  adaptive_compression=%t\n", l.AdaptiveCompression)
 		fmt.Fprintf(&buf, "  block_restart_interval=%d\n", l.BlockRestartInterval)
 		fmt.Fprintf(&buf, "  block_size=%d\n", l.BlockSize)
 		fmt.Fprintf(&buf, "  compression=%s\n", l.Compression)
@@ -662,6 +1024,8 @@ func (o *Options) Parse(s string, hooks *ParseHooks) error {
 		case section == "Options":
 			var err error
 			switch key {
+			case "blob_file_gc_threshold":
+				o.BlobFileGCThreshold, err = strconv.ParseFloat(value, 64)
 			case "bytes_per_sync":
 				o.BytesPerSync, err = strconv.Atoi(value)
 			case "cache_size":
@@ -689,20 +1053,48 @@ func (o *Options) Parse(s string, hooks *ParseHooks) error {
 						o.Comparer, err = hooks.NewComparer(value)
 					}
 				}
+			case "compaction_style":
+				// The RocksDB names of the compaction styles are accepted as well.
+				switch value {
+				case "leveled", "kCompactionStyleLevel":
+					o.CompactionStyle = CompactionStyleLeveled
+				case "tiered", "kCompactionStyleUniversal":
+					o.CompactionStyle = CompactionStyleTiered
+				case "fifo", "kCompactionStyleFIFO":
+					o.CompactionStyle = CompactionStyleFIFO
+				default:
+					return errors.Errorf("pebble: unknown compaction style: %q", errors.Safe(value))
+				}
 			case "disable_wal":
 				o.DisableWAL, err = strconv.ParseBool(value)
+			case "fifo_max_table_files_size":
+				o.FIFOCompaction.MaxTableFilesSize, err = strconv.ParseUint(value, 10, 64)
+			case "fifo_ttl":
+				o.FIFOCompaction.TTL, err = time.ParseDuration(value)
+			case "flush_split_bytes":
+				o.FlushSplitBytes, err = strconv.ParseInt(value, 10, 64)
+			case "follower":
+				o.Follower, err = strconv.ParseBool(value)
+			case "format_major_version":
+				var v uint64
+				v, err = strconv.ParseUint(value, 10, 64)
+				o.FormatMajorVersion = FormatMajorVersion(v)
 			case "l0_compaction_threshold":
 				o.L0CompactionThreshold, err = strconv.Atoi(value)
 			case "l0_stop_writes_threshold":
 				o.L0StopWritesThreshold, err = strconv.Atoi(value)
 			case "lbase_max_bytes":
 				o.LBaseMaxBytes, err = strconv.ParseInt(value, 10, 64)
+			case "max_change_feed_buffer_size":
+				o.MaxChangeFeedBufferSize, err = strconv.Atoi(value)
 			case "max_concurrent_compactions":
 				o.MaxConcurrentCompactions, err = strconv.Atoi(value)
 			case "max_manifest_file_size":
 				o.MaxManifestFileSize, err = strconv.ParseInt(value, 10, 64)
 			case "max_open_files":
 				o.MaxOpenFiles, err = strconv.Atoi(value)
+			case "max_subcompactions":
+				o.MaxSubcompactions, err = strconv.Atoi(value)
 			case "mem_table_size":
 				o.MemTableSize, err = strconv.Atoi(value)
 			case "mem_table_stop_writes_threshold":
@@ -711,6 +1103,8 @@ func (o *Options) Parse(s string, hooks *ParseHooks) error {
 				o.MinCompactionRate, err = strconv.Atoi(value)
 			case "min_flush_rate":
 				o.MinFlushRate, err = strconv.Atoi(value)
+			case "multi_level_compactions":
+				o.MultiLevelCompactions, err = strconv.ParseBool(value)
 			case "merger":
 				switch value {
 				case "nullptr":
@@ -722,19 +1116,43 @@ func (o *Options) Parse(s string, hooks *ParseHooks) error {
 						o.Merger, err = hooks.NewMerger(value)
 					}
 				}
+			case "periodic_compaction_seconds":
+				// RocksDB uses a value of 0xfffffffffffffffe to select its
+				// default, which is parsed as 0.
+				var v uint64
+				v, err = strconv.ParseUint(value, 10, 64)
+				if v <= math.MaxInt64 {
+					o.PeriodicCompactionSeconds = int64(v)
+				}
+			case "read_compaction_rate":
+				o.ReadCompactionRate, err = strconv.ParseInt(value, 10, 64)
+			case "read_sampling_multiplier":
+				o.ReadSamplingMultiplier, err = strconv.ParseInt(value, 10, 64)
 			case "table_format":
 				switch value {
 				case "leveldb":
 					o.TableFormat = TableFormatLevelDB
 				case "rocksdbv2":
 					o.TableFormat = TableFormatRocksDBv2
+				case "pebblev1":
+					o.TableFormat = TableFormatPebblev1
 				default:
 					return errors.Errorf("pebble: unknown table format: %q", errors.Safe(value))
 				}
 			case "table_property_collectors":
 				// TODO(peter): set o.TablePropertyCollectors
+			case "tiered_max_size_amplification_percent":
+				o.TieredCompaction.MaxSizeAmplificationPercent, err = strconv.Atoi(value)
+			case "tiered_min_merge_width":
+				o.TieredCompaction.MinMergeWidth, err = strconv.Atoi(value)
+			case "tiered_size_ratio":
+				o.TieredCompaction.SizeRatio, err = strconv.Atoi(value)
+			case "value_separation_threshold":
+				o.ValueSeparationThreshold, err = strconv.Atoi(value)
 			case "wal_dir":
 				o.WALDir = value
+			case "wal_retention_period":
+				o.WALRetentionPeriod, err = time.ParseDuration(value)
 			default:
 				if hooks != nil && hooks.SkipUnknown != nil && hooks.SkipUnknown(section+"."+key) {
 					return nil
@@ -764,19 +1182,15 @@ func (o *Options) Parse(s string, hooks *ParseHooks) error {
 
 			var err error
 			switch key {
+			case "adaptive_compression":
+				l.AdaptiveCompression, err = strconv.ParseBool(value)
 			case "block_restart_interval":
 				l.BlockRestartInterval, err = strconv.Atoi(value)
 			case "block_size":
 				l.BlockSize, err = strconv.Atoi(value)
 			case "compression":
-				switch value {
-				case "Default":
-					l.Compression = DefaultCompression
-				case "NoCompression":
-					l.Compression = NoCompression
-				case "Snappy":
-					l.Compression = SnappyCompression
-				default:
+				var ok bool
+				if l.Compression, ok = sstable.CompressionByName(value); !ok {
 					return errors.Errorf("pebble: unknown compression: %q", errors.Safe(value))
 				}
 			case "filter_policy":
@@ -852,6 +1266,24 @@ func (o *Options) Validate() error {
 	case TableFormatLevelDB:
 		fmt.Fprintf(&buf, "TableFormatLevelDB not supported for DB\n")
 	}
+	switch o.CompactionStyle {
+	case CompactionStyleLeveled, CompactionStyleTiered, CompactionStyleFIFO:
+	default:
+		fmt.Fprintf(&buf, "CompactionStyle (%d) is unknown\n", o.CompactionStyle)
+	}
+	if o.FormatMajorVersion > FormatNewest {
+		fmt.Fprintf(&buf, "FormatMajorVersion (%d) must be <= %d\n",
+			o.FormatMajorVersion, FormatNewest)
+	}
+	if o.BlobFileGCThreshold > 1 {
+		fmt.Fprintf(&buf, "BlobFileGCThreshold (%g) must be <= 1\n", o.BlobFileGCThreshold)
+	}
+	for i := range o.Levels {
+		if !o.Levels[i].Compression.Registered() {
+			fmt.Fprintf(&buf, "Levels[%d].Compression (%d) is not registered\n",
+				i, o.Levels[i].Compression)
+		}
+	}
 	if buf.Len() == 0 {
 		return nil
 	}
@@ -885,12 +1317,15 @@ func (o *Options) MakeWriterOptions(level int) sstable.WriterOptions {
 		}
 		writerOpts.TableFormat = o.TableFormat
 		writerOpts.TablePropertyCollectors = o.TablePropertyCollectors
+		writerOpts.BlockPropertyCollectors = o.BlockPropertyCollectors
 	}
 	levelOpts := o.Level(level)
 	writerOpts.BlockRestartInterval = levelOpts.BlockRestartInterval
 	writerOpts.BlockSize = levelOpts.BlockSize
 	writerOpts.BlockSizeThreshold = levelOpts.BlockSizeThreshold
 	writerOpts.Compression = levelOpts.Compression
+	writerOpts.CompressionStats = true
+	writerOpts.AdaptiveCompression = levelOpts.AdaptiveCompression
 	writerOpts.FilterPolicy = levelOpts.FilterPolicy
 	writerOpts.FilterType = levelOpts.FilterType
 	writerOpts.IndexBlockSize = levelOpts.IndexBlockSize
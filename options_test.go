@@ -5,10 +5,18 @@
 package pebble
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/stretchr/testify/require"
 )
@@ -43,26 +51,45 @@ func TestOptionsString(t *testing.T) {
   pebble_version=0.1
 
 [Options]
+  blob_file_gc_threshold=0.5
   bytes_per_sync=524288
   cache_size=8388608
   cleaner=delete
   comparer=leveldb.BytewiseComparator
+  compaction_style=leveled
   disable_wal=false
+  fifo_max_table_files_size=1073741824
+  fifo_ttl=0s
+  flush_split_bytes=4194304
+  follower=false
+  format_major_version=1
   l0_compaction_threshold=4
   l0_stop_writes_threshold=12
   lbase_max_bytes=67108864
+  max_change_feed_buffer_size=67108864
   max_concurrent_compactions=1
   max_manifest_file_size=134217728
   max_open_files=1000
+  max_subcompactions=1
   mem_table_size=4194304
   mem_table_stop_writes_threshold=2
   min_compaction_rate=4194304
   min_flush_rate=1048576
   merger=pebble.concatenate
+  multi_level_compactions=false
+  periodic_compaction_seconds=0
+  read_compaction_rate=16000
+  read_sampling_multiplier=16
   table_property_collectors=[]
+  tiered_max_size_amplification_percent=200
+  tiered_min_merge_width=2
+  tiered_size_ratio=1
+  value_separation_threshold=0
   wal_dir=
+  wal_retention_period=0s
 
 [Level "0"]
+  adaptive_compression=false
   block_restart_interval=16
   block_size=4096
   compression=Snappy
@@ -174,9 +201,13 @@ func TestOptionsParse(t *testing.T) {
 			opts.Comparer = c.comparer
 			opts.Merger = c.merger
 			opts.WALDir = "wal"
+			opts.CompactionStyle = CompactionStyleTiered
+			opts.FIFOCompaction.TTL = time.Hour
+			opts.PeriodicCompactionSeconds = 3600
 			opts.Levels = make([]LevelOptions, 3)
 			opts.Levels[0].BlockSize = 1024
 			opts.Levels[1].BlockSize = 2048
+			opts.Levels[1].AdaptiveCompression = true
 			opts.Levels[2].BlockSize = 4096
 			opts.EnsureDefaults()
 			str := opts.String()
@@ -192,6 +223,21 @@ func TestOptionsParse(t *testing.T) {
 			}
 		})
 	}
+
+	// The RocksDB names of the compaction styles are accepted.
+	for name, style := range map[string]CompactionStyle{
+		"kCompactionStyleLevel":     CompactionStyleLeveled,
+		"kCompactionStyleUniversal": CompactionStyleTiered,
+		"kCompactionStyleFIFO":      CompactionStyleFIFO,
+	} {
+		var opts Options
+		require.NoError(t, opts.Parse("[CFOptions \"default\"]\n  compaction_style="+name+"\n", nil))
+		require.Equal(t, style, opts.CompactionStyle)
+	}
+	var opts Options
+	require.NoError(t, opts.Parse("[CFOptions \"default\"]\n  periodic_compaction_seconds=18446744073709551614\n", nil))
+	require.Equal(t, int64(0), opts.PeriodicCompactionSeconds)
+	require.Regexp(t, `unknown compaction style`, opts.Parse("[Options]\n  compaction_style=foo\n", nil))
 }
 
 func TestOptionsValidate(t *testing.T) {
@@ -236,3 +282,107 @@ func TestOptionsValidate(t *testing.T) {
 		})
 	}
 }
+
+// flateCompressor is a Compressor using the DEFLATE format. The compressed
+// block is prefixed with its decompressed length.
+type flateCompressor struct{}
+
+func (flateCompressor) Encode(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst[:0])
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(src)))])
+	w, _ := flate.NewWriter(buf, flate.BestCompression)
+	_, _ = w.Write(src)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+func (flateCompressor) DecodedLen(src []byte) (int, error) {
+	n, _ := binary.Uvarint(src)
+	return int(n), nil
+}
+
+func (flateCompressor) Decode(dst, src []byte) error {
+	_, i := binary.Uvarint(src)
+	_, err := io.ReadFull(flate.NewReader(bytes.NewReader(src[i:])), dst)
+	return err
+}
+
+var testFlateCompression = sstable.RegisterCompression(100, "test-flate", flateCompressor{})
+
+func TestLevelCompression(t *testing.T) {
+	var opts Options
+	require.NoError(t, opts.Parse(`
+[Level "0"]
+  compression=Snappy
+[Level "6"]
+  compression=test-flate
+`, nil))
+	require.Regexp(t, `unknown compression: "zstd"`,
+		(&Options{}).Parse("[Level \"0\"]\n  compression=zstd\n", nil))
+
+	mem := vfs.NewMem()
+	opts.FS = mem
+	d, err := Open("", &opts)
+	require.NoError(t, err)
+	require.Equal(t, SnappyCompression, d.opts.Level(5).Compression)
+	require.Equal(t, testFlateCompression, d.opts.Level(6).Compression)
+	require.Contains(t, d.opts.String(), "compression=test-flate\n")
+
+	// Write two overlapping tables to L0, so that compacting them rewrites
+	// their data rather than moving the table.
+	value := bytes.Repeat([]byte("value"), 100)
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 100; i++ {
+			require.NoError(t, d.Set([]byte(fmt.Sprintf("%03d", i)), value, nil))
+		}
+		require.NoError(t, d.Flush())
+	}
+	// readCompressions returns the compression property of the last table, and
+	// the codecs used by its blocks.
+	readCompressions := func() (string, []string) {
+		d.mu.Lock()
+		var file *fileMetadata
+		for level := range d.mu.versions.currentVersion().Files {
+			for _, f := range d.mu.versions.currentVersion().Files[level] {
+				file = f
+			}
+		}
+		d.mu.Unlock()
+		f, err := mem.Open(base.MakeFilename(mem, "", fileTypeTable, file.FileNum))
+		require.NoError(t, err)
+		r, err := sstable.NewReader(f, sstable.ReaderOptions{})
+		require.NoError(t, err)
+		defer r.Close()
+		counts, err := r.BlockCompressions()
+		require.NoError(t, err)
+		var codecs []string
+		for codec := range counts {
+			codecs = append(codecs, codec)
+		}
+		sort.Strings(codecs)
+		return r.Properties.CompressionName, codecs
+	}
+	name, codecs := readCompressions()
+	require.Equal(t, "Snappy", name)
+	require.Equal(t, []string{"Snappy"}, codecs)
+
+	// The tables are rewritten with the codec of L6 by compacting them into L6.
+	require.NoError(t, d.Compact([]byte("000"), []byte("100")))
+	name, codecs = readCompressions()
+	require.Equal(t, "test-flate", name)
+	require.Equal(t, []string{"test-flate"}, codecs)
+
+	for i := 0; i < 100; i++ {
+		v, closer, err := d.Get([]byte(fmt.Sprintf("%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, value, v)
+		require.NoError(t, closer.Close())
+	}
+	require.NoError(t, d.Close())
+
+	// A level may not use an unregistered codec.
+	opts = Options{Levels: []LevelOptions{{Compression: Compression(99)}}}
+	opts.EnsureDefaults()
+	require.Regexp(t, `Levels\[0\].Compression \(99\) is not registered`, opts.Validate())
+}
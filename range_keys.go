@@ -0,0 +1,408 @@
+// Copyright 2020 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/cockroachdb/pebble/internal/rangekey"
+)
+
+// RangeKeyData describes the value of a range key for a particular suffix.
+type RangeKeyData = rangekey.SuffixValue
+
+// collectRangeKeys gathers the range keys from the batch and the memtables
+// in the read state which are older than seqNum. The range keys in the
+// sstables are gathered lazily, from only the sstables which overlap the
+// iterator bounds. See Iterator.rangeKeyLoad.
+func (d *DB) collectRangeKeys(
+	batchRangeKeyIter internalIterator, readState *readState, seqNum uint64, o *IterOptions,
+) ([]rangekey.Span, error) {
+	var spans []rangekey.Span
+	collect := func(iter internalIterator) error {
+		if iter == nil {
+			return nil
+		}
+		var err error
+		spans, err = rangekey.Collect(spans, iter)
+		return firstError(err, iter.Close())
+	}
+
+	if err := collect(batchRangeKeyIter); err != nil {
+		return nil, err
+	}
+	memtables := readState.memtables
+	for i := len(memtables) - 1; i >= 0; i-- {
+		mem := memtables[i]
+		if mem.logSeqNum >= seqNum {
+			continue
+		}
+		if err := collect(mem.newRangeKeyIter(o)); err != nil {
+			return nil, err
+		}
+	}
+	return spans, nil
+}
+
+// iteratorRangeKeyState holds the state used by an Iterator to interleave
+// range keys with point keys. The positions of such an iterator are the
+// point keys, the start keys of the range key spans, and the key passed to
+// SeekGE or SeekPrefixGE if it lies within a range key span.
+type iteratorRangeKeyState struct {
+	// memSpans are the range keys of the batch and the memtables, which are
+	// gathered when the iterator is created.
+	memSpans []rangekey.Span
+	// newIter returns an iterator over the range keys of an sstable.
+	newIter func(*fileMetadata) (internalIterator, error)
+	// seqNum is the sequence number at which the range keys are read.
+	seqNum uint64
+	// loaded is true if spans holds the range keys within the bounds [lower,
+	// upper), where a nil bound is unbounded. The range keys are loaded again
+	// if the iterator bounds are widened beyond them.
+	loaded       bool
+	lower, upper []byte
+	// spans are the visible range key spans, sorted by start key.
+	spans []rangekey.CoalescedSpan
+	// clipped are spans truncated to the iterator bounds.
+	clipped []rangekey.CoalescedSpan
+	// dir is the direction of the last positioning operation: +1 for forward,
+	// -1 for backward, and 0 if the iterator is unpositioned.
+	dir int8
+	// key is the current position of the iterator, or nil if the iterator is
+	// exhausted. When hasPoint is true, the point iterator is positioned at key,
+	// otherwise it is positioned at the next point key in direction dir.
+	key      []byte
+	keyBuf   []byte
+	prevBuf  []byte
+	hasPoint bool
+	// span is the span covering key, or nil.
+	span *rangekey.CoalescedSpan
+}
+
+func (s *iteratorRangeKeyState) clip(cmp Compare, lower, upper []byte) {
+	s.clipped = s.clipped[:0]
+	for _, span := range s.spans {
+		if lower != nil && cmp(span.Start, lower) < 0 {
+			span.Start = lower
+		}
+		if upper != nil && cmp(span.End, upper) > 0 {
+			span.End = upper
+		}
+		if cmp(span.Start, span.End) < 0 {
+			s.clipped = append(s.clipped, span)
+		}
+	}
+}
+
+// setBounds sets the iterator bounds, clipping the loaded spans to them if
+// they lie within the bounds of the loaded spans.
+func (s *iteratorRangeKeyState) setBounds(cmp Compare, lower, upper []byte) {
+	widened := (s.lower != nil && (lower == nil || cmp(lower, s.lower) < 0)) ||
+		(s.upper != nil && (upper == nil || cmp(upper, s.upper) > 0))
+	if widened {
+		s.loaded = false
+	}
+	if s.loaded {
+		s.clip(cmp, lower, upper)
+	}
+}
+
+func (s *iteratorRangeKeyState) reset() {
+	s.dir = 0
+	s.key = nil
+	s.hasPoint = false
+	s.span = nil
+}
+
+// find returns the span containing key, or nil.
+func (s *iteratorRangeKeyState) find(cmp Compare, key []byte) *rangekey.CoalescedSpan {
+	j := sort.Search(len(s.clipped), func(j int) bool {
+		return cmp(s.clipped[j].End, key) > 0
+	})
+	if j < len(s.clipped) && cmp(s.clipped[j].Start, key) <= 0 {
+		return &s.clipped[j]
+	}
+	return nil
+}
+
+// rangeKeyLoad gathers the range keys within the iterator bounds, if they
+// have not already been gathered. Only the sstables which overlap the bounds
+// are read.
+func (i *Iterator) rangeKeyLoad() error {
+	s := i.rangeKey
+	if s.loaded {
+		return nil
+	}
+	lower, upper := i.opts.LowerBound, i.opts.UpperBound
+	spans := append([]rangekey.Span(nil), s.memSpans...)
+	for _, files := range i.readState.current.Files {
+		for _, f := range files {
+			if !f.HasRangeKeys ||
+				(lower != nil && i.cmp(f.Largest.UserKey, lower) < 0) ||
+				(upper != nil && i.cmp(f.Smallest.UserKey, upper) >= 0) {
+				continue
+			}
+			iter, err := s.newIter(f)
+			if err != nil {
+				return err
+			}
+			if iter == nil {
+				continue
+			}
+			spans, err = rangekey.Collect(spans, iter)
+			if err = firstError(err, iter.Close()); err != nil {
+				return err
+			}
+		}
+	}
+
+	frags := rangekey.Fragment(i.cmp, spans)
+	s.spans = rangekey.Coalesce(i.cmp, frags, func(seqNum uint64) bool {
+		return seqNum < s.seqNum || (seqNum&InternalKeySeqNumBatch) != 0
+	})
+	s.lower, s.upper = nil, nil
+	if lower != nil {
+		s.lower = append([]byte(nil), lower...)
+	}
+	if upper != nil {
+		s.upper = append([]byte(nil), upper...)
+	}
+	s.loaded = true
+	s.clip(i.cmp, lower, upper)
+	return nil
+}
+
+func (i *Iterator) pointsEnabled() bool {
+	return i.opts.KeyTypes != IterKeyTypeRangesOnly
+}
+
+// rangeKeySettleForward positions the iterator at the smaller of the current
+// point key and the first range key position after key (or at key, if
+// inclusive is true). A nil key is considered smaller than any other key.
+func (i *Iterator) rangeKeySettleForward(key []byte, inclusive bool) bool {
+	s := i.rangeKey
+	s.dir = +1
+	s.hasPoint = false
+	s.span = nil
+	if i.err != nil {
+		s.key = nil
+		return false
+	}
+
+	spans := s.clipped
+	var rangePos []byte
+	var j int
+	switch {
+	case key == nil:
+		j = 0
+	case inclusive:
+		j = sort.Search(len(spans), func(j int) bool {
+			return i.cmp(spans[j].End, key) > 0
+		})
+	default:
+		j = sort.Search(len(spans), func(j int) bool {
+			return i.cmp(spans[j].Start, key) > 0
+		})
+	}
+	if j < len(spans) {
+		rangePos = spans[j].Start
+		if key != nil && inclusive && i.cmp(rangePos, key) < 0 {
+			rangePos = key
+		}
+		if i.prefix != nil {
+			if n := i.split(rangePos); !bytes.Equal(i.prefix, rangePos[:n]) {
+				rangePos = nil
+			}
+		}
+	}
+
+	switch {
+	case i.valid && (rangePos == nil || i.cmp(i.key, rangePos) <= 0):
+		s.keyBuf = append(s.keyBuf[:0], i.key...)
+		s.hasPoint = true
+		s.span = s.find(i.cmp, i.key)
+	case rangePos != nil:
+		s.keyBuf = append(s.keyBuf[:0], rangePos...)
+		s.span = &spans[j]
+	default:
+		s.key = nil
+		return false
+	}
+	s.key = s.keyBuf
+	return true
+}
+
+// rangeKeySettleBackward positions the iterator at the larger of the current
+// point key and the last range key position before key. A nil key is
+// considered larger than any other key.
+func (i *Iterator) rangeKeySettleBackward(key []byte) bool {
+	s := i.rangeKey
+	s.dir = -1
+	s.hasPoint = false
+	s.span = nil
+	if i.err != nil {
+		s.key = nil
+		return false
+	}
+
+	spans := s.clipped
+	j := len(spans) - 1
+	if key != nil {
+		j = sort.Search(len(spans), func(j int) bool {
+			return i.cmp(spans[j].Start, key) >= 0
+		}) - 1
+	}
+	var rangePos []byte
+	if j >= 0 {
+		rangePos = spans[j].Start
+	}
+
+	switch {
+	case i.valid && (rangePos == nil || i.cmp(i.key, rangePos) >= 0):
+		s.keyBuf = append(s.keyBuf[:0], i.key...)
+		s.hasPoint = true
+		s.span = s.find(i.cmp, i.key)
+	case rangePos != nil:
+		s.keyBuf = append(s.keyBuf[:0], rangePos...)
+		s.span = &spans[j]
+	default:
+		s.key = nil
+		return false
+	}
+	s.key = s.keyBuf
+	return true
+}
+
+func (i *Iterator) rangeKeySeekGE(key []byte) bool {
+	i.valid = false
+	if err := i.rangeKeyLoad(); err != nil {
+		i.err = err
+		i.rangeKey.key = nil
+		return false
+	}
+	if i.pointsEnabled() {
+		switch {
+		case i.prefix != nil:
+			i.iterKey, i.iterValue = i.iter.SeekPrefixGE(i.prefix, key)
+		case key != nil:
+			i.iterKey, i.iterValue = i.iter.SeekGE(key)
+		default:
+			i.iterKey, i.iterValue = i.iter.First()
+		}
+		i.findNextEntry()
+	}
+	return i.rangeKeySettleForward(key, true)
+}
+
+func (i *Iterator) rangeKeySeekLT(key []byte) bool {
+	i.valid = false
+	if err := i.rangeKeyLoad(); err != nil {
+		i.err = err
+		i.rangeKey.key = nil
+		return false
+	}
+	if i.pointsEnabled() {
+		if key != nil {
+			i.iterKey, i.iterValue = i.iter.SeekLT(key)
+		} else {
+			i.iterKey, i.iterValue = i.iter.Last()
+		}
+		i.findPrevEntry()
+	}
+	return i.rangeKeySettleBackward(key)
+}
+
+func (i *Iterator) rangeKeyNext() bool {
+	s := i.rangeKey
+	if s.key == nil {
+		if s.dir < 0 {
+			// We're positioned before the first key. Reposition to the first key.
+			return i.First()
+		}
+		return false
+	}
+	// Save the current position as it will be overwritten by the settle.
+	s.prevBuf = append(s.prevBuf[:0], s.key...)
+	cur := s.prevBuf
+	if i.pointsEnabled() {
+		if s.dir > 0 {
+			if s.hasPoint {
+				i.nextPoint()
+			}
+		} else {
+			// Switching directions. Reposition the point iterator at the first
+			// point key after the current position.
+			i.iterKey, i.iterValue = i.iter.SeekGE(cur)
+			if i.findNextEntry() && i.equal(i.key, cur) {
+				i.nextPoint()
+			}
+		}
+	}
+	return i.rangeKeySettleForward(cur, false)
+}
+
+func (i *Iterator) rangeKeyPrev() bool {
+	s := i.rangeKey
+	if s.key == nil {
+		if s.dir > 0 {
+			// We're positioned after the last key. Reposition to the last key.
+			return i.Last()
+		}
+		return false
+	}
+	s.prevBuf = append(s.prevBuf[:0], s.key...)
+	cur := s.prevBuf
+	if i.pointsEnabled() {
+		if s.dir < 0 {
+			if s.hasPoint {
+				i.prevPoint()
+			}
+		} else {
+			// Switching directions. Reposition the point iterator at the last point
+			// key before the current position.
+			i.valid = false
+			i.iterKey, i.iterValue = i.iter.SeekLT(cur)
+			i.findPrevEntry()
+		}
+	}
+	return i.rangeKeySettleBackward(cur)
+}
+
+// HasPointAndRange indicates whether there exists a point key, a range key or
+// both at the current iterator position. A range key exists at the position
+// if the current key lies within a range key span. An iterator which is not
+// configured to iterate over range keys never reports a range key.
+func (i *Iterator) HasPointAndRange() (hasPoint, hasRange bool) {
+	if i.rangeKey == nil {
+		return i.valid, false
+	}
+	if i.rangeKey.key == nil {
+		return false, false
+	}
+	return i.rangeKey.hasPoint, i.rangeKey.span != nil
+}
+
+// RangeBounds returns the start (inclusive) and end (exclusive) bounds of the
+// range key span covering the current iterator position, truncated to the
+// iterator bounds. Returns nil bounds if there is no range key at the current
+// position. The caller should not modify the contents of the returned
+// slices.
+func (i *Iterator) RangeBounds() (start, end []byte) {
+	if i.rangeKey == nil || i.rangeKey.key == nil || i.rangeKey.span == nil {
+		return nil, nil
+	}
+	return i.rangeKey.span.Start, i.rangeKey.span.End
+}
+
+// RangeKeys returns the range keys covering the current iterator position,
+// sorted by suffix. Returns nil if there is no range key at the current
+// position. The caller should not modify the returned slice or its contents.
+func (i *Iterator) RangeKeys() []RangeKeyData {
+	if i.rangeKey == nil || i.rangeKey.key == nil || i.rangeKey.span == nil {
+		return nil
+	}
+	return i.rangeKey.span.Items
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeKeys(t *testing.T) {
+	var d *DB
+	var b *Batch
+	var snap *Snapshot
+	var mem vfs.FS
+	defer func() {
+		if snap != nil {
+			require.NoError(t, snap.Close())
+		}
+		if d != nil {
+			require.NoError(t, d.Close())
+		}
+	}()
+
+	datadriven.RunTest(t, "testdata/range_keys", func(td *datadriven.TestData) string {
+		switch td.Cmd {
+		case "reset":
+			if snap != nil {
+				if err := snap.Close(); err != nil {
+					return err.Error()
+				}
+				snap = nil
+			}
+			if d != nil {
+				if err := d.Close(); err != nil {
+					return err.Error()
+				}
+			}
+			mem = vfs.NewMem()
+			var err error
+			d, err = Open("", &Options{
+				FS:                 mem,
+				DebugCheck:         DebugCheckLevels,
+				FormatMajorVersion: FormatRangeKeys,
+			})
+			if err != nil {
+				return err.Error()
+			}
+			return ""
+
+		case "batch":
+			wb := d.NewBatch()
+			if err := runBatchDefineCmd(td, wb); err != nil {
+				return err.Error()
+			}
+			if err := wb.Commit(nil); err != nil {
+				return err.Error()
+			}
+			return ""
+
+		case "indexed-batch":
+			b = d.NewIndexedBatch()
+			if err := runBatchDefineCmd(td, b); err != nil {
+				return err.Error()
+			}
+			return ""
+
+		case "build":
+			if err := runBuildCmd(td, d, mem); err != nil {
+				return err.Error()
+			}
+			return ""
+
+		case "ingest":
+			if err := runIngestCmd(td, d, mem); err != nil {
+				return err.Error()
+			}
+			return runLSMCmd(td, d)
+
+		case "flush":
+			if err := d.Flush(); err != nil {
+				return err.Error()
+			}
+			return runLSMCmd(td, d)
+
+		case "compact":
+			if err := runCompactCmd(td, d); err != nil {
+				return err.Error()
+			}
+			return runLSMCmd(td, d)
+
+		case "snapshot":
+			if snap != nil {
+				if err := snap.Close(); err != nil {
+					return err.Error()
+				}
+			}
+			snap = d.NewSnapshot()
+			return ""
+
+		case "iter":
+			o := &IterOptions{KeyTypes: IterKeyTypePointsAndRanges}
+			var useBatch, useSnapshot bool
+			for _, arg := range td.CmdArgs {
+				switch arg.Key {
+				case "batch":
+					useBatch = true
+					continue
+				case "snapshot":
+					useSnapshot = true
+					continue
+				}
+				if len(arg.Vals) != 1 {
+					return fmt.Sprintf("%s: %s=<value>", td.Cmd, arg.Key)
+				}
+				switch arg.Key {
+				case "keys":
+					switch arg.Vals[0] {
+					case "points":
+						o.KeyTypes = IterKeyTypePointsOnly
+					case "ranges":
+						o.KeyTypes = IterKeyTypeRangesOnly
+					case "both":
+						o.KeyTypes = IterKeyTypePointsAndRanges
+					default:
+						return fmt.Sprintf("%s: unknown key types: %s", td.Cmd, arg.Vals[0])
+					}
+				case "lower":
+					o.LowerBound = []byte(arg.Vals[0])
+				case "upper":
+					o.UpperBound = []byte(arg.Vals[0])
+				default:
+					return fmt.Sprintf("%s: unknown arg: %s", td.Cmd, arg.Key)
+				}
+			}
+			var iter *Iterator
+			switch {
+			case useBatch:
+				iter = b.NewIter(o)
+			case useSnapshot:
+				iter = snap.NewIter(o)
+			default:
+				iter = d.NewIter(o)
+			}
+			defer iter.Close()
+			return runIterCmd(td, iter)
+
+		default:
+			return fmt.Sprintf("unknown command: %s", td.Cmd)
+		}
+	})
+}
+
+func TestRangeKeysLazyLoad(t *testing.T) {
+	d, err := Open("", &Options{FS: vfs.NewMem(), FormatMajorVersion: FormatRangeKeys})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+	for _, k := range [][2]string{{"a", "c"}, {"x", "z"}} {
+		require.NoError(t, d.RangeKeySet([]byte(k[0]), []byte(k[1]), nil, []byte(k[0]), nil))
+		require.NoError(t, d.Flush())
+	}
+
+	iter := d.NewIter(&IterOptions{
+		KeyTypes:   IterKeyTypeRangesOnly,
+		LowerBound: []byte("a"),
+		UpperBound: []byte("d"),
+	})
+	defer func() {
+		require.NoError(t, iter.Close())
+	}()
+	var loaded []string
+	newIter := iter.rangeKey.newIter
+	iter.rangeKey.newIter = func(f *fileMetadata) (internalIterator, error) {
+		loaded = append(loaded, fmt.Sprintf("%s-%s", f.Smallest.UserKey, f.Largest.UserKey))
+		return newIter(f)
+	}
+	spans := func() []string {
+		var spans []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			start, end := iter.RangeBounds()
+			spans = append(spans, fmt.Sprintf("[%s-%s)", start, end))
+		}
+		require.NoError(t, iter.Error())
+		return spans
+	}
+
+	// Only the sstable overlapping the bounds is read.
+	require.Equal(t, []string{"[a-c)"}, spans())
+	require.Equal(t, []string{"a-c"}, loaded)
+
+	// Narrowing the bounds does not read the sstables again.
+	iter.SetBounds([]byte("b"), []byte("c"))
+	require.Equal(t, []string{"[b-c)"}, spans())
+	require.Equal(t, []string{"a-c"}, loaded)
+
+	// Widening the bounds does.
+	iter.SetBounds(nil, nil)
+	require.Equal(t, []string{"[a-c)", "[x-z)"}, spans())
+	require.Equal(t, []string{"a-c", "a-c", "x-z"}, loaded)
+}
@@ -62,8 +62,8 @@ func (s *readState) unrefLocked() {
 	}
 
 	// NB: Unlike readState.unref(), we don't attempt to cleanup newly obsolete
-	// tables as unrefLocked() is only called during DB shutdown to release the
-	// current readState.
+	// tables as the callers of unrefLocked() either release the current
+	// readState during DB shutdown, or delete the obsolete files themselves.
 }
 
 // loadReadState returns the current readState. The returned readState must be
@@ -0,0 +1,187 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/rate"
+)
+
+// dynamicOptions are the options which may be changed by DB.SetOptions,
+// identified by the section and key of the option in the OPTIONS file. The
+// options of every level are identified by the "Level" section.
+var dynamicOptions = map[string]bool{
+	"Options.l0_compaction_threshold":    true,
+	"Options.l0_stop_writes_threshold":   true,
+	"Options.max_concurrent_compactions": true,
+	"Options.mem_table_size":             true,
+	"Options.min_compaction_rate":        true,
+	"Options.min_flush_rate":             true,
+	"Level.adaptive_compression":         true,
+	"Level.compression":                  true,
+	"Level.target_file_size":             true,
+}
+
+// SetOptions changes the options of the DB while it is open. The options are
+// specified in the format of the OPTIONS file (see Options.String), e.g.:
+//
+//	[Options]
+//	  l0_compaction_threshold=8
+//	[Level "6"]
+//	  compression=NoCompression
+//
+// Only the following options may be changed: MemTableSize,
+// L0CompactionThreshold, L0StopWritesThreshold, MaxConcurrentCompactions,
+// MinCompactionRate, MinFlushRate, and the TargetFileSize, Compression and
+// AdaptiveCompression of each level. An error is returned if the options
+// specify any other option, or if the resulting options are invalid, in which
+// case none of the options are changed.
+//
+// A change of MemTableSize takes effect when the next memtable is created.
+// The other changes take effect when the next flush or compaction is picked,
+// and do not affect the flushes and compactions which are already running.
+// The changed options are written to a new OPTIONS file.
+func (d *DB) SetOptions(s string) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	maxLevel := -1
+	err := parseOptions(s, func(section, key, value string) error {
+		name := section + "." + key
+		var level int
+		if n, _ := fmt.Sscanf(section, `Level "%d"`, &level); n == 1 {
+			if level < 0 || level >= numLevels {
+				return errors.Errorf("pebble: invalid level: %d", errors.Safe(level))
+			}
+			if maxLevel < level {
+				maxLevel = level
+			}
+			name = "Level." + key
+		}
+		if !dynamicOptions[name] {
+			return errors.Errorf("pebble: option %s.%s cannot be changed while the DB is open",
+				errors.Safe(section), errors.Safe(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The options are parsed into a copy of the current options, so that no
+	// option is changed if an error is returned.
+	opts := d.opts.Clone()
+	opts.Levels = append([]LevelOptions(nil), d.opts.Levels...)
+	// The options of a level beyond the levels specified when the DB was
+	// opened are derived from the options of the last level (see
+	// Options.Level). They are made explicit before they are changed.
+	for level := len(opts.Levels); level <= maxLevel; level++ {
+		opts.Levels = append(opts.Levels, d.opts.Level(level))
+	}
+	if err := opts.Parse(s, nil); err != nil {
+		return err
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"MemTableSize", int64(opts.MemTableSize)},
+		{"L0CompactionThreshold", int64(opts.L0CompactionThreshold)},
+		{"MaxConcurrentCompactions", int64(opts.MaxConcurrentCompactions)},
+		{"MinCompactionRate", int64(opts.MinCompactionRate)},
+		{"MinFlushRate", int64(opts.MinFlushRate)},
+	} {
+		if v.value <= 0 {
+			return errors.Errorf("pebble: %s (%d) must be > 0", errors.Safe(v.name), errors.Safe(v.value))
+		}
+	}
+	for i := range opts.Levels {
+		if opts.Levels[i].TargetFileSize <= 0 {
+			return errors.Errorf("pebble: Levels[%d].TargetFileSize (%d) must be > 0",
+				errors.Safe(i), errors.Safe(opts.Levels[i].TargetFileSize))
+		}
+	}
+
+	if err := d.writeOptionsFile(opts); err != nil {
+		return err
+	}
+
+	// The options are read while holding d.mu, or captured while holding d.mu
+	// by the flushes and compactions which read them without holding it.
+	d.opts.MemTableSize = opts.MemTableSize
+	d.opts.L0CompactionThreshold = opts.L0CompactionThreshold
+	d.opts.L0StopWritesThreshold = opts.L0StopWritesThreshold
+	d.opts.MaxConcurrentCompactions = opts.MaxConcurrentCompactions
+	d.opts.MinCompactionRate = opts.MinCompactionRate
+	d.opts.MinFlushRate = opts.MinFlushRate
+	d.opts.Levels = opts.Levels
+
+	if d.mu.mem.nextSize > d.opts.MemTableSize {
+		d.mu.mem.nextSize = d.opts.MemTableSize
+	}
+	// A batch which is not large must fit in a memtable of the new size.
+	atomic.StoreInt64(&d.largeBatchThreshold, largeBatchThreshold(d.opts.MemTableSize))
+	if l, ok := d.compactionLimiter.(*rate.Limiter); ok {
+		l.SetLimit(rate.Limit(d.opts.MinCompactionRate))
+		l.SetBurst(d.opts.MinCompactionRate)
+	}
+	if l, ok := d.flushLimiter.(*rate.Limiter); ok {
+		l.SetLimit(rate.Limit(d.opts.MinFlushRate))
+		l.SetBurst(d.opts.MinFlushRate)
+	}
+
+	// Wake up the writers which are stalled, as the stall thresholds may have
+	// been raised, and check for flushes and compactions the new options
+	// require.
+	d.mu.compact.cond.Broadcast()
+	d.maybeScheduleFlush()
+	d.maybeScheduleCompaction()
+
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	d.deleteObsoleteFiles(jobID)
+	return nil
+}
+
+// writeOptionsFile writes the specified options to a new OPTIONS file, which
+// replaces the current OPTIONS file of the DB.
+//
+// d.mu must be held when calling this.
+func (d *DB) writeOptionsFile(opts *Options) error {
+	fileNum := d.mu.versions.getNextFileNum()
+	optionsFile, err := opts.FS.Create(
+		base.MakeFilename(opts.FS, d.dirname, fileTypeOptions, fileNum))
+	if err != nil {
+		return err
+	}
+	if _, err := optionsFile.Write([]byte(opts.String())); err != nil {
+		_ = optionsFile.Close()
+		return err
+	}
+	_ = optionsFile.Sync()
+	_ = optionsFile.Close()
+	if err := d.dataDir.Sync(); err != nil {
+		return err
+	}
+	if d.optionsFileNum != 0 {
+		d.mu.versions.obsoleteOptions = append(d.mu.versions.obsoleteOptions, d.optionsFileNum)
+	}
+	d.optionsFileNum = fileNum
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetOptions(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{
+		FS:                    mem,
+		L0CompactionThreshold: 4,
+		L0StopWritesThreshold: 8,
+		Levels:                []LevelOptions{{TargetFileSize: 1 << 20}},
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+
+	optionsFile := func() string {
+		d.mu.Lock()
+		fileNum := d.optionsFileNum
+		d.mu.Unlock()
+		f, err := mem.Open(base.MakeFilename(mem, "", fileTypeOptions, fileNum))
+		require.NoError(t, err)
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		return string(data)
+	}
+	lsm := func() string {
+		d.mu.Lock()
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+		defer d.mu.Unlock()
+		return d.mu.versions.currentVersion().String()
+	}
+
+	// Options which cannot be changed at runtime are rejected, and leave the
+	// options unchanged.
+	for _, s := range []string{
+		"[Options]\n  comparer=foo\n",
+		"[Options]\n  mem_table_size=1024\n  max_open_files=10\n",
+		"[Level \"1\"]\n  block_size=1024\n",
+		"[Level \"7\"]\n  target_file_size=1024\n",
+	} {
+		require.Error(t, d.SetOptions(s))
+	}
+	// Invalid options are rejected.
+	require.Regexp(t, `L0StopWritesThreshold \(2\) must be >= L0CompactionThreshold \(4\)`,
+		d.SetOptions("[Options]\n  l0_stop_writes_threshold=2\n"))
+	require.Regexp(t, `MemTableSize \(0\) must be > 0`,
+		d.SetOptions("[Options]\n  mem_table_size=0\n  l0_compaction_threshold=1\n"))
+	require.Equal(t, 4, d.opts.L0CompactionThreshold)
+	require.Equal(t, 8, d.opts.L0StopWritesThreshold)
+	require.Equal(t, 1, len(d.opts.Levels))
+	require.Contains(t, optionsFile(), "l0_compaction_threshold=4\n")
+
+	// Two overlapping tables in L0 are below the compaction threshold.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, d.Set([]byte("a"), nil, nil))
+		require.NoError(t, d.Set([]byte("b"), nil, nil))
+		require.NoError(t, d.Flush())
+	}
+	require.Equal(t, "0:\n  000005:[a-b]\n  000007:[a-b]\n", lsm())
+
+	// Lowering the threshold compacts them.
+	require.NoError(t, d.SetOptions(`
+[Options]
+  l0_compaction_threshold=2
+  mem_table_size=1048576
+[Level "6"]
+  compression=NoCompression
+  target_file_size=4194304
+`))
+	require.Equal(t, "6:\n  000009:[a-b]\n", lsm())
+	f, err := mem.Open(base.MakeFilename(mem, "", fileTypeTable, 9))
+	require.NoError(t, err)
+	r, err := sstable.NewReader(f, sstable.ReaderOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "NoCompression", r.Properties.CompressionName)
+	require.NoError(t, r.Close())
+
+	require.Equal(t, 2, d.opts.L0CompactionThreshold)
+	require.Equal(t, 1<<20, d.opts.MemTableSize)
+	// The options of the levels up to L6 are derived from the options of L0.
+	require.Equal(t, numLevels, len(d.opts.Levels))
+	for level := 0; level < numLevels-1; level++ {
+		require.Equal(t, int64(1<<(20+level)), d.opts.Level(level).TargetFileSize)
+		require.Equal(t, SnappyCompression, d.opts.Level(level).Compression)
+	}
+	require.Equal(t, int64(4<<20), d.opts.Level(6).TargetFileSize)
+	require.Equal(t, NoCompression, d.opts.Level(6).Compression)
+
+	// The changes are recorded in a new OPTIONS file, and the previous OPTIONS
+	// file is deleted.
+	s := optionsFile()
+	require.Contains(t, s, "l0_compaction_threshold=2\n")
+	require.Contains(t, s, "mem_table_size=1048576\n")
+	require.Contains(t, s, "[Level \"6\"]\n  adaptive_compression=false\n  block_restart_interval=16\n  block_size=4096\n  compression=NoCompression\n")
+	ls, err := mem.List("")
+	require.NoError(t, err)
+	var n int
+	for _, filename := range ls {
+		if fileType, _, ok := base.ParseFilename(mem, filename); ok && fileType == fileTypeOptions {
+			n++
+		}
+	}
+	require.Equal(t, 1, n)
+
+	// The new options are checked against the options when the DB is
+	// reopened.
+	var opts Options
+	require.NoError(t, opts.Parse(s, nil))
+	opts.Cache.Unref()
+	require.Equal(t, 2, opts.L0CompactionThreshold)
+	require.Equal(t, NoCompression, opts.Levels[6].Compression)
+}
+
+func TestSetOptionsConcurrent(t *testing.T) {
+	d, err := Open("", &Options{
+		FS:                       vfs.NewMem(),
+		MaxConcurrentCompactions: 2,
+	})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			for c := 'a'; c <= 'z'; c++ {
+				require.NoError(t, d.Set([]byte{byte(c)}, []byte{byte(i)}, nil))
+			}
+			require.NoError(t, d.Flush())
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, d.SetOptions(fmt.Sprintf(`
+[Options]
+  l0_compaction_threshold=%d
+  mem_table_size=%d
+  max_concurrent_compactions=%d
+[Level "%d"]
+  target_file_size=%d
+  compression=NoCompression
+`, 1+i%4, (1+i%3)<<20, 1+i%2, i%numLevels, (1+i)<<10)))
+	}
+	<-done
+	require.NoError(t, d.Close())
+}
+
+func TestSetOptionsMemTableSizeLargeBatch(t *testing.T) {
+	d, err := Open("", &Options{
+		FS:           vfs.NewMem(),
+		MemTableSize: 4 << 20,
+	})
+	require.NoError(t, err)
+
+	// After shrinking the memtables, a batch which would have fit in the old
+	// memtables but not in the new ones is committed as a large batch.
+	require.NoError(t, d.SetOptions("[Options]\n  mem_table_size=262144\n"))
+	require.Equal(t, largeBatchThreshold(256<<10), atomic.LoadInt64(&d.largeBatchThreshold))
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Set([]byte("a"), make([]byte, 1<<20), nil)
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out committing a large batch")
+	}
+	value, closer, err := d.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, 1<<20, len(value))
+	require.NoError(t, closer.Close())
+	require.NoError(t, d.Close())
+}
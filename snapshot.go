@@ -42,7 +42,8 @@ func (s *Snapshot) NewIter(o *IterOptions) *Iterator {
 	if s.db == nil {
 		panic(ErrClosed)
 	}
-	return s.db.newIterInternal(nil /* batchIter */, nil /* batchRangeDelIter */, s, o)
+	return s.db.newIterInternal(nil /* batchIter */, nil, /* batchRangeDelIter */
+		nil /* batchRangeKeyIter */, s, o)
 }
 
 // Close closes the snapshot, releasing its resources. Close must be
@@ -55,6 +56,11 @@ func (s *Snapshot) Close() error {
 	}
 	s.db.mu.Lock()
 	s.db.mu.snapshots.remove(s)
+	if len(s.db.mu.compact.deletionHints) > 0 {
+		// Releasing the snapshot may allow tables covered by a range tombstone
+		// to be deleted.
+		s.db.maybeScheduleCompaction()
+	}
 	s.db.mu.Unlock()
 	s.db = nil
 	return nil
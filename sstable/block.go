@@ -5,14 +5,58 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
 	"unsafe"
 
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/cache"
+	"github.com/cockroachdb/pebble/internal/xxhash"
 )
 
+// A data block may end with a hash index which maps the hash of a user key to
+// the restart interval containing the key. The hash index follows the restart
+// points, and consists of one byte per bucket followed by the number of
+// buckets as a uint16. The presence of the hash index is flagged by the high
+// bit of the uint32 number of restart points at the end of the block. A bucket
+// holds the index of the restart interval containing the keys which hash to
+// it, hashIndexNoEntry if no key hashes to it, or hashIndexCollision if keys in
+// different restart intervals hash to it. The layout matches RocksDB's
+// kDataBlockBinaryAndHash, though the hash function differs.
+const (
+	hashIndexFlag = 1 << 31
+	// hashIndexMaxRestarts is the maximum number of restart points of a block
+	// with a hash index, as the buckets store restart indexes in a byte.
+	hashIndexMaxRestarts = 253
+	hashIndexCollision   = 254
+	hashIndexNoEntry     = 255
+	// hashIndexMaxBuckets is the maximum number of buckets of a hash index, as
+	// the number of buckets is stored in a uint16.
+	hashIndexMaxBuckets = 1<<16 - 1
+)
+
+// hashIndexKey returns the hash of a user key in a data block hash index.
+func hashIndexKey(userKey []byte) uint32 {
+	return uint32(xxhash.Sum64(userKey))
+}
+
+// hashIndexBuckets returns the number of buckets of a hash index of numKeys
+// keys: the number of keys divided by a utilization ratio of 0.75, rounded up
+// to an odd number.
+func hashIndexBuckets(numKeys int) int {
+	n := numKeys * 4 / 3
+	if n > hashIndexMaxBuckets {
+		n = hashIndexMaxBuckets
+	}
+	return n | 1
+}
+
+type hashIndexEntry struct {
+	hash    uint32
+	restart int
+}
+
 func uvarintLen(v uint32) int {
 	i := 0
 	for v >= 0x80 {
@@ -32,6 +76,11 @@ type blockWriter struct {
 	curValue        []byte
 	prevKey         []byte
 	tmp             [4]byte
+	// hashIndex is true if a hash index is written at the end of the block.
+	// The hash and restart interval of each user key added to the block are
+	// accumulated in hashEntries.
+	hashIndex   bool
+	hashEntries []hashIndexEntry
 }
 
 func (w *blockWriter) store(keySize int, value []byte) {
@@ -122,6 +171,13 @@ func (w *blockWriter) add(key InternalKey, value []byte) {
 	key.Encode(w.curKey)
 
 	w.store(size, value)
+
+	if w.hashIndex {
+		e := hashIndexEntry{hash: hashIndexKey(key.UserKey), restart: len(w.restarts) - 1}
+		if n := len(w.hashEntries); n == 0 || w.hashEntries[n-1] != e {
+			w.hashEntries = append(w.hashEntries, e)
+		}
+	}
 }
 
 func (w *blockWriter) finish() []byte {
@@ -140,7 +196,27 @@ func (w *blockWriter) finish() []byte {
 		binary.LittleEndian.PutUint32(tmp4, x)
 		w.buf = append(w.buf, tmp4...)
 	}
-	binary.LittleEndian.PutUint32(tmp4, uint32(len(w.restarts)))
+	footer := uint32(len(w.restarts))
+	if w.hashIndex && len(w.hashEntries) > 0 && len(w.restarts) <= hashIndexMaxRestarts {
+		numBuckets := hashIndexBuckets(len(w.hashEntries))
+		n := len(w.buf)
+		for i := 0; i < numBuckets; i++ {
+			w.buf = append(w.buf, hashIndexNoEntry)
+		}
+		buckets := w.buf[n:]
+		for _, e := range w.hashEntries {
+			b := &buckets[e.hash%uint32(numBuckets)]
+			if *b == hashIndexNoEntry {
+				*b = byte(e.restart)
+			} else if *b != byte(e.restart) {
+				*b = hashIndexCollision
+			}
+		}
+		binary.LittleEndian.PutUint16(tmp4, uint16(numBuckets))
+		w.buf = append(w.buf, tmp4[:2]...)
+		footer |= hashIndexFlag
+	}
+	binary.LittleEndian.PutUint32(tmp4, footer)
 	w.buf = append(w.buf, tmp4...)
 	result := w.buf
 
@@ -149,11 +225,16 @@ func (w *blockWriter) finish() []byte {
 	w.nextRestart = 0
 	w.buf = w.buf[:0]
 	w.restarts = w.restarts[:0]
+	w.hashEntries = w.hashEntries[:0]
 	return result
 }
 
 func (w *blockWriter) estimatedSize() int {
-	return len(w.buf) + 4*(len(w.restarts)+1)
+	size := len(w.buf) + 4*(len(w.restarts)+1)
+	if w.hashIndex && len(w.hashEntries) > 0 {
+		size += hashIndexBuckets(len(w.hashEntries)) + 2
+	}
+	return size
 }
 
 type blockEntry struct {
@@ -202,7 +283,10 @@ type blockIter struct {
 	restarts int32
 	// Number of restart points in this block. Encoded at the end of the block
 	// as a uint32.
-	numRestarts  int32
+	numRestarts int32
+	// hashIndex contains the buckets of the hash index of the block, if the
+	// block has one. See hashIndexFlag.
+	hashIndex    []byte
 	globalSeqNum uint64
 	ptr          unsafe.Pointer
 	data         []byte
@@ -254,12 +338,26 @@ func (i *blockIter) String() string {
 }
 
 func (i *blockIter) init(cmp Compare, block block, globalSeqNum uint64) error {
-	numRestarts := int32(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	footer := binary.LittleEndian.Uint32(block[len(block)-4:])
+	numRestarts := int32(footer &^ hashIndexFlag)
 	if numRestarts == 0 {
 		return errors.New("pebble/table: invalid table (block has no restart points)")
 	}
+	end := int32(len(block)) - 4
+	i.hashIndex = nil
+	if footer&hashIndexFlag != 0 {
+		if end < 2 {
+			return errors.New("pebble/table: invalid table (block has a corrupt hash index)")
+		}
+		numBuckets := int32(binary.LittleEndian.Uint16(block[end-2:]))
+		end -= 2 + numBuckets
+		if end < 4*numRestarts {
+			return errors.New("pebble/table: invalid table (block has a corrupt hash index)")
+		}
+		i.hashIndex = block[end : end+numBuckets]
+	}
 	i.cmp = cmp
-	i.restarts = int32(len(block)) - 4*(1+numRestarts)
+	i.restarts = end - 4*numRestarts
 	i.numRestarts = numRestarts
 	i.globalSeqNum = globalSeqNum
 	i.ptr = unsafe.Pointer(&block[0])
@@ -424,6 +522,12 @@ func (i *blockIter) SeekGE(key []byte) (*InternalKey, []byte) {
 
 	ikey := base.MakeSearchKey(key)
 
+	if i.hashIndex != nil {
+		if k, v, ok := i.seekGEUsingHashIndex(key, ikey); ok {
+			return k, v
+		}
+	}
+
 	// Find the index of the smallest restart point whose key is > the key
 	// sought; index will be numRestarts if there is no such restart point.
 	i.offset = 0
@@ -522,6 +626,44 @@ func (i *blockIter) SeekGE(key []byte) (*InternalKey, []byte) {
 	return nil, nil
 }
 
+// seekGEUsingHashIndex looks up the restart interval containing the key in
+// the hash index of the block, and scans the interval for the first entry
+// which is >= the search key. The hash index only records the keys which are
+// in the block, so the result is only returned (ok is true) if the key is
+// found. Otherwise, the caller falls back to a binary search of the restart
+// points.
+//
+// The key is found at the position SeekGE would find it: all the entries of
+// the key are in the restart interval recorded by the hash index, as the key
+// would otherwise hash to a collision. This relies on keys which compare as
+// equal being bytewise equal, so the hash index is only used with the default
+// comparer (see supportsDataBlockHashIndex).
+func (i *blockIter) seekGEUsingHashIndex(
+	key []byte, ikey InternalKey,
+) (_ *InternalKey, _ []byte, ok bool) {
+	restart := int32(i.hashIndex[hashIndexKey(key)%uint32(len(i.hashIndex))])
+	if restart >= i.numRestarts {
+		// The bucket is hashIndexNoEntry or hashIndexCollision.
+		return nil, nil, false
+	}
+	end := i.restarts
+	if restart+1 < i.numRestarts {
+		end = int32(binary.LittleEndian.Uint32(i.data[i.restarts+4*(restart+1):]))
+	}
+	i.offset = int32(binary.LittleEndian.Uint32(i.data[i.restarts+4*restart:]))
+	i.readEntry()
+	i.decodeInternalKey(i.key)
+	for ; i.offset < end; i.Next() {
+		if base.InternalCompare(i.cmp, i.ikey, ikey) >= 0 {
+			if !bytes.Equal(i.ikey.UserKey, key) {
+				break
+			}
+			return &i.ikey, i.val, true
+		}
+	}
+	return nil, nil, false
+}
+
 // SeekPrefixGE implements internalIterator.SeekPrefixGE, as documented in the
 // pebble package.
 func (i *blockIter) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
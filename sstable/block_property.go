@@ -0,0 +1,379 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Block properties are an optional user-facing feature that can be used to
+// filter data blocks (and whole sstables) from an Iterator before they are
+// loaded. They do not apply to range deletion or range key blocks. The
+// feature is enabled by configuring BlockPropertyCollectors when writing an
+// sstable, and BlockPropertyFilters when reading it.
+//
+// A BlockPropertyCollector computes a property for each data block from the
+// keys and values added to it. The encoded properties of all the collectors
+// are appended to the block handle in the data block's index entry. The
+// collector also aggregates the properties of the data blocks in each index
+// block (which are appended to the block handle in the top-level index entry
+// when a two-level index is in use), and of the whole table (which is stored
+// in the table's user properties under the collector's name).
+//
+// When a BlockPropertyFilter is supplied to an iterator, the filter is
+// consulted with the property of the table, of each index block and of each
+// data block, and the table or block is skipped if the filter reports that
+// the property does not intersect it. A filter is ignored for a table that
+// was written without the collector of the same name.
+//
+// Note that tables written with block property collectors store additional
+// bytes after the block handles in their index entries and cannot be read by
+// RocksDB or LevelDB.
+
+// BlockPropertyCollector is used when writing an sstable. A new
+// BlockPropertyCollector is created for each sstable. The collector is
+// presented with every point key added to the sstable and computes an
+// encoded property for each data block, each index block and the table.
+//
+// The calls to the collector are made in the following order. Add is called
+// for the keys of a data block, followed by FinishDataBlock. The data block's
+// index entry is added to the current index block after any preceding index
+// block has been finished with FinishIndexBlock, at which point
+// AddPrevDataBlockToIndexBlock is called. FinishIndexBlock is only called
+// when the table uses a two-level index. FinishTable is called last.
+//
+// An empty property may be returned to indicate that there is nothing to
+// record, in which case it is not stored and filters are presented with an
+// empty property.
+type BlockPropertyCollector interface {
+	// Name returns the name of the block property collector. The name is used
+	// to key the table-level property in the user properties, and to match
+	// collectors with filters.
+	Name() string
+	// Add is called with each point key added to the sstable, in sorted order.
+	Add(key InternalKey, value []byte) error
+	// FinishDataBlock is called when all the keys of a data block have been
+	// added. The property for the block is appended to buf and returned.
+	FinishDataBlock(buf []byte) ([]byte, error)
+	// AddPrevDataBlockToIndexBlock adds the data block that was most recently
+	// finished with FinishDataBlock to the current index block.
+	AddPrevDataBlockToIndexBlock()
+	// FinishIndexBlock is called when an index block, containing the data
+	// blocks added by AddPrevDataBlockToIndexBlock since the previous call to
+	// FinishIndexBlock, is finished. The property for the index block is
+	// appended to buf and returned.
+	FinishIndexBlock(buf []byte) ([]byte, error)
+	// FinishTable is called when the sstable is finished. The property for the
+	// table is appended to buf and returned.
+	FinishTable(buf []byte) ([]byte, error)
+}
+
+// BlockPropertyFilter is used by an iterator to filter out sstables and
+// blocks using the properties computed by the BlockPropertyCollector with the
+// same name.
+type BlockPropertyFilter interface {
+	// Name returns the name of the block property collector whose properties
+	// the filter applies to.
+	Name() string
+	// Intersects returns true if the set represented by prop intersects with
+	// the set in the filter, and false if the table or block can be skipped.
+	// The property is empty if the collector did not record one.
+	Intersects(prop []byte) (bool, error)
+}
+
+// maxBlockPropertyCollectors is the maximum number of block property
+// collectors that may be configured for a table. Each collector is assigned a
+// one byte short ID, which is used to identify its properties within an
+// encoded set of block properties.
+const maxBlockPropertyCollectors = math.MaxUint8 + 1
+
+// blockPropertiesEncoder encodes the properties of a block. The encoding is a
+// sequence of entries, in increasing order of short ID:
+//
+//   <shortID:uint8><prop-len:uvarint><prop>
+//
+// Collectors with an empty property are omitted.
+type blockPropertiesEncoder struct {
+	buf []byte
+}
+
+func (e *blockPropertiesEncoder) reset() {
+	e.buf = e.buf[:0]
+}
+
+func (e *blockPropertiesEncoder) add(shortID uint8, prop []byte) {
+	if len(prop) == 0 {
+		return
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(prop)))
+	e.buf = append(e.buf, shortID)
+	e.buf = append(e.buf, tmp[:n]...)
+	e.buf = append(e.buf, prop...)
+}
+
+// decodeBlockProperty decodes the first entry of the encoded block properties
+// in buf, returning the entry's short ID and property, and the remainder of
+// buf.
+func decodeBlockProperty(buf []byte) (shortID uint8, prop, rest []byte, err error) {
+	if len(buf) == 0 {
+		return 0, nil, nil, errors.New("pebble/table: corrupt block properties")
+	}
+	shortID = buf[0]
+	v, n := binary.Uvarint(buf[1:])
+	if n <= 0 || uint64(len(buf)-1-n) < v {
+		return 0, nil, nil, errors.New("pebble/table: corrupt block properties")
+	}
+	buf = buf[1+n:]
+	return shortID, buf[:v:v], buf[v:], nil
+}
+
+// blockPropertiesFilterer applies a set of BlockPropertyFilters to the
+// encoded block properties of a table. Only the filters whose collector was
+// used when writing the table are retained.
+type blockPropertiesFilterer struct {
+	filters []BlockPropertyFilter
+	// shortIDs[i] is the short ID of the collector for filters[i]. The filters
+	// are sorted by short ID.
+	shortIDs []uint8
+}
+
+// newBlockPropertiesFilterer returns a filterer for the table with the
+// specified user properties, and whether the table-level properties
+// intersect the filters. A nil filterer is returned if none of the filters
+// apply to the table.
+func newBlockPropertiesFilterer(
+	filters []BlockPropertyFilter, userProps map[string]string,
+) (*blockPropertiesFilterer, bool, error) {
+	var f *blockPropertiesFilterer
+	for _, filter := range filters {
+		tableProp, ok := userProps[filter.Name()]
+		if !ok || len(tableProp) == 0 {
+			// The table was written without the collector.
+			continue
+		}
+		intersects, err := filter.Intersects([]byte(tableProp[1:]))
+		if err != nil || !intersects {
+			return nil, false, err
+		}
+		if f == nil {
+			f = &blockPropertiesFilterer{}
+		}
+		shortID := tableProp[0]
+		j := len(f.shortIDs)
+		for j > 0 && f.shortIDs[j-1] > shortID {
+			j--
+		}
+		f.filters = append(f.filters, nil)
+		copy(f.filters[j+1:], f.filters[j:])
+		f.filters[j] = filter
+		f.shortIDs = append(f.shortIDs, 0)
+		copy(f.shortIDs[j+1:], f.shortIDs[j:])
+		f.shortIDs[j] = shortID
+	}
+	return f, true, nil
+}
+
+// intersects returns true if the encoded block properties intersect all of
+// the filters.
+func (f *blockPropertiesFilterer) intersects(props []byte) (bool, error) {
+	for i := range f.filters {
+		var prop []byte
+		for len(props) > 0 && props[0] <= f.shortIDs[i] {
+			shortID, p, rest, err := decodeBlockProperty(props)
+			if err != nil {
+				return false, err
+			}
+			if shortID == f.shortIDs[i] {
+				// NB: props is not advanced past the entry as another filter may
+				// share the same short ID.
+				prop = p
+				break
+			}
+			props = rest
+		}
+		intersects, err := f.filters[i].Intersects(prop)
+		if err != nil || !intersects {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// DataBlockIntervalCollector is the interface used by
+// NewBlockIntervalCollector to compute a [lower, upper) interval of uint64
+// values for each data block, such as the range of timestamps of the keys in
+// the block.
+type DataBlockIntervalCollector interface {
+	// Add is called with each point key added to the current data block.
+	Add(key InternalKey, value []byte) error
+	// FinishDataBlock returns the interval [lower, upper) for the current data
+	// block, and resets the state for the next block. An empty interval
+	// (lower >= upper) indicates that the block has no values.
+	FinishDataBlock() (lower uint64, upper uint64, err error)
+}
+
+// interval is a [lower, upper) interval of uint64 values. An interval with
+// lower >= upper is empty.
+type interval struct {
+	lower uint64
+	upper uint64
+}
+
+func (i interval) empty() bool {
+	return i.lower >= i.upper
+}
+
+func (i *interval) union(x interval) {
+	if x.empty() {
+		return
+	}
+	if i.empty() {
+		*i = x
+		return
+	}
+	if i.lower > x.lower {
+		i.lower = x.lower
+	}
+	if i.upper < x.upper {
+		i.upper = x.upper
+	}
+}
+
+func (i interval) intersects(x interval) bool {
+	if i.empty() || x.empty() {
+		return false
+	}
+	return i.lower < x.upper && x.lower < i.upper
+}
+
+// encode appends the encoding of the interval to buf. An empty interval
+// encodes to nothing; otherwise the encoding is:
+//
+//   <lower:uvarint><upper-lower:uvarint>
+func (i interval) encode(buf []byte) []byte {
+	if i.empty() {
+		return buf
+	}
+	var tmp [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], i.lower)
+	n += binary.PutUvarint(tmp[n:], i.upper-i.lower)
+	return append(buf, tmp[:n]...)
+}
+
+func decodeInterval(buf []byte) (interval, error) {
+	if len(buf) == 0 {
+		return interval{}, nil
+	}
+	var i interval
+	var n int
+	i.lower, n = binary.Uvarint(buf)
+	if n <= 0 || n >= len(buf) {
+		return interval{}, errors.New("pebble/table: corrupt interval block property")
+	}
+	delta, m := binary.Uvarint(buf[n:])
+	if m <= 0 || n+m != len(buf) {
+		return interval{}, errors.New("pebble/table: corrupt interval block property")
+	}
+	i.upper = i.lower + delta
+	return i, nil
+}
+
+// blockIntervalCollector is a BlockPropertyCollector which records a
+// [lower, upper) interval for each data block, index block and table.
+type blockIntervalCollector struct {
+	name  string
+	dbic  DataBlockIntervalCollector
+	block interval
+	index interval
+	table interval
+}
+
+var _ BlockPropertyCollector = (*blockIntervalCollector)(nil)
+
+// NewBlockIntervalCollector returns a BlockPropertyCollector which records
+// the intervals computed by the DataBlockIntervalCollector. The property of
+// an index block or table is the union of the intervals of its data blocks.
+// Use NewBlockIntervalFilter to filter using the collected intervals.
+func NewBlockIntervalCollector(
+	name string, dbic DataBlockIntervalCollector,
+) BlockPropertyCollector {
+	return &blockIntervalCollector{name: name, dbic: dbic}
+}
+
+// Name implements the BlockPropertyCollector interface.
+func (c *blockIntervalCollector) Name() string {
+	return c.name
+}
+
+// Add implements the BlockPropertyCollector interface.
+func (c *blockIntervalCollector) Add(key InternalKey, value []byte) error {
+	return c.dbic.Add(key, value)
+}
+
+// FinishDataBlock implements the BlockPropertyCollector interface.
+func (c *blockIntervalCollector) FinishDataBlock(buf []byte) ([]byte, error) {
+	var err error
+	c.block.lower, c.block.upper, err = c.dbic.FinishDataBlock()
+	if err != nil {
+		return buf, err
+	}
+	c.table.union(c.block)
+	return c.block.encode(buf), nil
+}
+
+// AddPrevDataBlockToIndexBlock implements the BlockPropertyCollector
+// interface.
+func (c *blockIntervalCollector) AddPrevDataBlockToIndexBlock() {
+	c.index.union(c.block)
+	c.block = interval{}
+}
+
+// FinishIndexBlock implements the BlockPropertyCollector interface.
+func (c *blockIntervalCollector) FinishIndexBlock(buf []byte) ([]byte, error) {
+	buf = c.index.encode(buf)
+	c.index = interval{}
+	return buf, nil
+}
+
+// FinishTable implements the BlockPropertyCollector interface.
+func (c *blockIntervalCollector) FinishTable(buf []byte) ([]byte, error) {
+	return c.table.encode(buf), nil
+}
+
+// BlockIntervalFilter is a BlockPropertyFilter which filters the blocks whose
+// interval, as recorded by a collector returned by NewBlockIntervalCollector,
+// does not intersect with the interval [lower, upper) of the filter.
+type BlockIntervalFilter struct {
+	name   string
+	filter interval
+}
+
+var _ BlockPropertyFilter = (*BlockIntervalFilter)(nil)
+
+// NewBlockIntervalFilter returns a filter which skips the blocks whose
+// interval, as recorded by the interval collector with the specified name,
+// does not intersect [lower, upper). Blocks without any values are skipped as
+// well.
+func NewBlockIntervalFilter(name string, lower, upper uint64) *BlockIntervalFilter {
+	return &BlockIntervalFilter{name: name, filter: interval{lower: lower, upper: upper}}
+}
+
+// Name implements the BlockPropertyFilter interface.
+func (f *BlockIntervalFilter) Name() string {
+	return f.name
+}
+
+// Intersects implements the BlockPropertyFilter interface.
+func (f *BlockIntervalFilter) Intersects(prop []byte) (bool, error) {
+	i, err := decodeInterval(prop)
+	if err != nil {
+		return false, err
+	}
+	return i.intersects(f.filter), nil
+}
@@ -0,0 +1,295 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/stretchr/testify/require"
+)
+
+const testSuffixIntervalName = "test-suffix-interval"
+
+// testSuffixIntervalCollector is a DataBlockIntervalCollector which collects
+// the interval of the numeric suffixes of keys of the form <key>@<suffix>.
+// Keys without a suffix are ignored.
+type testSuffixIntervalCollector struct {
+	interval
+}
+
+func newTestSuffixIntervalCollector() BlockPropertyCollector {
+	return NewBlockIntervalCollector(testSuffixIntervalName, &testSuffixIntervalCollector{})
+}
+
+func (c *testSuffixIntervalCollector) Add(key InternalKey, value []byte) error {
+	i := bytes.LastIndexByte(key.UserKey, '@')
+	if i < 0 {
+		return nil
+	}
+	v, err := strconv.ParseUint(string(key.UserKey[i+1:]), 10, 64)
+	if err != nil {
+		return err
+	}
+	c.union(interval{lower: v, upper: v + 1})
+	return nil
+}
+
+func (c *testSuffixIntervalCollector) FinishDataBlock() (uint64, uint64, error) {
+	lower, upper := c.lower, c.upper
+	c.interval = interval{}
+	return lower, upper, nil
+}
+
+func TestIntervalEncodeDecode(t *testing.T) {
+	testCases := []interval{
+		{},
+		{lower: 5, upper: 5},
+		{lower: 0, upper: 1},
+		{lower: 5, upper: 10},
+		{lower: 1 << 40, upper: 1<<40 + 7},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d-%d", tc.lower, tc.upper), func(t *testing.T) {
+			buf := tc.encode(nil)
+			i, err := decodeInterval(buf)
+			require.NoError(t, err)
+			if tc.empty() {
+				require.Equal(t, 0, len(buf))
+				require.True(t, i.empty())
+			} else {
+				require.Equal(t, tc, i)
+			}
+		})
+	}
+
+	_, err := decodeInterval([]byte{0x80})
+	require.Error(t, err)
+	_, err = decodeInterval(append(interval{lower: 1, upper: 2}.encode(nil), 0))
+	require.Error(t, err)
+}
+
+func TestIntervalIntersects(t *testing.T) {
+	testCases := []struct {
+		a, b     interval
+		expected bool
+	}{
+		{interval{5, 10}, interval{5, 10}, true},
+		{interval{5, 10}, interval{9, 20}, true},
+		{interval{5, 10}, interval{10, 20}, false},
+		{interval{5, 10}, interval{0, 5}, false},
+		{interval{5, 10}, interval{0, 6}, true},
+		{interval{5, 10}, interval{6, 7}, true},
+		{interval{5, 10}, interval{}, false},
+		{interval{}, interval{}, false},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, tc.a.intersects(tc.b), "%v %v", tc.a, tc.b)
+		require.Equal(t, tc.expected, tc.b.intersects(tc.a), "%v %v", tc.b, tc.a)
+	}
+}
+
+// testPropFilter is a BlockPropertyFilter which intersects the properties
+// equal to prop.
+type testPropFilter struct {
+	name string
+	prop string
+}
+
+func (f testPropFilter) Name() string {
+	return f.name
+}
+
+func (f testPropFilter) Intersects(prop []byte) (bool, error) {
+	return string(prop) == f.prop, nil
+}
+
+func TestBlockPropertiesFilterer(t *testing.T) {
+	var enc blockPropertiesEncoder
+	enc.add(0, []byte("a"))
+	enc.add(2, nil)
+	enc.add(5, []byte("bcd"))
+	props := append([]byte(nil), enc.buf...)
+
+	userProps := map[string]string{
+		"p0": "\x00a",
+		"p2": "\x02",
+		"p5": "\x05bcd",
+	}
+
+	testCases := []struct {
+		filters    []BlockPropertyFilter
+		nilFilter  bool
+		tableMatch bool
+		blockMatch bool
+	}{
+		{
+			// A filter for an unknown collector is ignored.
+			filters:    []BlockPropertyFilter{testPropFilter{"unknown", "x"}},
+			nilFilter:  true,
+			tableMatch: true,
+		},
+		{
+			filters:    []BlockPropertyFilter{testPropFilter{"p5", "bcd"}, testPropFilter{"p0", "a"}},
+			tableMatch: true,
+			blockMatch: true,
+		},
+		{
+			// The filter for p2 is presented with the empty property.
+			filters:    []BlockPropertyFilter{testPropFilter{"p2", ""}, testPropFilter{"p5", "bcd"}},
+			tableMatch: true,
+			blockMatch: true,
+		},
+		{
+			// Filters sharing a collector.
+			filters:    []BlockPropertyFilter{testPropFilter{"p5", "bcd"}, testPropFilter{"p5", "bcd"}},
+			tableMatch: true,
+			blockMatch: true,
+		},
+		{
+			filters:    []BlockPropertyFilter{testPropFilter{"p0", "b"}},
+			tableMatch: false,
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			f, tableMatch, err := newBlockPropertiesFilterer(tc.filters, userProps)
+			require.NoError(t, err)
+			require.Equal(t, tc.tableMatch, tableMatch)
+			if !tableMatch {
+				return
+			}
+			require.Equal(t, tc.nilFilter, f == nil)
+			if f == nil {
+				return
+			}
+			blockMatch, err := f.intersects(props)
+			require.NoError(t, err)
+			require.Equal(t, tc.blockMatch, blockMatch)
+
+			// Truncated properties are reported as an error.
+			_, err = f.intersects(props[:len(props)-1])
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestBlockProperties(t *testing.T) {
+	var r *Reader
+	defer func() {
+		if r != nil {
+			require.NoError(t, r.Close())
+		}
+	}()
+
+	datadriven.RunTest(t, "testdata/block_properties", func(td *datadriven.TestData) string {
+		switch td.Cmd {
+		case "build":
+			if r != nil {
+				_ = r.Close()
+				r = nil
+			}
+			var err error
+			_, r, err = runBuildCmd(td)
+			if err != nil {
+				return err.Error()
+			}
+			return ""
+
+		case "props":
+			return describeBlockProperties(r)
+
+		case "iter":
+			return runIterCmd(td, r)
+
+		default:
+			return fmt.Sprintf("unknown command: %s", td.Cmd)
+		}
+	})
+}
+
+// describeBlockProperties returns the intervals recorded by the test suffix
+// interval collector for the table, and for each of its index and data
+// blocks.
+func describeBlockProperties(r *Reader) string {
+	var buf bytes.Buffer
+	formatInterval := func(prop []byte) string {
+		i, err := decodeInterval(prop)
+		if err != nil {
+			return err.Error()
+		}
+		if i.empty() {
+			return "[]"
+		}
+		return fmt.Sprintf("[%d,%d)", i.lower, i.upper)
+	}
+	formatProps := func(props []byte) string {
+		if len(props) == 0 {
+			return "[]"
+		}
+		_, prop, _, err := decodeBlockProperty(props)
+		if err != nil {
+			return err.Error()
+		}
+		return formatInterval(prop)
+	}
+	formatIndex := func(indent string, data []byte) error {
+		iter, err := newBlockIter(r.Compare, data)
+		if err != nil {
+			return err
+		}
+		for key, value := iter.First(); key != nil; key, value = iter.Next() {
+			bhp, err := decodeBlockHandleWithProperties(value)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&buf, "%s%s: %s\n", indent, key.UserKey, formatProps(bhp.Props))
+		}
+		return iter.Close()
+	}
+
+	tableProp := r.Properties.UserProperties[testSuffixIntervalName]
+	if len(tableProp) == 0 {
+		return "no table property\n"
+	}
+	fmt.Fprintf(&buf, "table: %s\n", formatInterval([]byte(tableProp[1:])))
+
+	indexH, err := r.readIndex()
+	if err != nil {
+		return err.Error()
+	}
+	defer indexH.Release()
+	if r.Properties.IndexType != twoLevelIndex {
+		if err := formatIndex("  ", indexH.Get()); err != nil {
+			return err.Error()
+		}
+		return buf.String()
+	}
+	topIter, err := newBlockIter(r.Compare, indexH.Get())
+	if err != nil {
+		return err.Error()
+	}
+	defer topIter.Close()
+	for key, value := topIter.First(); key != nil; key, value = topIter.Next() {
+		bhp, err := decodeBlockHandleWithProperties(value)
+		if err != nil {
+			return err.Error()
+		}
+		fmt.Fprintf(&buf, "  %s: %s\n", key.UserKey, formatProps(bhp.Props))
+		h, err := r.readBlock(bhp.BlockHandle, nil /* transform */)
+		if err != nil {
+			return err.Error()
+		}
+		err = formatIndex("    ", h.Get())
+		h.Release()
+		if err != nil {
+			return err.Error()
+		}
+	}
+	return buf.String()
+}
@@ -6,6 +6,7 @@ package sstable
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"strconv"
 	"strings"
@@ -310,45 +311,128 @@ func TestBlockIterReverseDirections(t *testing.T) {
 	}
 }
 
+func TestBlockHashIndex(t *testing.T) {
+	ikey := func(s string, seqNum uint64) InternalKey {
+		return base.MakeInternalKey([]byte(s), seqNum, InternalKeyKindSet)
+	}
+
+	w := &blockWriter{restartInterval: 2, hashIndex: true}
+	w.add(ikey("apple", 1), nil)
+	w.add(ikey("banana", 1), nil)
+	w.add(ikey("cherry", 1), nil)
+	block := w.finish()
+
+	i, err := newBlockIter(bytes.Compare, block)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), i.numRestarts)
+	require.Equal(t, 5, len(i.hashIndex))
+	require.Equal(t, uint32(2|hashIndexFlag), binary.LittleEndian.Uint32(block[len(block)-4:]))
+	for _, k := range []string{"apple", "banana"} {
+		require.Equal(t, byte(0), i.hashIndex[hashIndexKey([]byte(k))%5])
+	}
+	require.Equal(t, byte(1), i.hashIndex[hashIndexKey([]byte("cherry"))%5])
+
+	// A block with more restart points than the hash index can address is
+	// written without a hash index.
+	w = &blockWriter{restartInterval: 1, hashIndex: true}
+	for j := 0; j <= hashIndexMaxRestarts; j++ {
+		w.add(ikey(fmt.Sprintf("%05d", j), 1), nil)
+	}
+	i, err = newBlockIter(bytes.Compare, w.finish())
+	require.NoError(t, err)
+	require.Nil(t, i.hashIndex)
+	require.Equal(t, int32(hashIndexMaxRestarts+1), i.numRestarts)
+}
+
+func TestBlockIterHashIndex(t *testing.T) {
+	// Build the same block with and without a hash index, and check that SeekGE
+	// finds the same entries for keys in and not in the block. Some keys have
+	// several versions, which may span restart intervals.
+	rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+	for _, restartInterval := range []int{2, 4, 16} {
+		t.Run(fmt.Sprintf("restart=%d", restartInterval), func(t *testing.T) {
+			w := &blockWriter{restartInterval: restartInterval, hashIndex: true}
+			wNoHash := &blockWriter{restartInterval: restartInterval}
+			for j := 0; j < 150; j++ {
+				k := fmt.Sprintf("%05d", 2*j)
+				for seqNum := uint64(rng.Intn(3) + 1); seqNum > 0; seqNum-- {
+					key := base.MakeInternalKey([]byte(k), seqNum, InternalKeyKindSet)
+					w.add(key, []byte(fmt.Sprint(seqNum)))
+					wNoHash.add(key, []byte(fmt.Sprint(seqNum)))
+				}
+			}
+			i, err := newBlockIter(bytes.Compare, w.finish())
+			require.NoError(t, err)
+			require.NotNil(t, i.hashIndex)
+			iNoHash, err := newBlockIter(bytes.Compare, wNoHash.finish())
+			require.NoError(t, err)
+			require.Nil(t, iNoHash.hashIndex)
+
+			for j := -1; j <= 300; j++ {
+				k := []byte(fmt.Sprintf("%05d", j))
+				key, value := i.SeekGE(k)
+				expectedKey, expectedValue := iNoHash.SeekGE(k)
+				if expectedKey == nil {
+					require.Nil(t, key)
+					continue
+				}
+				require.NotNil(t, key, "%s", k)
+				require.Equal(t, *expectedKey, *key, "%s", k)
+				require.Equal(t, expectedValue, value, "%s", k)
+				// The iterator is positioned for iteration.
+				expectedKey, _ = iNoHash.Next()
+				key, _ = i.Next()
+				require.Equal(t, expectedKey == nil, key == nil)
+				if key != nil {
+					require.Equal(t, *expectedKey, *key, "%s", k)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkBlockIterSeekGE(b *testing.B) {
 	const blockSize = 32 << 10
 
 	for _, restartInterval := range []int{16} {
-		b.Run(fmt.Sprintf("restart=%d", restartInterval),
-			func(b *testing.B) {
-				w := &blockWriter{
-					restartInterval: restartInterval,
-				}
+		for _, hashIndex := range []bool{false, true} {
+			b.Run(fmt.Sprintf("restart=%d/hash-index=%t", restartInterval, hashIndex),
+				func(b *testing.B) {
+					w := &blockWriter{
+						restartInterval: restartInterval,
+						hashIndex:       hashIndex,
+					}
 
-				var ikey InternalKey
-				var keys [][]byte
-				for i := 0; w.estimatedSize() < blockSize; i++ {
-					key := []byte(fmt.Sprintf("%05d", i))
-					keys = append(keys, key)
-					ikey.UserKey = key
-					w.add(ikey, nil)
-				}
+					var ikey InternalKey
+					var keys [][]byte
+					for i := 0; w.estimatedSize() < blockSize; i++ {
+						key := []byte(fmt.Sprintf("%05d", i))
+						keys = append(keys, key)
+						ikey.UserKey = key
+						w.add(ikey, nil)
+					}
 
-				it, err := newBlockIter(bytes.Compare, w.finish())
-				if err != nil {
-					b.Fatal(err)
-				}
-				rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+					it, err := newBlockIter(bytes.Compare, w.finish())
+					if err != nil {
+						b.Fatal(err)
+					}
+					rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
 
-				b.ResetTimer()
-				for i := 0; i < b.N; i++ {
-					k := keys[rng.Intn(len(keys))]
-					it.SeekGE(k)
-					if testing.Verbose() {
-						if !it.Valid() {
-							b.Fatal("expected to find key")
-						}
-						if !bytes.Equal(k, it.Key().UserKey) {
-							b.Fatalf("expected %s, but found %s", k, it.Key().UserKey)
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						k := keys[rng.Intn(len(keys))]
+						it.SeekGE(k)
+						if testing.Verbose() {
+							if !it.Valid() {
+								b.Fatal("expected to find key")
+							}
+							if !bytes.Equal(k, it.Key().UserKey) {
+								b.Fatalf("expected %s, but found %s", k, it.Key().UserKey)
+							}
 						}
 					}
-				}
-			})
+				})
+		}
 	}
 }
 
@@ -0,0 +1,54 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"github.com/cockroachdb/pebble/internal/crc"
+	"github.com/cockroachdb/pebble/internal/xxhash"
+)
+
+// footerType returns the checksum type recorded in the footer of a table for
+// c, or noChecksum if c is not one of the available types.
+func (c ChecksumType) footerType() uint8 {
+	switch c {
+	case CRC32cChecksum:
+		return checksumCRC32c
+	case XXHash64Checksum:
+		return checksumXXHash64
+	default:
+		return noChecksum
+	}
+}
+
+// checksumTypeForFooter returns the ChecksumType for the checksum type recorded
+// in the footer of a table, or false if the checksum type is not supported.
+func checksumTypeForFooter(t uint8) (ChecksumType, bool) {
+	switch t {
+	case checksumCRC32c:
+		return CRC32cChecksum, true
+	case checksumXXHash64:
+		return XXHash64Checksum, true
+	default:
+		return DefaultChecksum, false
+	}
+}
+
+// computeChecksum returns the checksum of a block: the block data followed by
+// the block type byte. For XXHash64 checksums, the checksum is the lower 32
+// bits of the hash, as in RocksDB.
+func computeChecksum(c ChecksumType, data []byte, blockType byte) uint32 {
+	switch c {
+	case XXHash64Checksum:
+		var d xxhash.Digest
+		d.Reset()
+		_, _ = d.Write(data)
+		_ = d.WriteByte(blockType)
+		return uint32(d.Sum64())
+	default:
+		var b [1]byte
+		b[0] = blockType
+		return crc.New(data).Update(b[:]).Value()
+	}
+}
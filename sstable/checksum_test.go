@@ -0,0 +1,126 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/crc"
+	"github.com/cockroachdb/pebble/internal/xxhash"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeChecksum(t *testing.T) {
+	data := []byte("hello world")
+	require.Equal(t, crc.New(append(data[:len(data):len(data)], 1)).Value(),
+		computeChecksum(CRC32cChecksum, data, 1))
+	require.Equal(t, uint32(xxhash.Sum64(append(data[:len(data):len(data)], 1))),
+		computeChecksum(XXHash64Checksum, data, 1))
+}
+
+func TestChecksum(t *testing.T) {
+	writeTable := func(mem vfs.FS, o WriterOptions) {
+		f, err := mem.Create("test")
+		require.NoError(t, err)
+		o.BlockSize = 100
+		w := NewWriter(f, o)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, w.Set([]byte(fmt.Sprintf("%05d", i)), nil))
+		}
+		require.NoError(t, w.Close())
+	}
+	readTable := func(mem vfs.FS) (*Reader, error) {
+		f, err := mem.Open("test")
+		require.NoError(t, err)
+		return NewReader(f, ReaderOptions{})
+	}
+	rewriteTable := func(mem vfs.FS, fn func(data []byte)) {
+		f, err := mem.Open("test")
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		fn(data)
+		f, err = mem.Create("test")
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	testCases := []struct {
+		opts     WriterOptions
+		expected ChecksumType
+	}{
+		{WriterOptions{}, CRC32cChecksum},
+		{WriterOptions{Checksum: CRC32cChecksum}, CRC32cChecksum},
+		{WriterOptions{Checksum: XXHash64Checksum}, XXHash64Checksum},
+		{WriterOptions{Checksum: ChecksumType(100)}, CRC32cChecksum},
+		{WriterOptions{Checksum: XXHash64Checksum, TableFormat: TableFormatLevelDB}, CRC32cChecksum},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			mem := vfs.NewMem()
+			writeTable(mem, c.opts)
+
+			r, err := readTable(mem)
+			require.NoError(t, err)
+			l, err := r.Layout()
+			require.NoError(t, err)
+			require.Equal(t, c.expected, l.Checksum)
+			iter, err := r.NewIter(nil, nil)
+			require.NoError(t, err)
+			var n int
+			for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+				n++
+			}
+			require.Equal(t, 100, n)
+			require.NoError(t, iter.Close())
+			require.NoError(t, r.Close())
+
+			// Corrupting a data block is detected.
+			rewriteTable(mem, func(data []byte) {
+				data[l.Data[0].Offset] ^= 0xff
+			})
+			r, err = readTable(mem)
+			require.NoError(t, err)
+			_, err = r.readBlock(l.Data[0], nil /* transform */)
+			require.EqualError(t, err, "pebble/table: invalid table (checksum mismatch)")
+			h, err := r.readBlock(l.Data[1], nil /* transform */)
+			require.NoError(t, err)
+			h.Release()
+			require.NoError(t, r.Close())
+		})
+	}
+
+	// A table with an unsupported checksum type in its footer is rejected.
+	mem := vfs.NewMem()
+	writeTable(mem, WriterOptions{})
+	rewriteTable(mem, func(data []byte) {
+		data[len(data)-rocksDBFooterLen] = checksumXXHash
+	})
+	_, err := readTable(mem)
+	require.EqualError(t, err, "pebble/table: unsupported checksum type 2")
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	for _, c := range []ChecksumType{CRC32cChecksum, XXHash64Checksum} {
+		for _, size := range []int{256, 4 << 10, 32 << 10} {
+			b.Run(fmt.Sprintf("%s/size=%d", c, size), func(b *testing.B) {
+				data := make([]byte, size)
+				rand.New(rand.NewSource(0)).Read(data)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					computeChecksum(c, data, noCompressionBlockType)
+				}
+			})
+		}
+	}
+}
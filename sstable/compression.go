@@ -0,0 +1,179 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+	"github.com/golang/snappy"
+)
+
+// Compressor implements a block compression codec. A Compressor must be safe
+// for concurrent use by multiple goroutines.
+type Compressor interface {
+	// Encode returns the compressed form of src. The returned slice may use the
+	// storage of dst if it is large enough.
+	Encode(dst, src []byte) []byte
+	// DecodedLen returns the length of the decompressed form of src.
+	DecodedLen(src []byte) (int, error)
+	// Decode decompresses src into dst, whose length is the length returned by
+	// DecodedLen.
+	Decode(dst, src []byte) error
+}
+
+// compressionCodec is a registered compression codec.
+type compressionCodec struct {
+	name       string
+	compressor Compressor
+}
+
+// codecRegistry holds the registered compression codecs, indexed by the block
+// type recorded in the trailer of the blocks they compress. The table is
+// copied on registration, so that lookups do not need to lock.
+type codecRegistry struct {
+	mu     sync.Mutex
+	codecs atomic.Value // *[256]*compressionCodec
+}
+
+var compressionRegistry = newCodecRegistry()
+
+func newCodecRegistry() *codecRegistry {
+	var codecs [256]*compressionCodec
+	codecs[noCompressionBlockType] = &compressionCodec{name: "NoCompression"}
+	codecs[snappyCompressionBlockType] = &compressionCodec{
+		name:       "Snappy",
+		compressor: snappyCompressor{},
+	}
+	r := &codecRegistry{}
+	r.codecs.Store(&codecs)
+	return r
+}
+
+// RegisterCompression registers a block compression codec, and returns the
+// Compression which selects it in WriterOptions.Compression. The id is
+// recorded in the trailer of each block compressed by the codec, and must be
+// the same wherever tables using the codec are read. The name is used by
+// Compression.String, the OPTIONS file and the table properties.
+//
+// The ids 0 and 1 are reserved for NoCompression and SnappyCompression. RocksDB
+// uses the ids 2 through 7 for the zlib, bzip2, lz4, lz4hc, xpress and zstd
+// formats. RegisterCompression panics if the id or name is already registered.
+// Codecs should be registered before opening any DB or table which uses them,
+// typically from an init function.
+func RegisterCompression(id byte, name string, compressor Compressor) Compression {
+	if name == "" || name == "Default" || name == "Unknown" || compressor == nil {
+		panic(errors.AssertionFailedf("pebble: invalid compression %q", errors.Safe(name)))
+	}
+
+	compressionRegistry.mu.Lock()
+	defer compressionRegistry.mu.Unlock()
+	codecs := *compressionRegistry.codecs.Load().(*[256]*compressionCodec)
+	if codecs[id] != nil {
+		panic(errors.AssertionFailedf("pebble: compression id %d already registered by %q",
+			errors.Safe(id), errors.Safe(codecs[id].name)))
+	}
+	for i := range codecs {
+		if codecs[i] != nil && codecs[i].name == name {
+			panic(errors.AssertionFailedf("pebble: compression %q already registered",
+				errors.Safe(name)))
+		}
+	}
+	codecs[id] = &compressionCodec{name: name, compressor: compressor}
+	compressionRegistry.codecs.Store(&codecs)
+	return compressionForBlockType(id)
+}
+
+// CompressionByName returns the Compression which selects the registered
+// codec with the given name, or DefaultCompression for "Default". Returns
+// false if there is no such codec.
+func CompressionByName(name string) (Compression, bool) {
+	if name == "Default" {
+		return DefaultCompression, true
+	}
+	codecs := compressionRegistry.codecs.Load().(*[256]*compressionCodec)
+	for i := range codecs {
+		if codecs[i] != nil && codecs[i].name == name {
+			return compressionForBlockType(byte(i)), true
+		}
+	}
+	return DefaultCompression, false
+}
+
+// lookupCodec returns the codec registered with the given block type, or nil
+// if there is none.
+func lookupCodec(blockType byte) *compressionCodec {
+	return compressionRegistry.codecs.Load().(*[256]*compressionCodec)[blockType]
+}
+
+// The block type of a codec is recorded in the block trailer. The
+// Compression of a codec is offset from its block type by one, so that the
+// zero value of the Compression type is DefaultCompression.
+func compressionForBlockType(blockType byte) Compression {
+	return Compression(blockType) + 1
+}
+
+func (c Compression) blockType() byte {
+	return byte(c - 1)
+}
+
+// Registered returns true if c selects a registered codec. DefaultCompression
+// is not registered, and is replaced by SnappyCompression when options are
+// defaulted.
+func (c Compression) Registered() bool {
+	return c.codec() != nil
+}
+
+// codec returns the registered codec selected by c, or nil if c is
+// DefaultCompression or does not select a registered codec.
+func (c Compression) codec() *compressionCodec {
+	if c <= DefaultCompression || c > compressionForBlockType(255) {
+		return nil
+	}
+	return lookupCodec(c.blockType())
+}
+
+// adaptiveCompressionSampleBlocks is the number of blocks sampled by adaptive
+// compression before deciding whether to compress the rest of the table.
+const adaptiveCompressionSampleBlocks = 8
+
+// poorCompression returns true if compressing size bytes into compressedSize
+// bytes saves less than 12.5%, in which case the compressed data is discarded.
+func poorCompression(size, compressedSize uint64) bool {
+	return compressedSize >= size-size/8
+}
+
+// compressionStats accumulates the compression statistics of the blocks of a
+// table. See Properties.NumCompressedBlocks.
+type compressionStats struct {
+	compressedBlocks   uint64
+	uncompressedBlocks uint64
+	inputSize          uint64
+	outputSize         uint64
+}
+
+// snappyCompressor implements SnappyCompression.
+type snappyCompressor struct{}
+
+func (snappyCompressor) Encode(dst, src []byte) []byte {
+	return snappy.Encode(dst, src)
+}
+
+func (snappyCompressor) DecodedLen(src []byte) (int, error) {
+	return snappy.DecodedLen(src)
+}
+
+func (snappyCompressor) Decode(dst, src []byte) error {
+	result, err := snappy.Decode(dst, src)
+	if err != nil {
+		return err
+	}
+	if len(result) != 0 && (len(result) != len(dst) || &result[0] != &dst[0]) {
+		return errors.Errorf("pebble/table: snappy decoded into unexpected buffer: %p != %p",
+			errors.Safe(result), errors.Safe(dst))
+	}
+	return nil
+}
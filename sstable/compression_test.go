@@ -0,0 +1,230 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/crc"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+// flateCompressor is a Compressor using the DEFLATE format. The compressed
+// block is prefixed with its decompressed length.
+type flateCompressor struct{}
+
+func (flateCompressor) Encode(dst, src []byte) []byte {
+	var buf bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(src)))])
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(src); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return append(dst[:0], buf.Bytes()...)
+}
+
+func (flateCompressor) DecodedLen(src []byte) (int, error) {
+	n, i := binary.Uvarint(src)
+	if i <= 0 {
+		return 0, errors.New("flate: corrupt block length")
+	}
+	return int(n), nil
+}
+
+func (flateCompressor) Decode(dst, src []byte) error {
+	_, i := binary.Uvarint(src)
+	r := flate.NewReader(bytes.NewReader(src[i:]))
+	defer r.Close()
+	_, err := io.ReadFull(r, dst)
+	return err
+}
+
+var flateCompression = RegisterCompression(200, "Flate", flateCompressor{})
+
+func TestCompressionRegistry(t *testing.T) {
+	for _, c := range []Compression{NoCompression, SnappyCompression, flateCompression} {
+		require.True(t, c.Registered())
+		got, ok := CompressionByName(c.String())
+		require.True(t, ok)
+		require.Equal(t, c, got)
+	}
+	require.Equal(t, "Flate", flateCompression.String())
+
+	c, ok := CompressionByName("Default")
+	require.True(t, ok)
+	require.Equal(t, DefaultCompression, c)
+	require.False(t, DefaultCompression.Registered())
+
+	_, ok = CompressionByName("Zstd")
+	require.False(t, ok)
+	require.False(t, Compression(100).Registered())
+	require.Equal(t, "Unknown", Compression(100).String())
+
+	require.Panics(t, func() { RegisterCompression(200, "Flate2", flateCompressor{}) })
+	require.Panics(t, func() { RegisterCompression(201, "Snappy", flateCompressor{}) })
+	require.Panics(t, func() { RegisterCompression(201, "Default", flateCompressor{}) })
+	require.Panics(t, func() { RegisterCompression(201, "Flate2", nil) })
+}
+
+func TestRegisteredCompression(t *testing.T) {
+	mem := vfs.NewMem()
+	f, err := mem.Create("test")
+	require.NoError(t, err)
+	w := NewWriter(f, WriterOptions{
+		BlockSize:      100,
+		IndexBlockSize: 1 << 20,
+		Compression:    flateCompression,
+	})
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%05d", i))
+		require.NoError(t, w.Set(key, bytes.Repeat(key, 10)))
+	}
+	require.NoError(t, w.Close())
+
+	f, err = mem.Open("test")
+	require.NoError(t, err)
+	r, err := NewReader(f, ReaderOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "Flate", r.Properties.CompressionName)
+
+	counts, err := r.BlockCompressions()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(counts))
+	require.Equal(t, int(r.Properties.NumDataBlocks+1), counts["Flate"])
+
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(t, err)
+	var n int
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		require.Equal(t, fmt.Sprintf("%05d", n), string(key.UserKey))
+		require.Equal(t, bytes.Repeat(key.UserKey, 10), value)
+		n++
+	}
+	require.Equal(t, 1000, n)
+	require.NoError(t, iter.Close())
+	l, err := r.Layout()
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	// Rewrite the block type of the data blocks to an unregistered id.
+	f, err = mem.Open("test")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	for _, bh := range l.Data {
+		trailer := data[bh.Offset+bh.Length:]
+		require.Equal(t, flateCompression.blockType(), trailer[0])
+		trailer[0] = 201
+		binary.LittleEndian.PutUint32(trailer[1:],
+			crc.New(data[bh.Offset:bh.Offset+bh.Length+1]).Value())
+	}
+	f, err = mem.Create("test")
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = mem.Open("test")
+	require.NoError(t, err)
+	r, err = NewReader(f, ReaderOptions{})
+	require.NoError(t, err)
+	counts, err = r.BlockCompressions()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{
+		"Flate":        1,
+		"Unknown(201)": int(r.Properties.NumDataBlocks),
+	}, counts)
+	iter, err = r.NewIter(nil, nil)
+	require.NoError(t, err)
+	key, _ := iter.First()
+	require.Nil(t, key)
+	require.EqualError(t, iter.Close(),
+		"pebble/table: block compressed with unregistered compression 201")
+	require.NoError(t, r.Close())
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	// The values of the first half of the keys are random, and the values of
+	// the second half are compressible.
+	rng := rand.New(rand.NewSource(0))
+	value := func(i int) []byte {
+		v := make([]byte, 100)
+		if i < 500 {
+			rng.Read(v)
+		}
+		return v
+	}
+
+	build := func(o WriterOptions) Properties {
+		mem := vfs.NewMem()
+		f, err := mem.Create("test")
+		require.NoError(t, err)
+		o.BlockSize = 1000
+		o.IndexBlockSize = 1 << 20
+		o.Compression = SnappyCompression
+		w := NewWriter(f, o)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, w.Set([]byte(fmt.Sprintf("%05d", i)), value(i)))
+		}
+		require.NoError(t, w.Close())
+
+		f, err = mem.Open("test")
+		require.NoError(t, err)
+		r, err := NewReader(f, ReaderOptions{})
+		require.NoError(t, err)
+		defer r.Close()
+		iter, err := r.NewIter(nil, nil)
+		require.NoError(t, err)
+		var n int
+		for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+			n++
+		}
+		require.Equal(t, 1000, n)
+		require.NoError(t, iter.Close())
+		return r.Properties
+	}
+
+	// The compression statistics are not saved by default.
+	props := build(WriterOptions{})
+	for _, prop := range []string{
+		"pebble.compression.compressed-blocks", "pebble.compression.uncompressed-blocks",
+		"pebble.compression.input-size", "pebble.compression.output-size",
+	} {
+		require.NotContains(t, props.String(), prop)
+	}
+
+	// The random values are left uncompressed, and the rest are compressed.
+	props = build(WriterOptions{CompressionStats: true})
+	numBlocks := props.NumDataBlocks + 1
+	require.Equal(t, numBlocks, props.NumCompressedBlocks+props.NumUncompressedBlocks)
+	require.True(t, props.NumCompressedBlocks > numBlocks/3)
+	require.True(t, props.NumUncompressedBlocks > numBlocks/3)
+	require.True(t, props.CompressionOutputSize < props.CompressionInputSize)
+	require.True(t, props.CompressionInputSize > props.DataSize)
+
+	// Adaptive compression samples the random values of the first blocks, and
+	// leaves the rest of the blocks uncompressed.
+	props = build(WriterOptions{AdaptiveCompression: true})
+	require.Equal(t, uint64(0), props.NumCompressedBlocks)
+	require.Equal(t, numBlocks, props.NumUncompressedBlocks)
+	require.Equal(t, props.CompressionInputSize, props.CompressionOutputSize)
+}
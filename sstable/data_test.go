@@ -50,6 +50,24 @@ func runBuildCmd(td *datadriven.TestData) (*WriterMetadata, *Reader, error) {
 			if err != nil {
 				return nil, nil, err
 			}
+		case "checksum":
+			if len(arg.Vals) != 1 {
+				return nil, nil, errors.Errorf("%s: arg %s expects 1 value", td.Cmd, arg.Key)
+			}
+			switch arg.Vals[0] {
+			case "crc32c":
+				writerOpts.Checksum = CRC32cChecksum
+			case "xxhash64":
+				writerOpts.Checksum = XXHash64Checksum
+			default:
+				return nil, nil, errors.Errorf("%s: unknown checksum %s", td.Cmd, arg.Vals[0])
+			}
+		case "block-interval-collector":
+			if len(arg.Vals) != 0 {
+				return nil, nil, errors.Errorf("%s: arg %s expects 0 values", td.Cmd, arg.Key)
+			}
+			writerOpts.BlockPropertyCollectors = append(writerOpts.BlockPropertyCollectors,
+				newTestSuffixIntervalCollector)
 		default:
 			return nil, nil, errors.Errorf("%s: unknown arg %s", td.Cmd, arg.Key)
 		}
@@ -157,6 +175,7 @@ func runBuildRawCmd(td *datadriven.TestData) (*WriterMetadata, *Reader, error) {
 }
 
 func runIterCmd(td *datadriven.TestData, r *Reader) string {
+	var filters []BlockPropertyFilter
 	for _, arg := range td.CmdArgs {
 		switch arg.Key {
 		case "globalSeqNum":
@@ -168,11 +187,24 @@ func runIterCmd(td *datadriven.TestData, r *Reader) string {
 				return err.Error()
 			}
 			r.Properties.GlobalSeqNum = uint64(v)
+		case "block-interval-filter":
+			if len(arg.Vals) != 2 {
+				return fmt.Sprintf("%s: arg %s expects 2 values", td.Cmd, arg.Key)
+			}
+			lower, err := strconv.ParseUint(arg.Vals[0], 10, 64)
+			if err != nil {
+				return err.Error()
+			}
+			upper, err := strconv.ParseUint(arg.Vals[1], 10, 64)
+			if err != nil {
+				return err.Error()
+			}
+			filters = append(filters, NewBlockIntervalFilter(testSuffixIntervalName, lower, upper))
 		default:
 			return fmt.Sprintf("%s: unknown arg: %s", td.Cmd, arg.Key)
 		}
 	}
-	origIter, err := r.NewIter(nil /* lower */, nil /* upper */)
+	origIter, err := r.NewIterWithBlockPropertyFilters(nil /* lower */, nil /* upper */, filters)
 	if err != nil {
 		return err.Error()
 	}
@@ -9,25 +9,47 @@ import (
 	"github.com/cockroachdb/pebble/internal/cache"
 )
 
-// Compression is the per-block compression algorithm to use.
+// Compression is the per-block compression algorithm to use. Additional
+// codecs may be added by RegisterCompression.
 type Compression int
 
-// The available compression types.
+// The built-in compression types.
 const (
 	DefaultCompression Compression = iota
 	NoCompression
 	SnappyCompression
-	NCompression
 )
 
 func (c Compression) String() string {
+	if c == DefaultCompression {
+		return "Default"
+	}
+	if codec := c.codec(); codec != nil {
+		return codec.name
+	}
+	return "Unknown"
+}
+
+// ChecksumType is the algorithm used to checksum the blocks of a table. The
+// checksum type is recorded in the footer of the table, so that the reader
+// verifies the blocks with the algorithm the writer used.
+type ChecksumType int
+
+// The available checksum types.
+const (
+	DefaultChecksum ChecksumType = iota
+	CRC32cChecksum
+	XXHash64Checksum
+)
+
+func (c ChecksumType) String() string {
 	switch c {
-	case DefaultCompression:
+	case DefaultChecksum:
 		return "Default"
-	case NoCompression:
-		return "NoCompression"
-	case SnappyCompression:
-		return "Snappy"
+	case CRC32cChecksum:
+		return "CRC32c"
+	case XXHash64Checksum:
+		return "XXHash64"
 	default:
 		return "Unknown"
 	}
@@ -57,8 +79,32 @@ type TableFormat uint32
 const (
 	TableFormatRocksDBv2 TableFormat = iota
 	TableFormatLevelDB
+	// TableFormatPebblev1 extends TableFormatRocksDBv2 with a hash index in
+	// each data block, which maps the hash of a user key to the restart
+	// interval containing the key (see RocksDB's kDataBlockBinaryAndHash). The
+	// hash index allows point lookups to skip the binary search of the restart
+	// points of the block. It is only written if the Comparer is the default
+	// bytewise comparer, as it relies on equal keys being bytewise equal. The
+	// footer of the table has a Pebble-specific magic
+	// number, so that RocksDB and versions of Pebble which do not support the
+	// hash index reject the table rather than misinterpret its data blocks.
+	TableFormatPebblev1
 )
 
+// String implements fmt.Stringer.
+func (f TableFormat) String() string {
+	switch f {
+	case TableFormatRocksDBv2:
+		return "RocksDBv2"
+	case TableFormatLevelDB:
+		return "LevelDB"
+	case TableFormatPebblev1:
+		return "Pebblev1"
+	default:
+		return "Unknown"
+	}
+}
+
 // TablePropertyCollector provides a hook for collecting user-defined
 // properties based on the keys and values stored in an sstable. A new
 // TablePropertyCollector is created for an sstable when the sstable is being
@@ -150,9 +196,33 @@ type WriterOptions struct {
 
 	// Compression defines the per-block compression to use.
 	//
-	// The default value (DefaultCompression) uses snappy compression.
+	// The default value (DefaultCompression) uses snappy compression. A
+	// Compression which does not select a registered codec is also replaced by
+	// snappy compression.
 	Compression Compression
 
+	// Checksum defines the algorithm used to checksum each block. The checksum
+	// type is recorded in the footer of the table. The LevelDB table format
+	// only supports CRC32c checksums.
+	//
+	// The default value (DefaultChecksum) uses CRC32c checksums. A ChecksumType
+	// which is not one of the available types is also replaced by CRC32c.
+	Checksum ChecksumType
+
+	// CompressionStats, if true, saves the compression statistics of the table
+	// in its properties (see Properties.NumCompressedBlocks). The statistics
+	// are Pebble-specific properties, and are not saved by default so that the
+	// tables written are identical to those written by RocksDB.
+	CompressionStats bool
+
+	// AdaptiveCompression, if true, samples the compression ratio of the first
+	// blocks of the table, and leaves the rest of the blocks of the table
+	// uncompressed if the sampled blocks compressed poorly as a whole. This
+	// avoids spending CPU on data which is already compressed or encrypted.
+	// Adaptive compression saves the compression statistics of the table, as if
+	// CompressionStats were true.
+	AdaptiveCompression bool
+
 	// FilterPolicy defines a filter algorithm (such as a Bloom filter) that can
 	// reduce disk reads for Get calls.
 	//
@@ -188,13 +258,21 @@ type WriterOptions struct {
 	// TableFormat specifies the format version for writing sstables. The default
 	// is TableFormatRocksDBv2 which creates RocksDB compatible sstables. Use
 	// TableFormatLevelDB to create LevelDB compatible sstable which can be used
-	// by a wider range of tools and libraries.
+	// by a wider range of tools and libraries. Use TableFormatPebblev1 to
+	// create sstables with data block hash indexes, which speed up point
+	// lookups but can only be read by Pebble.
 	TableFormat TableFormat
 
 	// TablePropertyCollectors is a list of TablePropertyCollector creation
 	// functions. A new TablePropertyCollector is created for each sstable built
 	// and lives for the lifetime of the table.
 	TablePropertyCollectors []func() TablePropertyCollector
+
+	// BlockPropertyCollectors is a list of BlockPropertyCollector creation
+	// functions. A new BlockPropertyCollector is created for each sstable
+	// built and lives for the lifetime of writing that table. At most 256
+	// collectors may be specified.
+	BlockPropertyCollectors []func() BlockPropertyCollector
 }
 
 func (o WriterOptions) ensureDefaults() WriterOptions {
@@ -210,9 +288,12 @@ func (o WriterOptions) ensureDefaults() WriterOptions {
 	if o.Comparer == nil {
 		o.Comparer = base.DefaultComparer
 	}
-	if o.Compression <= DefaultCompression || o.Compression >= NCompression {
+	if o.Compression.codec() == nil {
 		o.Compression = SnappyCompression
 	}
+	if o.Checksum.footerType() == noChecksum {
+		o.Checksum = CRC32cChecksum
+	}
 	if o.IndexBlockSize <= 0 {
 		o.IndexBlockSize = o.BlockSize
 	}
@@ -64,10 +64,16 @@ type Properties struct {
 	ColumnFamilyName string `prop:"rocksdb.column.family.name"`
 	// The name of the comparer used in this table.
 	ComparerName string `prop:"rocksdb.comparator"`
+	// The total size of the blocks counted by NumCompressedBlocks and
+	// NumUncompressedBlocks, before compression.
+	CompressionInputSize uint64 `prop:"pebble.compression.input-size"`
 	// The compression algorithm used to compress blocks.
 	CompressionName string `prop:"rocksdb.compression"`
 	// The compression options used to compress blocks.
 	CompressionOptions string `prop:"rocksdb.compression_options"`
+	// The total size of the blocks counted by NumCompressedBlocks and
+	// NumUncompressedBlocks, as stored in the table.
+	CompressionOutputSize uint64 `prop:"pebble.compression.output-size"`
 	// The time when the SST file was created. Since SST files are immutable,
 	// this is equivalent to last modified time.
 	CreationTime uint64 `prop:"rocksdb.creation.time"`
@@ -103,6 +109,10 @@ type Properties struct {
 	IndexValueIsDeltaEncoded uint64 `prop:"rocksdb.index.value.is.delta.encoded"`
 	// The name of the merger used in this table. Empty if no merger is used.
 	MergerName string `prop:"rocksdb.merge.operator"`
+	// The number of data and index blocks which were compressed. Only present if
+	// WriterOptions.CompressionStats was enabled, and the table used a
+	// compression other than NoCompression.
+	NumCompressedBlocks uint64 `prop:"pebble.compression.compressed-blocks"`
 	// The number of blocks in this table.
 	NumDataBlocks uint64 `prop:"rocksdb.num.data.blocks"`
 	// The number of deletion entries in this table.
@@ -113,6 +123,13 @@ type Properties struct {
 	NumMergeOperands uint64 `prop:"rocksdb.merge.operands"`
 	// The number of range deletions in this table.
 	NumRangeDeletions uint64 `prop:"rocksdb.num.range-deletions"`
+	// The number of range keys in this table.
+	NumRangeKeys uint64 `prop:"pebble.num.range-keys"`
+	// The number of data and index blocks which were left uncompressed, either
+	// because compressing them saved less than 12.5%, or because adaptive
+	// compression disabled compression for the rest of the table. See
+	// NumCompressedBlocks.
+	NumUncompressedBlocks uint64 `prop:"pebble.compression.uncompressed-blocks"`
 	// Timestamp of the earliest key. 0 if unknown.
 	OldestKeyTime uint64 `prop:"rocksdb.oldest.key.time"`
 	// The name of the prefix extractor used in this table. Empty if no prefix
@@ -275,6 +292,12 @@ func (p *Properties) save(w *rawBlockWriter) {
 	if p.ComparerName != "" {
 		p.saveString(m, unsafe.Offsetof(p.ComparerName), p.ComparerName)
 	}
+	if p.NumCompressedBlocks+p.NumUncompressedBlocks > 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.CompressionInputSize), p.CompressionInputSize)
+		p.saveUvarint(m, unsafe.Offsetof(p.CompressionOutputSize), p.CompressionOutputSize)
+		p.saveUvarint(m, unsafe.Offsetof(p.NumCompressedBlocks), p.NumCompressedBlocks)
+		p.saveUvarint(m, unsafe.Offsetof(p.NumUncompressedBlocks), p.NumUncompressedBlocks)
+	}
 	if p.CompressionName != "" {
 		p.saveString(m, unsafe.Offsetof(p.CompressionName), p.CompressionName)
 	}
@@ -312,6 +335,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 	p.saveUvarint(m, unsafe.Offsetof(p.NumDeletions), p.NumDeletions)
 	p.saveUvarint(m, unsafe.Offsetof(p.NumMergeOperands), p.NumMergeOperands)
 	p.saveUvarint(m, unsafe.Offsetof(p.NumRangeDeletions), p.NumRangeDeletions)
+	if p.NumRangeKeys > 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumRangeKeys), p.NumRangeKeys)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.OldestKeyTime), p.OldestKeyTime)
 	if p.PrefixExtractorName != "" {
 		p.saveString(m, unsafe.Offsetof(p.PrefixExtractorName), p.PrefixExtractorName)
@@ -18,12 +18,10 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/cache"
-	"github.com/cockroachdb/pebble/internal/crc"
 	"github.com/cockroachdb/pebble/internal/invariants"
 	"github.com/cockroachdb/pebble/internal/private"
 	"github.com/cockroachdb/pebble/internal/rangedel"
 	"github.com/cockroachdb/pebble/vfs"
-	"github.com/golang/snappy"
 )
 
 var errCorruptIndexEntry = errors.New("pebble/table: corrupt index entry")
@@ -46,6 +44,34 @@ func encodeBlockHandle(dst []byte, b BlockHandle) int {
 	return n + m
 }
 
+// BlockHandleWithProperties is the value of an entry in an index block: the
+// handle of a data block (or of an index block for the top-level index of a
+// two-level index) followed by the block's encoded block properties. See
+// BlockPropertyCollector.
+type BlockHandleWithProperties struct {
+	BlockHandle
+	Props []byte
+}
+
+// decodeBlockHandleWithProperties decodes the value of an index block entry.
+// The returned properties alias src.
+func decodeBlockHandleWithProperties(src []byte) (BlockHandleWithProperties, error) {
+	bh, n := decodeBlockHandle(src)
+	if n == 0 {
+		return BlockHandleWithProperties{}, errCorruptIndexEntry
+	}
+	return BlockHandleWithProperties{BlockHandle: bh, Props: src[n:]}, nil
+}
+
+// encodeBlockHandleWithProperties appends the encoding of b to dst and
+// returns the result.
+func encodeBlockHandleWithProperties(dst []byte, b BlockHandleWithProperties) []byte {
+	var tmp [2 * binary.MaxVarintLen64]byte
+	n := encodeBlockHandle(tmp[:], b.BlockHandle)
+	dst = append(dst, tmp[:n]...)
+	return append(dst, b.Props...)
+}
+
 // block is a []byte that holds a sequence of key/value pairs plus an index
 // over those pairs.
 type block []byte
@@ -75,6 +101,10 @@ type singleLevelIterator struct {
 	dataBH     BlockHandle
 	err        error
 	closeHook  func(i Iterator) error
+	// bpfs is used to skip the data blocks (and index blocks, for a two-level
+	// index) whose block properties do not intersect the filters. Nil if no
+	// filtering is performed.
+	bpfs *blockPropertiesFilterer
 }
 
 // singleLevelIterator implements the base.InternalIterator interface.
@@ -127,7 +157,9 @@ func checkTwoLevelIterator(obj interface{}) {
 // init initializes a singleLevelIterator for reading from the table. It is
 // synonmous with Reader.NewIter, but allows for reusing of the iterator
 // between different Readers.
-func (i *singleLevelIterator) init(r *Reader, lower, upper []byte) error {
+func (i *singleLevelIterator) init(
+	r *Reader, lower, upper []byte, bpfs *blockPropertiesFilterer,
+) error {
 	if r.err != nil {
 		return r.err
 	}
@@ -138,6 +170,7 @@ func (i *singleLevelIterator) init(r *Reader, lower, upper []byte) error {
 
 	i.lower = lower
 	i.upper = upper
+	i.bpfs = bpfs
 	i.reader = r
 	i.cmp = r.Compare
 	err = i.index.initHandle(i.cmp, indexH, r.Properties.GlobalSeqNum)
@@ -178,35 +211,64 @@ func (i *singleLevelIterator) initBounds() {
 	}
 }
 
+// loadBlockResult is the result of loading a data block or an index block.
+type loadBlockResult int8
+
+const (
+	// loadBlockOK indicates that the block was loaded.
+	loadBlockOK loadBlockResult = iota
+	// loadBlockFailed indicates that the block was not loaded, either because
+	// of an error (recorded in i.err) or because the index is exhausted.
+	loadBlockFailed
+	// loadBlockIrrelevant indicates that the block was not loaded because its
+	// block properties do not intersect the block property filters. The
+	// iterator should skip to the next (or previous) block.
+	loadBlockIrrelevant
+)
+
 // loadBlock loads the block at the current index position and leaves i.data
 // unpositioned. If unsuccessful, it sets i.err to any error encountered, which
 // may be nil if we have simply exhausted the entire table.
-func (i *singleLevelIterator) loadBlock() bool {
+func (i *singleLevelIterator) loadBlock() loadBlockResult {
 	// Ensure the data block iterator is invalidated even if loading of the block
 	// fails.
 	i.data.invalidate()
 	if !i.index.Valid() {
-		return false
+		return loadBlockFailed
 	}
 	// Load the next block.
-	v := i.index.Value()
-	var n int
-	i.dataBH, n = decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
-		i.err = errCorruptIndexEntry
-		return false
+	bhp, err := decodeBlockHandleWithProperties(i.index.Value())
+	i.dataBH = bhp.BlockHandle
+	if err != nil {
+		i.err = err
+		return loadBlockFailed
+	}
+	if i.bpfs != nil {
+		intersects, err := i.bpfs.intersects(bhp.Props)
+		if err != nil {
+			i.err = errCorruptIndexEntry
+			return loadBlockFailed
+		}
+		if !intersects {
+			return loadBlockIrrelevant
+		}
 	}
 	block, err := i.reader.readBlock(i.dataBH, nil /* transform */)
 	if err != nil {
 		i.err = err
-		return false
+		return loadBlockFailed
 	}
 	i.err = i.data.initHandle(i.cmp, block, i.reader.Properties.GlobalSeqNum)
 	if i.err != nil {
-		return false
+		return loadBlockFailed
+	}
+	if !i.reader.dataHashIndex {
+		// The hash index of a block written by RocksDB uses a different hash
+		// function, and the hash index cannot be used with other comparers.
+		i.data.hashIndex = nil
 	}
 	i.initBounds()
-	return true
+	return loadBlockOK
 }
 
 func (i *singleLevelIterator) recordOffset() uint64 {
@@ -240,7 +302,10 @@ func (i *singleLevelIterator) SeekGE(key []byte) (*InternalKey, []byte) {
 		i.data.invalidate()
 		return nil, nil
 	}
-	if !i.loadBlock() {
+	if result := i.loadBlock(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipForward()
+		}
 		return nil, nil
 	}
 	if ikey, val := i.data.SeekGE(key); ikey != nil {
@@ -259,7 +324,7 @@ func (i *singleLevelIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []
 	i.err = nil // clear cached iteration error
 
 	// Check prefix bloom filter.
-	if i.reader.tableFilter != nil {
+	if i.reader.tableFilter != nil && i.reader.prefixFilterUsable() {
 		var dataH cache.Handle
 		dataH, i.err = i.reader.readFilter()
 		if i.err != nil {
@@ -278,7 +343,10 @@ func (i *singleLevelIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []
 		i.data.invalidate()
 		return nil, nil
 	}
-	if !i.loadBlock() {
+	if result := i.loadBlock(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipForward()
+		}
 		return nil, nil
 	}
 	if ikey, val := i.data.SeekGE(key); ikey != nil {
@@ -299,7 +367,10 @@ func (i *singleLevelIterator) SeekLT(key []byte) (*InternalKey, []byte) {
 	if ikey, _ := i.index.SeekGE(key); ikey == nil {
 		i.index.Last()
 	}
-	if !i.loadBlock() {
+	if result := i.loadBlock(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipBackward()
+		}
 		return nil, nil
 	}
 	if ikey, val := i.data.SeekLT(key); ikey != nil {
@@ -333,7 +404,10 @@ func (i *singleLevelIterator) First() (*InternalKey, []byte) {
 		i.data.invalidate()
 		return nil, nil
 	}
-	if !i.loadBlock() {
+	if result := i.loadBlock(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipForward()
+		}
 		return nil, nil
 	}
 	if ikey, val := i.data.First(); ikey != nil {
@@ -356,7 +430,10 @@ func (i *singleLevelIterator) Last() (*InternalKey, []byte) {
 		i.data.invalidate()
 		return nil, nil
 	}
-	if !i.loadBlock() {
+	if result := i.loadBlock(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipBackward()
+		}
 		return nil, nil
 	}
 	if ikey, val := i.data.Last(); ikey != nil {
@@ -402,17 +479,24 @@ func (i *singleLevelIterator) Prev() (*InternalKey, []byte) {
 
 func (i *singleLevelIterator) skipForward() (*InternalKey, []byte) {
 	for {
-		if key, _ := i.index.Next(); key == nil {
+		indexKey, _ := i.index.Next()
+		if indexKey == nil {
 			i.data.invalidate()
 			break
 		}
-		if i.loadBlock() {
+		result := i.loadBlock()
+		if result == loadBlockOK {
 			if key, val := i.data.First(); key != nil {
 				if i.blockUpper != nil && i.cmp(key.UserKey, i.blockUpper) >= 0 {
 					return nil, nil
 				}
 				return key, val
 			}
+		} else if result == loadBlockIrrelevant && i.upper != nil &&
+			i.cmp(indexKey.UserKey, i.upper) >= 0 {
+			// The keys in the following blocks are all greater than the index key
+			// of the skipped block, and thus beyond the upper bound.
+			break
 		}
 	}
 	return nil, nil
@@ -424,7 +508,7 @@ func (i *singleLevelIterator) skipBackward() (*InternalKey, []byte) {
 			i.data.invalidate()
 			break
 		}
-		if i.loadBlock() {
+		if i.loadBlock() == loadBlockOK {
 			key, val := i.data.Last()
 			if key == nil {
 				return nil, nil
@@ -551,7 +635,7 @@ func (i *compactionIterator) skipForward(key *InternalKey, val []byte) (*Interna
 			if key, _ := i.index.Next(); key == nil {
 				break
 			}
-			if i.loadBlock() {
+			if i.loadBlock() == loadBlockOK {
 				if key, val = i.data.First(); key != nil {
 					break
 				}
@@ -565,6 +649,66 @@ func (i *compactionIterator) skipForward(key *InternalKey, val []byte) (*Interna
 	return key, val
 }
 
+// emptyIterator is an Iterator over no keys. It is returned for a table whose
+// block properties do not intersect the block property filters.
+type emptyIterator struct {
+	closeHook func(i Iterator) error
+}
+
+// emptyIterator implements the base.InternalIterator interface.
+var _ base.InternalIterator = (*emptyIterator)(nil)
+
+func (i *emptyIterator) SeekGE(key []byte) (*InternalKey, []byte) {
+	return nil, nil
+}
+
+func (i *emptyIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
+	return nil, nil
+}
+
+func (i *emptyIterator) SeekLT(key []byte) (*InternalKey, []byte) {
+	return nil, nil
+}
+
+func (i *emptyIterator) First() (*InternalKey, []byte) {
+	return nil, nil
+}
+
+func (i *emptyIterator) Last() (*InternalKey, []byte) {
+	return nil, nil
+}
+
+func (i *emptyIterator) Next() (*InternalKey, []byte) {
+	return nil, nil
+}
+
+func (i *emptyIterator) Prev() (*InternalKey, []byte) {
+	return nil, nil
+}
+
+func (i *emptyIterator) Error() error {
+	return nil
+}
+
+func (i *emptyIterator) Close() error {
+	var err error
+	if i.closeHook != nil {
+		err = i.closeHook(i)
+		i.closeHook = nil
+	}
+	return err
+}
+
+func (i *emptyIterator) SetBounds(lower, upper []byte) {}
+
+func (i *emptyIterator) SetCloseHook(fn func(i Iterator) error) {
+	i.closeHook = fn
+}
+
+func (i *emptyIterator) String() string {
+	return "empty"
+}
+
 type twoLevelIterator struct {
 	singleLevelIterator
 	topLevelIndex blockIter
@@ -577,27 +721,45 @@ var _ base.InternalIterator = (*twoLevelIterator)(nil)
 // leaves i.index unpositioned. If unsuccessful, it gets i.err to any error
 // encountered, which may be nil if we have simply exhausted the entire table.
 // This is used for two level indexes.
-func (i *twoLevelIterator) loadIndex() bool {
+func (i *twoLevelIterator) loadIndex() loadBlockResult {
+	// Ensure the data block iterator is invalidated even if loading of the
+	// index block fails.
+	i.data.invalidate()
 	if !i.topLevelIndex.Valid() {
 		i.index.offset = 0
 		i.index.restarts = 0
-		return false
+		return loadBlockFailed
 	}
-	h, n := decodeBlockHandle(i.topLevelIndex.Value())
-	if n == 0 || n != len(i.topLevelIndex.Value()) {
+	bhp, err := decodeBlockHandleWithProperties(i.topLevelIndex.Value())
+	if err != nil {
 		i.err = errors.New("pebble/table: corrupt top level index entry")
-		return false
+		return loadBlockFailed
+	}
+	if i.bpfs != nil {
+		intersects, err := i.bpfs.intersects(bhp.Props)
+		if err != nil {
+			i.err = errors.New("pebble/table: corrupt top level index entry")
+			return loadBlockFailed
+		}
+		if !intersects {
+			return loadBlockIrrelevant
+		}
 	}
-	indexBlock, err := i.reader.readBlock(h, nil /* transform */)
+	indexBlock, err := i.reader.readBlock(bhp.BlockHandle, nil /* transform */)
 	if err != nil {
 		i.err = err
-		return false
+		return loadBlockFailed
 	}
 	i.err = i.index.initHandle(i.cmp, indexBlock, i.reader.Properties.GlobalSeqNum)
-	return i.err == nil
+	if i.err != nil {
+		return loadBlockFailed
+	}
+	return loadBlockOK
 }
 
-func (i *twoLevelIterator) init(r *Reader, lower, upper []byte) error {
+func (i *twoLevelIterator) init(
+	r *Reader, lower, upper []byte, bpfs *blockPropertiesFilterer,
+) error {
 	if r.err != nil {
 		return r.err
 	}
@@ -608,6 +770,7 @@ func (i *twoLevelIterator) init(r *Reader, lower, upper []byte) error {
 
 	i.lower = lower
 	i.upper = upper
+	i.bpfs = bpfs
 	i.reader = r
 	i.cmp = r.Compare
 	err = i.topLevelIndex.initHandle(i.cmp, topLevelIndexH, r.Properties.GlobalSeqNum)
@@ -633,7 +796,10 @@ func (i *twoLevelIterator) SeekGE(key []byte) (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if !i.loadIndex() {
+	if result := i.loadIndex(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipForward()
+		}
 		return nil, nil
 	}
 
@@ -653,7 +819,10 @@ func (i *twoLevelIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byt
 		return nil, nil
 	}
 
-	if !i.loadIndex() {
+	if result := i.loadIndex(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipForward()
+		}
 		return nil, nil
 	}
 
@@ -674,14 +843,23 @@ func (i *twoLevelIterator) SeekLT(key []byte) (*InternalKey, []byte) {
 			return nil, nil
 		}
 
-		if !i.loadIndex() {
+		if result := i.loadIndex(); result != loadBlockOK {
+			if result == loadBlockIrrelevant {
+				return i.skipBackward()
+			}
 			return nil, nil
 		}
 
-		return i.singleLevelIterator.Last()
+		if ikey, val := i.singleLevelIterator.Last(); ikey != nil {
+			return ikey, val
+		}
+		return i.skipBackward()
 	}
 
-	if !i.loadIndex() {
+	if result := i.loadIndex(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipBackward()
+		}
 		return nil, nil
 	}
 
@@ -702,7 +880,10 @@ func (i *twoLevelIterator) First() (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if !i.loadIndex() {
+	if result := i.loadIndex(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipForward()
+		}
 		return nil, nil
 	}
 
@@ -723,7 +904,10 @@ func (i *twoLevelIterator) Last() (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if !i.loadIndex() {
+	if result := i.loadIndex(); result != loadBlockOK {
+		if result == loadBlockIrrelevant {
+			return i.skipBackward()
+		}
 		return nil, nil
 	}
 
@@ -766,12 +950,22 @@ func (i *twoLevelIterator) skipForward() (*InternalKey, []byte) {
 			// which implies the previous positioning call reached the upper bound.
 			return nil, nil
 		}
-		if ikey, _ := i.topLevelIndex.Next(); ikey == nil {
+		topKey, _ := i.topLevelIndex.Next()
+		if topKey == nil {
 			return nil, nil
 		}
-		if !i.loadIndex() {
+		result := i.loadIndex()
+		if result == loadBlockFailed {
 			return nil, nil
 		}
+		if result == loadBlockIrrelevant {
+			if i.upper != nil && i.cmp(topKey.UserKey, i.upper) >= 0 {
+				// The keys in the following index blocks are all beyond the upper
+				// bound.
+				return nil, nil
+			}
+			continue
+		}
 		if ikey, val := i.singleLevelIterator.First(); ikey != nil {
 			return ikey, val
 		}
@@ -788,9 +982,13 @@ func (i *twoLevelIterator) skipBackward() (*InternalKey, []byte) {
 		if ikey, _ := i.topLevelIndex.Prev(); ikey == nil {
 			return nil, nil
 		}
-		if !i.loadIndex() {
+		result := i.loadIndex()
+		if result == loadBlockFailed {
 			return nil, nil
 		}
+		if result == loadBlockIrrelevant {
+			continue
+		}
 		if ikey, val := i.singleLevelIterator.Last(); ikey != nil {
 			return ikey, val
 		}
@@ -877,7 +1075,7 @@ func (i *twoLevelCompactionIterator) skipForward(
 			if key, _ := i.topLevelIndex.Next(); key == nil {
 				break
 			}
-			if i.loadIndex() {
+			if i.loadIndex() == loadBlockOK {
 				if key, val = i.singleLevelIterator.First(); key != nil {
 					break
 				}
@@ -1022,14 +1220,18 @@ type Reader struct {
 	filter            weakCachedBlock
 	rangeDel          weakCachedBlock
 	rangeDelTransform blockTransform
+	rangeKey          weakCachedBlock
 	propertiesBH      BlockHandle
 	metaIndexBH       BlockHandle
 	footerBH          BlockHandle
+	dataHashIndex     bool
+	checksumType      ChecksumType
 	opts              ReaderOptions
 	Compare           Compare
 	split             Split
 	mergerOK          bool
 	tableFilter       *tableFilterReader
+	prefixFilter      bool
 	Properties        Properties
 }
 
@@ -1038,6 +1240,7 @@ func (r *Reader) Close() error {
 	r.index.release()
 	r.filter.release()
 	r.rangeDel.release()
+	r.rangeKey.release()
 	r.opts.Cache.Unref()
 
 	if r.err != nil {
@@ -1072,7 +1275,7 @@ func (r *Reader) get(key []byte) (value []byte, err error) {
 			return nil, err
 		}
 		var lookupKey []byte
-		if r.split != nil {
+		if r.prefixFilter {
 			lookupKey = key[:r.split(key)]
 		} else {
 			lookupKey = key
@@ -1111,12 +1314,41 @@ func (r *Reader) get(key []byte) (value []byte, err error) {
 // NewIter returns an iterator for the contents of the table. If an error
 // occurs, NewIter cleans up after itself and returns a nil iterator.
 func (r *Reader) NewIter(lower, upper []byte) (Iterator, error) {
+	return r.NewIterWithBlockPropertyFilters(lower, upper, nil /* filters */)
+}
+
+// NewIterWithBlockPropertyFilters returns an iterator for the contents of the
+// table, skipping the data blocks whose block properties do not intersect the
+// filters. An empty iterator is returned if the table-level properties do not
+// intersect the filters. The filters whose block property collector was not
+// used when writing the table are ignored. If an error occurs,
+// NewIterWithBlockPropertyFilters cleans up after itself and returns a nil
+// iterator.
+func (r *Reader) NewIterWithBlockPropertyFilters(
+	lower, upper []byte, filters []BlockPropertyFilter,
+) (Iterator, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	var bpfs *blockPropertiesFilterer
+	if len(filters) > 0 {
+		var intersects bool
+		var err error
+		bpfs, intersects, err = newBlockPropertiesFilterer(filters, r.Properties.UserProperties)
+		if err != nil {
+			return nil, err
+		}
+		if !intersects {
+			return &emptyIterator{}, nil
+		}
+	}
+
 	// NB: pebble.tableCache wraps the returned iterator with one which performs
 	// reference counting on the Reader, preventing the Reader from being closed
 	// until the final iterator closes.
 	if r.Properties.IndexType == twoLevelIndex {
 		i := twoLevelIterPool.Get().(*twoLevelIterator)
-		err := i.init(r, lower, upper)
+		err := i.init(r, lower, upper, bpfs)
 		if err != nil {
 			return nil, err
 		}
@@ -1124,7 +1356,7 @@ func (r *Reader) NewIter(lower, upper []byte) (Iterator, error) {
 	}
 
 	i := singleLevelIterPool.Get().(*singleLevelIterator)
-	err := i.init(r, lower, upper)
+	err := i.init(r, lower, upper, bpfs)
 	if err != nil {
 		return nil, err
 	}
@@ -1137,7 +1369,7 @@ func (r *Reader) NewIter(lower, upper []byte) (Iterator, error) {
 func (r *Reader) NewCompactionIter(bytesIterated *uint64) (Iterator, error) {
 	if r.Properties.IndexType == twoLevelIndex {
 		i := twoLevelIterPool.Get().(*twoLevelIterator)
-		err := i.init(r, nil /* lower */, nil /* upper */)
+		err := i.init(r, nil /* lower */, nil /* upper */, nil /* bpfs */)
 		if err != nil {
 			return nil, err
 		}
@@ -1147,7 +1379,7 @@ func (r *Reader) NewCompactionIter(bytesIterated *uint64) (Iterator, error) {
 		}, nil
 	}
 	i := singleLevelIterPool.Get().(*singleLevelIterator)
-	err := i.init(r, nil /* lower */, nil /* upper */)
+	err := i.init(r, nil /* lower */, nil /* upper */, nil /* bpfs */)
 	if err != nil {
 		return nil, err
 	}
@@ -1175,6 +1407,25 @@ func (r *Reader) NewRangeDelIter() (base.InternalIterator, error) {
 	return i, nil
 }
 
+// NewRangeKeyIter returns an internal iterator for the contents of the
+// range-key block for the table. Returns nil if the table does not contain any
+// range keys. The range keys in the block are fragmented and their values are
+// encoded with rangekey.EncodeValue.
+func (r *Reader) NewRangeKeyIter() (base.InternalIterator, error) {
+	if r.rangeKey.bh.Length == 0 {
+		return nil, nil
+	}
+	h, err := r.readWeakCachedBlock(&r.rangeKey, nil /* transform */)
+	if err != nil {
+		return nil, err
+	}
+	i := &blockIter{}
+	if err := i.initHandle(r.Compare, h, r.Properties.GlobalSeqNum); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
 func (r *Reader) readIndex() (cache.Handle, error) {
 	return r.readWeakCachedBlock(&r.index, nil /* transform */)
 }
@@ -1222,7 +1473,7 @@ func (r *Reader) readBlock(bh BlockHandle, transform blockTransform) (cache.Hand
 	}
 
 	checksum0 := binary.LittleEndian.Uint32(b[bh.Length+1:])
-	checksum1 := crc.New(b[:bh.Length+1]).Value()
+	checksum1 := computeChecksum(r.checksumType, b[:bh.Length], b[bh.Length])
 	if checksum0 != checksum1 {
 		r.opts.Cache.Free(v)
 		return cache.Handle{}, errors.New("pebble/table: invalid table (checksum mismatch)")
@@ -1232,33 +1483,26 @@ func (r *Reader) readBlock(bh BlockHandle, transform blockTransform) (cache.Hand
 	b = b[:bh.Length]
 	v.Truncate(len(b))
 
-	switch typ {
-	case noCompressionBlockType:
-		break
-	case snappyCompressionBlockType:
-		decodedLen, err := snappy.DecodedLen(b)
+	if typ != noCompressionBlockType {
+		codec := lookupCodec(typ)
+		if codec == nil || codec.compressor == nil {
+			r.opts.Cache.Free(v)
+			return cache.Handle{}, errors.Errorf(
+				"pebble/table: block compressed with unregistered compression %d", errors.Safe(typ))
+		}
+		decodedLen, err := codec.compressor.DecodedLen(b)
 		if err != nil {
 			r.opts.Cache.Free(v)
 			return cache.Handle{}, err
 		}
 		decoded := r.opts.Cache.Alloc(decodedLen)
-		decodedBuf := decoded.Buf()
-		result, err := snappy.Decode(decodedBuf, b)
+		err = codec.compressor.Decode(decoded.Buf(), b)
 		r.opts.Cache.Free(v)
 		if err != nil {
 			r.opts.Cache.Free(decoded)
 			return cache.Handle{}, err
 		}
-		if len(result) != 0 &&
-			(len(result) != len(decodedBuf) || &result[0] != &decodedBuf[0]) {
-			r.opts.Cache.Free(decoded)
-			return cache.Handle{}, errors.Errorf("pebble/table: snappy decoded into unexpected buffer: %p != %p",
-				errors.Safe(result), errors.Safe(decodedBuf))
-		}
-		v, b = decoded, decodedBuf
-	default:
-		r.opts.Cache.Free(v)
-		return cache.Handle{}, errors.Errorf("pebble/table: unknown block compression: %d", errors.Safe(typ))
+		v, b = decoded, decoded.Buf()
 	}
 
 	if transform != nil {
@@ -1374,6 +1618,10 @@ func (r *Reader) readMetaindex(metaindexBH BlockHandle) error {
 		}
 	}
 
+	if bh, ok := meta[metaRangeKeyName]; ok {
+		r.rangeKey.bh = bh
+	}
+
 	for name, fp := range r.opts.Filters {
 		types := []struct {
 			ftype  FilterType
@@ -1414,9 +1662,11 @@ func (r *Reader) Layout() (*Layout, error) {
 		Data:       make([]BlockHandle, 0, r.Properties.NumDataBlocks),
 		Filter:     r.filter.bh,
 		RangeDel:   r.rangeDel.bh,
+		RangeKey:   r.rangeKey.bh,
 		Properties: r.propertiesBH,
 		MetaIndex:  r.metaIndexBH,
 		Footer:     r.footerBH,
+		Checksum:   r.checksumType,
 	}
 
 	indexH, err := r.readIndex()
@@ -1429,33 +1679,33 @@ func (r *Reader) Layout() (*Layout, error) {
 		l.Index = append(l.Index, r.index.bh)
 		iter, _ := newBlockIter(r.Compare, indexH.Get())
 		for key, value := iter.First(); key != nil; key, value = iter.Next() {
-			dataBH, n := decodeBlockHandle(value)
-			if n == 0 || n != len(value) {
+			dataBH, err := decodeBlockHandleWithProperties(value)
+			if err != nil {
 				return nil, errCorruptIndexEntry
 			}
-			l.Data = append(l.Data, dataBH)
+			l.Data = append(l.Data, dataBH.BlockHandle)
 		}
 	} else {
 		l.TopIndex = r.index.bh
 		topIter, _ := newBlockIter(r.Compare, indexH.Get())
 		for key, value := topIter.First(); key != nil; key, value = topIter.Next() {
-			indexBH, n := decodeBlockHandle(value)
-			if n == 0 || n != len(value) {
+			indexBH, err := decodeBlockHandleWithProperties(value)
+			if err != nil {
 				return nil, errCorruptIndexEntry
 			}
-			l.Index = append(l.Index, indexBH)
+			l.Index = append(l.Index, indexBH.BlockHandle)
 
-			subIndex, err := r.readBlock(indexBH, nil /* transform */)
+			subIndex, err := r.readBlock(indexBH.BlockHandle, nil /* transform */)
 			if err != nil {
 				return nil, err
 			}
 			iter, _ := newBlockIter(r.Compare, subIndex.Get())
 			for key, value := iter.First(); key != nil; key, value = iter.Next() {
-				dataBH, n := decodeBlockHandle(value)
-				if n == 0 || n != len(value) {
+				dataBH, err := decodeBlockHandleWithProperties(value)
+				if err != nil {
 					return nil, errCorruptIndexEntry
 				}
-				l.Data = append(l.Data, dataBH)
+				l.Data = append(l.Data, dataBH.BlockHandle)
 			}
 			subIndex.Release()
 		}
@@ -1464,6 +1714,35 @@ func (r *Reader) Layout() (*Layout, error) {
 	return l, nil
 }
 
+// BlockCompressions returns the number of the data and index blocks of the
+// sstable which are compressed by each codec, keyed by the name of the codec.
+// Blocks which were left uncompressed are counted under NoCompression, and
+// blocks compressed by a codec which is not registered are counted under
+// Unknown(<id>).
+func (r *Reader) BlockCompressions() (map[string]int, error) {
+	l, err := r.Layout()
+	if err != nil {
+		return nil, err
+	}
+	handles := append(append([]BlockHandle(nil), l.Data...), l.Index...)
+	if l.TopIndex.Length != 0 {
+		handles = append(handles, l.TopIndex)
+	}
+	counts := make(map[string]int)
+	var typ [1]byte
+	for _, bh := range handles {
+		if _, err := r.file.ReadAt(typ[:], int64(bh.Offset+bh.Length)); err != nil {
+			return nil, err
+		}
+		if codec := lookupCodec(typ[0]); codec != nil {
+			counts[codec.name]++
+		} else {
+			counts[fmt.Sprintf("Unknown(%d)", typ[0])]++
+		}
+	}
+	return counts, nil
+}
+
 // EstimateDiskUsage returns the total size of data blocks overlapping the range
 // `[start, end]`. Even if a data block partially overlaps, or we cannot determine
 // overlap due to abbreviated index keys, the full data block size is included in
@@ -1507,11 +1786,11 @@ func (r *Reader) EstimateDiskUsage(start, end []byte) (uint64, error) {
 			// The range falls completely after this file, or an error occurred.
 			return 0, topIter.Error()
 		}
-		startIdxBH, n := decodeBlockHandle(val)
-		if n == 0 || n != len(val) {
+		startIdxBH, err := decodeBlockHandleWithProperties(val)
+		if err != nil {
 			return 0, errCorruptIndexEntry
 		}
-		startIdxBlock, err := r.readBlock(startIdxBH, nil /* transform */)
+		startIdxBlock, err := r.readBlock(startIdxBH.BlockHandle, nil /* transform */)
 		if err != nil {
 			return 0, err
 		}
@@ -1526,11 +1805,11 @@ func (r *Reader) EstimateDiskUsage(start, end []byte) (uint64, error) {
 				return 0, err
 			}
 		} else {
-			endIdxBH, n := decodeBlockHandle(val)
-			if n == 0 || n != len(val) {
+			endIdxBH, err := decodeBlockHandleWithProperties(val)
+			if err != nil {
 				return 0, errCorruptIndexEntry
 			}
-			endIdxBlock, err := r.readBlock(endIdxBH, nil /* transform */)
+			endIdxBlock, err := r.readBlock(endIdxBH.BlockHandle, nil /* transform */)
 			if err != nil {
 				return 0, err
 			}
@@ -1548,8 +1827,8 @@ func (r *Reader) EstimateDiskUsage(start, end []byte) (uint64, error) {
 		// The range falls completely after this file, or an error occurred.
 		return 0, startIdxIter.Error()
 	}
-	startBH, n := decodeBlockHandle(val)
-	if n == 0 || n != len(val) {
+	startBH, err := decodeBlockHandleWithProperties(val)
+	if err != nil {
 		return 0, errCorruptIndexEntry
 	}
 
@@ -1565,8 +1844,8 @@ func (r *Reader) EstimateDiskUsage(start, end []byte) (uint64, error) {
 		// The range spans beyond this file. Include data blocks through the last.
 		return r.Properties.DataSize - startBH.Offset, nil
 	}
-	endBH, n := decodeBlockHandle(val)
-	if n == 0 || n != len(val) {
+	endBH, err := decodeBlockHandleWithProperties(val)
+	if err != nil {
 		return 0, errCorruptIndexEntry
 	}
 	return endBH.Offset + endBH.Length + blockTrailerLen - startBH.Offset, nil
@@ -1609,12 +1888,14 @@ func NewReader(f vfs.File, o ReaderOptions, extraOpts ...ReaderOption) (*Reader,
 		r.err = err
 		return nil, r.Close()
 	}
+	r.checksumType, _ = checksumTypeForFooter(footer.checksum)
 	// Read the metaindex.
 	if err := r.readMetaindex(footer.metaindexBH); err != nil {
 		r.err = err
 		return nil, r.Close()
 	}
 	r.index.bh = footer.indexBH
+	r.dataHashIndex = supportsDataBlockHashIndex(footer.format, r.Properties.ComparerName)
 	r.metaIndexBH = footer.metaindexBH
 	r.footerBH = footer.footerBH
 
@@ -1635,6 +1916,8 @@ func NewReader(f vfs.File, o ReaderOptions, extraOpts ...ReaderOption) (*Reader,
 		}
 	}
 
+	r.initFilterMode(o.Comparer)
+
 	if r.Compare == nil {
 		r.err = errors.Errorf("pebble/table: %d: unknown comparer %s",
 			errors.Safe(r.fileNum), errors.Safe(r.Properties.ComparerName))
@@ -1651,6 +1934,34 @@ func NewReader(f vfs.File, o ReaderOptions, extraOpts ...ReaderOption) (*Reader,
 	return r, nil
 }
 
+// initFilterMode sets prefixFilter if the table properties record that the
+// table filter contains the prefixes of the keys rather than the whole keys. A filter of
+// prefixes is only usable if the keys are split the same way they were when
+// the table was written: looking up keys split any other way would produce
+// false negatives, so the filter is ignored instead.
+func (r *Reader) initFilterMode(comparer *Comparer) {
+	if r.tableFilter == nil || !r.Properties.PrefixFiltering {
+		return
+	}
+	splitName := r.Properties.ComparerName
+	if splitName == "" {
+		splitName = comparer.Name
+	}
+	if r.split != nil && r.Properties.PrefixExtractorName == splitName {
+		r.prefixFilter = true
+	} else {
+		r.tableFilter = nil
+	}
+}
+
+// prefixFilterUsable returns true if the table filter can be consulted for
+// the prefix passed to SeekPrefixGE. A filter of whole keys can only be
+// consulted if there is no split function, as the prefix is then the whole
+// key.
+func (r *Reader) prefixFilterUsable() bool {
+	return r.prefixFilter || r.split == nil
+}
+
 // Layout describes the block organization of an sstable.
 type Layout struct {
 	Data       []BlockHandle
@@ -1658,9 +1969,12 @@ type Layout struct {
 	TopIndex   BlockHandle
 	Filter     BlockHandle
 	RangeDel   BlockHandle
+	RangeKey   BlockHandle
 	Properties BlockHandle
 	MetaIndex  BlockHandle
 	Footer     BlockHandle
+	// Checksum is the checksum type of the blocks, as recorded in the footer.
+	Checksum ChecksumType
 }
 
 // Describe returns a description of the layout. If the verbose parameter is
@@ -1689,6 +2003,9 @@ func (l *Layout) Describe(
 	if l.RangeDel.Length != 0 {
 		blocks = append(blocks, block{l.RangeDel, "range-del"})
 	}
+	if l.RangeKey.Length != 0 {
+		blocks = append(blocks, block{l.RangeKey, "range-key"})
+	}
 	if l.Properties.Length != 0 {
 		blocks = append(blocks, block{l.Properties, "properties"})
 	}
@@ -1709,7 +2026,11 @@ func (l *Layout) Describe(
 
 	for i := range blocks {
 		b := &blocks[i]
-		fmt.Fprintf(w, "%10d  %s (%d)\n", b.Offset, b.name, b.Length)
+		if b.name == "footer" || b.name == "leveldb-footer" {
+			fmt.Fprintf(w, "%10d  %s (%d) checksum=%s\n", b.Offset, b.name, b.Length, l.Checksum)
+		} else {
+			fmt.Fprintf(w, "%10d  %s (%d)\n", b.Offset, b.name, b.Length)
+		}
 
 		if !verbose {
 			continue
@@ -1749,7 +2070,7 @@ func (l *Layout) Describe(
 
 		var lastKey InternalKey
 		switch b.name {
-		case "data", "range-del":
+		case "data", "range-del", "range-key":
 			iter, _ := newBlockIter(r.Compare, h.Get())
 			for key, value := iter.First(); key != nil; key, value = iter.Next() {
 				ptr := unsafe.Pointer(uintptr(iter.ptr) + uintptr(iter.offset))
@@ -1784,16 +2105,23 @@ func (l *Layout) Describe(
 				lastKey.UserKey = append(lastKey.UserKey[:0], key.UserKey...)
 			}
 			formatRestarts(iter.data, iter.restarts, iter.numRestarts)
+			if iter.hashIndex != nil {
+				fmt.Fprintf(w, "%10d    [hash index %d buckets]\n",
+					b.Offset+uint64(iter.restarts+4*iter.numRestarts), len(iter.hashIndex))
+			}
 		case "index", "top-index":
 			iter, _ := newBlockIter(r.Compare, h.Get())
 			for key, value := iter.First(); key != nil; key, value = iter.Next() {
-				bh, n := decodeBlockHandle(value)
-				if n == 0 || n != len(value) {
+				bh, err := decodeBlockHandleWithProperties(value)
+				if err != nil {
 					fmt.Fprintf(w, "%10d    [err: %s]\n", b.Offset+uint64(iter.offset), err)
 					continue
 				}
 				fmt.Fprintf(w, "%10d    block:%d/%d",
 					b.Offset+uint64(iter.offset), bh.Offset, bh.Length)
+				if len(bh.Props) > 0 {
+					fmt.Fprintf(w, " props:%x", bh.Props)
+				}
 				formatIsRestart(iter.data, iter.restarts, iter.numRestarts, iter.offset)
 			}
 			formatRestarts(iter.data, iter.restarts, iter.numRestarts)
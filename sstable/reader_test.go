@@ -385,6 +385,201 @@ func checkValidPrefix(prefix, key []byte) bool {
 	return prefix == nil || bytes.HasPrefix(key, prefix)
 }
 
+func TestReaderDataBlockHashIndex(t *testing.T) {
+	for _, format := range []TableFormat{TableFormatRocksDBv2, TableFormatPebblev1} {
+		t.Run(format.String(), func(t *testing.T) {
+			mem := vfs.NewMem()
+			f, err := mem.Create("test")
+			require.NoError(t, err)
+			w := NewWriter(f, WriterOptions{BlockSize: 1000, TableFormat: format})
+			for i := 0; i < 1000; i++ {
+				// Keys have several versions, which may span blocks.
+				key := []byte(fmt.Sprintf("%05d", 2*i))
+				for seqNum := uint64(i%3 + 1); seqNum > 0; seqNum-- {
+					value := []byte(fmt.Sprintf("%s@%d", key, seqNum))
+					require.NoError(t, w.Add(base.MakeInternalKey(key, seqNum, InternalKeyKindSet), value))
+				}
+			}
+			require.NoError(t, w.Close())
+
+			f, err = mem.Open("test")
+			require.NoError(t, err)
+			r, err := NewReader(f, ReaderOptions{})
+			require.NoError(t, err)
+			defer r.Close()
+			l, err := r.Layout()
+			require.NoError(t, err)
+			require.True(t, len(l.Data) > 1)
+			var buf bytes.Buffer
+			l.Describe(&buf, true /* verbose */, r, nil)
+			require.Equal(t, format == TableFormatPebblev1, strings.Contains(buf.String(), "[hash index"))
+
+			for i := -1; i <= 2000; i++ {
+				key := []byte(fmt.Sprintf("%05d", i))
+				value, err := r.get(key)
+				if i < 0 || i%2 == 1 || i >= 2000 {
+					require.Equal(t, base.ErrNotFound, err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("%s@%d", key, (i/2)%3+1), string(value))
+			}
+
+			// The hash index of the data blocks is only used by the format which
+			// writes it.
+			iter, err := r.NewIter(nil /* lower */, nil /* upper */)
+			require.NoError(t, err)
+			key, _ := iter.SeekGE([]byte("01000"))
+			require.Equal(t, "01000", string(key.UserKey))
+			data := &iter.(*singleLevelIterator).data
+			require.Equal(t, format == TableFormatPebblev1, data.hashIndex != nil)
+			require.NoError(t, iter.Close())
+		})
+	}
+}
+
+func TestReaderDataBlockHashIndexComparer(t *testing.T) {
+	// A case-insensitive comparer, for which keys which compare as equal are
+	// not bytewise equal.
+	comparer := *base.DefaultComparer
+	comparer.Name = "test.case-insensitive"
+	comparer.Compare = func(a, b []byte) int {
+		return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+	}
+	comparer.Equal = func(a, b []byte) bool {
+		return bytes.EqualFold(a, b)
+	}
+
+	mem := vfs.NewMem()
+	f, err := mem.Create("test")
+	require.NoError(t, err)
+	w := NewWriter(f, WriterOptions{
+		BlockSize:   1000,
+		Comparer:    &comparer,
+		TableFormat: TableFormatPebblev1,
+	})
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		require.NoError(t, w.Set(key, key))
+	}
+	require.NoError(t, w.Close())
+
+	f, err = mem.Open("test")
+	require.NoError(t, err)
+	r, err := NewReader(f, ReaderOptions{Comparer: &comparer})
+	require.NoError(t, err)
+	defer r.Close()
+
+	// The data blocks have no hash index, as it cannot find keys which are
+	// equal but not bytewise equal.
+	l, err := r.Layout()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	l.Describe(&buf, true /* verbose */, r, nil)
+	require.NotContains(t, buf.String(), "[hash index")
+	for i := 0; i < 1000; i++ {
+		value, err := r.get([]byte(fmt.Sprintf("K%04d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("k%04d", i), string(value))
+	}
+}
+
+func TestReaderPrefixFilter(t *testing.T) {
+	// The prefix of a key is the portion before the '@' separating the version.
+	split := func(a []byte) int {
+		if i := bytes.IndexByte(a, '@'); i >= 0 {
+			return i
+		}
+		return len(a)
+	}
+	splitComparer := *base.DefaultComparer
+	splitComparer.Split = split
+	fp := bloom.FilterPolicy(10)
+
+	build := func(t *testing.T, comparer *Comparer) vfs.File {
+		mem := vfs.NewMem()
+		f, err := mem.Create("test")
+		require.NoError(t, err)
+		w := NewWriter(f, WriterOptions{Comparer: comparer, FilterPolicy: fp})
+		for i := 0; i < 100; i += 2 {
+			for v := 1; v <= 3; v++ {
+				key := []byte(fmt.Sprintf("%03d@%d", i, v))
+				require.NoError(t, w.Set(key, key))
+			}
+		}
+		require.NoError(t, w.Close())
+		f, err = mem.Open("test")
+		require.NoError(t, err)
+		return f
+	}
+	open := func(t *testing.T, f vfs.File, comparer *Comparer) (*Reader, *FilterMetrics) {
+		m := &FilterMetrics{}
+		r, err := NewReader(f, ReaderOptions{
+			Comparer: comparer,
+			Filters:  map[string]FilterPolicy{fp.Name(): fp},
+		}, m)
+		require.NoError(t, err)
+		return r, m
+	}
+	seekPrefix := func(t *testing.T, r *Reader, prefix string) bool {
+		iter, err := r.NewIter(nil /* lower */, nil /* upper */)
+		require.NoError(t, err)
+		defer iter.Close()
+		key, _ := iter.SeekPrefixGE([]byte(prefix), []byte(prefix))
+		return key != nil && strings.HasPrefix(string(key.UserKey), prefix+"@")
+	}
+
+	t.Run("prefix", func(t *testing.T) {
+		r, m := open(t, build(t, &splitComparer), &splitComparer)
+		defer r.Close()
+		require.True(t, r.Properties.PrefixFiltering)
+		require.False(t, r.Properties.WholeKeyFiltering)
+		require.Equal(t, splitComparer.Name, r.Properties.PrefixExtractorName)
+
+		// Every version of a key passes the filter, as it contains the prefix.
+		_, err := r.get([]byte("010@9"))
+		require.Equal(t, base.ErrNotFound, err)
+		require.Equal(t, FilterMetrics{Misses: 1}, *m)
+		require.True(t, seekPrefix(t, r, "010"))
+		require.Equal(t, int64(2), m.Misses)
+
+		// Most of the absent prefixes are ruled out by the filter.
+		for i := 1; i < 100; i += 2 {
+			require.False(t, seekPrefix(t, r, fmt.Sprintf("%03d", i)))
+		}
+		require.True(t, m.Hits > 40, "%d", m.Hits)
+	})
+
+	t.Run("prefix-without-split", func(t *testing.T) {
+		// A filter of prefixes is not consulted by a reader which cannot split
+		// keys, as the whole keys it would look up are not in the filter.
+		r, m := open(t, build(t, &splitComparer), base.DefaultComparer)
+		defer r.Close()
+		require.True(t, r.Properties.PrefixFiltering)
+		value, err := r.get([]byte("010@2"))
+		require.NoError(t, err)
+		require.Equal(t, "010@2", string(value))
+		require.Equal(t, FilterMetrics{}, *m)
+	})
+
+	t.Run("whole-key", func(t *testing.T) {
+		// A filter of whole keys is consulted by a reader which can split keys
+		// for gets, but not when seeking to a prefix.
+		r, m := open(t, build(t, base.DefaultComparer), &splitComparer)
+		defer r.Close()
+		require.False(t, r.Properties.PrefixFiltering)
+		require.True(t, r.Properties.WholeKeyFiltering)
+		_, err := r.get([]byte("010@9"))
+		require.Equal(t, base.ErrNotFound, err)
+		value, err := r.get([]byte("010@2"))
+		require.NoError(t, err)
+		require.Equal(t, "010@2", string(value))
+		require.Equal(t, FilterMetrics{Hits: 1, Misses: 1}, *m)
+		require.True(t, seekPrefix(t, r, "010"))
+		require.Equal(t, FilterMetrics{Hits: 1, Misses: 1}, *m)
+	})
+}
+
 func TestBytesIteratedCompressed(t *testing.T) {
 	blockSizes := []int{10, 100, 1000, 4096, math.MaxInt32}
 	for _, blockSize := range blockSizes {
@@ -483,7 +678,9 @@ func buildTestTable(
 	return r
 }
 
-func buildBenchmarkTable(b *testing.B, blockSize, restartInterval int) (*Reader, [][]byte) {
+func buildBenchmarkTable(
+	b *testing.B, blockSize, restartInterval int, tableFormat TableFormat,
+) (*Reader, [][]byte) {
 	mem := vfs.NewMem()
 	f0, err := mem.Create("bench")
 	if err != nil {
@@ -494,6 +691,7 @@ func buildBenchmarkTable(b *testing.B, blockSize, restartInterval int) (*Reader,
 		BlockRestartInterval: restartInterval,
 		BlockSize:            blockSize,
 		FilterPolicy:         nil,
+		TableFormat:          tableFormat,
 	})
 
 	var keys [][]byte
@@ -530,20 +728,23 @@ func BenchmarkTableIterSeekGE(b *testing.B) {
 	const blockSize = 32 << 10
 
 	for _, restartInterval := range []int{16} {
-		b.Run(fmt.Sprintf("restart=%d", restartInterval),
-			func(b *testing.B) {
-				r, keys := buildBenchmarkTable(b, blockSize, restartInterval)
-				it, err := r.NewIter(nil /* lower */, nil /* upper */)
-				require.NoError(b, err)
-				rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
-
-				b.ResetTimer()
-				for i := 0; i < b.N; i++ {
-					it.SeekGE(keys[rng.Intn(len(keys))])
-				}
+		for _, format := range []TableFormat{TableFormatRocksDBv2, TableFormatPebblev1} {
+			b.Run(fmt.Sprintf("restart=%d/format=%s", restartInterval, format),
+				func(b *testing.B) {
+					r, keys := buildBenchmarkTable(b, blockSize, restartInterval, format)
+					it, err := r.NewIter(nil /* lower */, nil /* upper */)
+					require.NoError(b, err)
+					rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						it.SeekGE(keys[rng.Intn(len(keys))])
+					}
 
-				it.Close()
-			})
+					it.Close()
+					r.Close()
+				})
+		}
 	}
 }
 
@@ -553,7 +754,7 @@ func BenchmarkTableIterSeekLT(b *testing.B) {
 	for _, restartInterval := range []int{16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
-				r, keys := buildBenchmarkTable(b, blockSize, restartInterval)
+				r, keys := buildBenchmarkTable(b, blockSize, restartInterval, TableFormatRocksDBv2)
 				it, err := r.NewIter(nil /* lower */, nil /* upper */)
 				require.NoError(b, err)
 				rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
@@ -574,7 +775,7 @@ func BenchmarkTableIterNext(b *testing.B) {
 	for _, restartInterval := range []int{16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
-				r, _ := buildBenchmarkTable(b, blockSize, restartInterval)
+				r, _ := buildBenchmarkTable(b, blockSize, restartInterval, TableFormatRocksDBv2)
 				it, err := r.NewIter(nil /* lower */, nil /* upper */)
 				require.NoError(b, err)
 
@@ -603,7 +804,7 @@ func BenchmarkTableIterPrev(b *testing.B) {
 	for _, restartInterval := range []int{16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
-				r, _ := buildBenchmarkTable(b, blockSize, restartInterval)
+				r, _ := buildBenchmarkTable(b, blockSize, restartInterval, TableFormatRocksDBv2)
 				it, err := r.NewIter(nil /* lower */, nil /* upper */)
 				require.NoError(b, err)
 
@@ -65,6 +65,7 @@ import (
 	"io"
 
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/vfs"
 )
 
@@ -88,7 +89,9 @@ The table file format looks like:
 Each block consists of some data and a 5 byte trailer: a 1 byte block type and
 a 4 byte checksum of the compressed data. The block type gives the per-block
 compression used; each block is compressed independently. The checksum
-algorithm is described in the pebble/crc package.
+covers the compressed data and the block type. Its algorithm is given by the
+checksum type in the footer: either CRC32c, described in the pebble/crc
+package, or the lower 32 bits of XXH64.
 
 The decompressed block data consists of a sequence of key/value entries
 followed by a trailer. Each key is encoded as a shared prefix length and a
@@ -109,6 +112,13 @@ uint32 values are the block offsets of each restart point. The final uint32
 value is P itself. Thus, when seeking for a particular key, one can use binary
 search to find the largest restart point whose key is <= the key sought.
 
+In the Pebblev1 table format, the restart points of a data block may be
+followed by a hash index, which maps the hash of each user key in the block to
+the restart point at which the key is found. The hash index is flagged by the
+high bit of the final uint32 value. A point lookup consults the hash index
+before falling back to the binary search. The hash index is only written for
+tables using the default bytewise comparer.
+
 An index block is a block with N key/value entries. The i'th value is the
 encoded block handle of the i'th data block. The i'th key is a separator for
 i < N-1, and a successor for i == N-1. The separator between blocks i and i+1
@@ -136,27 +146,35 @@ const (
 
 	rocksDBExternalFormatVersion = 2
 
+	// The Pebble footer has the same layout as the RocksDB footer, with a
+	// different magic number.
+	pebbleDBMagic = "\xf0\x9f\xaa\xb3\xf0\x9f\xa6\x94"
+
 	minFooterLen = levelDBFooterLen
 	maxFooterLen = rocksDBFooterLen
 
 	levelDBFormatVersion  = 0
 	rocksDBFormatVersion2 = 2
+	pebbleFormatVersion1  = 1
 
-	noChecksum     = 0
-	checksumCRC32c = 1
-	checksumXXHash = 2
+	noChecksum       = 0
+	checksumCRC32c   = 1
+	checksumXXHash   = 2
+	checksumXXHash64 = 3
 
 	// The block type gives the per-block compression format.
 	// These constants are part of the file format and should not be changed.
 	// They are different from the Compression constants because the latter
 	// are designed so that the zero value of the Compression type means to
-	// use the default compression (which is snappy).
+	// use the default compression (which is snappy). The block types of other
+	// codecs are the ids given to RegisterCompression.
 	noCompressionBlockType     byte = 0
 	snappyCompressionBlockType byte = 1
 
 	metaPropertiesName = "rocksdb.properties"
 	metaRangeDelName   = "rocksdb.range_del"
 	metaRangeDelV2Name = "rocksdb.range_del2"
+	metaRangeKeyName   = "pebble.range_key"
 
 	// Index Types.
 	// A space efficient index block that is optimized for binary-search-based
@@ -186,6 +204,9 @@ const (
 //    <padding> to make the total size 2 * BlockHandle::kMaxEncodedLength + 1
 //    footer version (4 bytes)
 //    table_magic_number (8 bytes)
+//
+// The Pebble footer format is the same as the RocksDB footer format, with a
+// Pebble-specific table_magic_number.
 type footer struct {
 	format      TableFormat
 	checksum    uint8
@@ -226,7 +247,7 @@ func readFooter(f vfs.File) (footer, error) {
 		footer.format = TableFormatLevelDB
 		footer.checksum = checksumCRC32c
 
-	case rocksDBMagic:
+	case rocksDBMagic, pebbleDBMagic:
 		if len(buf) < rocksDBFooterLen {
 			return footer, errors.Errorf("pebble/table: invalid table (footer too short): %d", errors.Safe(len(buf)))
 		}
@@ -234,12 +255,19 @@ func readFooter(f vfs.File) (footer, error) {
 		buf = buf[len(buf)-rocksDBFooterLen:]
 		footer.footerBH.Length = uint64(len(buf))
 		version := binary.LittleEndian.Uint32(buf[rocksDBVersionOffset:rocksDBMagicOffset])
-		if version != rocksDBFormatVersion2 {
-			return footer, errors.Errorf("pebble/table: unsupported format version %d", errors.Safe(version))
+		if string(buf[rocksDBMagicOffset:]) == pebbleDBMagic {
+			if version != pebbleFormatVersion1 {
+				return footer, errors.Errorf("pebble/table: unsupported format version %d", errors.Safe(version))
+			}
+			footer.format = TableFormatPebblev1
+		} else {
+			if version != rocksDBFormatVersion2 {
+				return footer, errors.Errorf("pebble/table: unsupported format version %d", errors.Safe(version))
+			}
+			footer.format = TableFormatRocksDBv2
 		}
-		footer.format = TableFormatRocksDBv2
 		footer.checksum = uint8(buf[0])
-		if footer.checksum != checksumCRC32c {
+		if _, ok := checksumTypeForFooter(footer.checksum); !ok {
 			return footer, errors.Errorf("pebble/table: unsupported checksum type %d", errors.Safe(footer.checksum))
 		}
 		buf = buf[1:]
@@ -276,7 +304,7 @@ func (f footer) encode(buf []byte) []byte {
 		n += encodeBlockHandle(buf[n:], f.indexBH)
 		copy(buf[len(buf)-len(levelDBMagic):], levelDBMagic)
 
-	case TableFormatRocksDBv2:
+	case TableFormatRocksDBv2, TableFormatPebblev1:
 		buf = buf[:rocksDBFooterLen]
 		for i := range buf {
 			buf[i] = 0
@@ -285,18 +313,31 @@ func (f footer) encode(buf []byte) []byte {
 		n := 1
 		n += encodeBlockHandle(buf[n:], f.metaindexBH)
 		n += encodeBlockHandle(buf[n:], f.indexBH)
-		binary.LittleEndian.PutUint32(buf[rocksDBVersionOffset:], rocksDBFormatVersion2)
-		copy(buf[len(buf)-len(rocksDBMagic):], rocksDBMagic)
+		if f.format == TableFormatPebblev1 {
+			binary.LittleEndian.PutUint32(buf[rocksDBVersionOffset:], pebbleFormatVersion1)
+			copy(buf[len(buf)-len(pebbleDBMagic):], pebbleDBMagic)
+		} else {
+			binary.LittleEndian.PutUint32(buf[rocksDBVersionOffset:], rocksDBFormatVersion2)
+			copy(buf[len(buf)-len(rocksDBMagic):], rocksDBMagic)
+		}
 	}
 
 	return buf
 }
 
+// supportsDataBlockHashIndex returns true if the data blocks of a table of the
+// given format and comparer have a hash index. A lookup in the hash index
+// relies on keys which compare as equal being bytewise equal, so the hash index
+// is restricted to tables using the default bytewise comparer.
+func supportsDataBlockHashIndex(format TableFormat, comparerName string) bool {
+	return format == TableFormatPebblev1 && comparerName == base.DefaultComparer.Name
+}
+
 func supportsTwoLevelIndex(format TableFormat) bool {
 	switch format {
 	case TableFormatLevelDB:
 		return false
-	case TableFormatRocksDBv2:
+	case TableFormatRocksDBv2, TableFormatPebblev1:
 		return true
 	}
 	return true
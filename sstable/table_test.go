@@ -346,6 +346,7 @@ func build(
 	propCollector func() TablePropertyCollector,
 	blockSize int,
 	indexBlockSize int,
+	tableFormat TableFormat,
 ) (vfs.File, error) {
 	// Create a sorted list of wordCount's keys.
 	keys := make([]string, len(wordCount))
@@ -372,6 +373,7 @@ func build(
 		FilterType:     ftype,
 		IndexBlockSize: indexBlockSize,
 		MergerName:     "nullptr",
+		TableFormat:    tableFormat,
 	}
 	if propCollector != nil {
 		writerOpts.TablePropertyCollectors = append(writerOpts.TablePropertyCollectors, propCollector)
@@ -588,14 +590,16 @@ func TestWriterRoundTrip(t *testing.T) {
 				"none":       nil,
 				"bloom10bit": bloom.FilterPolicy(10),
 			} {
-				t.Run(fmt.Sprintf("bloom=%s", name), func(t *testing.T) {
-					f, err := build(DefaultCompression, fp, TableFilter,
-						nil, nil, blockSize, indexBlockSize)
-					require.NoError(t, err)
-
-					// Check that we can read a freshly made table.
-					require.NoError(t, check(f, nil, nil))
-				})
+				for _, format := range []TableFormat{TableFormatRocksDBv2, TableFormatPebblev1} {
+					t.Run(fmt.Sprintf("bloom=%s,format=%s", name, format), func(t *testing.T) {
+						f, err := build(DefaultCompression, fp, TableFilter,
+							nil, nil, blockSize, indexBlockSize, format)
+						require.NoError(t, err)
+
+						// Check that we can read a freshly made table.
+						require.NoError(t, check(f, nil, nil))
+					})
+				}
 			}
 		}
 	}
@@ -690,7 +694,7 @@ func TestReaderGlobalSeqNum(t *testing.T) {
 
 func TestMetaIndexEntriesSorted(t *testing.T) {
 	f, err := build(DefaultCompression, nil, /* filter policy */
-		TableFilter, nil, nil, 4096, 4096)
+		TableFilter, nil, nil, 4096, 4096, TableFormatRocksDBv2)
 	require.NoError(t, err)
 
 	r, err := NewReader(f, ReaderOptions{})
@@ -720,9 +724,14 @@ func TestFooterRoundTrip(t *testing.T) {
 	for _, format := range []TableFormat{
 		TableFormatRocksDBv2,
 		TableFormatLevelDB,
+		TableFormatPebblev1,
 	} {
 		t.Run(fmt.Sprintf("format=%d", format), func(t *testing.T) {
-			for _, checksum := range []uint8{checksumCRC32c} {
+			checksums := []uint8{checksumCRC32c, checksumXXHash64}
+			if format == TableFormatLevelDB {
+				checksums = checksums[:1]
+			}
+			for _, checksum := range checksums {
 				t.Run(fmt.Sprintf("checksum=%d", checksum), func(t *testing.T) {
 					footer := footer{
 						format:      format,
@@ -786,6 +795,7 @@ func TestReadFooter(t *testing.T) {
 		{encode(TableFormatRocksDBv2, 0)[1:], "footer too short"},
 		{encode(TableFormatRocksDBv2, noChecksum), "unsupported checksum type"},
 		{encode(TableFormatRocksDBv2, checksumXXHash), "unsupported checksum type"},
+		{encode(TableFormatPebblev1, noChecksum), "unsupported checksum type"},
 	}
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
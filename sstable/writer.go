@@ -15,21 +15,25 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/cache"
-	"github.com/cockroachdb/pebble/internal/crc"
 	"github.com/cockroachdb/pebble/internal/private"
 	"github.com/cockroachdb/pebble/internal/rangedel"
-	"github.com/golang/snappy"
+	"github.com/cockroachdb/pebble/internal/rangekey"
 )
 
 // WriterMetadata holds info about a finished sstable.
 type WriterMetadata struct {
-	Size           uint64
-	SmallestPoint  InternalKey
-	SmallestRange  InternalKey
-	LargestPoint   InternalKey
-	LargestRange   InternalKey
-	SmallestSeqNum uint64
-	LargestSeqNum  uint64
+	Size          uint64
+	SmallestPoint InternalKey
+	SmallestRange InternalKey
+	LargestPoint  InternalKey
+	LargestRange  InternalKey
+	// SmallestRangeKey and LargestRangeKey are the bounds of the range keys in
+	// the table. LargestRangeKey is a range deletion sentinel key because the
+	// end key of a range key is exclusive.
+	SmallestRangeKey InternalKey
+	LargestRangeKey  InternalKey
+	SmallestSeqNum   uint64
+	LargestSeqNum    uint64
 }
 
 func (m *WriterMetadata) updateSeqNum(seqNum uint64) {
@@ -41,32 +45,42 @@ func (m *WriterMetadata) updateSeqNum(seqNum uint64) {
 	}
 }
 
-// Smallest returns the smaller of SmallestPoint and SmallestRange.
+// Smallest returns the smallest of SmallestPoint, SmallestRange and
+// SmallestRangeKey.
 func (m *WriterMetadata) Smallest(cmp Compare) InternalKey {
-	if m.SmallestPoint.UserKey == nil {
-		return m.SmallestRange
+	return smallestKey(cmp, smallestKey(cmp, m.SmallestPoint, m.SmallestRange), m.SmallestRangeKey)
+}
+
+// Largest returns the largest of LargestPoint, LargestRange and
+// LargestRangeKey.
+func (m *WriterMetadata) Largest(cmp Compare) InternalKey {
+	return largestKey(cmp, largestKey(cmp, m.LargestPoint, m.LargestRange), m.LargestRangeKey)
+}
+
+func smallestKey(cmp Compare, a, b InternalKey) InternalKey {
+	if a.UserKey == nil {
+		return b
 	}
-	if m.SmallestRange.UserKey == nil {
-		return m.SmallestPoint
+	if b.UserKey == nil {
+		return a
 	}
-	if base.InternalCompare(cmp, m.SmallestPoint, m.SmallestRange) < 0 {
-		return m.SmallestPoint
+	if base.InternalCompare(cmp, a, b) < 0 {
+		return a
 	}
-	return m.SmallestRange
+	return b
 }
 
-// Largest returns the larget of LargestPoint and LargestRange.
-func (m *WriterMetadata) Largest(cmp Compare) InternalKey {
-	if m.LargestPoint.UserKey == nil {
-		return m.LargestRange
+func largestKey(cmp Compare, a, b InternalKey) InternalKey {
+	if a.UserKey == nil {
+		return b
 	}
-	if m.LargestRange.UserKey == nil {
-		return m.LargestPoint
+	if b.UserKey == nil {
+		return a
 	}
-	if base.InternalCompare(cmp, m.LargestPoint, m.LargestRange) > 0 {
-		return m.LargestPoint
+	if base.InternalCompare(cmp, a, b) > 0 {
+		return a
 	}
-	return m.LargestRange
+	return b
 }
 
 type flusher interface {
@@ -99,6 +113,7 @@ type Writer struct {
 	split                   Split
 	formatter               base.Formatter
 	compression             Compression
+	checksumType            ChecksumType
 	separator               Separator
 	successor               Successor
 	tableFormat             TableFormat
@@ -130,9 +145,28 @@ type Writer struct {
 	block            blockWriter
 	indexBlock       blockWriter
 	rangeDelBlock    blockWriter
+	rangeKeyBlock    blockWriter
 	props            Properties
 	propCollectors   []TablePropertyCollector
-	// compressedBuf is the destination buffer for snappy compression. It is
+	// blockPropCollectors compute the block properties of the data blocks,
+	// index blocks and the table. See BlockPropertyCollector.
+	blockPropCollectors []BlockPropertyCollector
+	blockPropsEncoder   blockPropertiesEncoder
+	// dataBlockProps holds the encoded block properties of the most recently
+	// finished data block.
+	dataBlockProps []byte
+	// indexValueBuf is a scratch buffer for encoding index entry values.
+	indexValueBuf []byte
+	// compressionStats accumulates the compression statistics of the blocks
+	// written with the table's compression. They are saved in the properties
+	// if saveCompressionStats is true. See WriterOptions.CompressionStats.
+	compressionStats     compressionStats
+	saveCompressionStats bool
+	// adaptiveCompression and compressionDisabled implement adaptive
+	// compression. See WriterOptions.AdaptiveCompression.
+	adaptiveCompression bool
+	compressionDisabled bool
+	// compressedBuf is the destination buffer for block compression. It is
 	// re-used over the lifetime of the writer, avoiding the allocation of a
 	// temporary buffer for each block.
 	compressedBuf []byte
@@ -145,7 +179,13 @@ type Writer struct {
 	tmp [rocksDBFooterLen]byte
 
 	topLevelIndexBlock blockWriter
-	indexPartitions    []blockWriter
+	indexPartitions    []indexBlockAndBlockProperties
+}
+
+type indexBlockAndBlockProperties struct {
+	block blockWriter
+	// properties are the encoded block properties of the index block.
+	properties []byte
 }
 
 // Set sets the value for the given key. The sequence number is set to
@@ -198,19 +238,60 @@ func (w *Writer) Merge(key, value []byte) error {
 	return w.addPoint(base.MakeInternalKey(key, 0, InternalKeyKindMerge), value)
 }
 
+// RangeKeySet sets the range key with the specified suffix to value over the
+// span [start,end). The sequence number is set to 0. Intended for use to
+// externally construct an sstable before ingestion into a DB. Range keys must
+// be added ordered by their start key and must not overlap.
+func (w *Writer) RangeKeySet(start, end, suffix, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.addRangeKey(base.MakeInternalKey(start, 0, InternalKeyKindRangeKeySet),
+		rangekey.EncodeValue(nil, end, suffix, value))
+}
+
+// RangeKeyUnset removes the range key with the specified suffix over the span
+// [start,end). The sequence number is set to 0. Intended for use to externally
+// construct an sstable before ingestion into a DB. Range keys must be added
+// ordered by their start key and must not overlap.
+func (w *Writer) RangeKeyUnset(start, end, suffix []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.addRangeKey(base.MakeInternalKey(start, 0, InternalKeyKindRangeKeyUnset),
+		rangekey.EncodeValue(nil, end, suffix, nil))
+}
+
+// RangeKeyDelete removes all of the range keys over the span [start,end). The
+// sequence number is set to 0. Intended for use to externally construct an
+// sstable before ingestion into a DB. Range keys must be added ordered by
+// their start key and must not overlap.
+func (w *Writer) RangeKeyDelete(start, end []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.addRangeKey(base.MakeInternalKey(start, 0, InternalKeyKindRangeKeyDelete),
+		rangekey.EncodeValue(nil, end, nil, nil))
+}
+
 // Add adds a key/value pair to the table being written. For a given Writer,
 // the keys passed to Add must be in increasing order. The exception to this
 // rule is range deletion tombstones. Range deletion tombstones need to be
 // added ordered by their start key, but they can be added out of order from
 // point entries. Additionally, range deletion tombstones must be fragmented
-// (i.e. by rangedel.Fragmenter).
+// (i.e. by rangedel.Fragmenter). The same rules apply to range keys, whose
+// values must be encoded with rangekey.EncodeValue and which must be
+// fragmented by rangekey.Fragment.
 func (w *Writer) Add(key InternalKey, value []byte) error {
 	if w.err != nil {
 		return w.err
 	}
 
-	if key.Kind() == InternalKeyKindRangeDelete {
+	switch key.Kind() {
+	case InternalKeyKindRangeDelete:
 		return w.addTombstone(key, value)
+	case InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset, InternalKeyKindRangeKeyDelete:
+		return w.addRangeKey(key, value)
 	}
 	return w.addPoint(key, value)
 }
@@ -237,6 +318,12 @@ func (w *Writer) addPoint(key InternalKey, value []byte) error {
 			return err
 		}
 	}
+	for i := range w.blockPropCollectors {
+		if err := w.blockPropCollectors[i].Add(key, value); err != nil {
+			w.err = err
+			return err
+		}
+	}
 
 	w.maybeAddToFilter(key.UserKey)
 	w.block.add(key, value)
@@ -324,6 +411,66 @@ func (w *Writer) addTombstone(key InternalKey, value []byte) error {
 	return nil
 }
 
+func (w *Writer) addRangeKey(key InternalKey, value []byte) error {
+	span, ok := rangekey.Decode(key, value)
+	if !ok {
+		w.err = errors.Errorf("pebble: invalid range key value: %s", key.Pretty(w.formatter))
+		return w.err
+	}
+	if w.compare(span.Start.UserKey, span.End) >= 0 {
+		w.err = errors.Errorf("pebble: empty range key: %s", span.Pretty(w.formatter))
+		return w.err
+	}
+	if !w.disableKeyOrderChecks && w.rangeKeyBlock.nEntries > 0 {
+		// Check that range keys are being added in fragmented order. If the two
+		// range keys overlap, their start and end keys must be identical.
+		prevKey := base.DecodeInternalKey(w.rangeKeyBlock.curKey)
+		prev, _ := rangekey.Decode(prevKey, w.rangeKeyBlock.curValue)
+		switch c := w.compare(prevKey.UserKey, key.UserKey); {
+		case c > 0:
+			w.err = errors.Errorf("pebble: keys must be added in order: %s, %s",
+				prevKey.Pretty(w.formatter), key.Pretty(w.formatter))
+			return w.err
+		case c == 0:
+			if w.compare(prev.End, span.End) != 0 {
+				w.err = errors.Errorf("pebble: overlapping range keys must be fragmented: %s vs %s",
+					prev.Pretty(w.formatter), span.Pretty(w.formatter))
+				return w.err
+			}
+			if prevKey.Trailer <= key.Trailer {
+				w.err = errors.Errorf("pebble: keys must be added in order: %s, %s",
+					prevKey.Pretty(w.formatter), key.Pretty(w.formatter))
+				return w.err
+			}
+		default:
+			if w.compare(prev.End, key.UserKey) > 0 {
+				w.err = errors.Errorf("pebble: overlapping range keys must be fragmented: %s vs %s",
+					prev.Pretty(w.formatter), span.Pretty(w.formatter))
+				return w.err
+			}
+		}
+	}
+
+	for i := range w.propCollectors {
+		if err := w.propCollectors[i].Add(key, value); err != nil {
+			return err
+		}
+	}
+
+	w.meta.updateSeqNum(key.SeqNum())
+	if w.props.NumRangeKeys == 0 {
+		w.meta.SmallestRangeKey = key.Clone()
+	}
+	// Because the range keys are fragmented, the end key of the last added
+	// range key is the largest range key bound.
+	w.meta.LargestRangeKey = base.MakeRangeDeleteSentinelKey(span.End).Clone()
+	w.props.NumRangeKeys++
+	w.props.RawKeySize += uint64(key.Size())
+	w.props.RawValueSize += uint64(len(value))
+	w.rangeKeyBlock.add(key, value)
+	return nil
+}
+
 func (w *Writer) maybeAddToFilter(key []byte) {
 	if w.filter != nil {
 		if w.split != nil {
@@ -340,21 +487,48 @@ func (w *Writer) maybeFlush(key InternalKey, value []byte) error {
 		return nil
 	}
 
+	if err := w.finishDataBlockProps(); err != nil {
+		w.err = err
+		return w.err
+	}
 	bh, err := w.writeBlock(w.block.finish(), w.compression)
 	if err != nil {
 		w.err = err
 		return w.err
 	}
-	w.addIndexEntry(key, bh)
+	if err := w.addIndexEntry(key, bh); err != nil {
+		w.err = err
+		return w.err
+	}
+	return nil
+}
+
+// finishDataBlockProps computes the encoded block properties of the current
+// data block, storing them in w.dataBlockProps.
+func (w *Writer) finishDataBlockProps() error {
+	if len(w.blockPropCollectors) == 0 {
+		return nil
+	}
+	var scratch []byte
+	w.blockPropsEncoder.reset()
+	for i := range w.blockPropCollectors {
+		var err error
+		scratch, err = w.blockPropCollectors[i].FinishDataBlock(scratch[:0])
+		if err != nil {
+			return err
+		}
+		w.blockPropsEncoder.add(uint8(i), scratch)
+	}
+	w.dataBlockProps = append(w.dataBlockProps[:0], w.blockPropsEncoder.buf...)
 	return nil
 }
 
 // addIndexEntry adds an index entry for the specified key and block handle.
-func (w *Writer) addIndexEntry(key InternalKey, bh BlockHandle) {
+func (w *Writer) addIndexEntry(key InternalKey, bh BlockHandle) error {
 	if bh.Length == 0 {
 		// A valid blockHandle must be non-zero.
 		// In particular, it must have a non-zero length.
-		return
+		return nil
 	}
 	prevKey := base.DecodeInternalKey(w.block.curKey)
 	var sep InternalKey
@@ -363,16 +537,23 @@ func (w *Writer) addIndexEntry(key InternalKey, bh BlockHandle) {
 	} else {
 		sep = prevKey.Separator(w.compare, w.separator, nil, key)
 	}
-	n := encodeBlockHandle(w.tmp[:], bh)
+	w.indexValueBuf = encodeBlockHandleWithProperties(w.indexValueBuf[:0],
+		BlockHandleWithProperties{BlockHandle: bh, Props: w.dataBlockProps})
 
 	if supportsTwoLevelIndex(w.tableFormat) &&
-		shouldFlush(sep, w.tmp[:n], &w.indexBlock, w.indexBlockSize, w.indexBlockSizeThreshold) {
+		shouldFlush(sep, w.indexValueBuf, &w.indexBlock, w.indexBlockSize, w.indexBlockSizeThreshold) {
 		// Enable two level indexes if there is more than one index block.
 		w.twoLevelIndex = true
-		w.finishIndexBlock()
+		if err := w.finishIndexBlock(); err != nil {
+			return err
+		}
 	}
 
-	w.indexBlock.add(sep, w.tmp[:n])
+	for i := range w.blockPropCollectors {
+		w.blockPropCollectors[i].AddPrevDataBlockToIndexBlock()
+	}
+	w.indexBlock.add(sep, w.indexValueBuf)
+	return nil
 }
 
 func shouldFlush(
@@ -407,19 +588,39 @@ func shouldFlush(
 
 // finishIndexBlock finishes the current index block and adds it to the top
 // level index block. This is only used when two level indexes are enabled.
-func (w *Writer) finishIndexBlock() {
-	w.indexPartitions = append(w.indexPartitions, w.indexBlock)
+func (w *Writer) finishIndexBlock() error {
+	var props []byte
+	if len(w.blockPropCollectors) > 0 {
+		var scratch []byte
+		w.blockPropsEncoder.reset()
+		for i := range w.blockPropCollectors {
+			var err error
+			scratch, err = w.blockPropCollectors[i].FinishIndexBlock(scratch[:0])
+			if err != nil {
+				return err
+			}
+			w.blockPropsEncoder.add(uint8(i), scratch)
+		}
+		props = append(props, w.blockPropsEncoder.buf...)
+	}
+	w.indexPartitions = append(w.indexPartitions, indexBlockAndBlockProperties{
+		block:      w.indexBlock,
+		properties: props,
+	})
 	w.indexBlock = blockWriter{
 		restartInterval: 1,
 	}
+	return nil
 }
 
 func (w *Writer) writeTwoLevelIndex() (BlockHandle, error) {
 	// Add the final unfinished index.
-	w.finishIndexBlock()
+	if err := w.finishIndexBlock(); err != nil {
+		return BlockHandle{}, err
+	}
 
 	for i := range w.indexPartitions {
-		b := &w.indexPartitions[i]
+		b := &w.indexPartitions[i].block
 		w.props.NumDataBlocks += uint64(b.nEntries)
 		sep := base.DecodeInternalKey(b.curKey)
 		data := b.finish()
@@ -428,8 +629,9 @@ func (w *Writer) writeTwoLevelIndex() (BlockHandle, error) {
 		if err != nil {
 			return BlockHandle{}, err
 		}
-		n := encodeBlockHandle(w.tmp[:], bh)
-		w.topLevelIndexBlock.add(sep, w.tmp[:n])
+		w.indexValueBuf = encodeBlockHandleWithProperties(w.indexValueBuf[:0],
+			BlockHandleWithProperties{BlockHandle: bh, Props: w.indexPartitions[i].properties})
+		w.topLevelIndexBlock.add(sep, w.indexValueBuf)
 	}
 
 	// NB: RocksDB includes the block trailer length in the index size
@@ -444,20 +646,24 @@ func (w *Writer) writeTwoLevelIndex() (BlockHandle, error) {
 
 func (w *Writer) writeBlock(b []byte, compression Compression) (BlockHandle, error) {
 	blockType := noCompressionBlockType
-	if compression == SnappyCompression {
-		// Compress the buffer, discarding the result if the improvement isn't at
-		// least 12.5%.
-		compressed := snappy.Encode(w.compressedBuf, b)
-		w.compressedBuf = compressed[:cap(compressed)]
-		if len(compressed) < len(b)-len(b)/8 {
-			blockType = snappyCompressionBlockType
-			b = compressed
+	if codec := compression.codec(); codec != nil && codec.compressor != nil {
+		size := len(b)
+		if !w.compressionDisabled {
+			// Compress the buffer, discarding the result if the improvement isn't
+			// at least 12.5%.
+			compressed := codec.compressor.Encode(w.compressedBuf, b)
+			w.compressedBuf = compressed[:cap(compressed)]
+			if !poorCompression(uint64(len(b)), uint64(len(compressed))) {
+				blockType = compression.blockType()
+				b = compressed
+			}
 		}
+		w.recordCompression(size, len(b), blockType != noCompressionBlockType)
 	}
 	w.tmp[0] = blockType
 
 	// Calculate the checksum.
-	checksum := crc.New(b).Update(w.tmp[:1]).Value()
+	checksum := computeChecksum(w.checksumType, b, blockType)
 	binary.LittleEndian.PutUint32(w.tmp[1:5], checksum)
 	bh := BlockHandle{w.meta.Size, uint64(len(b))}
 
@@ -485,6 +691,26 @@ func (w *Writer) writeBlock(b []byte, compression Compression) (BlockHandle, err
 	return bh, nil
 }
 
+// recordCompression records the compression of a block of the given size,
+// which was stored in storedSize bytes. If adaptive compression is enabled,
+// compression is disabled for the rest of the table if the first
+// adaptiveCompressionSampleBlocks blocks compressed poorly as a whole.
+func (w *Writer) recordCompression(size, storedSize int, compressed bool) {
+	s := &w.compressionStats
+	if compressed {
+		s.compressedBlocks++
+	} else {
+		s.uncompressedBlocks++
+	}
+	s.inputSize += uint64(size)
+	s.outputSize += uint64(storedSize)
+	if w.adaptiveCompression && !w.compressionDisabled &&
+		s.compressedBlocks+s.uncompressedBlocks == adaptiveCompressionSampleBlocks &&
+		poorCompression(s.inputSize, s.outputSize) {
+		w.compressionDisabled = true
+	}
+}
+
 // Close finishes writing the table and closes the underlying file that the
 // table was written to.
 func (w *Writer) Close() (err error) {
@@ -505,12 +731,19 @@ func (w *Writer) Close() (err error) {
 	// Finish the last data block, or force an empty data block if there
 	// aren't any data blocks at all.
 	if w.block.nEntries > 0 || w.indexBlock.nEntries == 0 {
+		if err := w.finishDataBlockProps(); err != nil {
+			w.err = err
+			return w.err
+		}
 		bh, err := w.writeBlock(w.block.finish(), w.compression)
 		if err != nil {
 			w.err = err
 			return w.err
 		}
-		w.addIndexEntry(InternalKey{}, bh)
+		if err := w.addIndexEntry(InternalKey{}, bh); err != nil {
+			w.err = err
+			return w.err
+		}
 	}
 	w.props.DataSize = w.meta.Size
 
@@ -579,6 +812,19 @@ func (w *Writer) Close() (err error) {
 		}
 	}
 
+	// Write the range-key block. The block handle is added to the meta index
+	// block before the properties block handle as "pebble.range_key" sorts
+	// before "rocksdb.properties".
+	if w.props.NumRangeKeys > 0 {
+		bh, err := w.writeBlock(w.rangeKeyBlock.finish(), NoCompression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		metaindex.add(InternalKey{UserKey: []byte(metaRangeKeyName)}, w.tmp[:n])
+	}
+
 	{
 		userProps := make(map[string]string)
 		for i := range w.propCollectors {
@@ -586,6 +832,18 @@ func (w *Writer) Close() (err error) {
 				return err
 			}
 		}
+		// The table-level block properties are stored in the user properties,
+		// prefixed by the collector's short ID.
+		var scratch []byte
+		for i := range w.blockPropCollectors {
+			scratch = append(scratch[:0], uint8(i))
+			scratch, err = w.blockPropCollectors[i].FinishTable(scratch)
+			if err != nil {
+				w.err = err
+				return w.err
+			}
+			userProps[w.blockPropCollectors[i].Name()] = string(scratch)
+		}
 		if len(userProps) > 0 {
 			w.props.UserProperties = userProps
 		}
@@ -597,6 +855,12 @@ func (w *Writer) Close() (err error) {
 		// reduces table size without a significant impact on performance.
 		raw.restartInterval = propertiesBlockRestartInterval
 		w.props.CompressionOptions = rocksDBCompressionOptions
+		if w.saveCompressionStats {
+			w.props.NumCompressedBlocks = w.compressionStats.compressedBlocks
+			w.props.NumUncompressedBlocks = w.compressionStats.uncompressedBlocks
+			w.props.CompressionInputSize = w.compressionStats.inputSize
+			w.props.CompressionOutputSize = w.compressionStats.outputSize
+		}
 		w.props.save(&raw)
 		bh, err := w.writeBlock(raw.finish(), NoCompression)
 		if err != nil {
@@ -634,7 +898,7 @@ func (w *Writer) Close() (err error) {
 	// Write the table footer.
 	footer := footer{
 		format:      w.tableFormat,
-		checksum:    checksumCRC32c,
+		checksum:    w.checksumType.footerType(),
 		metaindexBH: metaindexBH,
 		indexBH:     indexBH,
 	}
@@ -714,12 +978,16 @@ func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *
 		split:                   o.Comparer.Split,
 		formatter:               o.Comparer.Format,
 		compression:             o.Compression,
+		checksumType:            o.Checksum,
+		saveCompressionStats:    o.CompressionStats || o.AdaptiveCompression,
+		adaptiveCompression:     o.AdaptiveCompression,
 		separator:               o.Comparer.Separator,
 		successor:               o.Comparer.Successor,
 		tableFormat:             o.TableFormat,
 		cache:                   o.Cache,
 		block: blockWriter{
 			restartInterval: o.BlockRestartInterval,
+			hashIndex:       supportsDataBlockHashIndex(o.TableFormat, o.Comparer.Name),
 		},
 		indexBlock: blockWriter{
 			restartInterval: 1,
@@ -727,6 +995,9 @@ func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *
 		rangeDelBlock: blockWriter{
 			restartInterval: 1,
 		},
+		rangeKeyBlock: blockWriter{
+			restartInterval: 1,
+		},
 		topLevelIndexBlock: blockWriter{
 			restartInterval: 1,
 		},
@@ -735,6 +1006,10 @@ func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *
 		w.err = errors.New("pebble: nil file")
 		return w
 	}
+	if w.tableFormat == TableFormatLevelDB {
+		// The LevelDB footer has no checksum type.
+		w.checksumType = CRC32cChecksum
+	}
 
 	// Note that WriterOptions are applied in two places; the ones with a
 	// preApply() method are applied here, and the rest are applied after
@@ -784,6 +1059,17 @@ func NewWriter(f writeCloseSyncer, o WriterOptions, extraOpts ...WriterOption) *
 		w.props.PropertyCollectorNames = buf.String()
 	}
 
+	if len(o.BlockPropertyCollectors) > 0 {
+		if len(o.BlockPropertyCollectors) > maxBlockPropertyCollectors {
+			w.err = errors.New("pebble: too many block property collectors")
+			return w
+		}
+		w.blockPropCollectors = make([]BlockPropertyCollector, len(o.BlockPropertyCollectors))
+		for i := range o.BlockPropertyCollectors {
+			w.blockPropCollectors[i] = o.BlockPropertyCollectors[i]()
+		}
+	}
+
 	// Apply the remaining WriterOptions that do not have a preApply() method.
 	for _, opt := range extraOpts {
 		if _, ok := opt.(preApply); !ok {
@@ -0,0 +1,265 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble/internal/manifest"
+	"github.com/cockroachdb/pebble/internal/rangedel"
+)
+
+// split splits the compaction into at most n subcompactions, each of which
+// compacts a disjoint user key range [lower, upper) of the inputs. The split
+// points are the smallest user keys of the input tables, chosen such that the
+// inputs of each subcompaction are at least as large as the target size of an
+// output table. A subcompaction reads the input tables which overlap its key
+// range, ignoring the point keys outside of the range and truncating range
+// tombstones and range keys to the range. As every version of a user key is
+// compacted by the same subcompaction, the handling of snapshots is
+// unaffected, and range tombstones continue to be truncated to the bounds of
+// their atomic compaction units before being truncated to the bounds of the
+// subcompaction.
+//
+// A flush, an intra-L0 compaction, or a compaction which cannot be split is
+// returned as the sole subcompaction.
+func (c *compaction) split(n int) []*compaction {
+	if n <= 1 || len(c.flushing) != 0 || c.outputLevel == 0 {
+		return []*compaction{c}
+	}
+
+	var files []*fileMetadata
+	for i := range c.inputs {
+		files = append(files, c.inputs[i]...)
+	}
+	if len(files) == 0 {
+		return []*compaction{c}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return c.cmp(files[i].Smallest.UserKey, files[j].Smallest.UserKey) < 0
+	})
+
+	total := totalSize(files)
+	target := total / uint64(n)
+	if target < c.maxOutputFileSize {
+		target = c.maxOutputFileSize
+	}
+
+	// Walk the input tables in order of their smallest keys, splitting before
+	// a table once the preceding tables since the last split point reach the
+	// target size.
+	var subs []*compaction
+	var lower []byte
+	prev := files[0].Smallest.UserKey
+	var size, remaining uint64 = 0, total
+	for _, f := range files {
+		if size >= target && remaining >= target && len(subs) < n-1 &&
+			c.cmp(f.Smallest.UserKey, prev) > 0 {
+			subs = append(subs, c.newSubcompaction(lower, f.Smallest.UserKey))
+			lower = f.Smallest.UserKey
+			prev = lower
+			size = 0
+		}
+		size += f.Size
+		remaining -= f.Size
+	}
+	if len(subs) == 0 {
+		return []*compaction{c}
+	}
+	return append(subs, c.newSubcompaction(lower, nil))
+}
+
+// newSubcompaction returns a subcompaction of the user key range [lower,
+// upper) of c, whose inputs are the input tables of c which overlap the range.
+// A nil bound is unbounded.
+func (c *compaction) newSubcompaction(lower, upper []byte) *compaction {
+	sub := &compaction{
+		cmp:                 c.cmp,
+		format:              c.format,
+		logger:              c.logger,
+		version:             c.version,
+		score:               c.score,
+		startLevel:          c.startLevel,
+		outputLevel:         c.outputLevel,
+		extraLevel:          c.extraLevel,
+		maxOutputFileSize:   c.maxOutputFileSize,
+		maxOverlapBytes:     c.maxOverlapBytes,
+		maxExpandedBytes:    c.maxExpandedBytes,
+		atomicBytesIterated: c.atomicBytesIterated,
+		grandparents:        c.grandparents,
+		inuseKeyRanges:      c.inuseKeyRanges,
+		splitLower:          lower,
+		splitUpper:          upper,
+
+		disableRangeTombstoneElision: c.disableRangeTombstoneElision,
+		keepCreationTime:             c.keepCreationTime,
+		writerOpts:                   c.writerOpts,
+		maxBlobFileSize:              c.maxBlobFileSize,
+	}
+	for i := range c.inputs {
+		for _, f := range c.inputs[i] {
+			if lower != nil {
+				// The largest key of a table is exclusive if it is a range
+				// deletion sentinel.
+				v := c.cmp(f.Largest.UserKey, lower)
+				if v < 0 || (v == 0 && f.Largest.Trailer == InternalKeyRangeDeleteSentinel) {
+					continue
+				}
+			}
+			if upper != nil && c.cmp(f.Smallest.UserKey, upper) >= 0 {
+				continue
+			}
+			sub.inputs[i] = append(sub.inputs[i], f)
+		}
+	}
+	// The tables of the intermediate level of a multi-level compaction are
+	// inputs too, and may extend beyond those of the start and output levels.
+	inputs := append(append([]*fileMetadata(nil), sub.inputs[0]...), sub.inputs[2]...)
+	sub.smallest, sub.largest = manifest.KeyRange(c.cmp, inputs, sub.inputs[1])
+	return sub
+}
+
+// truncateToSplit truncates the range tombstones returned by iter to the
+// bounds of a subcompaction. The iterator is returned unmodified for a
+// compaction which was not split.
+func (c *compaction) truncateToSplit(iter internalIterator) internalIterator {
+	if c.splitLower == nil && c.splitUpper == nil {
+		return iter
+	}
+	return rangedel.Truncate(c.cmp, iter, c.splitLower, c.splitUpper)
+}
+
+// boundToSplit returns an iterator over the input keys of a subcompaction,
+// which omits the keys of iter lying outside the bounds of the subcompaction.
+// The iterator is returned unmodified for a compaction which was not split.
+func (c *compaction) boundToSplit(iter internalIterator) internalIterator {
+	if c.splitLower == nil && c.splitUpper == nil {
+		return iter
+	}
+	return &splitIter{
+		internalIterator: iter,
+		cmp:              c.cmp,
+		lower:            c.splitLower,
+		upper:            c.splitUpper,
+	}
+}
+
+// splitIter restricts the keys returned by a compaction input iterator to the
+// bounds of a subcompaction. The range tombstones returned by the input
+// iterator have already been truncated to the bounds (see truncateToSplit),
+// so the input iterator does not return a key beneath the lower bound after
+// one above it, and returns no keys of interest after the first key at or
+// above the upper bound. Only forward iteration is supported, which is all
+// that a compaction requires.
+type splitIter struct {
+	internalIterator
+	cmp          Compare
+	lower, upper []byte
+}
+
+func (i *splitIter) First() (*InternalKey, []byte) {
+	key, val := i.internalIterator.First()
+	for key != nil && i.lower != nil && i.cmp(key.UserKey, i.lower) < 0 {
+		key, val = i.internalIterator.Next()
+	}
+	return i.checkUpper(key, val)
+}
+
+func (i *splitIter) Next() (*InternalKey, []byte) {
+	return i.checkUpper(i.internalIterator.Next())
+}
+
+func (i *splitIter) checkUpper(key *InternalKey, val []byte) (*InternalKey, []byte) {
+	if key != nil && i.upper != nil && i.cmp(key.UserKey, i.upper) >= 0 {
+		return nil, nil
+	}
+	return key, val
+}
+
+// runSubcompactions runs the subcompactions of a compaction concurrently, and
+// combines their outputs into a single version edit. If any subcompaction
+// fails, the outputs of the others are marked obsolete.
+//
+// d.mu must not be held when calling this.
+func (d *DB) runSubcompactions(
+	jobID int, c *compaction, subs []*compaction, snapshots []uint64,
+) (*versionEdit, []FileNum, error) {
+	type result struct {
+		ve             *versionEdit
+		pendingOutputs []FileNum
+		duration       time.Duration
+		err            error
+	}
+	results := make([]result, len(subs))
+	var wg sync.WaitGroup
+	for i := range subs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := &results[i]
+			startTime := d.timeNow()
+			r.ve, r.pendingOutputs, r.err = d.runSubcompaction(
+				jobID, subs[i], snapshots, d.newCompactionPacer())
+			r.duration = d.timeNow().Sub(startTime)
+		}(i)
+	}
+	wg.Wait()
+
+	var err error
+	for i := range results {
+		err = firstError(err, results[i].err)
+	}
+	if err != nil {
+		d.mu.Lock()
+		for i := range results {
+			if results[i].err == nil {
+				d.addObsoletePendingOutputsLocked(results[i].ve, results[i].pendingOutputs)
+			}
+		}
+		d.mu.Unlock()
+		return nil, nil, err
+	}
+
+	ve := &versionEdit{
+		DeletedFiles: map[deletedFileEntry]bool{},
+	}
+	var pendingOutputs []FileNum
+	metrics := &LevelMetrics{}
+	c.subcompactions = make([]SubcompactionInfo, len(subs))
+	for i, sub := range subs {
+		r := &results[i]
+		ve.NewFiles = append(ve.NewFiles, r.ve.NewFiles...)
+		ve.NewBlobFiles = append(ve.NewBlobFiles, r.ve.NewBlobFiles...)
+		for e := range r.ve.DeletedFiles {
+			ve.DeletedFiles[e] = true
+		}
+		pendingOutputs = append(pendingOutputs, r.pendingOutputs...)
+		c.deletionHints = append(c.deletionHints, sub.deletionHints...)
+		metrics.Add(sub.metrics[c.outputLevel])
+		if sub.filterInfo.Name != "" {
+			c.filterInfo.Name = sub.filterInfo.Name
+			c.filterInfo.KeysRemoved += sub.filterInfo.KeysRemoved
+			c.filterInfo.KeysChanged += sub.filterInfo.KeysChanged
+		}
+
+		info := &c.subcompactions[i]
+		info.Start = sub.splitLower
+		info.End = sub.splitUpper
+		info.Duration = r.duration
+		for j := range r.ve.NewFiles {
+			info.Output = append(info.Output, r.ve.NewFiles[j].Meta.TableInfo())
+		}
+	}
+	// The subcompactions can share input tables, so the bytes read are those
+	// of the inputs of the compaction.
+	metrics.BytesIn = totalSize(c.inputs[0]) + totalSize(c.inputs[2])
+	metrics.BytesRead = totalSize(c.inputs[1]) + metrics.BytesIn
+	c.metrics = map[int]*LevelMetrics{
+		c.outputLevel: metrics,
+	}
+	return ve, pendingOutputs, nil
+}
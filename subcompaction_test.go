@@ -0,0 +1,213 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionSplit(t *testing.T) {
+	parseMeta := func(s string) *fileMetadata {
+		parts := strings.Split(s, "-")
+		require.Equal(t, 2, len(parts), s)
+		return &fileMetadata{
+			Smallest: base.ParseInternalKey(parts[0]),
+			Largest:  base.ParseInternalKey(parts[1]),
+			Size:     1,
+		}
+	}
+	parseFiles := func(s string) []*fileMetadata {
+		var files []*fileMetadata
+		for _, f := range strings.Fields(s) {
+			files = append(files, parseMeta(f))
+		}
+		return files
+	}
+	format := func(subs []*compaction) string {
+		var parts []string
+		for _, sub := range subs {
+			var files []string
+			for i := range sub.inputs {
+				for _, f := range sub.inputs[i] {
+					files = append(files, fmt.Sprintf("%s-%s", f.Smallest.UserKey, f.Largest.UserKey))
+				}
+			}
+			parts = append(parts, fmt.Sprintf("[%s,%s): %s",
+				sub.splitLower, sub.splitUpper, strings.Join(files, " ")))
+		}
+		return strings.Join(parts, " | ")
+	}
+
+	testCases := []struct {
+		inputs            [2]string
+		n                 int
+		maxOutputFileSize uint64
+		expected          string
+	}{
+		{
+			inputs:            [2]string{"a.SET.1-c.SET.1 e.SET.1-f.SET.1", "a.SET.2-b.SET.2 c.SET.2-d.SET.2 e.SET.2-g.SET.2"},
+			n:                 1,
+			maxOutputFileSize: 1,
+			expected:          "[,): a-c e-f a-b c-d e-g",
+		},
+		{
+			// A table which spans a split point is an input of both of the
+			// subcompactions. There are only three distinct split points.
+			inputs:            [2]string{"a.SET.1-c.SET.1 e.SET.1-f.SET.1", "a.SET.2-b.SET.2 c.SET.2-d.SET.2 e.SET.2-g.SET.2"},
+			n:                 4,
+			maxOutputFileSize: 1,
+			expected:          "[,c): a-c a-b | [c,e): a-c c-d | [e,): e-f e-g",
+		},
+		{
+			inputs:            [2]string{"a.SET.1-b.SET.1 c.SET.1-d.SET.1 e.SET.1-f.SET.1", "a.SET.2-b.SET.2 c.SET.2-d.SET.2 e.SET.2-f.SET.2"},
+			n:                 3,
+			maxOutputFileSize: 1,
+			expected:          "[,c): a-b a-b | [c,e): c-d c-d | [e,): e-f e-f",
+		},
+		{
+			// The subcompactions must be at least as large as an output table, and
+			// a split would leave too small a remainder.
+			inputs:            [2]string{"a.SET.1-b.SET.1 c.SET.1-d.SET.1 e.SET.1-f.SET.1", "a.SET.2-b.SET.2 c.SET.2-d.SET.2 e.SET.2-f.SET.2"},
+			n:                 3,
+			maxOutputFileSize: 4,
+			expected:          "[,): a-b c-d e-f a-b c-d e-f",
+		},
+		{
+			// A table whose largest key is a range deletion sentinel does not
+			// contain its largest user key, and is not an input of the
+			// subcompaction starting at that key.
+			inputs:            [2]string{"a.SET.1-c.RANGEDEL.72057594037927935 c.SET.1-d.SET.1", "a.SET.2-b.SET.2 c.SET.2-d.SET.2"},
+			n:                 2,
+			maxOutputFileSize: 1,
+			expected:          "[,c): a-c a-b | [c,): c-d c-d",
+		},
+		{
+			// The versions of a user key which spans two tables are compacted by
+			// the same subcompaction.
+			inputs:            [2]string{"a.SET.3-c.SET.3 c.SET.1-d.SET.1", "a.SET.2-b.SET.2 c.SET.2-d.SET.2"},
+			n:                 2,
+			maxOutputFileSize: 1,
+			expected:          "[,c): a-c a-b | [c,): a-c c-d c-d",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run("", func(t *testing.T) {
+			c := &compaction{
+				cmp:               DefaultComparer.Compare,
+				startLevel:        5,
+				outputLevel:       6,
+				maxOutputFileSize: tc.maxOutputFileSize,
+			}
+			c.inputs[0] = parseFiles(tc.inputs[0])
+			c.inputs[1] = parseFiles(tc.inputs[1])
+			require.Equal(t, tc.expected, format(c.split(tc.n)))
+		})
+	}
+}
+
+func TestSubcompactions(t *testing.T) {
+	var mu sync.Mutex
+	var infos []CompactionInfo
+	mem := vfs.NewMem()
+	opts := &Options{
+		FS:                mem,
+		DebugCheck:        DebugCheckLevels,
+		FlushSplitBytes:   1,
+		MaxSubcompactions: 4,
+		Levels:            []LevelOptions{{TargetFileSize: 2048}},
+		EventListener: EventListener{
+			CompactionEnd: func(info CompactionInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				infos = append(infos, info)
+			},
+		},
+	}
+	d, err := Open("", opts)
+	require.NoError(t, err)
+
+	const numKeys = 1000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%04d", i))
+	}
+	value := func(i, version int) []byte {
+		return []byte(fmt.Sprintf("%04d-%d-%s", i, version, strings.Repeat("x", 100)))
+	}
+
+	// Write a version of each key to two overlapping L0 tables and compact
+	// them into the bottommost level, which will contain many tables.
+	for j := 0; j < 2; j++ {
+		for i := j; i < numKeys; i += 2 {
+			require.NoError(t, d.Set(key(i), value(i, 1), nil))
+		}
+		require.NoError(t, d.Flush())
+	}
+	require.NoError(t, d.Compact(key(0), key(numKeys)))
+
+	// Overwrite every key and delete a range of keys while a snapshot is open.
+	// The flush is split at the boundaries of the bottommost tables, so the
+	// compaction of the flushed tables can be split into subcompactions.
+	snap := d.NewSnapshot()
+	for i := 0; i < numKeys; i++ {
+		require.NoError(t, d.Set(key(i), value(i, 2), nil))
+	}
+	require.NoError(t, d.DeleteRange(key(100), key(900), nil))
+	require.NoError(t, d.Flush())
+	mu.Lock()
+	infos = nil
+	mu.Unlock()
+	require.NoError(t, d.Compact(key(0), key(numKeys)))
+
+	mu.Lock()
+	require.Equal(t, 1, len(infos))
+	info := infos[0]
+	mu.Unlock()
+	n := len(info.Subcompactions)
+	require.True(t, n > 1 && n <= opts.MaxSubcompactions, "%d subcompactions", n)
+	var outputs int
+	for i, sub := range info.Subcompactions {
+		require.NotEmpty(t, sub.Output)
+		outputs += len(sub.Output)
+		if i == 0 {
+			require.Nil(t, sub.Start)
+		} else {
+			require.Equal(t, info.Subcompactions[i-1].End, sub.Start)
+			require.True(t, bytes.Compare(sub.Start, key(0)) > 0)
+		}
+		if i == len(info.Subcompactions)-1 {
+			require.Nil(t, sub.End)
+		}
+	}
+	require.Equal(t, len(info.Output.Tables), outputs)
+	require.Contains(t, info.String(), fmt.Sprintf(", %d subcompactions", n))
+
+	get := func(r Reader, i int) string {
+		v, closer, err := r.Get(key(i))
+		if err == ErrNotFound {
+			return ""
+		}
+		require.NoError(t, err)
+		defer closer.Close()
+		return string(v)
+	}
+	for i := 0; i < numKeys; i++ {
+		require.Equal(t, string(value(i, 1)), get(snap, i))
+		if i >= 100 && i < 900 {
+			require.Equal(t, "", get(d, i))
+		} else {
+			require.Equal(t, string(value(i, 2)), get(d, i))
+		}
+	}
+	require.NoError(t, snap.Close())
+	require.NoError(t, d.Close())
+}
@@ -55,7 +55,22 @@ func (c *tableCache) getShard(fileNum FileNum) *tableCacheShard {
 func (c *tableCache) newIters(
 	meta *fileMetadata, opts *IterOptions, bytesIterated *uint64,
 ) (internalIterator, internalIterator, error) {
-	return c.getShard(meta.FileNum).newIters(meta, opts, bytesIterated)
+	return c.getShard(meta.BackingFileNum()).newIters(meta, opts, bytesIterated)
+}
+
+// newRangeKeyIter returns an iterator over the range keys in the table, or nil
+// if the table does not contain any range keys.
+func (c *tableCache) newRangeKeyIter(meta *fileMetadata) (internalIterator, error) {
+	return c.getShard(meta.BackingFileNum()).newRangeKeyIter(meta)
+}
+
+// withReader invokes fn with the reader for the physical sstable backing the
+// table. The reader must not be retained after fn returns. If the sstable is
+// not open in the cache, it is opened for the duration of the call without
+// being added to the cache, so that background readers such as the loading
+// of table stats do not hold files open.
+func (c *tableCache) withReader(meta *fileMetadata, fn func(*sstable.Reader) error) error {
+	return c.getShard(meta.BackingFileNum()).withReader(meta, fn)
 }
 
 func (c *tableCache) evict(fileNum FileNum) {
@@ -83,7 +98,7 @@ func (c *tableCache) metrics() (CacheMetrics, FilterMetrics) {
 // Assumes there is at least partial overlap, i.e., `[start, end]` falls neither
 // completely before nor completely after the file's range.
 func (c *tableCache) estimateDiskUsage(meta *fileMetadata, start, end []byte) (uint64, error) {
-	return c.getShard(meta.FileNum).estimateDiskUsage(meta, start, end)
+	return c.getShard(meta.BackingFileNum()).estimateDiskUsage(meta, start, end)
 }
 
 func (c *tableCache) iterCount() int64 {
@@ -181,7 +196,12 @@ func (c *tableCacheShard) newIters(
 	if bytesIterated != nil {
 		iter, err = n.reader.NewCompactionIter(bytesIterated)
 	} else {
-		iter, err = n.reader.NewIter(opts.GetLowerBound(), opts.GetUpperBound())
+		var filters []BlockPropertyFilter
+		if opts != nil {
+			filters = opts.PointKeyFilters
+		}
+		iter, err = n.reader.NewIterWithBlockPropertyFilters(
+			opts.GetLowerBound(), opts.GetUpperBound(), filters)
 	}
 	if err != nil {
 		c.unrefNode(n)
@@ -189,6 +209,11 @@ func (c *tableCacheShard) newIters(
 	}
 	// NB: n.closeHook takes responsibility for calling unrefNode(n) here.
 	iter.SetCloseHook(n.closeHook)
+	var pointIter internalIterator = iter
+	if meta.Virtual {
+		pointIter = newVirtualTableIter(c.opts.Comparer.Compare, iter, meta,
+			opts.GetLowerBound(), opts.GetUpperBound(), bytesIterated != nil)
+	}
 
 	atomic.AddInt32(&c.iterCount, 1)
 	if invariants.RaceEnabled {
@@ -200,15 +225,38 @@ func (c *tableCacheShard) newIters(
 	// NB: range-del iterator does not maintain a reference to the table, nor
 	// does it need to read from it after creation.
 	rangeDelIter, err := n.reader.NewRangeDelIter()
+	if err == nil && rangeDelIter != nil && meta.Virtual {
+		rangeDelIter, err = truncateVirtualRangeDels(c.opts.Comparer.Compare, rangeDelIter, meta)
+	}
 	if err != nil {
-		iter.Close()
+		pointIter.Close()
 		return nil, nil, err
 	}
 	if rangeDelIter != nil {
-		return iter, rangeDelIter, nil
+		return pointIter, rangeDelIter, nil
 	}
 	// NB: Translate a nil range-del iterator into a nil interface.
-	return iter, nil, nil
+	return pointIter, nil, nil
+}
+
+func (c *tableCacheShard) newRangeKeyIter(meta *fileMetadata) (internalIterator, error) {
+	n := c.findNode(meta)
+	<-n.loaded
+	// NB: the range-key iterator does not maintain a reference to the table,
+	// nor does it need to read from it after creation.
+	defer c.unrefNode(n)
+	if n.err != nil {
+		return nil, n.err
+	}
+	iter, err := n.reader.NewRangeKeyIter()
+	if err != nil || iter == nil {
+		// NB: Translate a nil range-key iterator into a nil interface.
+		return nil, err
+	}
+	if meta.Virtual {
+		return truncateVirtualRangeKeys(c.opts.Comparer.Compare, iter, meta)
+	}
+	return iter, nil
 }
 
 // releaseNode releases a node from the tableCacheShard.
@@ -224,7 +272,7 @@ func (c *tableCacheShard) releaseNode(n *tableCacheNode) {
 //
 // c.mu must be held when calling this.
 func (c *tableCacheShard) unlinkNode(n *tableCacheNode) {
-	delete(c.mu.nodes, n.meta.FileNum)
+	delete(c.mu.nodes, n.meta.BackingFileNum())
 	n.next.prev = n.prev
 	n.prev.next = n.next
 	n.prev = nil
@@ -242,14 +290,16 @@ func (c *tableCacheShard) unrefNode(n *tableCacheNode) {
 	}
 }
 
-// findNode returns the node for the table with the given file number, creating
-// that node if it didn't already exist. The caller is responsible for
+// findNode returns the node for the physical sstable backing the table,
+// creating that node if it didn't already exist. The caller is responsible for
 // decrementing the returned node's refCount.
 func (c *tableCacheShard) findNode(meta *fileMetadata) *tableCacheNode {
+	fileNum := meta.BackingFileNum()
+
 	// Fast-path for a hit in the cache. We grab the lock in shared mode, and use
 	// a batching mechanism to perform updates to the LRU list.
 	c.mu.RLock()
-	if n := c.mu.nodes[meta.FileNum]; n != nil {
+	if n := c.mu.nodes[fileNum]; n != nil {
 		// Fast-path hit.
 
 		// The caller is responsible for decrementing the refCount.
@@ -281,7 +331,7 @@ func (c *tableCacheShard) findNode(meta *fileMetadata) *tableCacheNode {
 		c.hitsPool.Put(hits)
 	}
 
-	n := c.mu.nodes[meta.FileNum]
+	n := c.mu.nodes[fileNum]
 	missed := n == nil
 	if missed {
 		// Slow-path miss.
@@ -303,7 +353,7 @@ func (c *tableCacheShard) findNode(meta *fileMetadata) *tableCacheNode {
 			refCount: 1,
 			loaded:   make(chan struct{}),
 		}
-		c.mu.nodes[meta.FileNum] = n
+		c.mu.nodes[fileNum] = n
 		if len(c.mu.nodes) > c.size {
 			// Release the tail node.
 			c.releaseNode(c.mu.lru.prev)
@@ -393,7 +443,49 @@ func (c *tableCacheShard) estimateDiskUsage(meta *fileMetadata, start, end []byt
 	if n.err != nil {
 		return 0, n.err
 	}
-	return n.reader.EstimateDiskUsage(start, end)
+	return estimateTableDiskUsage(c.opts.Comparer.Compare, n.reader, meta, start, end)
+}
+
+// estimateTableDiskUsage returns the estimated disk usage of the span [start,
+// end] in the table, whose backing sstable is read by r.
+func estimateTableDiskUsage(
+	cmp Compare, r *sstable.Reader, meta *fileMetadata, start, end []byte,
+) (uint64, error) {
+	if meta.Virtual {
+		// Only the data within the bounds of a virtual table is attributed to
+		// it.
+		if cmp(start, meta.Smallest.UserKey) < 0 {
+			start = meta.Smallest.UserKey
+		}
+		if cmp(end, meta.Largest.UserKey) > 0 {
+			end = meta.Largest.UserKey
+		}
+	}
+	return r.EstimateDiskUsage(start, end)
+}
+
+func (c *tableCacheShard) withReader(meta *fileMetadata, fn func(*sstable.Reader) error) error {
+	c.mu.RLock()
+	n := c.mu.nodes[meta.BackingFileNum()]
+	if n != nil {
+		// The caller is responsible for decrementing the refCount.
+		atomic.AddInt32(&n.refCount, 1)
+	}
+	c.mu.RUnlock()
+
+	if n == nil {
+		r, err := c.openReader(meta)
+		if err != nil {
+			return err
+		}
+		return firstError(fn(r), r.Close())
+	}
+	<-n.loaded
+	defer c.unrefNode(n)
+	if n.err != nil {
+		return n.err
+	}
+	return fn(n.reader)
 }
 
 func (c *tableCacheShard) Close() error {
@@ -447,20 +539,30 @@ type tableCacheNode struct {
 	refCount   int32
 }
 
-func (n *tableCacheNode) load(c *tableCacheShard) {
+// openReader opens the physical sstable backing the table.
+func (c *tableCacheShard) openReader(meta *fileMetadata) (*sstable.Reader, error) {
 	// Try opening the fileTypeTable first.
-	var f vfs.File
-	f, n.err = c.fs.Open(base.MakeFilename(c.fs, c.dirname, fileTypeTable, n.meta.FileNum),
+	fileNum := meta.BackingFileNum()
+	f, err := c.fs.Open(base.MakeFilename(c.fs, c.dirname, fileTypeTable, fileNum),
 		vfs.RandomReadsOption)
-	if n.err == nil {
-		cacheOpts := private.SSTableCacheOpts(c.cacheID, n.meta.FileNum).(sstable.ReaderOption)
-		n.reader, n.err = sstable.NewReader(f, c.opts, cacheOpts, c.filterMetrics)
+	if err != nil {
+		return nil, err
 	}
-	if n.err == nil {
-		if n.meta.SmallestSeqNum == n.meta.LargestSeqNum {
-			n.reader.Properties.GlobalSeqNum = n.meta.LargestSeqNum
-		}
+	cacheOpts := private.SSTableCacheOpts(c.cacheID, fileNum).(sstable.ReaderOption)
+	r, err := sstable.NewReader(f, c.opts, cacheOpts, c.filterMetrics)
+	if err != nil {
+		return nil, err
+	}
+	// NB: A virtual table inherits the sequence numbers of its backing, so any
+	// of the tables sharing the backing determine the global sequence number.
+	if meta.SmallestSeqNum == meta.LargestSeqNum {
+		r.Properties.GlobalSeqNum = meta.LargestSeqNum
 	}
+	return r, nil
+}
+
+func (n *tableCacheNode) load(c *tableCacheShard) {
+	n.reader, n.err = c.openReader(n.meta)
 	if n.err != nil {
 		c.mu.Lock()
 		defer c.mu.Unlock()
@@ -0,0 +1,239 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"github.com/cockroachdb/pebble/internal/rangedel"
+	"github.com/cockroachdb/pebble/internal/rangekey"
+)
+
+// virtualBounds returns the user key bounds of a virtual table. The lower
+// bound is inclusive. The upper bound is exclusive if the table's largest key
+// is a range deletion sentinel, and inclusive otherwise.
+func virtualBounds(meta *fileMetadata) (lower, upper []byte, upperInclusive bool) {
+	return meta.Smallest.UserKey, meta.Largest.UserKey,
+		meta.Largest.Trailer != InternalKeyRangeDeleteSentinel
+}
+
+// virtualTableIter constrains iteration over the backing sstable of a
+// virtual table to the bounds of the virtual table. The sstable iterator is
+// given the bounds which it is able to enforce: the lower bound, and an
+// exclusive upper bound. An inclusive upper bound is enforced by
+// virtualTableIter. A compaction iterator does not support bounds, so all of
+// the bounds are enforced by virtualTableIter.
+type virtualTableIter struct {
+	cmp  Compare
+	iter internalIterator
+	// The bounds of the virtual table.
+	lower, upper   []byte
+	upperInclusive bool
+	// The bounds passed to the sstable iterator: the intersection of the
+	// virtual table bounds and the bounds from the most recent call to
+	// SetBounds.
+	iterLower, iterUpper []byte
+	// forwardOnly is set for a compaction iterator, which only supports First
+	// and Next.
+	forwardOnly bool
+}
+
+// virtualTableIter implements the internalIterator interface.
+var _ internalIterator = (*virtualTableIter)(nil)
+
+func newVirtualTableIter(
+	cmp Compare, iter internalIterator, meta *fileMetadata, lower, upper []byte, forwardOnly bool,
+) *virtualTableIter {
+	i := &virtualTableIter{
+		cmp:         cmp,
+		iter:        iter,
+		forwardOnly: forwardOnly,
+	}
+	i.lower, i.upper, i.upperInclusive = virtualBounds(meta)
+	i.SetBounds(lower, upper)
+	return i
+}
+
+// checkLower returns the key if it lies at or above the lower bound.
+func (i *virtualTableIter) checkLower(key *InternalKey, val []byte) (*InternalKey, []byte) {
+	if key != nil && i.cmp(key.UserKey, i.iterLower) < 0 {
+		return nil, nil
+	}
+	return key, val
+}
+
+// checkUpper returns the key if it lies at or below an inclusive upper bound
+// of the virtual table. An exclusive upper bound is enforced by the sstable
+// iterator, unless it is a compaction iterator.
+func (i *virtualTableIter) checkUpper(key *InternalKey, val []byte) (*InternalKey, []byte) {
+	if key == nil {
+		return nil, nil
+	}
+	if i.upperInclusive && i.cmp(key.UserKey, i.upper) > 0 {
+		return nil, nil
+	}
+	if i.forwardOnly && i.iterUpper != nil && i.cmp(key.UserKey, i.iterUpper) >= 0 {
+		return nil, nil
+	}
+	return key, val
+}
+
+func (i *virtualTableIter) SeekGE(key []byte) (*InternalKey, []byte) {
+	if i.cmp(key, i.iterLower) < 0 {
+		key = i.iterLower
+	}
+	return i.checkUpper(i.iter.SeekGE(key))
+}
+
+func (i *virtualTableIter) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
+	if i.cmp(key, i.iterLower) < 0 {
+		key = i.iterLower
+	}
+	return i.checkUpper(i.iter.SeekPrefixGE(prefix, key))
+}
+
+func (i *virtualTableIter) SeekLT(key []byte) (*InternalKey, []byte) {
+	if i.upperInclusive && i.cmp(key, i.upper) > 0 {
+		return i.Last()
+	}
+	if i.iterUpper != nil && i.cmp(key, i.iterUpper) > 0 {
+		key = i.iterUpper
+	}
+	return i.checkLower(i.iter.SeekLT(key))
+}
+
+func (i *virtualTableIter) First() (*InternalKey, []byte) {
+	if !i.forwardOnly {
+		return i.SeekGE(i.iterLower)
+	}
+	key, val := i.iter.First()
+	for key != nil && i.cmp(key.UserKey, i.iterLower) < 0 {
+		key, val = i.iter.Next()
+	}
+	return i.checkUpper(key, val)
+}
+
+func (i *virtualTableIter) Last() (*InternalKey, []byte) {
+	if !i.upperInclusive || (i.iterUpper != nil && i.cmp(i.iterUpper, i.upper) <= 0) {
+		return i.checkLower(i.iter.SeekLT(i.iterUpper))
+	}
+	// Find the last key whose user key is less than or equal to the inclusive
+	// upper bound by stepping over the versions of the upper bound.
+	key, val := i.iter.SeekGE(i.upper)
+	for key != nil && i.cmp(key.UserKey, i.upper) <= 0 {
+		key, val = i.iter.Next()
+	}
+	if key == nil {
+		key, val = i.iter.Last()
+	} else {
+		key, val = i.iter.Prev()
+	}
+	return i.checkLower(key, val)
+}
+
+func (i *virtualTableIter) Next() (*InternalKey, []byte) {
+	return i.checkUpper(i.iter.Next())
+}
+
+func (i *virtualTableIter) Prev() (*InternalKey, []byte) {
+	return i.checkLower(i.iter.Prev())
+}
+
+func (i *virtualTableIter) Error() error {
+	return i.iter.Error()
+}
+
+func (i *virtualTableIter) Close() error {
+	return i.iter.Close()
+}
+
+func (i *virtualTableIter) SetBounds(lower, upper []byte) {
+	i.iterLower = i.lower
+	if lower != nil && i.cmp(lower, i.lower) > 0 {
+		i.iterLower = lower
+	}
+	i.iterUpper = upper
+	if !i.upperInclusive && (upper == nil || i.cmp(upper, i.upper) > 0) {
+		i.iterUpper = i.upper
+	}
+	if !i.forwardOnly {
+		i.iter.SetBounds(i.iterLower, i.iterUpper)
+	}
+}
+
+func (i *virtualTableIter) String() string {
+	return i.iter.String()
+}
+
+// truncateVirtualRangeDels returns an iterator over the range deletions of
+// the backing sstable of a virtual table which lie within the bounds of the
+// virtual table. The iterator is closed.
+func truncateVirtualRangeDels(
+	cmp Compare, iter internalIterator, meta *fileMetadata,
+) (internalIterator, error) {
+	lower, upper, upperInclusive := virtualBounds(meta)
+	var tombstones []rangedel.Tombstone
+	for key, val := iter.First(); key != nil; key, val = iter.Next() {
+		t := rangedel.Tombstone{Start: key.Clone(), End: append([]byte(nil), val...)}
+		if cmp(t.Start.UserKey, lower) < 0 {
+			t.Start.UserKey = lower
+		}
+		// NB: When the largest key of the virtual table is a point key, no
+		// range deletion within the table extends beyond it, as the table's
+		// largest key would otherwise be the range deletion sentinel.
+		if upperInclusive {
+			if cmp(t.Start.UserKey, upper) > 0 {
+				continue
+			}
+		} else if cmp(t.End, upper) > 0 {
+			t.End = upper
+		}
+		if cmp(t.Start.UserKey, t.End) < 0 {
+			tombstones = append(tombstones, t)
+		}
+	}
+	if err := firstError(iter.Error(), iter.Close()); err != nil {
+		return nil, err
+	}
+	if len(tombstones) == 0 {
+		return nil, nil
+	}
+	return rangedel.NewIter(cmp, tombstones), nil
+}
+
+// truncateVirtualRangeKeys returns an iterator over the range keys of the
+// backing sstable of a virtual table which lie within the bounds of the
+// virtual table. The iterator is closed.
+func truncateVirtualRangeKeys(
+	cmp Compare, iter internalIterator, meta *fileMetadata,
+) (internalIterator, error) {
+	spans, err := rangekey.Collect(nil, iter)
+	if err = firstError(err, iter.Close()); err != nil {
+		return nil, err
+	}
+	lower, upper, upperInclusive := virtualBounds(meta)
+	if upperInclusive {
+		// As with range deletions, the range keys within the table do not
+		// extend beyond a point key largest bound.
+		n := 0
+		for _, s := range spans {
+			if cmp(s.Start.UserKey, upper) <= 0 {
+				spans[n] = s
+				n++
+			}
+		}
+		spans = rangekey.Truncate(cmp, spans[:n], lower, nil)
+	} else {
+		spans = rangekey.Truncate(cmp, spans, lower, upper)
+	}
+	if len(spans) == 0 {
+		return nil, nil
+	}
+	// The encoded range keys are iterated over using a rangedel.Iter, which
+	// yields the start key and value of each entry in order.
+	entries := make([]rangedel.Tombstone, len(spans))
+	for i := range spans {
+		entries[i] = rangedel.Tombstone{Start: spans[i].Start, End: spans[i].EncodedValue()}
+	}
+	return rangedel.NewIter(cmp, entries), nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble/internal/manifest"
+	"github.com/cockroachdb/pebble/sstable"
+)
+
+// tableStats is an alias for the statistics loaded for a table. See
+// fileMetadata.Stats.
+type tableStats = manifest.TableStats
+
+// maybeCollectTableStatsLocked schedules the loading of the stats of the
+// tables in the current version which do not have stats, if a load is not
+// already in progress. The stats are loaded in the background, and do not
+// delay the flush, compaction or ingestion which added the tables.
+//
+// d.mu must be held when calling this.
+func (d *DB) maybeCollectTableStatsLocked() {
+	if d.opts.disableTableStats {
+		return
+	}
+	d.mu.tableStats.pending = true
+	if d.mu.tableStats.loading || atomic.LoadInt32(&d.closed) != 0 {
+		return
+	}
+	d.mu.tableStats.loading = true
+	go d.collectTableStats()
+}
+
+// collectTableStats loads the stats of the tables in the current version
+// which do not have stats. The tables are read without holding d.mu. Loading
+// is repeated until no further tables were added to the LSM while the stats
+// were being loaded, and stops early if the DB is closed.
+func (d *DB) collectTableStats() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.mu.tableStats.pending && atomic.LoadInt32(&d.closed) == 0 {
+		d.mu.tableStats.pending = false
+		initial := !d.mu.tableStats.loadedInitial
+		jobID := d.mu.nextJobID
+		d.mu.nextJobID++
+
+		// The read state holds a reference to the version, preventing the
+		// tables from being deleted while their stats are loaded.
+		rs := d.loadReadState()
+		var levels []int
+		var files []*fileMetadata
+		for level, lf := range rs.current.Files {
+			for _, f := range lf {
+				if !f.StatsValid {
+					levels = append(levels, level)
+					files = append(files, f)
+				}
+			}
+		}
+
+		d.mu.Unlock()
+		stats := make([]tableStats, len(files))
+		loaded := make([]bool, len(files))
+		for i, f := range files {
+			if atomic.LoadInt32(&d.closed) != 0 {
+				break
+			}
+			var err error
+			stats[i], err = d.loadTableStats(rs.current, levels[i], f)
+			if err != nil {
+				d.opts.EventListener.BackgroundError(err)
+				continue
+			}
+			loaded[i] = true
+		}
+		d.mu.Lock()
+		// The read state may hold the last reference to tables which became
+		// obsolete while the stats were loaded. They are deleted below, rather
+		// than in the background, so that the DB is quiescent once the load
+		// completes.
+		rs.unrefLocked()
+
+		info := TableStatsInfo{JobID: jobID, Initial: initial}
+		for i, f := range files {
+			if !loaded[i] {
+				continue
+			}
+			f.Stats = stats[i]
+			f.StatsValid = true
+			info.Tables++
+			info.NumDeletions += stats[i].NumDeletions
+			info.RangeDeletionsBytesEstimate += stats[i].RangeDeletionsBytesEstimate
+		}
+		d.mu.tableStats.loadedInitial = true
+		if info.Initial || info.Tables > 0 {
+			d.opts.EventListener.TableStatsLoaded(info)
+		}
+		d.deleteObsoleteFiles(jobID)
+		// The stats may change the choice of the files to compact.
+		d.maybeScheduleCompaction()
+	}
+	d.mu.tableStats.loading = false
+	d.mu.tableStats.cond.Broadcast()
+}
+
+// waitTableStats waits for the loads of table stats in progress, including
+// the loads scheduled while they were in progress, to complete. Only used by
+// tests which need a quiescent DB.
+func (d *DB) waitTableStats() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.mu.tableStats.loading {
+		d.mu.tableStats.cond.Wait()
+	}
+}
+
+// loadTableStats loads the stats of the table f in level of the version v.
+// The tables are read without adding them to the table cache.
+func (d *DB) loadTableStats(v *version, level int, f *fileMetadata) (tableStats, error) {
+	var stats tableStats
+	err := d.tableCache.withReader(f, func(r *sstable.Reader) error {
+		stats.NumEntries = r.Properties.NumEntries
+		// The deletion count of the properties includes the range deletions.
+		stats.NumDeletions = r.Properties.NumDeletions - r.Properties.NumRangeDeletions
+		stats.CompressionInputSize = r.Properties.CompressionInputSize
+		stats.CompressionOutputSize = r.Properties.CompressionOutputSize
+		if f.Virtual && f.FileBacking.Size > 0 {
+			// The properties describe the backing table. Attribute a share of
+			// the entries proportional to the size of the virtual table.
+			stats.NumEntries = stats.NumEntries * f.Size / f.FileBacking.Size
+			stats.NumDeletions = stats.NumDeletions * f.Size / f.FileBacking.Size
+			stats.CompressionInputSize = stats.CompressionInputSize * f.Size / f.FileBacking.Size
+			stats.CompressionOutputSize = stats.CompressionOutputSize * f.Size / f.FileBacking.Size
+		}
+
+		rangeDelIter, err := r.NewRangeDelIter()
+		if err == nil && rangeDelIter != nil && f.Virtual {
+			rangeDelIter, err = truncateVirtualRangeDels(d.cmp, rangeDelIter, f)
+		}
+		if err != nil || rangeDelIter == nil {
+			return err
+		}
+		defer rangeDelIter.Close()
+
+		// The tombstones are fragmented, and the fragments of overlapping
+		// tombstones share the same bounds. The space covered by each set of
+		// bounds is only counted once.
+		var prevStart, prevEnd []byte
+		for key, end := rangeDelIter.First(); key != nil; key, end = rangeDelIter.Next() {
+			if prevStart != nil && d.cmp(prevStart, key.UserKey) == 0 && d.cmp(prevEnd, end) == 0 {
+				continue
+			}
+			prevStart = append(prevStart[:0], key.UserKey...)
+			prevEnd = append(prevEnd[:0], end...)
+			size, err := d.estimateSizeBeneath(v, level, prevStart, prevEnd)
+			if err != nil {
+				return err
+			}
+			stats.RangeDeletionsBytesEstimate += size
+		}
+		return rangeDelIter.Error()
+	})
+	return stats, err
+}
+
+// estimateSizeBeneath returns an estimate of the number of bytes within the
+// span [start, end) in the tables of the levels beneath level in the version
+// v.
+func (d *DB) estimateSizeBeneath(v *version, level int, start, end []byte) (uint64, error) {
+	var size uint64
+	for l := level + 1; l < numLevels; l++ {
+		for _, f := range v.Overlaps(l, d.cmp, start, end) {
+			if d.cmp(f.Smallest.UserKey, end) >= 0 {
+				// The end of the span is exclusive.
+				continue
+			}
+			if d.cmp(start, f.Smallest.UserKey) <= 0 && d.cmp(f.Largest.UserKey, end) < 0 {
+				size += f.Size
+				continue
+			}
+			err := d.tableCache.withReader(f, func(r *sstable.Reader) error {
+				n, err := estimateTableDiskUsage(d.cmp, r, f, start, end)
+				size += n
+				return err
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return size, nil
+}
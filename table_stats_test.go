@@ -0,0 +1,93 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableStats(t *testing.T) {
+	var mu sync.Mutex
+	var loaded []TableStatsInfo
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+		EventListener: EventListener{
+			TableStatsLoaded: func(info TableStatsInfo) {
+				mu.Lock()
+				loaded = append(loaded, info)
+				mu.Unlock()
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+
+	lastLoaded := func() TableStatsInfo {
+		mu.Lock()
+		defer mu.Unlock()
+		return loaded[len(loaded)-1]
+	}
+	files := func(level int) []*fileMetadata {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.mu.versions.currentVersion().Files[level]
+	}
+
+	// The initial load is reported even though the DB has no tables.
+	d.waitTableStats()
+	require.Equal(t, TableStatsInfo{JobID: lastLoaded().JobID, Initial: true}, lastLoaded())
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, d.Set([]byte(k), []byte(k), nil))
+	}
+	require.NoError(t, d.Compact([]byte("a"), []byte("e")))
+	d.waitTableStats()
+	l6 := files(numLevels - 1)
+	require.Len(t, l6, 1)
+	// The data and index blocks are too small to be compressed.
+	require.Equal(t, tableStats{
+		NumEntries:            5,
+		CompressionInputSize:  95,
+		CompressionOutputSize: 95,
+	}, l6[0].Stats)
+	// The table is not held open once its stats are loaded.
+	require.Equal(t, int64(0), d.Metrics().TableCache.Count)
+
+	// The snapshot prevents a delete-only compaction from dropping the L6
+	// table beneath the range deletion.
+	snap := d.NewSnapshot()
+	defer snap.Close()
+	require.NoError(t, d.DeleteRange([]byte("a"), []byte("f"), nil))
+	require.NoError(t, d.Delete([]byte("x"), nil))
+	require.NoError(t, d.Flush())
+	d.waitTableStats()
+	l0 := files(0)
+	require.Len(t, l0, 1)
+	require.True(t, l0[0].StatsValid)
+	require.Equal(t, tableStats{
+		NumEntries:                  2,
+		NumDeletions:                1,
+		RangeDeletionsBytesEstimate: l6[0].Size,
+		CompressionInputSize:        42,
+		CompressionOutputSize:       42,
+	}, l0[0].Stats)
+
+	info := lastLoaded()
+	require.False(t, info.Initial)
+	require.Equal(t, 1, info.Tables)
+	require.Equal(t, uint64(1), info.NumDeletions)
+	require.Equal(t, l6[0].Size, info.RangeDeletionsBytesEstimate)
+
+	m := d.Metrics()
+	require.Equal(t, int64(0), m.Table.PendingStatsCount)
+	require.Equal(t, uint64(1), m.Table.NumDeletions)
+	require.Equal(t, l6[0].Size, m.Table.RangeDeletionsBytesEstimate)
+}
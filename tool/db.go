@@ -226,11 +226,24 @@ func (d *dbT) runCheck(cmd *cobra.Command, args []string) {
 }
 
 func (d *dbT) runLSM(cmd *cobra.Command, args []string) {
+	// Wait for the stats of the tables to be loaded so that they are included
+	// in the metrics.
+	statsLoaded := make(chan struct{})
+	d.opts.EventListener.TableStatsLoaded = func(info pebble.TableStatsInfo) {
+		if info.Initial {
+			close(statsLoaded)
+		}
+	}
+	defer func() {
+		d.opts.EventListener.TableStatsLoaded = nil
+	}()
+
 	db, err := d.openDB(args[0])
 	if err != nil {
 		fmt.Fprintf(stdout, "%s\n", err)
 		return
 	}
+	<-statsLoaded
 
 	fmt.Fprintf(stdout, "%s", db.Metrics())
 
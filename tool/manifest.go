@@ -136,6 +136,10 @@ func (m *manifestT) runDump(cmd *cobra.Command, args []string) {
 					empty = false
 					fmt.Fprintf(stdout, "  last-seq-num:  %d\n", ve.LastSeqNum)
 				}
+				if ve.FormatMajorVersion != 0 {
+					empty = false
+					fmt.Fprintf(stdout, "  format-major-version: %d\n", ve.FormatMajorVersion)
+				}
 				entries := make([]manifest.DeletedFileEntry, 0, len(ve.DeletedFiles))
 				for df := range ve.DeletedFiles {
 					empty = false
@@ -160,6 +164,7 @@ func (m *manifestT) runDump(cmd *cobra.Command, args []string) {
 						fmt.Fprintf(stdout, " (%s)",
 							time.Unix(nf.Meta.CreationTime, 0).UTC().Format(time.RFC3339))
 					}
+					formatBacking(stdout, nf.Meta)
 					fmt.Fprintf(stdout, "\n")
 				}
 				if empty {
@@ -183,6 +188,7 @@ func (m *manifestT) runDump(cmd *cobra.Command, args []string) {
 						fmt.Fprintf(stdout, "  %s:%d", f.FileNum, f.Size)
 						formatSeqNumRange(stdout, f.SmallestSeqNum, f.LargestSeqNum)
 						formatKeyRange(stdout, m.fmtKey, &f.Smallest, &f.Largest)
+						formatBacking(stdout, f)
 						fmt.Fprintf(stdout, "\n")
 					}
 				}
@@ -63,16 +63,19 @@ func newSSTable(
 	s.Check = &cobra.Command{
 		Use:   "check <sstables>",
 		Short: "verify checksums and metadata",
-		Long:  ``,
-		Args:  cobra.MinimumNArgs(1),
-		Run:   s.runCheck,
+		Long: `
+Verify the checksums and the key ordering of the sstables. The checksum type
+recorded in the footer of each sstable is displayed.
+`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  s.runCheck,
 	}
 	s.Layout = &cobra.Command{
 		Use:   "layout <sstables>",
 		Short: "print sstable block and record layout",
 		Long: `
-Print the layout for the sstables. The -v flag controls whether record layout
-is displayed or omitted.
+Print the layout for the sstables, including the checksum type recorded in the
+footer. The -v flag controls whether record layout is displayed or omitted.
 `,
 		Args: cobra.MinimumNArgs(1),
 		Run:  s.runLayout,
@@ -167,6 +170,13 @@ func (s *sstableT) runCheck(cmd *cobra.Command, args []string) {
 		// Update the internal formatter if this comparator has one specified.
 		s.fmtKey.setForComparer(r.Properties.ComparerName, s.comparers)
 
+		l, err := r.Layout()
+		if err != nil {
+			fmt.Fprintf(stdout, "%s\n", err)
+			return
+		}
+		fmt.Fprintf(stdout, "checksum: %s\n", l.Checksum)
+
 		iter, err := r.NewIter(nil, nil)
 		if err != nil {
 			fmt.Fprintf(stderr, "%s\n", err)
@@ -302,6 +312,25 @@ func (s *sstableT) runProperties(cmd *cobra.Command, args []string) {
 		fmt.Fprintf(tw, "  whole-key\t%t\n", r.Properties.WholeKeyFiltering)
 		fmt.Fprintf(tw, "compression\t%s\n", r.Properties.CompressionName)
 		fmt.Fprintf(tw, "  options\t%s\n", r.Properties.CompressionOptions)
+		if n := r.Properties.NumCompressedBlocks + r.Properties.NumUncompressedBlocks; n > 0 {
+			fmt.Fprintf(tw, "  compressed\t%d/%d blocks\n", r.Properties.NumCompressedBlocks, n)
+			fmt.Fprintf(tw, "  ratio\t%.2f (%d -> %d)\n",
+				float64(r.Properties.CompressionInputSize)/float64(r.Properties.CompressionOutputSize),
+				r.Properties.CompressionInputSize, r.Properties.CompressionOutputSize)
+		}
+		fmt.Fprintf(tw, "  blocks\t\n")
+		if counts, err := r.BlockCompressions(); err != nil {
+			fmt.Fprintf(tw, "    [err: %s]\n", err)
+		} else {
+			names := make([]string, 0, len(counts))
+			for name := range counts {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(tw, "    %s\t%d\n", name, counts[name])
+			}
+		}
 		fmt.Fprintf(tw, "user properties\t\n")
 		fmt.Fprintf(tw, "  collectors\t%s\n", r.Properties.PropertyCollectorNames)
 		keys := make([]string, 0, len(r.Properties.UserProperties))
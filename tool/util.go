@@ -15,6 +15,7 @@ import (
 
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/manifest"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 )
@@ -180,6 +181,13 @@ func formatKeyRange(w io.Writer, fmtKey formatter, start, end *base.InternalKey)
 	fmt.Fprintf(w, "[%s-%s]", start.Pretty(fmtKey.fn), end.Pretty(fmtKey.fn))
 }
 
+// formatBacking formats the physical sstable backing a virtual table.
+func formatBacking(w io.Writer, m *manifest.FileMetadata) {
+	if m.Virtual {
+		fmt.Fprintf(w, " (virtual, backing %s:%d)", m.FileBacking.FileNum, m.FileBacking.Size)
+	}
+}
+
 func formatKeyValue(
 	w io.Writer, fmtKey formatter, fmtValue formatter, key *base.InternalKey, value []byte,
 ) {
@@ -0,0 +1,300 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"io"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ErrConflict is returned by Txn.Commit if a key read by the transaction was
+// modified after the transaction started.
+var ErrConflict = errors.New("pebble: transaction conflict")
+
+// ErrNoSavepoint is returned by Txn.RollbackToSavepoint if the transaction has
+// no savepoint.
+var ErrNoSavepoint = errors.New("pebble: no savepoint")
+
+// Txn is an optimistic transaction. A Txn reads from a snapshot of the DB
+// taken when the transaction is created, overlaid with the transaction's own
+// writes, which are buffered in an indexed batch. The keys and spans read by
+// the transaction are recorded, and Commit validates that none of them were
+// modified after the snapshot was taken before applying the writes. No locks
+// are held while the transaction runs: conflicting writers are detected at
+// commit time, and the transaction which commits last fails with ErrConflict.
+//
+// A point read via Get records the key read. An iterator records the span
+// between each of its lower and upper bounds, regardless of how much of the span is
+// actually read. Iterators should be bounded to avoid spurious conflicts.
+//
+// Validation detects modifications by other transactions, and by writes
+// which committed before the validation. A write applied directly to the DB
+// concurrently with a transaction's commit may be missed. Writers that need
+// to be serialized with a transaction should themselves use transactions.
+//
+// A Txn is not safe for concurrent use.
+type Txn struct {
+	db    *DB
+	batch *Batch
+	snap  *Snapshot
+	// reads is the read set of the transaction.
+	reads []txnRead
+	// savepoints is the stack of savepoints, most recent last.
+	savepoints []txnSavepoint
+}
+
+var _ Reader = (*Txn)(nil)
+
+// txnRead is a point key or span read by a transaction. A point read has a
+// nil end. A span read is the range [start,end), where a nil start or end is
+// unbounded.
+type txnRead struct {
+	start, end []byte
+	point      bool
+}
+
+// txnSavepoint is the state of a transaction's batch at a savepoint.
+type txnSavepoint struct {
+	size  int
+	count uint64
+}
+
+// NewTxn returns a new optimistic transaction. The transaction must be
+// finished by calling Close, after an optional call to Commit.
+func (d *DB) NewTxn() *Txn {
+	return &Txn{
+		db:    d,
+		batch: d.NewIndexedBatch(),
+		snap:  d.NewSnapshot(),
+	}
+}
+
+// Get gets the value for the given key, reading the transaction's writes
+// and the DB state at the start of the transaction. The key is added to the
+// transaction's read set. It returns ErrNotFound if the key is not found.
+//
+// The caller should not modify the contents of the returned slice, but it is
+// safe to modify the contents of the argument after Get returns. The returned
+// slice will remain valid until the returned Closer is closed. On success, the
+// caller MUST call closer.Close() or a memory leak will occur.
+func (t *Txn) Get(key []byte) ([]byte, io.Closer, error) {
+	if t.snap == nil {
+		panic(ErrClosed)
+	}
+	t.reads = append(t.reads, txnRead{start: append([]byte(nil), key...), point: true})
+	return t.db.getInternal(key, t.batch, t.snap)
+}
+
+// NewIter returns an iterator over the transaction's writes and the DB state
+// at the start of the transaction. The span between the lower and upper
+// bounds of the iterator, and between any bounds later set by
+// Iterator.SetBounds, is added to the transaction's read set. The iterator is
+// invalidated by a call to RollbackToSavepoint.
+func (t *Txn) NewIter(o *IterOptions) *Iterator {
+	if t.snap == nil {
+		panic(ErrClosed)
+	}
+	t.readSpan(o.GetLowerBound(), o.GetUpperBound())
+	iter := t.db.newIterInternal(t.batch.newInternalIter(o),
+		t.batch.newRangeDelIter(o), t.batch.newRangeKeyIter(o), t.snap, o)
+	iter.txn = t
+	return iter
+}
+
+// readSpan adds the span [lower,upper) to the transaction's read set.
+func (t *Txn) readSpan(lower, upper []byte) {
+	t.reads = append(t.reads, txnRead{
+		start: append([]byte(nil), lower...),
+		end:   append([]byte(nil), upper...),
+	})
+}
+
+// Set sets the value for the given key within the transaction.
+//
+// It is safe to modify the contents of the arguments after Set returns.
+func (t *Txn) Set(key, value []byte) error {
+	return t.batch.Set(key, value, nil)
+}
+
+// Merge adds an action to the transaction that merges the value at key with
+// the new value.
+//
+// It is safe to modify the contents of the arguments after Merge returns.
+func (t *Txn) Merge(key, value []byte) error {
+	return t.batch.Merge(key, value, nil)
+}
+
+// Delete deletes the value for the given key within the transaction.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (t *Txn) Delete(key []byte) error {
+	return t.batch.Delete(key, nil)
+}
+
+// SingleDelete adds an action to the transaction that single deletes the
+// entry for key. See Writer.SingleDelete for more details on the semantics
+// of SingleDelete.
+//
+// It is safe to modify the contents of the arguments after SingleDelete
+// returns.
+func (t *Txn) SingleDelete(key []byte) error {
+	return t.batch.SingleDelete(key, nil)
+}
+
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// within the transaction.
+//
+// It is safe to modify the contents of the arguments after DeleteRange
+// returns.
+func (t *Txn) DeleteRange(start, end []byte) error {
+	return t.batch.DeleteRange(start, end, nil)
+}
+
+// SetSavepoint records the current state of the transaction's writes.
+// Savepoints nest: RollbackToSavepoint discards the writes made since the
+// most recent savepoint.
+func (t *Txn) SetSavepoint() {
+	t.savepoints = append(t.savepoints, txnSavepoint{
+		size:  len(t.batch.data),
+		count: t.batch.count,
+	})
+}
+
+// RollbackToSavepoint discards the writes made since the most recent
+// savepoint, and removes the savepoint. The keys read since the savepoint
+// remain in the transaction's read set. Iterators created by the transaction
+// must not be used after RollbackToSavepoint returns. It returns
+// ErrNoSavepoint if there is no savepoint.
+func (t *Txn) RollbackToSavepoint() error {
+	n := len(t.savepoints)
+	if n == 0 {
+		return ErrNoSavepoint
+	}
+	sp := t.savepoints[n-1]
+	t.savepoints = t.savepoints[:n-1]
+	t.batch.truncate(sp.size, sp.count)
+	return nil
+}
+
+// Commit validates the transaction's read set and applies its writes to the
+// DB. If a key in the read set was modified after the transaction started,
+// no writes are applied and ErrConflict is returned. The transaction can no
+// longer be used after Commit returns, other than to call Close.
+func (t *Txn) Commit(opts *WriteOptions) error {
+	if t.snap == nil {
+		panic(ErrClosed)
+	}
+	d := t.db
+	d.txnCommitMu.Lock()
+	defer d.txnCommitMu.Unlock()
+
+	err := t.validate()
+	if err == nil {
+		err = t.batch.Commit(opts)
+	}
+	t.closeSnapshot()
+	return err
+}
+
+// Close closes the transaction, discarding its writes if it was not
+// committed.
+func (t *Txn) Close() error {
+	t.closeSnapshot()
+	if t.batch == nil {
+		return nil
+	}
+	err := t.batch.Close()
+	t.batch = nil
+	return err
+}
+
+func (t *Txn) closeSnapshot() {
+	if t.snap != nil {
+		_ = t.snap.Close()
+		t.snap = nil
+	}
+}
+
+// validate returns ErrConflict if any of the keys in the read set were
+// modified after the transaction's snapshot.
+//
+// A key was modified if the current DB state contains a version of the key
+// newer than the snapshot, or if the key is visible at the snapshot but not
+// in the current DB state (i.e. it was removed by a newer range deletion). The
+// snapshot prevents compactions from dropping the versions of keys visible
+// at the snapshot, and the newer versions which shadow them.
+func (t *Txn) validate() error {
+	for _, r := range t.reads {
+		conflict, err := t.validateRead(r)
+		if err != nil {
+			return err
+		}
+		if conflict {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+func (t *Txn) validateRead(r txnRead) (bool, error) {
+	d := t.db
+	o := &IterOptions{LowerBound: r.start, UpperBound: r.end}
+	if r.point {
+		o.UpperBound = nil
+	}
+
+	// Count the user keys in the read, failing if a version of any of them is
+	// newer than the snapshot.
+	latest := d.newIterInternal(nil, /* batchIter */
+		nil /* batchRangeDelIter */, nil /* batchRangeKeyIter */, nil /* snapshot */, o)
+	latestKeys, conflict := t.countKeys(latest.iter, r)
+	if err := latest.Close(); err != nil || conflict {
+		return conflict, err
+	}
+
+	// Count the user keys in the read at the snapshot. If no version of a key
+	// in the current state is newer than the snapshot, the keys in the current
+	// state are a subset of those at the snapshot. A key which is missing from
+	// the current state was deleted by a newer range deletion.
+	snap := d.newIterInternal(nil, /* batchIter */
+		nil /* batchRangeDelIter */, nil /* batchRangeKeyIter */, t.snap, o)
+	snapKeys, _ := t.countKeys(snap.iter, r)
+	if err := snap.Close(); err != nil {
+		return false, err
+	}
+	return latestKeys != snapKeys, nil
+}
+
+// countKeys returns the number of distinct user keys in the read r returned
+// by iter, and whether any of the keys has a version newer than the
+// transaction's snapshot.
+func (t *Txn) countKeys(iter internalIterator, r txnRead) (count int, conflict bool) {
+	d := t.db
+	var lastUserKey []byte
+	var key *InternalKey
+	if r.start != nil {
+		key, _ = iter.SeekGE(r.start)
+	} else {
+		key, _ = iter.First()
+	}
+	for ; key != nil; key, _ = iter.Next() {
+		if r.point {
+			if !d.equal(key.UserKey, r.start) {
+				break
+			}
+		} else if r.end != nil && d.cmp(key.UserKey, r.end) >= 0 {
+			break
+		}
+		if key.SeqNum() >= t.snap.seqNum {
+			return count, true
+		}
+		if count == 0 || !d.equal(key.UserKey, lastUserKey) {
+			count++
+			lastUserKey = append(lastUserKey[:0], key.UserKey...)
+		}
+	}
+	return count, false
+}
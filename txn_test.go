@@ -0,0 +1,285 @@
+// Copyright 2021 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func txnScan(t *testing.T, txn *Txn, o *IterOptions) string {
+	iter := txn.NewIter(o)
+	var keys []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+	}
+	require.NoError(t, iter.Close())
+	return strings.Join(keys, " ")
+}
+
+func TestTxnReadYourWrites(t *testing.T) {
+	d, err := Open("", &Options{FS: vfs.NewMem()})
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Set([]byte("b"), []byte("2"), nil))
+	require.NoError(t, d.Set([]byte("c"), []byte("3"), nil))
+
+	txn := d.NewTxn()
+	defer txn.Close()
+
+	// Writes made after the transaction started are not visible.
+	require.NoError(t, d.Set([]byte("d"), []byte("4"), nil))
+	require.NoError(t, d.Set([]byte("a"), []byte("5"), nil))
+
+	require.NoError(t, txn.Merge([]byte("a"), []byte("x")))
+	require.NoError(t, txn.DeleteRange([]byte("b"), []byte("c")))
+	require.NoError(t, txn.Set([]byte("e"), []byte("6")))
+
+	value, closer, err := txn.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "1x", string(value))
+	require.NoError(t, closer.Close())
+	_, _, err = txn.Get([]byte("b"))
+	require.Equal(t, ErrNotFound, err)
+	_, _, err = txn.Get([]byte("d"))
+	require.Equal(t, ErrNotFound, err)
+	require.Equal(t, "a:1x c:3 e:6", txnScan(t, txn, nil))
+
+	// The transaction's writes are not visible outside of it until it commits.
+	_, _, err = d.Get([]byte("e"))
+	require.Equal(t, ErrNotFound, err)
+
+	// The read of "a" conflicts with the write made after the transaction
+	// started.
+	require.True(t, errors.Is(txn.Commit(nil), ErrConflict))
+	_, _, err = d.Get([]byte("e"))
+	require.Equal(t, ErrNotFound, err)
+}
+
+func TestTxnConflict(t *testing.T) {
+	type op func(d *DB) error
+	set := func(k string) op {
+		return func(d *DB) error { return d.Set([]byte(k), []byte("v"), nil) }
+	}
+	del := func(k string) op {
+		return func(d *DB) error { return d.Delete([]byte(k), nil) }
+	}
+	delRange := func(start, end string) op {
+		return func(d *DB) error { return d.DeleteRange([]byte(start), []byte(end), nil) }
+	}
+	flush := func(d *DB) error { return d.Flush() }
+	compact := func(d *DB) error { return d.Compact([]byte("a"), []byte("z")) }
+
+	type read func(txn *Txn)
+	get := func(k string) read {
+		return func(txn *Txn) {
+			_, closer, err := txn.Get([]byte(k))
+			if err == nil {
+				closer.Close()
+			}
+		}
+	}
+	scan := func(lower, upper string) read {
+		return func(txn *Txn) {
+			o := &IterOptions{}
+			if lower != "" {
+				o.LowerBound = []byte(lower)
+			}
+			if upper != "" {
+				o.UpperBound = []byte(upper)
+			}
+			iter := txn.NewIter(o)
+			for valid := iter.First(); valid; valid = iter.Next() {
+			}
+			iter.Close()
+		}
+	}
+	// scanSetBounds scans [lower,upper) after moving the bounds of an
+	// iterator created with the bounds [a,b).
+	scanSetBounds := func(lower, upper string) read {
+		return func(txn *Txn) {
+			iter := txn.NewIter(&IterOptions{LowerBound: []byte("a"), UpperBound: []byte("b")})
+			iter.SetBounds([]byte(lower), []byte(upper))
+			for valid := iter.First(); valid; valid = iter.Next() {
+			}
+			iter.Close()
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		before     []op
+		reads      []read
+		concurrent []op
+		conflict   bool
+	}{
+		{"no-reads", []op{set("a")}, nil, []op{set("a")}, false},
+		{"get-unmodified", []op{set("a")}, []read{get("a")}, []op{set("b")}, false},
+		{"get-set", []op{set("a")}, []read{get("a")}, []op{set("a")}, true},
+		{"get-missing-set", nil, []read{get("a")}, []op{set("a")}, true},
+		{"get-delete", []op{set("a")}, []read{get("a")}, []op{del("a")}, true},
+		{"get-delete-range", []op{set("a")}, []read{get("a")}, []op{delRange("a", "b")}, true},
+		{"get-missing-delete-range", nil, []read{get("a")}, []op{delRange("a", "b")}, false},
+		{"get-set-flush", []op{set("a")}, []read{get("a")}, []op{set("a"), flush}, true},
+		{"get-set-compact", []op{set("a"), flush}, []read{get("a")}, []op{set("a"), compact}, true},
+		{"get-delete-range-compact", []op{set("a"), flush}, []read{get("a")},
+			[]op{delRange("a", "b"), compact}, true},
+		{"get-unmodified-compact", []op{set("a"), flush}, []read{get("a")},
+			[]op{set("b"), compact}, false},
+		{"scan-set", []op{set("a")}, []read{scan("a", "c")}, []op{set("b")}, true},
+		{"scan-set-outside", []op{set("a")}, []read{scan("a", "c")}, []op{set("c"), set("0")}, false},
+		{"scan-unbounded", nil, []read{scan("", "")}, []op{set("z")}, true},
+		{"scan-delete-range", []op{set("b"), set("d")}, []read{scan("c", "e")},
+			[]op{delRange("a", "z")}, true},
+		{"scan-delete-range-outside", []op{set("b"), set("d")}, []read{scan("c", "e")},
+			[]op{delRange("a", "c")}, false},
+		{"scan-set-bounds", []op{set("d")}, []read{scanSetBounds("c", "e")}, []op{set("d")}, true},
+		{"scan-set-bounds-outside", []op{set("d")}, []read{scanSetBounds("c", "e")},
+			[]op{set("e")}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := Open("", &Options{FS: vfs.NewMem()})
+			require.NoError(t, err)
+			defer d.Close()
+
+			for _, op := range tc.before {
+				require.NoError(t, op(d))
+			}
+			txn := d.NewTxn()
+			defer txn.Close()
+			for _, r := range tc.reads {
+				r(txn)
+			}
+			require.NoError(t, txn.Set([]byte("txn"), []byte("v")))
+			for _, op := range tc.concurrent {
+				require.NoError(t, op(d))
+			}
+
+			err = txn.Commit(nil)
+			_, closer, getErr := d.Get([]byte("txn"))
+			if tc.conflict {
+				require.Equal(t, ErrConflict, err)
+				require.Equal(t, ErrNotFound, getErr)
+			} else {
+				require.NoError(t, err)
+				require.NoError(t, getErr)
+				require.NoError(t, closer.Close())
+			}
+		})
+	}
+}
+
+func TestTxnSavepoints(t *testing.T) {
+	d, err := Open("", &Options{FS: vfs.NewMem()})
+	require.NoError(t, err)
+	defer d.Close()
+	require.NoError(t, d.Set([]byte("d"), []byte("0"), nil))
+
+	txn := d.NewTxn()
+	defer txn.Close()
+	require.Equal(t, ErrNoSavepoint, txn.RollbackToSavepoint())
+
+	// Rolling back to a savepoint set on an empty transaction discards all
+	// of its writes.
+	txn.SetSavepoint()
+	require.NoError(t, txn.Set([]byte("z"), []byte("9")))
+	require.NoError(t, txn.RollbackToSavepoint())
+	require.Equal(t, "d:0", txnScan(t, txn, nil))
+
+	require.NoError(t, txn.Set([]byte("a"), []byte("1")))
+	txn.SetSavepoint()
+	require.NoError(t, txn.Set([]byte("b"), []byte("2")))
+	require.NoError(t, txn.DeleteRange([]byte("c"), []byte("e")))
+	txn.SetSavepoint()
+	require.NoError(t, txn.Merge([]byte("a"), []byte("x")))
+	require.NoError(t, txn.Set([]byte("c"), []byte("3")))
+	require.Equal(t, "a:1x b:2 c:3", txnScan(t, txn, nil))
+
+	require.NoError(t, txn.RollbackToSavepoint())
+	require.Equal(t, "a:1 b:2", txnScan(t, txn, nil))
+	require.NoError(t, txn.RollbackToSavepoint())
+	require.Equal(t, "a:1 d:0", txnScan(t, txn, nil))
+	require.Equal(t, ErrNoSavepoint, txn.RollbackToSavepoint())
+
+	// Writes made after rolling back are retained.
+	require.NoError(t, txn.Set([]byte("e"), []byte("5")))
+	require.NoError(t, txn.Commit(nil))
+
+	iter := d.NewIter(nil)
+	var keys []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, "a:1 d:0 e:5", strings.Join(keys, " "))
+}
+
+func TestTxnConcurrentIncrements(t *testing.T) {
+	d, err := Open("", &Options{FS: vfs.NewMem()})
+	require.NoError(t, err)
+	defer d.Close()
+
+	// Each goroutine increments a counter using a read-modify-write
+	// transaction, retrying on conflict. No increment may be lost.
+	const goroutines, increments = 4, 50
+	increment := func() error {
+		for {
+			txn := d.NewTxn()
+			var n int
+			value, closer, err := txn.Get([]byte("counter"))
+			if err == nil {
+				n, err = strconv.Atoi(string(value))
+				closer.Close()
+			} else if err == ErrNotFound {
+				err = nil
+			}
+			if err == nil {
+				err = txn.Set([]byte("counter"), []byte(strconv.Itoa(n+1)))
+			}
+			if err == nil {
+				err = txn.Commit(nil)
+			}
+			txn.Close()
+			if err != ErrConflict {
+				return err
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if err := increment(); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		require.NoError(t, err)
+	}
+
+	value, closer, err := d.Get([]byte("counter"))
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(goroutines*increments), string(value))
+	require.NoError(t, closer.Close())
+}
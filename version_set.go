@@ -54,8 +54,9 @@ type versionSet struct {
 
 	// A pointer to versionSet.addObsoleteLocked. Avoids allocating a new closure
 	// on the creation of every version.
-	obsoleteFn        func(obsolete []FileNum)
+	obsoleteFn        func(obsolete, obsoleteBlobFiles []FileNum)
 	obsoleteTables    []FileNum
+	obsoleteBlobFiles []FileNum
 	obsoleteManifests []FileNum
 	obsoleteOptions   []FileNum
 
@@ -78,11 +79,22 @@ type versionSet struct {
 	logSeqNum     uint64 // next seqNum to use for WAL writes
 	visibleSeqNum uint64 // visible seqNum (<= logSeqNum)
 
+	// formatMajorVersion is the DB's format major version, as recorded in the
+	// MANIFEST. It is read atomically, and updated atomically by logAndApply
+	// while holding the manifest lock.
+	formatMajorVersion uint64
+
 	// The current manifest file number.
 	manifestFileNum FileNum
 
 	manifestFile vfs.File
 	manifest     *record.Writer
+	// rotateManifest forces the next call to logAndApply to write a new
+	// MANIFEST. It is set after the metadata of tables in the current version
+	// is updated in place, as the new MANIFEST begins with a snapshot of the
+	// current version which records the updated metadata. Protected by the
+	// manifest lock (see logLock).
+	rotateManifest bool
 
 	writing    bool
 	writerCond sync.Cond
@@ -101,6 +113,7 @@ func (vs *versionSet) init(dirname string, opts *Options, mu *sync.Mutex) {
 	vs.obsoleteFn = vs.addObsoleteLocked
 	vs.zombieTables = make(map[FileNum]uint64)
 	vs.nextFileNum = 1
+	vs.formatMajorVersion = uint64(FormatMostCompatible)
 }
 
 // create creates a version set for a fresh DB.
@@ -111,6 +124,7 @@ func (vs *versionSet) create(
 	newVersion := &version{}
 	vs.append(newVersion)
 	vs.picker = newCompactionPicker(newVersion, vs.opts, nil)
+	vs.formatMajorVersion = uint64(opts.FormatMajorVersion)
 
 	// Note that a "snapshot" version edit is written to the manifest when it is
 	// created.
@@ -221,6 +235,9 @@ func (vs *versionSet) load(dirname string, opts *Options, mu *sync.Mutex) error
 		if ve.NextFileNum != 0 {
 			vs.nextFileNum = ve.NextFileNum
 		}
+		if ve.FormatMajorVersion != 0 {
+			vs.formatMajorVersion = ve.FormatMajorVersion
+		}
 		if ve.LastSeqNum != 0 {
 			// logSeqNum is the _next_ sequence number that will be assigned,
 			// while LastSeqNum is the last assigned sequence number. Note that
@@ -248,20 +265,25 @@ func (vs *versionSet) load(dirname string, opts *Options, mu *sync.Mutex) error
 		}
 	}
 	vs.markFileNumUsed(vs.minUnflushedLogNum)
+	if FormatMajorVersion(vs.formatMajorVersion) > FormatNewest {
+		return errors.Errorf("pebble: manifest file %q for DB %q: unsupported format major version %d",
+			errors.Safe(b), dirname, errors.Safe(vs.formatMajorVersion))
+	}
 
 	newVersion, _, err := bve.Apply(nil, vs.cmp, opts.Comparer.Format)
 	if err != nil {
 		return err
 	}
+	for _, files := range newVersion.Files {
+		for _, f := range files {
+			vs.initAllowedSeeks(f)
+		}
+	}
 	vs.append(newVersion)
 
 	vs.picker = newCompactionPicker(newVersion, vs.opts, nil)
 
-	for i := range vs.metrics.Levels {
-		l := &vs.metrics.Levels[i]
-		l.NumFiles = int64(len(newVersion.Files[i]))
-		l.Size = uint64(totalSize(newVersion.Files[i]))
-	}
+	vs.updateLevelMetrics(newVersion)
 	return nil
 }
 
@@ -361,7 +383,7 @@ func (vs *versionSet) logAndApply(
 	// Generate a new manifest if we don't currently have one, or the current one
 	// is too large.
 	var newManifestFileNum FileNum
-	if vs.manifest == nil || vs.manifest.Size() >= vs.opts.MaxManifestFileSize {
+	if vs.manifest == nil || vs.rotateManifest || vs.manifest.Size() >= vs.opts.MaxManifestFileSize {
 		newManifestFileNum = vs.getNextFileNum()
 	}
 
@@ -375,6 +397,14 @@ func (vs *versionSet) logAndApply(
 		vs.mu.Unlock()
 		defer vs.mu.Lock()
 
+		// Blob files which are no longer referenced by any table are removed
+		// from the version by the same edit.
+		ve.DeletedBlobFiles = manifest.UnreferencedBlobFiles(currentVersion, ve)
+
+		for i := range ve.NewFiles {
+			vs.initAllowedSeeks(ve.NewFiles[i].Meta)
+		}
+
 		var bve bulkVersionEdit
 		bve.Accumulate(ve)
 
@@ -449,11 +479,15 @@ func (vs *versionSet) logAndApply(
 	if ve.MinUnflushedLogNum != 0 {
 		vs.minUnflushedLogNum = ve.MinUnflushedLogNum
 	}
+	if ve.FormatMajorVersion != 0 {
+		atomic.StoreUint64(&vs.formatMajorVersion, ve.FormatMajorVersion)
+	}
 	if newManifestFileNum != 0 {
 		if vs.manifestFileNum != 0 {
 			vs.obsoleteManifests = append(vs.obsoleteManifests, vs.manifestFileNum)
 		}
 		vs.manifestFileNum = newManifestFileNum
+		vs.rotateManifest = false
 	}
 	vs.picker = newCompactionPicker(newVersion, vs.opts, inProgressCompactions())
 	if !vs.dynamicBaseLevel {
@@ -463,12 +497,36 @@ func (vs *versionSet) logAndApply(
 	for level, update := range metrics {
 		vs.metrics.Levels[level].Add(update)
 	}
+	vs.updateLevelMetrics(newVersion)
+	return nil
+}
+
+// updateLevelMetrics updates the per-level file counts, sizes and sublevel
+// counts from the specified version.
+func (vs *versionSet) updateLevelMetrics(v *version) {
 	for i := range vs.metrics.Levels {
 		l := &vs.metrics.Levels[i]
-		l.NumFiles = int64(len(newVersion.Files[i]))
-		l.Size = uint64(totalSize(newVersion.Files[i]))
+		l.NumFiles = int64(len(v.Files[i]))
+		l.Size = uint64(totalSize(v.Files[i]))
+		if i == 0 {
+			l.Sublevels = int32(len(v.L0Sublevels(vs.cmp).Levels))
+		} else if len(v.Files[i]) > 0 {
+			l.Sublevels = 1
+		} else {
+			l.Sublevels = 0
+		}
 	}
-	return nil
+}
+
+// initAllowedSeeks sets the number of sampled reads of the table f which are
+// allowed before it is queued for a read-triggered compaction. See
+// Options.ReadCompactionRate.
+func (vs *versionSet) initAllowedSeeks(f *fileMetadata) {
+	allowedSeeks := int64(f.Size) / vs.opts.ReadCompactionRate
+	if allowedSeeks < 100 {
+		allowedSeeks = 100
+	}
+	atomic.StoreInt64(&f.AllowedSeeks, allowedSeeks)
 }
 
 func (vs *versionSet) incrementCompactions() {
@@ -508,6 +566,12 @@ func (vs *versionSet) createManifest(
 	snapshot := versionEdit{
 		ComparerName: vs.cmpName,
 	}
+	// The most compatible format major version is left unset, so that the
+	// MANIFEST remains readable by versions which predate format major
+	// versions.
+	if fmv := atomic.LoadUint64(&vs.formatMajorVersion); fmv > uint64(FormatMostCompatible) {
+		snapshot.FormatMajorVersion = fmv
+	}
 	for level, fileMetadata := range vs.currentVersion().Files {
 		for _, meta := range fileMetadata {
 			snapshot.NewFiles = append(snapshot.NewFiles, newFileEntry{
@@ -516,6 +580,9 @@ func (vs *versionSet) createManifest(
 			})
 		}
 	}
+	for _, meta := range vs.currentVersion().BlobFiles {
+		snapshot.NewBlobFiles = append(snapshot.NewBlobFiles, meta)
+	}
 
 	// When creating a version snapshot for an existing DB, this snapshot VersionEdit will be
 	// immediately followed by another VersionEdit (being written in logAndApply()). That
@@ -583,16 +650,19 @@ func (vs *versionSet) addLiveFileNums(m map[FileNum]struct{}) {
 	for v := vs.versions.Front(); true; v = v.Next() {
 		for _, ff := range v.Files {
 			for _, f := range ff {
-				m[f.FileNum] = struct{}{}
+				m[f.BackingFileNum()] = struct{}{}
 			}
 		}
+		for fileNum := range v.BlobFiles {
+			m[fileNum] = struct{}{}
+		}
 		if v == current {
 			break
 		}
 	}
 }
 
-func (vs *versionSet) addObsoleteLocked(obsolete []FileNum) {
+func (vs *versionSet) addObsoleteLocked(obsolete, obsoleteBlobFiles []FileNum) {
 	for _, fileNum := range obsolete {
 		// Note that the obsolete tables are no longer zombie by the definition of
 		// zombie, but we leave them in the zombie tables map until they are
@@ -602,4 +672,5 @@ func (vs *versionSet) addObsoleteLocked(obsolete []FileNum) {
 		}
 	}
 	vs.obsoleteTables = append(vs.obsoleteTables, obsolete...)
+	vs.obsoleteBlobFiles = append(vs.obsoleteBlobFiles, obsoleteBlobFiles...)
 }